@@ -2,38 +2,694 @@ package v1
 
 import (
 	"context"
+	"errors"
+	"sync"
 	"time"
 
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	durationpb "google.golang.org/protobuf/types/known/durationpb"
 	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/zmzhang8/grpc_example/lib/auth"
+	"github.com/zmzhang8/grpc_example/lib/clientip"
+	"github.com/zmzhang8/grpc_example/lib/lockout"
+	"github.com/zmzhang8/grpc_example/lib/user"
+	"github.com/zmzhang8/grpc_example/middleware/logging"
 	pb "github.com/zmzhang8/grpc_example/proto/v1"
 )
 
+// AccountOptions configures the account management of the Account service.
+type AccountOptions struct {
+	// Hasher of new passwords.
+	Hasher *user.Hasher
+	// Policy of new passwords.
+	Policy      user.PasswordPolicy
+	ResetTokens *user.ResetTokens
+	// Notifier of password reset tokens.
+	Notifier user.Notifier
+	APIKeys  *auth.APIKeys
+	// Guard of logins against brute force. Logins are not limited if nil.
+	LoginGuard *lockout.Guard
+	// Challenges of logins of users with TOTP, which still need a one-time code.
+	LoginChallenges *user.LoginChallenges
+	// Issuer of TOTP provisioning URIs, which authenticator apps show.
+	TOTPIssuer string
+}
+
+// errReadOnly is returned by calls which change users of read-only stores, e.g. the file store.
+var errReadOnly = status.Error(codes.FailedPrecondition, "Users cannot be changed")
+
+// Attempts of compare-and-set changes of users, which are retried if the user changed concurrently,
+// e.g. by logins with other recovery codes.
+const maxUpdateAttempts = 10
+
 type accountServer struct {
 	pb.UnimplementedAccountServer
+	tokens      *auth.Tokens
+	users       user.UserStore
+	hasher      *user.Hasher
+	policy      user.PasswordPolicy
+	resetTokens *user.ResetTokens
+	notifier    user.Notifier
+	apiKeys     *auth.APIKeys
+	guard       *lockout.Guard
+	challenges  *user.LoginChallenges
+	totpIssuer  string
+	// Password reset tokens which are being sent in the background.
+	notifications sync.WaitGroup
 }
 
 func (s *accountServer) Login(
 	ctx context.Context,
 	in *pb.LoginRequest,
 ) (*pb.LoginResponse, error) {
-	if in.Username == "hello" && in.Password == "world" {
-		return &pb.LoginResponse{
-			Token:      "worldhello",
-			Expiration: timestamppb.New(time.Now().UTC().Add(time.Hour)), // valid for one hour
-		}, nil
+	// failures of unknown clients, e.g. of gateways which did not forward the client address, only count for the username
+	var client string
+	if addr := clientip.FromContext(ctx); addr.IsValid() {
+		client = addr.String()
+	}
+	username := in.Username
+	if in.Challenge != "" {
+		var err error
+		if username, err = s.challenges.Username(in.Challenge); err != nil {
+			return nil, status.Error(codes.Unauthenticated, "Invalid login challenge")
+		}
+	}
+	var attempt *lockout.Attempt
+	if s.guard != nil {
+		var wait time.Duration
+		var err error
+		attempt, wait, err = s.guard.Begin(ctx, username, client)
+		if err != nil {
+			logging.MustGetLogger(ctx).Errorw("Failed to check login attempts", "error", err)
+			return nil, status.Error(codes.Unavailable, "Failed to authenticate")
+		}
+		if wait > 0 {
+			return nil, retryLater(wait)
+		}
+		// attempts which neither fail nor succeed, e.g. which return a challenge, are not counted
+		defer func() {
+			if err := attempt.Release(ctx); err != nil {
+				logging.MustGetLogger(ctx).Errorw("Failed to release login attempt", "error", err)
+			}
+		}()
+	}
+
+	var u *user.User
+	var err error
+	if in.Challenge != "" {
+		// the password has been checked by the login of the challenge, if the user has not changed since
+		u, err = s.users.Get(ctx, username)
+		if errors.Is(err, user.ErrNotFound) {
+			return nil, status.Error(codes.Unauthenticated, "Authentication failed")
+		}
+		if err == nil && (!u.HasTOTP() || s.challenges.Check(in.Challenge, u) != nil) {
+			return nil, status.Error(codes.Unauthenticated, "Invalid login challenge")
+		}
+	} else {
+		u, err = user.Authenticate(ctx, s.users, s.hasher, username, in.Password)
+		if errors.Is(err, user.ErrInvalidCredentials) {
+			s.loginFailed(ctx, attempt, username, client)
+			return nil, status.Error(codes.Unauthenticated, "Authentication failed")
+		}
+	}
+	if err != nil {
+		logging.MustGetLogger(ctx).Errorw("Failed to authenticate", "error", err)
+		return nil, status.Error(codes.Internal, "Failed to authenticate")
+	}
+	if u.HasTOTP() {
+		if in.TotpCode == "" && in.RecoveryCode == "" {
+			challenge, expiration, err := s.challenges.Issue(u)
+			if err != nil {
+				logging.MustGetLogger(ctx).Errorw("Failed to issue login challenge", "error", err)
+				return nil, status.Error(codes.Internal, "Failed to authenticate")
+			}
+			return &pb.LoginResponse{
+				TotpRequired:        true,
+				Challenge:           challenge,
+				ChallengeExpiration: timestamppb.New(expiration),
+			}, nil
+		}
+		err := s.verifySecondFactor(ctx, u.Username, in.TotpCode, in.RecoveryCode)
+		if errors.Is(err, user.ErrInvalidTOTPCode) {
+			s.loginFailed(ctx, attempt, username, client)
+			return nil, status.Error(codes.Unauthenticated, "Invalid one-time code")
+		}
+		if err != nil {
+			logging.MustGetLogger(ctx).Errorw("Failed to verify one-time code", "error", err)
+			return nil, status.Error(codes.Internal, "Failed to authenticate")
+		}
+	}
+	// challenges are consumed by correct codes only, so that wrong codes can be corrected
+	if in.Challenge != "" {
+		if err := s.challenges.Use(in.Challenge, u); err != nil {
+			return nil, status.Error(codes.Unauthenticated, "Invalid login challenge")
+		}
+	}
+	if err := attempt.Success(ctx); err != nil {
+		logging.MustGetLogger(ctx).Errorw("Failed to reset login attempts", "error", err)
+	}
+
+	issued, err := s.tokens.Issue(ctx, u.Username, u.Roles)
+	if err != nil {
+		logging.MustGetLogger(ctx).Errorw("Failed to issue token", "error", err)
+		return nil, status.Error(codes.Internal, "Failed to issue token")
+	}
+	return loginResponse(issued), nil
+}
+
+func (s *accountServer) Refresh(
+	ctx context.Context,
+	in *pb.RefreshRequest,
+) (*pb.LoginResponse, error) {
+	issued, err := s.tokens.Refresh(ctx, in.RefreshToken)
+	if errors.Is(err, auth.ErrRefreshTokenReused) {
+		logging.MustGetLogger(ctx).Warn("Refresh token reused. Session revoked.")
+		return nil, status.Error(codes.Unauthenticated, "Invalid refresh token")
+	}
+	if errors.Is(err, auth.ErrInvalidRefreshToken) {
+		return nil, status.Error(codes.Unauthenticated, "Invalid refresh token")
+	}
+	if err != nil {
+		logging.MustGetLogger(ctx).Errorw("Failed to refresh token", "error", err)
+		return nil, status.Error(codes.Internal, "Failed to refresh token")
+	}
+	return loginResponse(issued), nil
+}
+
+func (s *accountServer) Logout(
+	ctx context.Context,
+	in *pb.LogoutRequest,
+) (*pb.LogoutResponse, error) {
+	principal := auth.MustFromContext(ctx)
+	if err := s.tokens.RevokeSession(ctx, principal.TokenID); err != nil {
+		logging.MustGetLogger(ctx).Errorw("Failed to revoke session", "error", err)
+		return nil, status.Error(codes.Internal, "Failed to revoke session")
+	}
+	return &pb.LogoutResponse{}, nil
+}
+
+// RevokeSessions revokes all sessions of the caller, or of another user if the caller has the admin role.
+func (s *accountServer) RevokeSessions(
+	ctx context.Context,
+	in *pb.RevokeSessionsRequest,
+) (*pb.RevokeSessionsResponse, error) {
+	caller := auth.MustFromContext(ctx)
+	username := in.Username
+	if username == "" {
+		username = caller.Subject
+	}
+	if username != caller.Subject && !caller.HasRole(auth.RoleAdmin) {
+		return nil, status.Error(codes.PermissionDenied, "Only admins can revoke sessions of other users")
+	}
+	revoked, err := s.tokens.RevokeUserSessions(ctx, username, "")
+	if err != nil {
+		logging.MustGetLogger(ctx).Errorw("Failed to revoke sessions", "error", err)
+		return nil, status.Error(codes.Internal, "Failed to revoke sessions")
+	}
+	return &pb.RevokeSessionsResponse{RevokedSessions: int32(revoked)}, nil
+}
+
+func (s *accountServer) Register(
+	ctx context.Context,
+	in *pb.RegisterRequest,
+) (*pb.RegisterResponse, error) {
+	violations := append(
+		fieldViolations("username", user.ValidateUsername(in.Username)),
+		fieldViolations("password", s.policy.Validate(in.Password))...,
+	)
+	if len(violations) > 0 {
+		return nil, badRequest(violations)
+	}
+	hash, err := s.hasher.Hash(in.Password)
+	if err != nil {
+		logging.MustGetLogger(ctx).Errorw("Failed to hash password", "error", err)
+		return nil, status.Error(codes.Internal, "Failed to register")
+	}
+	err = s.users.Create(ctx, user.User{Username: in.Username, PasswordHash: hash})
+	if errors.Is(err, user.ErrAlreadyExists) {
+		return nil, status.Error(codes.AlreadyExists, "User already exists")
+	}
+	if errors.Is(err, user.ErrReadOnly) {
+		return nil, errReadOnly
+	}
+	if err != nil {
+		logging.MustGetLogger(ctx).Errorw("Failed to create user", "error", err)
+		return nil, status.Error(codes.Internal, "Failed to register")
 	}
+	return &pb.RegisterResponse{}, nil
+}
+
+// ChangePassword keeps the session of the caller, and revokes the other sessions.
+func (s *accountServer) ChangePassword(
+	ctx context.Context,
+	in *pb.ChangePasswordRequest,
+) (*pb.ChangePasswordResponse, error) {
+	principal := auth.MustFromContext(ctx)
+	if err := s.checkPassword(ctx, principal.Subject, "current_password", in.CurrentPassword); err != nil {
+		return nil, err
+	}
+	if violations := fieldViolations("new_password", s.policy.Validate(in.NewPassword)); len(violations) > 0 {
+		return nil, badRequest(violations)
+	}
+	if err := s.setPassword(ctx, principal.Subject, in.NewPassword, principal.TokenID); err != nil {
+		return nil, err
+	}
+	return &pb.ChangePasswordResponse{}, nil
+}
+
+func (s *accountServer) RequestPasswordReset(
+	ctx context.Context,
+	in *pb.RequestPasswordResetRequest,
+) (*pb.RequestPasswordResetResponse, error) {
+	// unknown users get a token which is not kept, and tokens are sent in the background, so that the response
+	// and its time are the same for unknown users, and do not reveal which users exist
+	_, err := s.users.Get(ctx, in.Username)
+	known := err == nil
+	if err != nil && !errors.Is(err, user.ErrNotFound) {
+		logging.MustGetLogger(ctx).Errorw("Failed to get user", "error", err)
+		return nil, status.Error(codes.Internal, "Failed to request password reset")
+	}
+	var token string
+	var expiration time.Time
+	if known {
+		token, expiration, err = s.resetTokens.Issue(in.Username)
+	} else {
+		token, expiration, err = s.resetTokens.IssueDummy()
+	}
+	if err != nil {
+		logging.MustGetLogger(ctx).Errorw("Failed to issue password reset token", "error", err)
+		return nil, status.Error(codes.Internal, "Failed to request password reset")
+	}
+	if known {
+		logger := logging.MustGetLogger(ctx)
+		s.notifications.Add(1)
+		go func() {
+			defer s.notifications.Done()
+			// the notification outlives the call, so it only keeps the logger of the call
+			ctx := context.WithValue(context.Background(), logging.ContextKey(), logger)
+			if err := s.notifier.NotifyPasswordReset(ctx, in.Username, token, expiration); err != nil {
+				logger.Errorw("Failed to send password reset token", "error", err)
+			}
+		}()
+	}
+	return &pb.RequestPasswordResetResponse{}, nil
+}
 
-	return nil, status.Error(codes.Unauthenticated, "Authentication failed")
+func (s *accountServer) ResetPassword(
+	ctx context.Context,
+	in *pb.ResetPasswordRequest,
+) (*pb.ResetPasswordResponse, error) {
+	// the password is validated first, so that the token is not used up by an invalid password
+	if violations := fieldViolations("new_password", s.policy.Validate(in.NewPassword)); len(violations) > 0 {
+		return nil, badRequest(violations)
+	}
+	username, err := s.resetTokens.Use(in.ResetToken)
+	if err != nil {
+		return nil, status.Error(codes.PermissionDenied, "Invalid password reset token")
+	}
+	if err := s.setPassword(ctx, username, in.NewPassword, ""); err != nil {
+		return nil, err
+	}
+	return &pb.ResetPasswordResponse{}, nil
 }
 
+func (s *accountServer) DeleteAccount(
+	ctx context.Context,
+	in *pb.DeleteAccountRequest,
+) (*pb.DeleteAccountResponse, error) {
+	username := auth.MustFromContext(ctx).Subject
+	if err := s.checkPassword(ctx, username, "password", in.Password); err != nil {
+		return nil, err
+	}
+	err := s.users.Delete(ctx, username)
+	if errors.Is(err, user.ErrNotFound) {
+		return nil, status.Error(codes.NotFound, "User not found")
+	}
+	if errors.Is(err, user.ErrReadOnly) {
+		return nil, errReadOnly
+	}
+	if err != nil {
+		logging.MustGetLogger(ctx).Errorw("Failed to delete user", "error", err)
+		return nil, status.Error(codes.Internal, "Failed to delete account")
+	}
+	if _, err := s.tokens.RevokeUserSessions(ctx, username, ""); err != nil {
+		logging.MustGetLogger(ctx).Errorw("Failed to revoke sessions", "error", err)
+		return nil, status.Error(codes.Internal, "Failed to revoke sessions")
+	}
+	if s.apiKeys != nil {
+		if _, err := s.apiKeys.RevokeOwner(ctx, username); err != nil {
+			logging.MustGetLogger(ctx).Errorw("Failed to revoke API keys", "error", err)
+			return nil, status.Error(codes.Internal, "Failed to revoke API keys")
+		}
+	}
+	return &pb.DeleteAccountResponse{}, nil
+}
+
+func (s *accountServer) CreateApiKey(
+	ctx context.Context,
+	in *pb.CreateApiKeyRequest,
+) (*pb.CreateApiKeyResponse, error) {
+	if err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	var violations []*errdetails.BadRequest_FieldViolation
+	if in.Owner == "" {
+		violations = append(violations, fieldViolations("owner", []string{"is required"})...)
+	}
+	networks, err := auth.ParseNetworks(in.AllowedNetworks)
+	if err != nil {
+		violations = append(violations, fieldViolations("allowed_networks", []string{err.Error()})...)
+	}
+	var expiresAt time.Time
+	if in.Expiration != nil {
+		expiresAt = in.Expiration.AsTime()
+		if !expiresAt.After(time.Now()) {
+			violations = append(violations, fieldViolations("expiration", []string{"must be in the future"})...)
+		}
+	}
+	if len(violations) > 0 {
+		return nil, badRequest(violations)
+	}
+	key, stored, err := s.apiKeys.Create(ctx, in.Owner, in.Roles, expiresAt, networks)
+	if err != nil {
+		logging.MustGetLogger(ctx).Errorw("Failed to create API key", "error", err)
+		return nil, status.Error(codes.Internal, "Failed to create API key")
+	}
+	logging.MustGetLogger(ctx).Infow("Created API key", "prefix", stored.Prefix, "owner", stored.Owner)
+	return &pb.CreateApiKeyResponse{Key: key, ApiKey: apiKeyProto(stored)}, nil
+}
+
+func (s *accountServer) ListApiKeys(
+	ctx context.Context,
+	in *pb.ListApiKeysRequest,
+) (*pb.ListApiKeysResponse, error) {
+	if err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	keys, err := s.apiKeys.List(ctx, in.Owner)
+	if err != nil {
+		logging.MustGetLogger(ctx).Errorw("Failed to list API keys", "error", err)
+		return nil, status.Error(codes.Internal, "Failed to list API keys")
+	}
+	resp := &pb.ListApiKeysResponse{ApiKeys: make([]*pb.ApiKey, 0, len(keys))}
+	for i := range keys {
+		resp.ApiKeys = append(resp.ApiKeys, apiKeyProto(&keys[i]))
+	}
+	return resp, nil
+}
+
+func (s *accountServer) RevokeApiKey(
+	ctx context.Context,
+	in *pb.RevokeApiKeyRequest,
+) (*pb.RevokeApiKeyResponse, error) {
+	if err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	err := s.apiKeys.Revoke(ctx, in.Prefix)
+	if errors.Is(err, auth.ErrAPIKeyNotFound) {
+		return nil, status.Error(codes.NotFound, "API key not found")
+	}
+	if err != nil {
+		logging.MustGetLogger(ctx).Errorw("Failed to revoke API key", "error", err)
+		return nil, status.Error(codes.Internal, "Failed to revoke API key")
+	}
+	logging.MustGetLogger(ctx).Infow("Revoked API key", "prefix", in.Prefix)
+	return &pb.RevokeApiKeyResponse{}, nil
+}
+
+// EnrollTOTP replaces an unconfirmed secret of the caller, so that enrollment can be restarted.
+func (s *accountServer) EnrollTOTP(
+	ctx context.Context,
+	in *pb.EnrollTOTPRequest,
+) (*pb.EnrollTOTPResponse, error) {
+	username := auth.MustFromContext(ctx).Subject
+	if err := s.checkPassword(ctx, username, "password", in.Password); err != nil {
+		return nil, err
+	}
+	secret, err := user.NewTOTPSecret()
+	if err != nil {
+		logging.MustGetLogger(ctx).Errorw("Failed to create TOTP secret", "error", err)
+		return nil, status.Error(codes.Internal, "Failed to enroll TOTP")
+	}
+
+	err = s.users.SetTOTPSecret(ctx, username, secret)
+	if errors.Is(err, user.ErrConflict) {
+		return nil, status.Error(codes.FailedPrecondition, "TOTP is already enrolled")
+	}
+	if err := updateError(ctx, err); err != nil {
+		return nil, err
+	}
+	return &pb.EnrollTOTPResponse{
+		ProvisioningUri: user.TOTPURI(s.totpIssuer, username, secret),
+		Secret:          secret,
+	}, nil
+}
+
+func (s *accountServer) ConfirmTOTP(
+	ctx context.Context,
+	in *pb.ConfirmTOTPRequest,
+) (*pb.ConfirmTOTPResponse, error) {
+	username := auth.MustFromContext(ctx).Subject
+	u, err := s.getUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if u.HasTOTP() {
+		return nil, status.Error(codes.FailedPrecondition, "TOTP is already enrolled")
+	}
+	if u.TOTPSecret == "" {
+		return nil, status.Error(codes.FailedPrecondition, "TOTP enrollment has not been started")
+	}
+	step, err := user.VerifyTOTP(u.TOTPSecret, in.TotpCode, time.Now(), 0)
+	if errors.Is(err, user.ErrInvalidTOTPCode) {
+		return nil, badRequest(fieldViolations("totp_code", []string{"is incorrect"}))
+	}
+	if err != nil {
+		logging.MustGetLogger(ctx).Errorw("Failed to verify one-time code", "error", err)
+		return nil, status.Error(codes.Internal, "Failed to confirm TOTP")
+	}
+	recoveryCodes, hashes, err := user.NewRecoveryCodes()
+	if err != nil {
+		logging.MustGetLogger(ctx).Errorw("Failed to create recovery codes", "error", err)
+		return nil, status.Error(codes.Internal, "Failed to confirm TOTP")
+	}
+	err = s.users.ConfirmTOTP(ctx, username, u.TOTPSecret, step, hashes)
+	if errors.Is(err, user.ErrConflict) {
+		return nil, status.Error(codes.Aborted, "TOTP enrollment has changed")
+	}
+	if err := updateError(ctx, err); err != nil {
+		return nil, err
+	}
+	logging.MustGetLogger(ctx).Infow("Enrolled TOTP", "username", username)
+	return &pb.ConfirmTOTPResponse{RecoveryCodes: recoveryCodes}, nil
+}
+
+// verifySecondFactor checks a one-time code or a recovery code of username, and records its use, so that
+// it cannot be used again. It returns user.ErrInvalidTOTPCode if the code is invalid or has been used.
+func (s *accountServer) verifySecondFactor(ctx context.Context, username string, code string, recoveryCode string) error {
+	// The use is recorded only if the second factor has not changed since it was read, and is checked again
+	// otherwise, e.g. after a concurrent login, which may have used the same code.
+	var err error
+	for i := 0; i < maxUpdateAttempts; i++ {
+		var u *user.User
+		if u, err = s.users.Get(ctx, username); err != nil {
+			return err
+		}
+		if recoveryCode != "" {
+			var unused []string
+			if unused, err = user.UseRecoveryCode(u.RecoveryCodes, recoveryCode); err == nil {
+				err = s.users.SetRecoveryCodes(ctx, username, u.RecoveryCodes, unused)
+			}
+		} else {
+			var step int64
+			if step, err = user.VerifyTOTP(u.TOTPSecret, code, time.Now(), u.TOTPLastStep); err == nil {
+				err = s.users.UseTOTPStep(ctx, username, u.TOTPLastStep, step)
+			}
+		}
+		if !errors.Is(err, user.ErrConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+// getUser returns a NotFound error if the user does not exist.
+func (s *accountServer) getUser(ctx context.Context, username string) (*user.User, error) {
+	u, err := s.users.Get(ctx, username)
+	if errors.Is(err, user.ErrNotFound) {
+		return nil, status.Error(codes.NotFound, "User not found")
+	}
+	if err != nil {
+		logging.MustGetLogger(ctx).Errorw("Failed to get user", "error", err)
+		return nil, status.Error(codes.Internal, "Failed to get user")
+	}
+	return u, nil
+}
+
+// updateError converts an error of a change of a user into a status error, which is NotFound if the user
+// does not exist.
+func updateError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, user.ErrNotFound) {
+		return status.Error(codes.NotFound, "User not found")
+	}
+	if errors.Is(err, user.ErrReadOnly) {
+		return errReadOnly
+	}
+	logging.MustGetLogger(ctx).Errorw("Failed to update user", "error", err)
+	return status.Error(codes.Internal, "Failed to update user")
+}
+
+func (s *accountServer) requireAdmin(ctx context.Context) error {
+	if !auth.MustFromContext(ctx).HasRole(auth.RoleAdmin) {
+		return status.Error(codes.PermissionDenied, "Only admins can manage API keys")
+	}
+	return nil
+}
+
+func apiKeyProto(key *auth.APIKey) *pb.ApiKey {
+	networks := make([]string, 0, len(key.AllowedNetworks))
+	for _, network := range key.AllowedNetworks {
+		networks = append(networks, network.String())
+	}
+	out := &pb.ApiKey{
+		Prefix:          key.Prefix,
+		Owner:           key.Owner,
+		Roles:           key.Roles,
+		AllowedNetworks: networks,
+		CreateTime:      timestamppb.New(key.CreatedAt),
+	}
+	if !key.ExpiresAt.IsZero() {
+		out.Expiration = timestamppb.New(key.ExpiresAt)
+	}
+	return out
+}
+
+// loginFailed records a failed login attempt, and writes audit logs of lockouts.
+func (s *accountServer) loginFailed(ctx context.Context, attempt *lockout.Attempt, username string, client string) {
+	lockouts, err := attempt.Failure(ctx)
+	if err != nil {
+		logging.MustGetLogger(ctx).Errorw("Failed to record login attempt", "error", err)
+		return
+	}
+	for _, l := range lockouts {
+		logging.MustGetLogger(ctx).Warnw("Login locked out",
+			"audit", "login_lockout",
+			"key", l.Key,
+			"username", username,
+			"client", client,
+			"failures", l.Failures,
+			"until", l.Until,
+		)
+	}
+}
+
+// checkPassword returns a field violation of field if password is not the password of username.
+func (s *accountServer) checkPassword(ctx context.Context, username string, field string, password string) error {
+	_, err := user.Authenticate(ctx, s.users, s.hasher, username, password)
+	if errors.Is(err, user.ErrInvalidCredentials) {
+		return badRequest(fieldViolations(field, []string{"is incorrect"}))
+	}
+	if err != nil {
+		logging.MustGetLogger(ctx).Errorw("Failed to authenticate", "error", err)
+		return status.Error(codes.Internal, "Failed to authenticate")
+	}
+	return nil
+}
+
+// setPassword sets the password of username, and revokes the sessions of the user except for exceptSessionID.
+func (s *accountServer) setPassword(ctx context.Context, username string, password string, exceptSessionID string) error {
+	hash, err := s.hasher.Hash(password)
+	if err != nil {
+		logging.MustGetLogger(ctx).Errorw("Failed to hash password", "error", err)
+		return status.Error(codes.Internal, "Failed to set password")
+	}
+	err = s.users.SetPasswordHash(ctx, username, hash)
+	if errors.Is(err, user.ErrNotFound) {
+		return status.Error(codes.NotFound, "User not found")
+	}
+	if errors.Is(err, user.ErrReadOnly) {
+		return errReadOnly
+	}
+	if err != nil {
+		logging.MustGetLogger(ctx).Errorw("Failed to update user", "error", err)
+		return status.Error(codes.Internal, "Failed to set password")
+	}
+	if _, err := s.tokens.RevokeUserSessions(ctx, username, exceptSessionID); err != nil {
+		logging.MustGetLogger(ctx).Errorw("Failed to revoke sessions", "error", err)
+		return status.Error(codes.Internal, "Failed to revoke sessions")
+	}
+	return nil
+}
+
+// AuthFuncOverride allows login, refresh, registration and password reset without a session token. Other calls
+// require a session token, not an API key or a token of an external identity provider, so that principals of
+// the calls always have a session.
 func (s *accountServer) AuthFuncOverride(ctx context.Context, fullMethodName string) (context.Context, error) {
-	return auth.AllowAll(ctx)
+	switch fullMethodName {
+	case "/grpc_example.v1.Account/Login",
+		"/grpc_example.v1.Account/Refresh",
+		"/grpc_example.v1.Account/Register",
+		"/grpc_example.v1.Account/RequestPasswordReset",
+		"/grpc_example.v1.Account/ResetPassword":
+		return auth.AllowAll(ctx)
+	default:
+		return s.tokens.SessionAuth(ctx)
+	}
 }
 
-func NewAccountServer() *accountServer {
-	return &accountServer{}
+func loginResponse(issued *auth.IssuedTokens) *pb.LoginResponse {
+	return &pb.LoginResponse{
+		Token:             issued.Token,
+		Expiration:        timestamppb.New(issued.Expiration),
+		RefreshToken:      issued.RefreshToken,
+		RefreshExpiration: timestamppb.New(issued.RefreshExpiration),
+	}
+}
+
+func retryLater(wait time.Duration) error {
+	st, err := status.New(codes.ResourceExhausted, "Too many failed login attempts").
+		WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(wait)})
+	if err != nil {
+		return status.Error(codes.ResourceExhausted, "Too many failed login attempts")
+	}
+	return st.Err()
+}
+
+func fieldViolations(field string, descriptions []string) []*errdetails.BadRequest_FieldViolation {
+	violations := make([]*errdetails.BadRequest_FieldViolation, 0, len(descriptions))
+	for _, description := range descriptions {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: field, Description: description})
+	}
+	return violations
+}
+
+func badRequest(violations []*errdetails.BadRequest_FieldViolation) error {
+	st, err := status.New(codes.InvalidArgument, "Invalid arguments").
+		WithDetails(&errdetails.BadRequest{FieldViolations: violations})
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "Invalid arguments")
+	}
+	return st.Err()
+}
+
+func NewAccountServer(tokens *auth.Tokens, users user.UserStore, opts AccountOptions) *accountServer {
+	s := &accountServer{
+		tokens:      tokens,
+		users:       users,
+		hasher:      opts.Hasher,
+		policy:      opts.Policy,
+		resetTokens: opts.ResetTokens,
+		notifier:    opts.Notifier,
+		apiKeys:     opts.APIKeys,
+		guard:       opts.LoginGuard,
+		challenges:  opts.LoginChallenges,
+		totpIssuer:  opts.TOTPIssuer,
+	}
+	return s
 }
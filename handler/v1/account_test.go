@@ -2,35 +2,142 @@ package v1
 
 import (
 	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
 
+	"github.com/zmzhang8/grpc_example/lib/auth"
+	"github.com/zmzhang8/grpc_example/lib/lockout"
+	"github.com/zmzhang8/grpc_example/lib/log"
+	"github.com/zmzhang8/grpc_example/lib/user"
+	"github.com/zmzhang8/grpc_example/middleware/logging"
 	pb "github.com/zmzhang8/grpc_example/proto/v1"
 )
 
+func newTestTokens(t *testing.T) *auth.Tokens {
+	tokens, err := auth.NewTokens(auth.TokenOptions{Algorithm: auth.AlgorithmHS256, Issuer: "test", Audience: "test", TTL: time.Hour, RefreshTTL: time.Hour})
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return tokens
+}
+
+func newTestAccountServer(t *testing.T, tokens *auth.Tokens) *accountServer {
+	hash, err := bcrypt.GenerateFromPassword([]byte("world"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	hasher, err := user.NewHasher(user.AlgorithmBcrypt)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return NewAccountServer(tokens, user.NewMemoryStore(user.User{Username: "hello", PasswordHash: string(hash)}), AccountOptions{
+		Hasher:          hasher,
+		Policy:          user.PasswordPolicy{MinLength: 8, MinClasses: 2},
+		ResetTokens:     user.NewResetTokens(time.Hour),
+		Notifier:        &testNotifier{},
+		APIKeys:         auth.NewAPIKeys(auth.NewMemoryAPIKeyStore()),
+		LoginChallenges: user.NewLoginChallenges(time.Hour),
+		TOTPIssuer:      "test",
+	})
+}
+
+// testNotifier keeps the last password reset token.
+type testNotifier struct {
+	username string
+	token    string
+}
+
+func (n *testNotifier) NotifyPasswordReset(ctx context.Context, username string, token string, expiration time.Time) error {
+	n.username, n.token = username, token
+	return nil
+}
+
+// wantFieldViolation checks that err is InvalidArgument with a field violation of field.
+func wantFieldViolation(t *testing.T, err error, field string) {
+	t.Helper()
+	st := status.Convert(err)
+	if st.Code() != codes.InvalidArgument {
+		t.Fatalf("code %v; want %v", st.Code(), codes.InvalidArgument)
+	}
+	for _, detail := range st.Details() {
+		if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+			for _, violation := range badRequest.FieldViolations {
+				if violation.Field == field {
+					return
+				}
+			}
+		}
+	}
+	t.Errorf("details %v; want violation of %v", st.Details(), field)
+}
+
+// sessionContext returns the context of a call authenticated with a new session of username with roles.
+func sessionContext(t *testing.T, tokens *auth.Tokens, username string, roles ...string) context.Context {
+	issued, err := tokens.Issue(context.TODO(), username, roles)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return authenticate(t, tokens, issued.Token)
+}
+
+func authenticate(t *testing.T, tokens *auth.Tokens, token string) context.Context {
+	ctx := metadata.NewIncomingContext(loggerContext(), metadata.Pairs("authorization", "bearer "+token))
+	ctx, err := tokens.SessionAuth(ctx)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return ctx
+}
+
+func loggerContext() context.Context {
+	logger := log.NewLogger(log.NewCore(false, os.Stdout, false))
+	return context.WithValue(context.TODO(), logging.ContextKey(), logger)
+}
+
 func TestAccountServer_Login_success(t *testing.T) {
-	s := NewAccountServer()
+	tokens := newTestTokens(t)
+	s := newTestAccountServer(t, tokens)
 	ctx := context.TODO()
 	req := pb.LoginRequest{
 		Username: "hello",
 		Password: "world",
 	}
-	wantToken := "worldhello"
 
 	resp, err := s.Login(ctx, &req)
 
 	if err != nil {
-		t.Errorf("err %v; want <nil>", err)
+		t.Fatalf("err %v; want <nil>", err)
 	}
-	if resp.Token != wantToken {
-		t.Errorf("token %v; want %v", resp.Token, wantToken)
+	claims, err := tokens.Verify(resp.Token)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if claims.Subject != "hello" {
+		t.Errorf("subject %v; want hello", claims.Subject)
+	}
+	if !claims.ExpiresAt.Time.Equal(resp.Expiration.AsTime()) {
+		t.Errorf("expiration %v; want %v", resp.Expiration.AsTime(), claims.ExpiresAt.Time)
+	}
+	if resp.RefreshToken == "" || resp.RefreshExpiration == nil {
+		t.Errorf("refresh token %q expiring at %v; want token and expiration", resp.RefreshToken, resp.RefreshExpiration)
 	}
 }
 
 func TestAccountServer_Login_failure(t *testing.T) {
-	s := NewAccountServer()
+	s := newTestAccountServer(t, newTestTokens(t))
 	ctx := context.TODO()
 	req := pb.LoginRequest{
 		Username: "hello",
@@ -47,3 +154,545 @@ func TestAccountServer_Login_failure(t *testing.T) {
 		t.Errorf("err %v; want %v", err, wantErr)
 	}
 }
+
+func TestAccountServer_Login_unknownUser(t *testing.T) {
+	s := newTestAccountServer(t, newTestTokens(t))
+	req := pb.LoginRequest{
+		Username: "world",
+		Password: "world",
+	}
+
+	_, err := s.Login(context.TODO(), &req)
+
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("code %v; want %v", status.Code(err), codes.Unauthenticated)
+	}
+}
+
+func TestAccountServer_Login_lockout(t *testing.T) {
+	s := newTestAccountServer(t, newTestTokens(t))
+	s.guard = lockout.NewGuard(lockout.NewMemoryStore(), lockout.Options{
+		User:            lockout.Limits{FreeAttempts: 1, LockoutAfter: 2},
+		Backoff:         time.Second,
+		MaxBackoff:      time.Minute,
+		LockoutDuration: time.Hour,
+	})
+	ctx := loggerContext()
+	if _, err := s.Login(ctx, &pb.LoginRequest{Username: "hello", Password: "earth"}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("code %v; want %v", status.Code(err), codes.Unauthenticated)
+	}
+
+	_, err := s.Login(ctx, &pb.LoginRequest{Username: "hello", Password: "world"})
+
+	st := status.Convert(err)
+	if st.Code() != codes.ResourceExhausted {
+		t.Fatalf("code %v; want %v", st.Code(), codes.ResourceExhausted)
+	}
+	if len(st.Details()) != 1 {
+		t.Fatalf("details %v; want retry info", st.Details())
+	}
+	if retryInfo, ok := st.Details()[0].(*errdetails.RetryInfo); !ok || retryInfo.RetryDelay.AsDuration() <= 0 {
+		t.Errorf("details %v; want retry info with delay", st.Details())
+	}
+	if _, err := s.Login(ctx, &pb.LoginRequest{Username: "world", Password: "world"}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("code %v of other username; want %v", status.Code(err), codes.Unauthenticated)
+	}
+}
+
+func TestAccountServer_Refresh(t *testing.T) {
+	tokens := newTestTokens(t)
+	s := newTestAccountServer(t, tokens)
+	login, err := s.Login(context.TODO(), &pb.LoginRequest{Username: "hello", Password: "world"})
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	ctx := loggerContext()
+
+	resp, err := s.Refresh(ctx, &pb.RefreshRequest{RefreshToken: login.RefreshToken})
+
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if claims, err := tokens.Verify(resp.Token); err != nil || claims.Subject != "hello" {
+		t.Errorf("claims %v, err %v; want subject hello, <nil>", claims, err)
+	}
+	if _, err := s.Refresh(ctx, &pb.RefreshRequest{RefreshToken: login.RefreshToken}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("code %v of reused token; want %v", status.Code(err), codes.Unauthenticated)
+	}
+	if _, err := s.Refresh(ctx, &pb.RefreshRequest{RefreshToken: resp.RefreshToken}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("code %v of token of revoked session; want %v", status.Code(err), codes.Unauthenticated)
+	}
+}
+
+func TestAccountServer_Logout(t *testing.T) {
+	tokens := newTestTokens(t)
+	s := newTestAccountServer(t, tokens)
+	login, err := s.Login(context.TODO(), &pb.LoginRequest{Username: "hello", Password: "world"})
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	_, err = s.Logout(authenticate(t, tokens, login.Token), &pb.LogoutRequest{})
+
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	ctx := metadata.NewIncomingContext(context.TODO(), metadata.Pairs("authorization", "bearer "+login.Token))
+	if _, err := tokens.SessionAuth(ctx); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("code %v of token after logout; want %v", status.Code(err), codes.Unauthenticated)
+	}
+	if _, err := s.Refresh(context.TODO(), &pb.RefreshRequest{RefreshToken: login.RefreshToken}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("code %v of refresh token after logout; want %v", status.Code(err), codes.Unauthenticated)
+	}
+}
+
+func TestAccountServer_RevokeSessions(t *testing.T) {
+	tokens := newTestTokens(t)
+	s := newTestAccountServer(t, tokens)
+	if _, err := tokens.Issue(context.TODO(), "hello", nil); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	for _, tc := range []struct {
+		caller   string
+		roles    []string
+		username string
+		wantCode codes.Code
+		want     int32
+	}{
+		{"world", []string{"user"}, "hello", codes.PermissionDenied, 0},
+		{"world", []string{auth.RoleAdmin}, "hello", codes.OK, 1},
+		// the session of the caller
+		{"hello", nil, "", codes.OK, 1},
+	} {
+		resp, err := s.RevokeSessions(sessionContext(t, tokens, tc.caller, tc.roles...), &pb.RevokeSessionsRequest{Username: tc.username})
+
+		if status.Code(err) != tc.wantCode {
+			t.Errorf("%v/%v: code %v; want %v", tc.caller, tc.username, status.Code(err), tc.wantCode)
+		}
+		if resp.GetRevokedSessions() != tc.want {
+			t.Errorf("%v/%v: revoked %v; want %v", tc.caller, tc.username, resp.GetRevokedSessions(), tc.want)
+		}
+	}
+}
+
+func TestAccountServer_AuthFuncOverride(t *testing.T) {
+	s := newTestAccountServer(t, newTestTokens(t))
+
+	for method, wantCode := range map[string]codes.Code{
+		"/grpc_example.v1.Account/Login":                codes.OK,
+		"/grpc_example.v1.Account/Refresh":              codes.OK,
+		"/grpc_example.v1.Account/Logout":               codes.Unauthenticated,
+		"/grpc_example.v1.Account/RevokeSessions":       codes.Unauthenticated,
+		"/grpc_example.v1.Account/Register":             codes.OK,
+		"/grpc_example.v1.Account/ChangePassword":       codes.Unauthenticated,
+		"/grpc_example.v1.Account/RequestPasswordReset": codes.OK,
+		"/grpc_example.v1.Account/ResetPassword":        codes.OK,
+		"/grpc_example.v1.Account/DeleteAccount":        codes.Unauthenticated,
+		"/grpc_example.v1.Account/CreateApiKey":         codes.Unauthenticated,
+	} {
+		_, err := s.AuthFuncOverride(context.TODO(), method)
+
+		if status.Code(err) != wantCode {
+			t.Errorf("%v: code %v; want %v", method, status.Code(err), wantCode)
+		}
+	}
+	apiKeyCtx := metadata.NewIncomingContext(context.TODO(), metadata.Pairs("x-api-key", "prefix.secret"))
+	if _, err := s.AuthFuncOverride(apiKeyCtx, "/grpc_example.v1.Account/ListApiKeys"); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("code %v of API key; want %v", status.Code(err), codes.Unauthenticated)
+	}
+}
+
+func TestAccountServer_Register(t *testing.T) {
+	s := newTestAccountServer(t, newTestTokens(t))
+	ctx := loggerContext()
+
+	_, err := s.Register(ctx, &pb.RegisterRequest{Username: "world", Password: "Password"})
+
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if _, err := s.Login(ctx, &pb.LoginRequest{Username: "world", Password: "Password"}); err != nil {
+		t.Errorf("err %v of login; want <nil>", err)
+	}
+	if _, err := s.Register(ctx, &pb.RegisterRequest{Username: "world", Password: "Password"}); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("code %v of existing user; want %v", status.Code(err), codes.AlreadyExists)
+	}
+}
+
+func TestAccountServer_readOnly(t *testing.T) {
+	tokens := newTestTokens(t)
+	s := newTestAccountServer(t, tokens)
+	hello, err := s.users.Get(context.TODO(), "hello")
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	path := filepath.Join(t.TempDir(), "users.yaml")
+	if err := os.WriteFile(path, []byte("users:\n  - {username: hello, password_hash: "+hello.PasswordHash+"}\n"), 0o600); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if s.users, err = user.NewFileStore(path); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	ctx := sessionContext(t, tokens, "hello")
+
+	if _, err := s.Register(ctx, &pb.RegisterRequest{Username: "world", Password: "Password"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("code %v of register; want %v", status.Code(err), codes.FailedPrecondition)
+	}
+	if _, err := s.ChangePassword(ctx, &pb.ChangePasswordRequest{CurrentPassword: "world", NewPassword: "Password"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("code %v of change password; want %v", status.Code(err), codes.FailedPrecondition)
+	}
+	if _, err := s.DeleteAccount(ctx, &pb.DeleteAccountRequest{Password: "world"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("code %v of delete account; want %v", status.Code(err), codes.FailedPrecondition)
+	}
+	if _, err := s.Login(ctx, &pb.LoginRequest{Username: "hello", Password: "world"}); err != nil {
+		t.Errorf("err %v of login; want <nil>", err)
+	}
+}
+
+func TestAccountServer_Register_invalid(t *testing.T) {
+	s := newTestAccountServer(t, newTestTokens(t))
+
+	for _, tc := range []struct {
+		username  string
+		password  string
+		wantField string
+	}{
+		{"", "Password", "username"},
+		{"hello world", "Password", "username"},
+		{"world", "Pass", "password"},
+		{"world", "password", "password"},
+	} {
+		_, err := s.Register(context.TODO(), &pb.RegisterRequest{Username: tc.username, Password: tc.password})
+
+		wantFieldViolation(t, err, tc.wantField)
+	}
+}
+
+func TestAccountServer_ChangePassword(t *testing.T) {
+	tokens := newTestTokens(t)
+	s := newTestAccountServer(t, tokens)
+	other, err := tokens.Issue(context.TODO(), "hello", nil)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	ctx := sessionContext(t, tokens, "hello")
+
+	_, err = s.ChangePassword(ctx, &pb.ChangePasswordRequest{CurrentPassword: "world", NewPassword: "Password"})
+
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if _, err := s.Login(ctx, &pb.LoginRequest{Username: "hello", Password: "Password"}); err != nil {
+		t.Errorf("err %v of login with new password; want <nil>", err)
+	}
+	if _, err := tokens.SessionAuth(ctx); err != nil {
+		t.Errorf("err %v of own session; want <nil>", err)
+	}
+	otherCtx := metadata.NewIncomingContext(context.TODO(), metadata.Pairs("authorization", "bearer "+other.Token))
+	if _, err := tokens.SessionAuth(otherCtx); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("code %v of other session; want %v", status.Code(err), codes.Unauthenticated)
+	}
+}
+
+func TestAccountServer_ChangePassword_invalid(t *testing.T) {
+	tokens := newTestTokens(t)
+	s := newTestAccountServer(t, tokens)
+	ctx := sessionContext(t, tokens, "hello")
+
+	_, err := s.ChangePassword(ctx, &pb.ChangePasswordRequest{CurrentPassword: "earth", NewPassword: "Password"})
+	wantFieldViolation(t, err, "current_password")
+
+	_, err = s.ChangePassword(ctx, &pb.ChangePasswordRequest{CurrentPassword: "world", NewPassword: "short"})
+	wantFieldViolation(t, err, "new_password")
+}
+
+func TestAccountServer_ResetPassword(t *testing.T) {
+	tokens := newTestTokens(t)
+	s := newTestAccountServer(t, tokens)
+	session, err := tokens.Issue(context.TODO(), "hello", nil)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	ctx := loggerContext()
+	notifier := s.notifier.(*testNotifier)
+
+	_, err = s.RequestPasswordReset(ctx, &pb.RequestPasswordResetRequest{Username: "world"})
+	s.notifications.Wait()
+	if err != nil || notifier.token != "" {
+		t.Fatalf("token %q, err %v of unknown user; want no token, <nil>", notifier.token, err)
+	}
+	_, err = s.RequestPasswordReset(ctx, &pb.RequestPasswordResetRequest{Username: "hello"})
+	s.notifications.Wait()
+	if err != nil || notifier.username != "hello" {
+		t.Fatalf("username %q, err %v; want hello, <nil>", notifier.username, err)
+	}
+	_, err = s.ResetPassword(ctx, &pb.ResetPasswordRequest{ResetToken: notifier.token, NewPassword: "short"})
+	wantFieldViolation(t, err, "new_password")
+
+	_, err = s.ResetPassword(ctx, &pb.ResetPasswordRequest{ResetToken: notifier.token, NewPassword: "Password"})
+
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if _, err := s.Login(ctx, &pb.LoginRequest{Username: "hello", Password: "Password"}); err != nil {
+		t.Errorf("err %v of login with new password; want <nil>", err)
+	}
+	sessionCtx := metadata.NewIncomingContext(context.TODO(), metadata.Pairs("authorization", "bearer "+session.Token))
+	if _, err := tokens.SessionAuth(sessionCtx); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("code %v of session; want %v", status.Code(err), codes.Unauthenticated)
+	}
+	if _, err := s.ResetPassword(ctx, &pb.ResetPasswordRequest{ResetToken: notifier.token, NewPassword: "Password"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("code %v of used token; want %v", status.Code(err), codes.PermissionDenied)
+	}
+}
+
+func TestAccountServer_DeleteAccount(t *testing.T) {
+	tokens := newTestTokens(t)
+	s := newTestAccountServer(t, tokens)
+	ctx := sessionContext(t, tokens, "hello")
+	key, _, err := s.apiKeys.Create(ctx, "hello", nil, time.Time{}, nil)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	_, err = s.DeleteAccount(ctx, &pb.DeleteAccountRequest{Password: "earth"})
+	wantFieldViolation(t, err, "password")
+
+	_, err = s.DeleteAccount(ctx, &pb.DeleteAccountRequest{Password: "world"})
+
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if _, err := s.users.Get(ctx, "hello"); !errors.Is(err, user.ErrNotFound) {
+		t.Errorf("err %v; want %v", err, user.ErrNotFound)
+	}
+	if _, err := tokens.SessionAuth(ctx); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("code %v of session; want %v", status.Code(err), codes.Unauthenticated)
+	}
+	if _, err := s.apiKeys.Verify(ctx, key, netip.Addr{}); !errors.Is(err, auth.ErrAPIKeyNotFound) {
+		t.Errorf("err %v of API key; want %v", err, auth.ErrAPIKeyNotFound)
+	}
+}
+
+func TestAccountServer_ApiKeys(t *testing.T) {
+	tokens := newTestTokens(t)
+	s := newTestAccountServer(t, tokens)
+	ctx := sessionContext(t, tokens, "world", auth.RoleAdmin)
+
+	created, err := s.CreateApiKey(ctx, &pb.CreateApiKeyRequest{Owner: "batch", Roles: []string{"user"}, AllowedNetworks: []string{"10.0.0.0/8"}})
+
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if created.Key == "" || created.ApiKey.Owner != "batch" || created.ApiKey.Expiration != nil {
+		t.Errorf("resp %v; want key of batch without expiration", created)
+	}
+	listed, err := s.ListApiKeys(ctx, &pb.ListApiKeysRequest{Owner: "batch"})
+	if err != nil || len(listed.ApiKeys) != 1 || listed.ApiKeys[0].Prefix != created.ApiKey.Prefix {
+		t.Errorf("resp %v, err %v; want %v, <nil>", listed, err, created.ApiKey)
+	}
+	if _, err := s.RevokeApiKey(ctx, &pb.RevokeApiKeyRequest{Prefix: created.ApiKey.Prefix}); err != nil {
+		t.Errorf("err %v; want <nil>", err)
+	}
+	if _, err := s.RevokeApiKey(ctx, &pb.RevokeApiKeyRequest{Prefix: created.ApiKey.Prefix}); status.Code(err) != codes.NotFound {
+		t.Errorf("code %v of revoked key; want %v", status.Code(err), codes.NotFound)
+	}
+}
+
+func TestAccountServer_CreateApiKey_invalid(t *testing.T) {
+	tokens := newTestTokens(t)
+	s := newTestAccountServer(t, tokens)
+	ctx := sessionContext(t, tokens, "world", auth.RoleAdmin)
+
+	_, err := s.CreateApiKey(ctx, &pb.CreateApiKeyRequest{})
+	wantFieldViolation(t, err, "owner")
+
+	_, err = s.CreateApiKey(ctx, &pb.CreateApiKeyRequest{Owner: "batch", AllowedNetworks: []string{"hello"}})
+	wantFieldViolation(t, err, "allowed_networks")
+
+	_, err = s.CreateApiKey(ctx, &pb.CreateApiKeyRequest{Owner: "batch", Expiration: timestamppb.New(time.Now().Add(-time.Hour))})
+	wantFieldViolation(t, err, "expiration")
+
+	_, err = s.CreateApiKey(sessionContext(t, tokens, "hello"), &pb.CreateApiKeyRequest{Owner: "batch"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("code %v of non-admin; want %v", status.Code(err), codes.PermissionDenied)
+	}
+}
+
+func TestAccountServer_TOTP(t *testing.T) {
+	tokens := newTestTokens(t)
+	s := newTestAccountServer(t, tokens)
+	ctx := sessionContext(t, tokens, "hello")
+	login := func(req *pb.LoginRequest) (*pb.LoginResponse, error) {
+		return s.Login(loggerContext(), req)
+	}
+
+	_, err := s.EnrollTOTP(ctx, &pb.EnrollTOTPRequest{Password: "earth"})
+	wantFieldViolation(t, err, "password")
+	enrolled, err := s.EnrollTOTP(ctx, &pb.EnrollTOTPRequest{Password: "world"})
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if enrolled.Secret == "" || !strings.HasPrefix(enrolled.ProvisioningUri, "otpauth://totp/test:hello?") {
+		t.Errorf("secret %q, uri %q; want secret and otpauth uri", enrolled.Secret, enrolled.ProvisioningUri)
+	}
+	if resp, err := login(&pb.LoginRequest{Username: "hello", Password: "world"}); err != nil || resp.Token == "" {
+		t.Errorf("token %q, err %v before confirmation; want token, <nil>", resp.GetToken(), err)
+	}
+	_, err = s.ConfirmTOTP(ctx, &pb.ConfirmTOTPRequest{TotpCode: "000000"})
+	wantFieldViolation(t, err, "totp_code")
+	code := totpCode(t, enrolled.Secret, time.Now())
+	confirmed, err := s.ConfirmTOTP(ctx, &pb.ConfirmTOTPRequest{TotpCode: code})
+	if err != nil || len(confirmed.RecoveryCodes) == 0 {
+		t.Fatalf("recovery codes %v, err %v; want codes, <nil>", confirmed.GetRecoveryCodes(), err)
+	}
+
+	resp, err := login(&pb.LoginRequest{Username: "hello", Password: "world"})
+	if err != nil || !resp.TotpRequired || resp.Challenge == "" || resp.Token != "" {
+		t.Fatalf("response %v, err %v; want challenge without token, <nil>", resp, err)
+	}
+	if _, err := login(&pb.LoginRequest{Challenge: resp.Challenge, TotpCode: code}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("code %v of reused one-time code; want %v", status.Code(err), codes.Unauthenticated)
+	}
+	resp, err = login(&pb.LoginRequest{Username: "hello", Password: "world"})
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	nextCode := totpCode(t, enrolled.Secret, time.Now().Add(30*time.Second))
+	if resp, err := login(&pb.LoginRequest{Challenge: resp.Challenge, TotpCode: nextCode}); err != nil || resp.Token == "" {
+		t.Errorf("token %q, err %v; want token, <nil>", resp.GetToken(), err)
+	}
+	if _, err := login(&pb.LoginRequest{Challenge: resp.Challenge, TotpCode: nextCode}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("code %v of used challenge; want %v", status.Code(err), codes.Unauthenticated)
+	}
+
+	recovery := &pb.LoginRequest{Username: "hello", Password: "world", RecoveryCode: confirmed.RecoveryCodes[0]}
+	if resp, err := login(recovery); err != nil || resp.Token == "" {
+		t.Errorf("token %q, err %v of recovery code; want token, <nil>", resp.GetToken(), err)
+	}
+	if _, err := login(recovery); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("code %v of used recovery code; want %v", status.Code(err), codes.Unauthenticated)
+	}
+	if _, err := s.EnrollTOTP(ctx, &pb.EnrollTOTPRequest{Password: "world"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("code %v of enrolled user; want %v", status.Code(err), codes.FailedPrecondition)
+	}
+}
+
+func TestAccountServer_Login_challenge(t *testing.T) {
+	s := newTestAccountServer(t, newTestTokens(t))
+	ctx := loggerContext()
+	secret := enrollTOTP(t, s, "hello")
+	password := &pb.LoginRequest{Username: "hello", Password: "world"}
+	resp, err := s.Login(ctx, password)
+	if err != nil || resp.Challenge == "" {
+		t.Fatalf("challenge %q, err %v; want challenge, <nil>", resp.GetChallenge(), err)
+	}
+
+	_, err = s.Login(ctx, &pb.LoginRequest{Challenge: resp.Challenge, TotpCode: "000000"})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("code %v of wrong one-time code; want %v", status.Code(err), codes.Unauthenticated)
+	}
+	code := totpCode(t, secret, time.Now())
+	if resp, err := s.Login(ctx, &pb.LoginRequest{Challenge: resp.Challenge, TotpCode: code}); err != nil || resp.Token == "" {
+		t.Errorf("token %q, err %v after wrong one-time code; want token, <nil>", resp.GetToken(), err)
+	}
+
+	// a new user with the same name and without TOTP
+	resp, err = s.Login(ctx, password)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if err := s.users.Delete(ctx, "hello"); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if err := s.users.Create(ctx, user.User{Username: "hello", PasswordHash: "hash"}); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if _, err := s.Login(ctx, &pb.LoginRequest{Challenge: resp.Challenge}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("code %v of challenge of deleted user; want %v", status.Code(err), codes.Unauthenticated)
+	}
+}
+
+// enrollTOTP confirms a new TOTP secret of username, and returns the secret.
+func enrollTOTP(t *testing.T, s *accountServer, username string) string {
+	secret, err := user.NewTOTPSecret()
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if err := s.users.SetTOTPSecret(context.TODO(), username, secret); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if err := s.users.ConfirmTOTP(context.TODO(), username, secret, 0, nil); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return secret
+}
+
+func TestAccountServer_verifySecondFactor_concurrent(t *testing.T) {
+	s := newTestAccountServer(t, newTestTokens(t))
+	ctx := context.TODO()
+	secret, err := user.NewTOTPSecret()
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	recoveryCodes, hashes, err := user.NewRecoveryCodes()
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if err := s.users.SetTOTPSecret(ctx, "hello", secret); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if err := s.users.ConfirmTOTP(ctx, "hello", secret, 0, hashes); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	code := totpCode(t, secret, time.Now())
+
+	var wg sync.WaitGroup
+	codeErrs := make([]error, 5)
+	recoveryErrs := make([]error, 5)
+	for i := range codeErrs {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			codeErrs[i] = s.verifySecondFactor(ctx, "hello", code, "")
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			recoveryErrs[i] = s.verifySecondFactor(ctx, "hello", "", recoveryCodes[i])
+		}(i)
+	}
+	wg.Wait()
+
+	used := 0
+	for _, err := range codeErrs {
+		if err == nil {
+			used++
+		} else if !errors.Is(err, user.ErrInvalidTOTPCode) {
+			t.Errorf("err %v of one-time code; want <nil> or %v", err, user.ErrInvalidTOTPCode)
+		}
+	}
+	if used != 1 {
+		t.Errorf("uses %v of one-time code; want 1", used)
+	}
+	for i, err := range recoveryErrs {
+		if err != nil {
+			t.Errorf("err %v of recovery code %v; want <nil>", err, i)
+		}
+	}
+	u, err := s.users.Get(ctx, "hello")
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if len(u.RecoveryCodes) != len(hashes)-len(recoveryErrs) {
+		t.Errorf("recovery codes %v; want %v codes", u.RecoveryCodes, len(hashes)-len(recoveryErrs))
+	}
+}
+
+func totpCode(t *testing.T, secret string, at time.Time) string {
+	code, err := user.TOTPCode(secret, at)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return code
+}
@@ -3,16 +3,17 @@ package v1
 import (
 	"context"
 
+	grpc_middleware_auth "github.com/grpc-ecosystem/go-grpc-middleware/v2/auth"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
-	"github.com/zmzhang8/grpc_example/lib/auth"
 	"github.com/zmzhang8/grpc_example/middleware/logging"
 	pb "github.com/zmzhang8/grpc_example/proto/v1"
 )
 
 type greeterServer struct {
 	pb.UnimplementedGreeterServer
+	authFunc grpc_middleware_auth.AuthFunc
 }
 
 func (s *greeterServer) SayHello(
@@ -31,9 +32,9 @@ func (s *greeterServer) SayHello(
 }
 
 func (s *greeterServer) AuthFuncOverride(ctx context.Context, fullMethodName string) (context.Context, error) {
-	return auth.SessionAuth(ctx)
+	return s.authFunc(ctx)
 }
 
-func NewGreeterServer() *greeterServer {
-	return &greeterServer{}
+func NewGreeterServer(authFunc grpc_middleware_auth.AuthFunc) *greeterServer {
+	return &greeterServer{authFunc: authFunc}
 }
@@ -8,13 +8,14 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
+	"github.com/zmzhang8/grpc_example/lib/auth"
 	"github.com/zmzhang8/grpc_example/lib/log"
 	"github.com/zmzhang8/grpc_example/middleware/logging"
 	pb "github.com/zmzhang8/grpc_example/proto/v1"
 )
 
 func TestGreeterServer_SayHello_success(t *testing.T) {
-	s := NewGreeterServer()
+	s := NewGreeterServer(auth.AllowAll)
 	logger := log.NewLogger(log.NewCore(false, os.Stdout, false))
 	ctx := context.WithValue(context.TODO(), logging.ContextKey(), logger)
 	req := pb.HelloRequest{
@@ -34,7 +35,7 @@ func TestGreeterServer_SayHello_success(t *testing.T) {
 }
 
 func TestGreeterServer_SayHello_failure(t *testing.T) {
-	s := NewGreeterServer()
+	s := NewGreeterServer(auth.AllowAll)
 	logger := log.NewLogger(log.NewCore(false, os.Stdout, false))
 	ctx := context.WithValue(context.TODO(), logging.ContextKey(), logger)
 	req := pb.HelloRequest{
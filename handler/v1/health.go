@@ -8,25 +8,34 @@ import (
 	"google.golang.org/grpc/status"
 
 	"github.com/zmzhang8/grpc_example/lib/auth"
+	"github.com/zmzhang8/grpc_example/lib/health"
 	pb "github.com/zmzhang8/grpc_example/proto/v1"
 )
 
 type healthServer struct {
 	pb.UnimplementedHealthServer
+	health *health.Health
+}
+
+func (s *healthServer) status(ctx context.Context) pb.HealthCheckResponse_ServingStatus {
+	if s.health.IsReady(ctx) {
+		return pb.HealthCheckResponse_SERVING
+	}
+	return pb.HealthCheckResponse_NOT_SERVING
 }
 
 func (s *healthServer) Check(
 	ctx context.Context,
 	in *pb.HealthCheckRequest,
 ) (*pb.HealthCheckResponse, error) {
-	return &pb.HealthCheckResponse{Status: pb.HealthCheckResponse_SERVING}, nil
+	return &pb.HealthCheckResponse{Status: s.status(ctx)}, nil
 }
 
 func (s *healthServer) Watch(
 	in *pb.HealthCheckRequest,
 	stream pb.Health_WatchServer,
 ) error {
-	stream.Send(&pb.HealthCheckResponse{Status: pb.HealthCheckResponse_SERVING})
+	stream.Send(&pb.HealthCheckResponse{Status: s.status(stream.Context())})
 
 	ticker := time.NewTicker(time.Minute)
 	for {
@@ -34,7 +43,7 @@ func (s *healthServer) Watch(
 		case <-stream.Context().Done():
 			return status.Error(codes.Canceled, "")
 		case <-ticker.C:
-			stream.Send(&pb.HealthCheckResponse{Status: pb.HealthCheckResponse_SERVING})
+			stream.Send(&pb.HealthCheckResponse{Status: s.status(stream.Context())})
 		}
 	}
 }
@@ -43,6 +52,6 @@ func (s *healthServer) AuthFuncOverride(ctx context.Context, fullMethodName stri
 	return auth.AllowAll(ctx)
 }
 
-func NewHealthServer() *healthServer {
-	return &healthServer{}
+func NewHealthServer(health *health.Health) *healthServer {
+	return &healthServer{health: health}
 }
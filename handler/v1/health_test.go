@@ -10,6 +10,7 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
+	"github.com/zmzhang8/grpc_example/lib/health"
 	"github.com/zmzhang8/grpc_example/lib/log"
 	"github.com/zmzhang8/grpc_example/middleware/logging"
 	pb "github.com/zmzhang8/grpc_example/proto/v1"
@@ -24,21 +25,48 @@ func (s *healthWatchServerMock) Send(resp *pb.HealthCheckResponse) error {
 	return s.ServerStream.SendMsg(resp)
 }
 
+func newServingHealth() *health.Health {
+	h := health.New()
+	h.SetServing()
+	return h
+}
+
 func TestHealthServer_Check_success(t *testing.T) {
-	s := NewHealthServer()
+	s := NewHealthServer(newServingHealth())
+	logger := log.NewLogger(log.NewCore(false, os.Stdout, false))
+	ctx := context.WithValue(context.TODO(), logging.ContextKey(), logger)
+	req := pb.HealthCheckRequest{}
+
+	resp, err := s.Check(ctx, &req)
+
+	if err != nil {
+		t.Errorf("err %v; want <nil>", err)
+	}
+	if resp.GetStatus() != pb.HealthCheckResponse_SERVING {
+		t.Errorf("status %v; want %v", resp.GetStatus(), pb.HealthCheckResponse_SERVING)
+	}
+}
+
+func TestHealthServer_Check_draining(t *testing.T) {
+	h := newServingHealth()
+	h.Drain()
+	s := NewHealthServer(h)
 	logger := log.NewLogger(log.NewCore(false, os.Stdout, false))
 	ctx := context.WithValue(context.TODO(), logging.ContextKey(), logger)
 	req := pb.HealthCheckRequest{}
 
-	_, err := s.Check(ctx, &req)
+	resp, err := s.Check(ctx, &req)
 
 	if err != nil {
 		t.Errorf("err %v; want <nil>", err)
 	}
+	if resp.GetStatus() != pb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("status %v; want %v", resp.GetStatus(), pb.HealthCheckResponse_NOT_SERVING)
+	}
 }
 
 func TestHealthServer_Watch_success(t *testing.T) {
-	s := NewHealthServer()
+	s := NewHealthServer(newServingHealth())
 	logger := log.NewLogger(log.NewCore(false, os.Stdout, false))
 	ctx, cancelFunc := context.WithTimeout(
 		context.WithValue(context.TODO(), logging.ContextKey(), logger),
@@ -9,14 +9,15 @@ import (
 	"sync"
 	"time"
 
+	grpc_middleware_auth "github.com/grpc-ecosystem/go-grpc-middleware/v2/auth"
 	"google.golang.org/protobuf/proto"
 
-	"github.com/zmzhang8/grpc_example/lib/auth"
 	pb "github.com/zmzhang8/grpc_example/proto/v1"
 )
 
 type routeGuideServer struct {
 	pb.UnimplementedRouteGuideServer
+	authFunc      grpc_middleware_auth.AuthFunc
 	savedFeatures []*pb.Feature // read-only after initialized
 
 	mu         sync.Mutex // protects routeNotes
@@ -153,11 +154,11 @@ func inRange(point *pb.Point, rect *pb.Rectangle) bool {
 }
 
 func (s *routeGuideServer) AuthFuncOverride(ctx context.Context, fullMethodName string) (context.Context, error) {
-	return auth.SessionAuth(ctx)
+	return s.authFunc(ctx)
 }
 
-func NewRouteGuideServer() *routeGuideServer {
-	server := &routeGuideServer{routeNotes: make(map[string][]*pb.RouteNote)}
+func NewRouteGuideServer(authFunc grpc_middleware_auth.AuthFunc) *routeGuideServer {
+	server := &routeGuideServer{authFunc: authFunc, routeNotes: make(map[string][]*pb.RouteNote)}
 	if err := json.Unmarshal(exampleData, &server.savedFeatures); err != nil {
 		panic("Failed to load default features")
 	}
@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	grpc_middleware_auth "github.com/grpc-ecosystem/go-grpc-middleware/v2/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/zmzhang8/grpc_example/lib/clientip"
+)
+
+// Metadata key of API keys.
+const APIKeyHeader = "x-api-key"
+
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// APIKey is a stored API key of a machine client. Keys have the form {prefix}.{secret}, and only the hash
+// of the whole key is stored.
+type APIKey struct {
+	Prefix string
+	// SHA-256 hash of the key.
+	Hash  string
+	Owner string
+	Roles []string
+	// Zero if the key does not expire.
+	ExpiresAt time.Time
+	// The key can be used from anywhere if empty.
+	AllowedNetworks []netip.Prefix
+	CreatedAt       time.Time
+}
+
+// APIKeyStore keeps API keys by prefix.
+type APIKeyStore interface {
+	AddAPIKey(ctx context.Context, key APIKey) error
+	// GetAPIKey returns ErrAPIKeyNotFound if the key does not exist.
+	GetAPIKey(ctx context.Context, prefix string) (*APIKey, error)
+	// ListAPIKeys returns the keys of owner, or all keys if owner is empty.
+	ListAPIKeys(ctx context.Context, owner string) ([]APIKey, error)
+	// DeleteAPIKey returns ErrAPIKeyNotFound if the key does not exist.
+	DeleteAPIKey(ctx context.Context, prefix string) error
+}
+
+// APIKeys issues and verifies API keys.
+type APIKeys struct {
+	store APIKeyStore
+}
+
+func NewAPIKeys(store APIKeyStore) *APIKeys {
+	return &APIKeys{store: store}
+}
+
+// Create issues a new key, and returns it along with the stored key. The key cannot be recovered later.
+func (k *APIKeys) Create(ctx context.Context, owner string, roles []string, expiresAt time.Time, allowedNetworks []netip.Prefix) (string, *APIKey, error) {
+	if owner == "" {
+		return "", nil, errors.New("API key has no owner")
+	}
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	prefix := hex.EncodeToString(b)
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", nil, err
+	}
+	key := prefix + "." + secret
+	stored := &APIKey{
+		Prefix:          prefix,
+		Hash:            hashToken(key),
+		Owner:           owner,
+		Roles:           roles,
+		ExpiresAt:       expiresAt,
+		AllowedNetworks: allowedNetworks,
+		CreatedAt:       time.Now().UTC().Truncate(time.Second),
+	}
+	if err := k.store.AddAPIKey(ctx, *stored); err != nil {
+		return "", nil, err
+	}
+	return key, stored, nil
+}
+
+func (k *APIKeys) List(ctx context.Context, owner string) ([]APIKey, error) {
+	return k.store.ListAPIKeys(ctx, owner)
+}
+
+// Revoke deletes a key, which is rejected from then on.
+func (k *APIKeys) Revoke(ctx context.Context, prefix string) error {
+	return k.store.DeleteAPIKey(ctx, prefix)
+}
+
+// RevokeOwner deletes the keys of owner, e.g. of a deleted user, and returns the number of deleted keys.
+func (k *APIKeys) RevokeOwner(ctx context.Context, owner string) (int, error) {
+	if owner == "" {
+		return 0, errors.New("owner must not be empty")
+	}
+	keys, err := k.store.ListAPIKeys(ctx, owner)
+	if err != nil {
+		return 0, err
+	}
+	revoked := 0
+	for _, key := range keys {
+		err := k.store.DeleteAPIKey(ctx, key.Prefix)
+		if err != nil && !errors.Is(err, ErrAPIKeyNotFound) {
+			return revoked, err
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+// Verify returns the stored key of key if it is valid and can be used from addr.
+func (k *APIKeys) Verify(ctx context.Context, key string, addr netip.Addr) (*APIKey, error) {
+	prefix, _, ok := strings.Cut(key, ".")
+	if !ok {
+		return nil, errors.New("malformed API key")
+	}
+	stored, err := k.store.GetAPIKey(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(key)), []byte(stored.Hash)) != 1 {
+		return nil, ErrAPIKeyNotFound
+	}
+	if !stored.ExpiresAt.IsZero() && !time.Now().Before(stored.ExpiresAt) {
+		return nil, errors.New("API key expired")
+	}
+	if len(stored.AllowedNetworks) > 0 && !allowed(stored.AllowedNetworks, addr) {
+		return nil, errNetworkNotAllowed
+	}
+	return stored, nil
+}
+
+var errNetworkNotAllowed = errors.New("API key is not allowed from address")
+
+// APIKeyAuth authenticates calls with API keys, and puts the owner and the roles of the key into the context.
+// Network restrictions apply to the client address of clientip, and keys with allowed networks are rejected
+// if the client address is unknown.
+//
+// Expected header
+// key: x-api-key
+// value: {key}
+func (k *APIKeys) APIKeyAuth(ctx context.Context) (context.Context, error) {
+	key := apiKeysFromMD(ctx)
+	if len(key) != 1 || key[0] == "" {
+		return nil, status.Error(codes.Unauthenticated, "Missing API key")
+	}
+	stored, err := k.Verify(ctx, key[0], clientip.FromContext(ctx))
+	if errors.Is(err, errNetworkNotAllowed) {
+		return nil, status.Error(codes.PermissionDenied, "API key is not allowed from this address")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Invalid API key")
+	}
+	return WithPrincipal(ctx, Principal{
+		Subject:    stored.Owner,
+		AuthMethod: AuthMethodAPIKey,
+		Grants:     Grants{Roles: stored.Roles},
+		TokenID:    stored.Prefix,
+		ExpiresAt:  stored.ExpiresAt,
+	}), nil
+}
+
+// AuthOr authenticates calls with an x-api-key header by APIKeyAuth, and other calls by fallback,
+// e.g. SessionAuth.
+func (k *APIKeys) AuthOr(fallback grpc_middleware_auth.AuthFunc) grpc_middleware_auth.AuthFunc {
+	return func(ctx context.Context) (context.Context, error) {
+		if len(apiKeysFromMD(ctx)) > 0 {
+			return k.APIKeyAuth(ctx)
+		}
+		return fallback(ctx)
+	}
+}
+
+func apiKeysFromMD(ctx context.Context) []string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return md.Get(APIKeyHeader)
+}
+
+// ParseNetworks parses CIDRs, or single addresses, of allowed networks.
+func ParseNetworks(networks []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(networks))
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			addr, err := netip.ParseAddr(network)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network %q: %w", network, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", network, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func allowed(networks []netip.Prefix, addr netip.Addr) bool {
+	for _, network := range networks {
+		if addr.IsValid() && network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
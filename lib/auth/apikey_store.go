@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryAPIKeyStore keeps API keys in memory, so they are lost on restart.
+type MemoryAPIKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]APIKey // by prefix
+}
+
+func NewMemoryAPIKeyStore() *MemoryAPIKeyStore {
+	return &MemoryAPIKeyStore{keys: make(map[string]APIKey)}
+}
+
+func (s *MemoryAPIKeyStore) AddAPIKey(ctx context.Context, key APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[key.Prefix]; ok {
+		return errors.New("duplicate API key prefix")
+	}
+	s.keys[key.Prefix] = key
+	return nil
+}
+
+func (s *MemoryAPIKeyStore) GetAPIKey(ctx context.Context, prefix string) (*APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.keys[prefix]
+	if !ok {
+		return nil, ErrAPIKeyNotFound
+	}
+	return &key, nil
+}
+
+func (s *MemoryAPIKeyStore) ListAPIKeys(ctx context.Context, owner string) ([]APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys []APIKey
+	for _, key := range s.keys {
+		if owner == "" || key.Owner == owner {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Prefix < keys[j].Prefix })
+	return keys, nil
+}
+
+func (s *MemoryAPIKeyStore) DeleteAPIKey(ctx context.Context, prefix string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[prefix]; !ok {
+		return ErrAPIKeyNotFound
+	}
+	delete(s.keys, prefix)
+	return nil
+}
+
+const sqliteAPIKeysSchema = `CREATE TABLE IF NOT EXISTS api_keys (
+	prefix TEXT PRIMARY KEY,
+	hash TEXT NOT NULL,
+	owner TEXT NOT NULL,
+	roles TEXT NOT NULL,
+	expires_at INTEGER NOT NULL,
+	allowed_networks TEXT NOT NULL,
+	created_at INTEGER NOT NULL
+)`
+
+// SQLiteAPIKeyStore keeps API keys in the api_keys table of a SQLite database. Roles and networks are
+// space-separated, and times are Unix seconds, or 0 for keys without expiry.
+type SQLiteAPIKeyStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteAPIKeyStore creates the api_keys table in db if it does not exist. db is opened by sqlite.Open.
+func NewSQLiteAPIKeyStore(ctx context.Context, db *sql.DB) (*SQLiteAPIKeyStore, error) {
+	if _, err := db.ExecContext(ctx, sqliteAPIKeysSchema); err != nil {
+		return nil, err
+	}
+	return &SQLiteAPIKeyStore{db: db}, nil
+}
+
+func (s *SQLiteAPIKeyStore) AddAPIKey(ctx context.Context, key APIKey) error {
+	var expiresAt int64
+	if !key.ExpiresAt.IsZero() {
+		expiresAt = key.ExpiresAt.Unix()
+	}
+	networks := make([]string, 0, len(key.AllowedNetworks))
+	for _, network := range key.AllowedNetworks {
+		networks = append(networks, network.String())
+	}
+	_, err := s.db.ExecContext(ctx, "INSERT INTO api_keys (prefix, hash, owner, roles, expires_at, allowed_networks, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		key.Prefix, key.Hash, key.Owner, strings.Join(key.Roles, " "), expiresAt, strings.Join(networks, " "), key.CreatedAt.Unix())
+	return err
+}
+
+func (s *SQLiteAPIKeyStore) GetAPIKey(ctx context.Context, prefix string) (*APIKey, error) {
+	key, err := scanAPIKey(s.db.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE prefix = ?", prefix))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAPIKeyNotFound
+	}
+	return key, err
+}
+
+func (s *SQLiteAPIKeyStore) ListAPIKeys(ctx context.Context, owner string) ([]APIKey, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE ? = '' OR owner = ? ORDER BY prefix", owner, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLiteAPIKeyStore) DeleteAPIKey(ctx context.Context, prefix string) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM api_keys WHERE prefix = ?", prefix)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+const apiKeyColumns = "prefix, hash, owner, roles, expires_at, allowed_networks, created_at"
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (*APIKey, error) {
+	key := &APIKey{}
+	var roles, networks string
+	var expiresAt, createdAt int64
+	if err := row.Scan(&key.Prefix, &key.Hash, &key.Owner, &roles, &expiresAt, &networks, &createdAt); err != nil {
+		return nil, err
+	}
+	if roles != "" {
+		key.Roles = strings.Fields(roles)
+	}
+	if expiresAt != 0 {
+		key.ExpiresAt = time.Unix(expiresAt, 0).UTC()
+	}
+	for _, network := range strings.Fields(networks) {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return nil, err
+		}
+		key.AllowedNetworks = append(key.AllowedNetworks, prefix)
+	}
+	key.CreatedAt = time.Unix(createdAt, 0).UTC()
+	return key, nil
+}
@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/zmzhang8/grpc_example/lib/clientip"
+	"github.com/zmzhang8/grpc_example/lib/sqlite"
+)
+
+// apiKeyContext returns the context of a call from the client address addr with key.
+func apiKeyContext(key string, addr string) context.Context {
+	ctx := metadata.NewIncomingContext(context.TODO(), metadata.Pairs(APIKeyHeader, key))
+	if addr == "" {
+		return ctx
+	}
+	return clientip.WithAddr(ctx, netip.MustParseAddr(addr))
+}
+
+func TestAPIKeys_APIKeyAuth(t *testing.T) {
+	keys := NewAPIKeys(NewMemoryAPIKeyStore())
+	networks, err := ParseNetworks([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	key, stored, err := keys.Create(context.TODO(), "batch", []string{"user"}, time.Now().Add(time.Hour), networks)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	expired, _, err := keys.Create(context.TODO(), "batch", nil, time.Now().Add(-time.Second), nil)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		key      string
+		addr     string
+		wantCode codes.Code
+	}{
+		{"network", key, "10.1.2.3", codes.OK},
+		{"address", key, "192.168.1.1", codes.OK},
+		{"other address", key, "192.168.1.2", codes.PermissionDenied},
+		{"unknown address", key, "", codes.PermissionDenied},
+		{"expired", expired, "10.1.2.3", codes.Unauthenticated},
+		{"wrong secret", stored.Prefix + ".worldhello", "10.1.2.3", codes.Unauthenticated},
+		{"unknown prefix", "000000000000.worldhello", "10.1.2.3", codes.Unauthenticated},
+		{"malformed", "worldhello", "10.1.2.3", codes.Unauthenticated},
+	} {
+		ctx, err := keys.APIKeyAuth(apiKeyContext(tc.key, tc.addr))
+
+		if status.Code(err) != tc.wantCode {
+			t.Errorf("%v: code %v; want %v", tc.name, status.Code(err), tc.wantCode)
+		}
+		if tc.wantCode != codes.OK {
+			continue
+		}
+		got := MustFromContext(ctx)
+		if got.Subject != "batch" || got.AuthMethod != AuthMethodAPIKey || got.TokenID != stored.Prefix {
+			t.Errorf("%v: principal %+v; want batch of %v with prefix %v", tc.name, got, AuthMethodAPIKey, stored.Prefix)
+		}
+		if !reflect.DeepEqual(got.Roles, []string{"user"}) {
+			t.Errorf("%v: roles %v; want [user]", tc.name, got.Roles)
+		}
+	}
+}
+
+func TestAPIKeys_Revoke(t *testing.T) {
+	keys := NewAPIKeys(NewMemoryAPIKeyStore())
+	key, stored, err := keys.Create(context.TODO(), "batch", nil, time.Time{}, nil)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	if err := keys.Revoke(context.TODO(), stored.Prefix); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	if _, err := keys.APIKeyAuth(apiKeyContext(key, "10.1.2.3")); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("code %v; want %v", status.Code(err), codes.Unauthenticated)
+	}
+	if err := keys.Revoke(context.TODO(), stored.Prefix); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("err %v; want %v", err, ErrAPIKeyNotFound)
+	}
+}
+
+func TestAPIKeys_RevokeOwner(t *testing.T) {
+	keys := NewAPIKeys(NewMemoryAPIKeyStore())
+	for _, owner := range []string{"batch", "batch", "other"} {
+		if _, _, err := keys.Create(context.TODO(), owner, nil, time.Time{}, nil); err != nil {
+			t.Fatalf("err %v; want <nil>", err)
+		}
+	}
+
+	revoked, err := keys.RevokeOwner(context.TODO(), "batch")
+
+	if err != nil || revoked != 2 {
+		t.Errorf("revoked %v, err %v; want 2, <nil>", revoked, err)
+	}
+	if got, err := keys.List(context.TODO(), ""); err != nil || len(got) != 1 || got[0].Owner != "other" {
+		t.Errorf("keys %+v, err %v; want key of other, <nil>", got, err)
+	}
+}
+
+func TestAPIKeys_AuthOr(t *testing.T) {
+	keys := NewAPIKeys(NewMemoryAPIKeyStore())
+	authFunc := keys.AuthOr(AllowAll)
+
+	if _, err := authFunc(context.TODO()); err != nil {
+		t.Errorf("err %v without API key; want <nil> of fallback", err)
+	}
+	if _, err := authFunc(apiKeyContext("worldhello", "10.1.2.3")); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("code %v of invalid API key; want %v", status.Code(err), codes.Unauthenticated)
+	}
+}
+
+func TestParseNetworks_invalid(t *testing.T) {
+	for _, network := range []string{"", "10.0.0.0/33", "hello"} {
+		if _, err := ParseNetworks([]string{network}); err == nil {
+			t.Errorf("%q: err <nil>; want error", network)
+		}
+	}
+}
+
+func TestAPIKeyStores(t *testing.T) {
+	db, err := sqlite.Open(filepath.Join(t.TempDir(), "keys.db"))
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	defer db.Close()
+	sqliteStore, err := NewSQLiteAPIKeyStore(context.TODO(), db)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	key := APIKey{
+		Prefix:          "0123456789ab",
+		Hash:            hashToken("0123456789ab.secret"),
+		Owner:           "batch",
+		Roles:           []string{"admin", "user"},
+		ExpiresAt:       time.Unix(2000000000, 0).UTC(),
+		AllowedNetworks: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		CreatedAt:       time.Unix(1000000000, 0).UTC(),
+	}
+
+	for name, store := range map[string]APIKeyStore{"memory": NewMemoryAPIKeyStore(), "sqlite": sqliteStore} {
+		if err := store.AddAPIKey(context.TODO(), key); err != nil {
+			t.Fatalf("%v: err %v; want <nil>", name, err)
+		}
+
+		if got, err := store.GetAPIKey(context.TODO(), key.Prefix); err != nil || !reflect.DeepEqual(*got, key) {
+			t.Errorf("%v: key %+v, err %v; want %+v, <nil>", name, got, err, key)
+		}
+		if got, err := store.ListAPIKeys(context.TODO(), "batch"); err != nil || len(got) != 1 {
+			t.Errorf("%v: keys %+v, err %v; want 1 key, <nil>", name, got, err)
+		}
+		if got, err := store.ListAPIKeys(context.TODO(), "other"); err != nil || len(got) != 0 {
+			t.Errorf("%v: keys %+v, err %v of other owner; want none, <nil>", name, got, err)
+		}
+		if err := store.DeleteAPIKey(context.TODO(), key.Prefix); err != nil {
+			t.Errorf("%v: err %v; want <nil>", name, err)
+		}
+		if _, err := store.GetAPIKey(context.TODO(), key.Prefix); !errors.Is(err, ErrAPIKeyNotFound) {
+			t.Errorf("%v: err %v of deleted key; want %v", name, err, ErrAPIKeyNotFound)
+		}
+	}
+}
@@ -2,20 +2,74 @@ package auth
 
 import (
 	"context"
+	"time"
 
-	grpc_middleware_auth "github.com/grpc-ecosystem/go-grpc-middleware/v2/auth"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 type contextKey struct{}
 
-func MustGetAuthMetadata(ctx context.Context) string {
-	metadata, ok := ctx.Value(contextKey{}).(string)
+// Methods of authentication of principals.
+const (
+	AuthMethodNone    = "none"
+	AuthMethodSession = "session"
+	AuthMethodAPIKey  = "api_key"
+	AuthMethodOIDC    = "oidc"
+)
+
+// Grants are the roles and scopes of the authenticated caller, which authorization checks.
+type Grants struct {
+	Roles  []string
+	Scopes []string
+}
+
+// RoleAdmin is the role of administrators, who can revoke sessions of other users and manage API keys.
+const RoleAdmin = "admin"
+
+// HasRole reports whether the grants include role.
+func (g Grants) HasRole(role string) bool {
+	for _, r := range g.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Principal is the caller of a call, which every auth function puts into the context.
+type Principal struct {
+	// Username of sessions, owner of API keys, or mapped subject of external tokens.
+	// It is empty for anonymous callers.
+	Subject    string
+	AuthMethod string
+	Grants
+	Tenant string
+	// Session id of sessions, prefix of API keys, or jti of external tokens.
+	TokenID string
+	// Expiration of the token or the key, which is zero if it does not expire.
+	ExpiresAt time.Time
+}
+
+// WithPrincipal returns a child context with the principal of the call.
+func WithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, principal)
+}
+
+// FromContext returns the principal of the call, and whether the call has been through an auth function.
+func FromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(contextKey{}).(Principal)
+	return principal, ok
+}
+
+// MustFromContext returns the principal of the call, and panics if the call has not been through
+// an auth function.
+func MustFromContext(ctx context.Context) Principal {
+	principal, ok := FromContext(ctx)
 	if !ok {
-		panic("cannot get auth metadata in context")
+		panic("cannot get principal in context")
 	}
-	return metadata
+	return principal
 }
 
 func RejectAll(ctx context.Context) (context.Context, error) {
@@ -25,18 +79,6 @@ func RejectAll(ctx context.Context) (context.Context, error) {
 func AllowAll(ctx context.Context) (context.Context, error) {
 	// https://pkg.go.dev/github.com/grpc-ecosystem/go-grpc-middleware/auth#pkg-types
 	// The `Context` returned must be a child `Context` of the one passed in
-	newCtx := context.WithValue(ctx, contextKey{}, "")
+	newCtx := WithPrincipal(ctx, Principal{AuthMethod: AuthMethodNone})
 	return newCtx, nil
 }
-
-// Expected header
-// key: authorization
-// value: bearer {token}
-func SessionAuth(ctx context.Context) (context.Context, error) {
-	_, err := grpc_middleware_auth.AuthFromMD(ctx, "bearer")
-	if err != nil {
-		return nil, err
-	}
-
-	return nil, status.Error(codes.Unauthenticated, "")
-}
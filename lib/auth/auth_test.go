@@ -4,30 +4,42 @@ import (
 	"context"
 	"testing"
 
-	grpc_middleware_auth "github.com/grpc-ecosystem/go-grpc-middleware/v2/auth"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
-func TestMustGetAuthMetadata_success(t *testing.T) {
-	ctx := context.WithValue(context.TODO(), contextKey{}, "dummy")
+func TestFromContext(t *testing.T) {
+	ctx := WithPrincipal(context.TODO(), Principal{Subject: "dummy", AuthMethod: AuthMethodSession})
 
-	gotMetadata := MustGetAuthMetadata(ctx)
+	got, ok := FromContext(ctx)
 
-	if gotMetadata != "dummy" {
-		t.Errorf("metadata %v; want dummy", gotMetadata)
+	if !ok || got.Subject != "dummy" || got.AuthMethod != AuthMethodSession {
+		t.Errorf("principal %+v, ok %v; want dummy of %v, true", got, ok, AuthMethodSession)
+	}
+	if got, ok := FromContext(context.TODO()); ok {
+		t.Errorf("principal %+v, ok %v; want false", got, ok)
+	}
+}
+
+func TestGrants_HasRole(t *testing.T) {
+	grants := Grants{Roles: []string{"user", RoleAdmin}, Scopes: []string{"read"}}
+
+	if !grants.HasRole(RoleAdmin) {
+		t.Errorf("has role %v false; want true", RoleAdmin)
+	}
+	if grants.HasRole("read") {
+		t.Errorf("has role read true; want false")
 	}
 }
 
-func TestMustGetAuthMetadata_failure(t *testing.T) {
+func TestMustFromContext_failure(t *testing.T) {
 	defer func() {
 		if r := recover(); r == nil {
 			t.Errorf("panicked false; want true")
 		}
 	}()
 
-	MustGetAuthMetadata(context.TODO())
+	MustFromContext(context.TODO())
 }
 
 func TestRejectAll(t *testing.T) {
@@ -44,35 +56,16 @@ func TestRejectAll(t *testing.T) {
 }
 
 func TestAllowAll(t *testing.T) {
-	ctx := context.TODO()
-	wantCtx := context.WithValue(ctx, contextKey{}, "")
-
-	gotCtx, gotErr := AllowAll(ctx)
+	gotCtx, gotErr := AllowAll(context.TODO())
 
 	if gotCtx == nil {
-		t.Errorf("context <nil>; want %v", wantCtx)
+		t.Fatalf("context <nil>; want anonymous principal")
 	}
-	gotCtxValue, ok := gotCtx.Value(contextKey{}).(string)
-	if !ok || gotCtxValue != "" {
-		t.Errorf("context %v; want %v", gotCtx, wantCtx)
+	got, ok := FromContext(gotCtx)
+	if !ok || got.Subject != "" || got.AuthMethod != AuthMethodNone {
+		t.Errorf("principal %+v, ok %v; want anonymous, true", got, ok)
 	}
 	if gotErr != nil {
 		t.Errorf("error %v; want <nil>", gotErr)
 	}
 }
-
-func TestSessionAuth_failureNotBearer(t *testing.T) {
-	ctx := metadata.NewIncomingContext(context.TODO(), metadata.Pairs(
-		"authorization", "basic worldhello",
-	))
-	_, wantErr := grpc_middleware_auth.AuthFromMD(ctx, "bearer")
-
-	gotCtx, gotErr := SessionAuth(ctx)
-
-	if gotCtx != nil {
-		t.Errorf("context %v; want nil", gotCtx)
-	}
-	if gotErr == nil || gotErr.Error() != wantErr.Error() {
-		t.Errorf("error %v; want %v", gotErr, wantErr)
-	}
-}
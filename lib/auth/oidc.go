@@ -0,0 +1,348 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	grpc_middleware_auth "github.com/grpc-ecosystem/go-grpc-middleware/v2/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/zmzhang8/grpc_example/lib/internal/reload"
+	"github.com/zmzhang8/grpc_example/lib/log"
+)
+
+// Signing algorithms of external tokens.
+var oidcMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// Maximum size of JWKS documents.
+const maxJWKSSize = 1 << 20
+
+type OIDCOptions struct {
+	// Path or http(s) URL of the JWKS of the identity provider.
+	JWKS string
+	// Expected iss claim.
+	Issuer string
+	// Expected aud claim.
+	Audience string
+	// Tolerance of exp and nbf checks for clocks out of sync.
+	ClockSkew time.Duration
+	// Claims of the subject, roles and scopes. Nested claims are separated by dots, e.g. realm_access.roles.
+	// Roles and scopes are arrays or space-separated strings, and are not mapped if the claim is empty.
+	SubjectClaim string
+	RolesClaim   string
+	ScopesClaim  string
+	// Claim of the tenant, which is a string. The tenant is not mapped if the claim is empty.
+	TenantClaim string
+}
+
+// OIDC verifies tokens of an external identity provider, e.g. OpenID Connect ID or access tokens,
+// with the public keys in its JWKS.
+type OIDC struct {
+	logger log.Logger
+	opts   OIDCOptions
+	client *http.Client
+
+	mu   sync.RWMutex
+	keys map[string]crypto.PublicKey // by kid
+}
+
+func NewOIDC(logger log.Logger, opts OIDCOptions) (*OIDC, error) {
+	if opts.JWKS == "" || opts.Issuer == "" || opts.Audience == "" {
+		return nil, errors.New("JWKS, issuer and audience of external tokens must not be empty")
+	}
+	if opts.SubjectClaim == "" {
+		opts.SubjectClaim = "sub"
+	}
+	return &OIDC{logger: logger, opts: opts, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+// Reload loads the JWKS, and replaces the keys.
+func (o *OIDC) Reload(ctx context.Context) error {
+	data, err := o.readJWKS(ctx)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("invalid JWKS %s: %w", o.opts.JWKS, err)
+	}
+	o.mu.Lock()
+	o.keys = keys
+	o.mu.Unlock()
+	o.logger.Infow("Loaded JWKS", "jwks", o.opts.JWKS, "keys", len(keys))
+	return nil
+}
+
+// Run reloads the JWKS every interval until ctx is done, so that rotated keys are picked up.
+// Failed reloads keep the current keys.
+func (o *OIDC) Run(ctx context.Context, interval time.Duration) {
+	reload.Every(ctx, interval, o.logger, "Failed to reload JWKS", o.Reload)
+}
+
+func (o *OIDC) readJWKS(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(o.opts.JWKS, "http://") && !strings.HasPrefix(o.opts.JWKS, "https://") {
+		return os.ReadFile(o.opts.JWKS)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.opts.JWKS, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get JWKS %s: %s", o.opts.JWKS, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+}
+
+// Verify checks the signature, iss, aud, exp and nbf of an external token, and returns its claims.
+func (o *OIDC) Verify(token string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	parser := jwt.NewParser(jwt.WithValidMethods(oidcMethods), jwt.WithoutClaimsValidation())
+	if _, err := parser.ParseWithClaims(token, claims, o.key); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if !claims.VerifyExpiresAt(now.Add(-o.opts.ClockSkew).Unix(), true) {
+		return nil, errors.New("token is expired or has no expiry")
+	}
+	if !claims.VerifyNotBefore(now.Add(o.opts.ClockSkew).Unix(), false) {
+		return nil, errors.New("token is not valid yet")
+	}
+	if !claims.VerifyIssuer(o.opts.Issuer, true) {
+		return nil, errors.New("invalid issuer")
+	}
+	if !claims.VerifyAudience(o.opts.Audience, true) {
+		return nil, errors.New("invalid audience")
+	}
+	return claims, nil
+}
+
+func (o *OIDC) key(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if key, ok := o.keys[kid]; ok {
+		return key, nil
+	}
+	// tokens without kid are accepted if the JWKS has a single key
+	if kid == "" && len(o.keys) == 1 {
+		for _, key := range o.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// OIDCAuth authenticates calls with external tokens, and puts the mapped subject, roles, scopes and tenant into
+// the context.
+//
+// Expected header
+// key: authorization
+// value: bearer {token}
+func (o *OIDC) OIDCAuth(ctx context.Context) (context.Context, error) {
+	token, err := grpc_middleware_auth.AuthFromMD(ctx, "bearer")
+	if err != nil {
+		return nil, err
+	}
+	claims, err := o.Verify(token)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Invalid external token")
+	}
+	subject, _ := claimValue(claims, o.opts.SubjectClaim).(string)
+	if strings.TrimSpace(subject) == "" {
+		return nil, status.Error(codes.Unauthenticated, "External token has no subject")
+	}
+	principal := Principal{
+		Subject:    subject,
+		AuthMethod: AuthMethodOIDC,
+		Grants: Grants{
+			Roles:  claimStrings(claims, o.opts.RolesClaim),
+			Scopes: claimStrings(claims, o.opts.ScopesClaim),
+		},
+	}
+	if o.opts.TenantClaim != "" {
+		principal.Tenant, _ = claimValue(claims, o.opts.TenantClaim).(string)
+	}
+	principal.TokenID, _ = claims["jti"].(string)
+	if exp, ok := claims["exp"].(float64); ok {
+		principal.ExpiresAt = time.Unix(int64(exp), 0)
+	}
+	return WithPrincipal(ctx, principal), nil
+}
+
+// AuthOr authenticates calls with bearer tokens of the external issuer by OIDCAuth, and other calls by fallback,
+// e.g. SessionAuth. The issuer is only used to choose the auth function, and is verified by OIDCAuth.
+func (o *OIDC) AuthOr(fallback grpc_middleware_auth.AuthFunc) grpc_middleware_auth.AuthFunc {
+	return func(ctx context.Context) (context.Context, error) {
+		token, err := grpc_middleware_auth.AuthFromMD(ctx, "bearer")
+		if err == nil && unverifiedIssuer(token) == o.opts.Issuer {
+			return o.OIDCAuth(ctx)
+		}
+		return fallback(ctx)
+	}
+}
+
+func unverifiedIssuer(token string) string {
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil {
+		return ""
+	}
+	issuer, _ := claims["iss"].(string)
+	return issuer
+}
+
+// claimValue returns the claim at a dot-separated path, or nil.
+func claimValue(claims jwt.MapClaims, path string) interface{} {
+	if path == "" {
+		return nil
+	}
+	var value interface{} = map[string]interface{}(claims)
+	for _, name := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[name]
+	}
+	return value
+}
+
+// claimStrings returns the strings of an array claim or a space-separated string claim.
+func claimStrings(claims jwt.MapClaims, path string) []string {
+	switch value := claimValue(claims, path).(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		var values []string
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// jwk is a JSON Web Key of RFC 7517.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC and OKP
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS returns the public signing keys of a JWKS. Keys of unsupported types or curves are skipped.
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set jwks
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", i, err)
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	return keys, nil
+}
+
+// publicKey returns nil if the type or the curve of the key is not supported.
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return key, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/zmzhang8/grpc_example/lib/log"
+)
+
+type testIdentityProvider struct {
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+	edKey  ed25519.PrivateKey
+	jwks   []byte
+}
+
+func newTestIdentityProvider(t *testing.T) *testIdentityProvider {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	jwks, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(edKey.Public().(ed25519.PublicKey))},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": b64(rsaKey.N.Bytes()), "e": "AQAB"},
+	}})
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return &testIdentityProvider{rsaKey: rsaKey, ecKey: ecKey, edKey: edKey, jwks: jwks}
+}
+
+func (p *testIdentityProvider) claims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":          "https://idp.example.com",
+		"aud":          []string{"grpc_example"},
+		"sub":          "alice",
+		"exp":          time.Now().Add(time.Hour).Unix(),
+		"scope":        "read write",
+		"tenant":       "acme",
+		"realm_access": map[string]interface{}{"roles": []string{"user", "admin"}},
+	}
+}
+
+func (p *testIdentityProvider) sign(t *testing.T, method jwt.SigningMethod, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	var key interface{}
+	switch method.Alg() {
+	case "RS256":
+		key = p.rsaKey
+	case "ES256":
+		key = p.ecKey
+	case "EdDSA":
+		key = p.edKey
+	default:
+		key = []byte("0123456789abcdef0123456789abcdef")
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return signed
+}
+
+func newTestOIDC(t *testing.T, jwks string) *OIDC {
+	o, err := NewOIDC(log.NewLogger(log.NewCore(false, os.Stdout, false)), OIDCOptions{
+		JWKS:        jwks,
+		Issuer:      "https://idp.example.com",
+		Audience:    "grpc_example",
+		ClockSkew:   time.Minute,
+		RolesClaim:  "realm_access.roles",
+		ScopesClaim: "scope",
+		TenantClaim: "tenant",
+	})
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if err := o.Reload(context.TODO()); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return o
+}
+
+func TestOIDC_Verify(t *testing.T) {
+	p := newTestIdentityProvider(t)
+	o := newTestOIDC(t, writeKeyFile(t, p.jwks))
+	with := func(name string, value interface{}) jwt.MapClaims {
+		claims := p.claims()
+		claims[name] = value
+		return claims
+	}
+	without := func(name string) jwt.MapClaims {
+		claims := p.claims()
+		delete(claims, name)
+		return claims
+	}
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"RS256", p.sign(t, jwt.SigningMethodRS256, "rsa", p.claims()), true},
+		{"ES256", p.sign(t, jwt.SigningMethodES256, "ec", p.claims()), true},
+		{"EdDSA", p.sign(t, jwt.SigningMethodEdDSA, "ed", p.claims()), true},
+		{"expired within skew", p.sign(t, jwt.SigningMethodRS256, "rsa", with("exp", time.Now().Add(-30*time.Second).Unix())), true},
+		{"not before within skew", p.sign(t, jwt.SigningMethodRS256, "rsa", with("nbf", time.Now().Add(30*time.Second).Unix())), true},
+		{"expired", p.sign(t, jwt.SigningMethodRS256, "rsa", with("exp", time.Now().Add(-2*time.Minute).Unix())), false},
+		{"not before", p.sign(t, jwt.SigningMethodRS256, "rsa", with("nbf", time.Now().Add(2*time.Minute).Unix())), false},
+		{"no expiry", p.sign(t, jwt.SigningMethodRS256, "rsa", without("exp")), false},
+		{"other issuer", p.sign(t, jwt.SigningMethodRS256, "rsa", with("iss", "https://other.example.com")), false},
+		{"other audience", p.sign(t, jwt.SigningMethodRS256, "rsa", with("aud", "other")), false},
+		{"unknown kid", p.sign(t, jwt.SigningMethodRS256, "other", p.claims()), false},
+		{"encryption key", p.sign(t, jwt.SigningMethodRS256, "enc", p.claims()), false},
+		{"key of other type", p.sign(t, jwt.SigningMethodRS256, "ec", p.claims()), false},
+		{"HS256", p.sign(t, jwt.SigningMethodHS256, "rsa", p.claims()), false},
+	} {
+		_, err := o.Verify(tc.token)
+
+		if (err == nil) != tc.valid {
+			t.Errorf("%v: err %v; want valid %v", tc.name, err, tc.valid)
+		}
+	}
+}
+
+func TestOIDC_OIDCAuth(t *testing.T) {
+	p := newTestIdentityProvider(t)
+	o := newTestOIDC(t, writeKeyFile(t, p.jwks))
+	token := p.sign(t, jwt.SigningMethodRS256, "rsa", p.claims())
+	ctx := metadata.NewIncomingContext(context.TODO(), metadata.Pairs("authorization", "bearer "+token))
+
+	gotCtx, err := o.OIDCAuth(ctx)
+
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	got := MustFromContext(gotCtx)
+	if got.Subject != "alice" || got.AuthMethod != AuthMethodOIDC || got.Tenant != "acme" || got.ExpiresAt.IsZero() {
+		t.Errorf("principal %+v; want alice of %v in acme with expiration", got, AuthMethodOIDC)
+	}
+	want := Grants{Roles: []string{"user", "admin"}, Scopes: []string{"read", "write"}}
+	if !reflect.DeepEqual(got.Grants, want) {
+		t.Errorf("grants %+v; want %+v", got.Grants, want)
+	}
+}
+
+func TestOIDC_AuthOr(t *testing.T) {
+	p := newTestIdentityProvider(t)
+	o := newTestOIDC(t, writeKeyFile(t, p.jwks))
+	tokens := newTestTokens(t, TokenOptions{Algorithm: AlgorithmHS256})
+	session, err := tokens.Issue(context.TODO(), "hello", nil)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	authFunc := o.AuthOr(tokens.SessionAuth)
+
+	for name, token := range map[string]string{
+		"external": p.sign(t, jwt.SigningMethodRS256, "rsa", p.claims()),
+		"session":  session.Token,
+	} {
+		ctx := metadata.NewIncomingContext(context.TODO(), metadata.Pairs("authorization", "bearer "+token))
+
+		if _, err := authFunc(ctx); err != nil {
+			t.Errorf("%v: err %v; want <nil>", name, err)
+		}
+	}
+	forged := p.sign(t, jwt.SigningMethodHS256, "", p.claims())
+	ctx := metadata.NewIncomingContext(context.TODO(), metadata.Pairs("authorization", "bearer "+forged))
+	if _, err := authFunc(ctx); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("code %v of forged token; want %v", status.Code(err), codes.Unauthenticated)
+	}
+}
+
+func TestOIDC_Reload_url(t *testing.T) {
+	p := newTestIdentityProvider(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(p.jwks)
+	}))
+	defer server.Close()
+	o := newTestOIDC(t, server.URL)
+
+	if _, err := o.Verify(p.sign(t, jwt.SigningMethodEdDSA, "ed", p.claims())); err != nil {
+		t.Errorf("err %v; want <nil>", err)
+	}
+}
+
+func TestOIDC_Reload_unsupportedCurve(t *testing.T) {
+	p := newTestIdentityProvider(t)
+	var set map[string][]map[string]interface{}
+	if err := json.Unmarshal(p.jwks, &set); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	set["keys"] = append(set["keys"],
+		map[string]interface{}{"kty": "EC", "kid": "p1", "crv": "P-1", "x": "AA", "y": "AA"},
+		map[string]interface{}{"kty": "OKP", "kid": "x448", "crv": "Ed448", "x": "AA"},
+	)
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	o := newTestOIDC(t, writeKeyFile(t, data))
+
+	if _, err := o.Verify(p.sign(t, jwt.SigningMethodRS256, "rsa", p.claims())); err != nil {
+		t.Errorf("err %v; want <nil>", err)
+	}
+}
+
+func TestOIDC_Reload_invalid(t *testing.T) {
+	for name, jwks := range map[string]string{
+		"syntax":  `{"keys": [`,
+		"no keys": `{"keys": []}`,
+		"curve":   `{"keys": [{"kty": "EC", "crv": "P-1", "x": "AA", "y": "AA"}]}`,
+		"point":   `{"keys": [{"kty": "EC", "crv": "P-256", "x": "AA", "y": "AA"}]}`,
+	} {
+		o, err := NewOIDC(log.NewLogger(log.NewCore(false, os.Stdout, false)), OIDCOptions{
+			JWKS:     writeKeyFile(t, []byte(jwks)),
+			Issuer:   "https://idp.example.com",
+			Audience: "grpc_example",
+		})
+		if err != nil {
+			t.Fatalf("err %v; want <nil>", err)
+		}
+
+		if err := o.Reload(context.TODO()); err == nil {
+			t.Errorf("%v: err <nil>; want error", name)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrRefreshTokenNotFound = errors.New("refresh token not found")
+
+// RefreshToken is a stored refresh token of a session.
+type RefreshToken struct {
+	// SHA-256 hash of the token, which is not stored.
+	Hash      string
+	SessionID string
+	Username  string
+	Roles     []string
+	ExpiresAt time.Time
+	// End of the session, which refresh tokens do not outlive.
+	SessionExpiresAt time.Time
+	// Used tokens are kept until they expire, to detect reuse.
+	Used bool
+}
+
+// SessionStore keeps refresh tokens and revoked sessions. Servers sharing a store share sessions.
+type SessionStore interface {
+	AddRefreshToken(ctx context.Context, token RefreshToken) error
+	// UseRefreshToken marks an unexpired refresh token as used, and returns it as it was before.
+	// It returns ErrRefreshTokenNotFound if the token does not exist.
+	UseRefreshToken(ctx context.Context, hash string) (RefreshToken, error)
+	// RevokeSession deletes the refresh tokens of a session, and marks it as revoked until expiration.
+	RevokeSession(ctx context.Context, sessionID string, expiration time.Time) error
+	// UserSessions returns the ids of sessions of a user with unexpired refresh tokens.
+	UserSessions(ctx context.Context, username string) ([]string, error)
+	IsSessionRevoked(ctx context.Context, sessionID string) (bool, error)
+}
+
+// Expired tokens and sessions are ignored on access, and deleted by a sweep at most once per sweepInterval.
+const sweepInterval = time.Minute
+
+// MemorySessionStore keeps sessions in memory, so they are lost on restart and not shared by servers.
+type MemorySessionStore struct {
+	mu            sync.Mutex
+	refreshTokens map[string]RefreshToken // by hash
+	revoked       map[string]time.Time    // expiration by session id
+	lastSweep     time.Time
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		refreshTokens: make(map[string]RefreshToken),
+		revoked:       make(map[string]time.Time),
+	}
+}
+
+func (s *MemorySessionStore) AddRefreshToken(ctx context.Context, token RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(time.Now())
+	s.refreshTokens[token.Hash] = token
+	return nil
+}
+
+func (s *MemorySessionStore) UseRefreshToken(ctx context.Context, hash string) (RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.refreshTokens[hash]
+	if !ok || !time.Now().Before(token.ExpiresAt) {
+		return RefreshToken{}, ErrRefreshTokenNotFound
+	}
+	used := token
+	used.Used = true
+	s.refreshTokens[hash] = used
+	return token, nil
+}
+
+func (s *MemorySessionStore) RevokeSession(ctx context.Context, sessionID string, expiration time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, token := range s.refreshTokens {
+		if token.SessionID == sessionID {
+			delete(s.refreshTokens, hash)
+		}
+	}
+	if expiration.After(s.revoked[sessionID]) {
+		s.revoked[sessionID] = expiration
+	}
+	return nil
+}
+
+func (s *MemorySessionStore) UserSessions(ctx context.Context, username string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	seen := make(map[string]bool)
+	var sessions []string
+	for _, token := range s.refreshTokens {
+		if token.Username == username && now.Before(token.ExpiresAt) && !seen[token.SessionID] {
+			seen[token.SessionID] = true
+			sessions = append(sessions, token.SessionID)
+		}
+	}
+	return sessions, nil
+}
+
+func (s *MemorySessionStore) IsSessionRevoked(ctx context.Context, sessionID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expiration, ok := s.revoked[sessionID]
+	return ok && time.Now().Before(expiration), nil
+}
+
+func (s *MemorySessionStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for hash, token := range s.refreshTokens {
+		if !now.Before(token.ExpiresAt) {
+			delete(s.refreshTokens, hash)
+		}
+	}
+	for sessionID, expiration := range s.revoked {
+		if !now.Before(expiration) {
+			delete(s.revoked, sessionID)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	grpc_middleware_auth "github.com/grpc-ecosystem/go-grpc-middleware/v2/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Signing algorithms of session tokens.
+const (
+	AlgorithmHS256 = "HS256"
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+// Minimum size in bytes of HS256 secrets.
+const minSecretSize = 32
+
+type TokenOptions struct {
+	// One of HS256, RS256 and EdDSA.
+	Algorithm string
+	// File of the HS256 secret, or of the PEM-encoded RSA or Ed25519 private key.
+	// A random HS256 secret is generated if empty, so tokens are only valid until restart.
+	KeyFile string
+	// iss and aud claims of issued tokens, which are required by verification.
+	Issuer   string
+	Audience string
+	// Lifetime of issued tokens.
+	TTL time.Duration
+	// Lifetime of refresh tokens, which is renewed on refresh.
+	RefreshTTL time.Duration
+	// Lifetime of sessions since login, which is not renewed on refresh. Zero means RefreshTTL.
+	SessionTTL time.Duration
+	// Lookup of the current roles of users on refresh. Refresh keeps the roles of the session if nil.
+	Lookup UserLookup
+	// Store of refresh tokens and revoked sessions. An in-memory store is used if nil.
+	Store SessionStore
+}
+
+// UserLookup returns the current roles of a user, or ErrUserNotFound if the user does not exist anymore.
+type UserLookup func(ctx context.Context, username string) ([]string, error)
+
+// Claims of session tokens.
+type Claims struct {
+	jwt.RegisteredClaims
+	// Id of the session, which is shared by the tokens issued on login and on refresh.
+	SessionID string `json:"sid,omitempty"`
+	// Roles of the subject when the token was issued.
+	Roles []string `json:"roles,omitempty"`
+}
+
+// IssuedTokens are the tokens of a session issued on login or refresh.
+type IssuedTokens struct {
+	Token             string
+	Expiration        time.Time
+	RefreshToken      string
+	RefreshExpiration time.Time
+}
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+	ErrUserNotFound        = errors.New("user not found")
+)
+
+// Tokens issues and verifies signed session tokens (JWT).
+type Tokens struct {
+	method     jwt.SigningMethod
+	signKey    interface{}
+	verifyKey  interface{}
+	issuer     string
+	audience   string
+	ttl        time.Duration
+	refreshTTL time.Duration
+	sessionTTL time.Duration
+	lookup     UserLookup
+	store      SessionStore
+}
+
+func NewTokens(opts TokenOptions) (*Tokens, error) {
+	if opts.TTL <= 0 || opts.RefreshTTL <= 0 || opts.SessionTTL < 0 {
+		return nil, errors.New("token TTLs must be positive")
+	}
+	if opts.SessionTTL == 0 {
+		opts.SessionTTL = opts.RefreshTTL
+	}
+	if opts.Issuer == "" || opts.Audience == "" {
+		return nil, errors.New("token issuer and audience must not be empty")
+	}
+	t := &Tokens{
+		issuer:     opts.Issuer,
+		audience:   opts.Audience,
+		ttl:        opts.TTL,
+		refreshTTL: opts.RefreshTTL,
+		sessionTTL: opts.SessionTTL,
+		lookup:     opts.Lookup,
+		store:      opts.Store,
+	}
+	if t.store == nil {
+		t.store = NewMemorySessionStore()
+	}
+
+	var data []byte
+	if opts.KeyFile != "" {
+		var err error
+		if data, err = os.ReadFile(opts.KeyFile); err != nil {
+			return nil, err
+		}
+	}
+	switch opts.Algorithm {
+	case AlgorithmHS256:
+		t.method = jwt.SigningMethodHS256
+		if opts.KeyFile == "" {
+			data = make([]byte, minSecretSize)
+			if _, err := rand.Read(data); err != nil {
+				return nil, err
+			}
+		}
+		if len(data) < minSecretSize {
+			return nil, fmt.Errorf("HS256 secret must have at least %d bytes", minSecretSize)
+		}
+		t.signKey, t.verifyKey = data, data
+	case AlgorithmRS256:
+		t.method = jwt.SigningMethodRS256
+		key, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RS256 key file: %w", err)
+		}
+		t.signKey, t.verifyKey = key, key.Public()
+	case AlgorithmEdDSA:
+		t.method = jwt.SigningMethodEdDSA
+		key, err := jwt.ParseEdPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EdDSA key file: %w", err)
+		}
+		t.signKey, t.verifyKey = key, key.(crypto.Signer).Public()
+	default:
+		return nil, fmt.Errorf("invalid token algorithm %q", opts.Algorithm)
+	}
+	return t, nil
+}
+
+// Issue starts a new session of subject with roles, and returns its tokens.
+func (t *Tokens) Issue(ctx context.Context, subject string, roles []string) (*IssuedTokens, error) {
+	sessionID, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+	return t.issue(ctx, subject, roles, sessionID, time.Now().UTC().Truncate(time.Second).Add(t.sessionTTL))
+}
+
+// Refresh exchanges an unused refresh token for new tokens of its session with the current roles of the user.
+// Reusing a refresh token, which may have been stolen, revokes the session, and so does refreshing a session
+// of a deleted user. Tokens do not outlive the session.
+func (t *Tokens) Refresh(ctx context.Context, refreshToken string) (*IssuedTokens, error) {
+	stored, err := t.store.UseRefreshToken(ctx, hashToken(refreshToken))
+	if errors.Is(err, ErrRefreshTokenNotFound) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stored.Used {
+		if err := t.RevokeSession(ctx, stored.SessionID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+	roles := stored.Roles
+	if t.lookup != nil {
+		roles, err = t.lookup(ctx, stored.Username)
+		if errors.Is(err, ErrUserNotFound) {
+			if err := t.RevokeSession(ctx, stored.SessionID); err != nil {
+				return nil, err
+			}
+			return nil, ErrInvalidRefreshToken
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t.issue(ctx, stored.Username, roles, stored.SessionID, stored.SessionExpiresAt)
+}
+
+// RevokeSession revokes the refresh tokens of a session, and its tokens until they expire.
+func (t *Tokens) RevokeSession(ctx context.Context, sessionID string) error {
+	return t.store.RevokeSession(ctx, sessionID, time.Now().Add(t.ttl))
+}
+
+// RevokeUserSessions revokes the sessions of a user except for the session exceptSessionID, which may be empty,
+// and returns the number of revoked sessions.
+func (t *Tokens) RevokeUserSessions(ctx context.Context, username string, exceptSessionID string) (int, error) {
+	sessions, err := t.store.UserSessions(ctx, username)
+	if err != nil {
+		return 0, err
+	}
+	revoked := 0
+	for _, sessionID := range sessions {
+		if sessionID == exceptSessionID {
+			continue
+		}
+		if err := t.RevokeSession(ctx, sessionID); err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+func (t *Tokens) issue(
+	ctx context.Context,
+	subject string,
+	roles []string,
+	sessionID string,
+	sessionExpiresAt time.Time,
+) (*IssuedTokens, error) {
+	id, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	if !now.Before(sessionExpiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+	issued := &IssuedTokens{
+		Expiration:        earliest(now.Add(t.ttl), sessionExpiresAt),
+		RefreshToken:      refreshToken,
+		RefreshExpiration: earliest(now.Add(t.refreshTTL), sessionExpiresAt),
+	}
+	claims := &Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    t.issuer,
+			Subject:   subject,
+			Audience:  jwt.ClaimStrings{t.audience},
+			ExpiresAt: jwt.NewNumericDate(issued.Expiration),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        id,
+		},
+		SessionID: sessionID,
+		Roles:     roles,
+	}
+	if issued.Token, err = jwt.NewWithClaims(t.method, claims).SignedString(t.signKey); err != nil {
+		return nil, err
+	}
+	if err := t.store.AddRefreshToken(ctx, RefreshToken{
+		Hash:             hashToken(refreshToken),
+		SessionID:        sessionID,
+		Username:         subject,
+		Roles:            roles,
+		ExpiresAt:        issued.RefreshExpiration,
+		SessionExpiresAt: sessionExpiresAt,
+	}); err != nil {
+		return nil, err
+	}
+	return issued, nil
+}
+
+func earliest(a time.Time, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+// Verify checks the signature, issuer, audience and expiry of a token, and returns its claims.
+func (t *Tokens) Verify(token string) (*Claims, error) {
+	claims := &Claims{}
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{t.method.Alg()}))
+	if _, err := parser.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return t.verifyKey, nil
+	}); err != nil {
+		return nil, err
+	}
+	if claims.ExpiresAt == nil {
+		return nil, errors.New("token has no expiry")
+	}
+	if !claims.VerifyIssuer(t.issuer, true) {
+		return nil, errors.New("invalid issuer")
+	}
+	if !claims.VerifyAudience(t.audience, true) {
+		return nil, errors.New("invalid audience")
+	}
+	if strings.TrimSpace(claims.Subject) == "" || claims.SessionID == "" {
+		return nil, errors.New("token has no subject or session")
+	}
+	return claims, nil
+}
+
+// SessionAuth authenticates calls with session tokens, and puts the principal of the session into the context.
+//
+// Expected header
+// key: authorization
+// value: bearer {token}
+func (t *Tokens) SessionAuth(ctx context.Context) (context.Context, error) {
+	token, err := grpc_middleware_auth.AuthFromMD(ctx, "bearer")
+	if err != nil {
+		return nil, err
+	}
+	claims, err := t.Verify(token)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Invalid session token")
+	}
+	revoked, err := t.store.IsSessionRevoked(ctx, claims.SessionID)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, "Failed to check session")
+	}
+	if revoked {
+		return nil, status.Error(codes.Unauthenticated, "Session revoked")
+	}
+
+	return WithPrincipal(ctx, Principal{
+		Subject:    claims.Subject,
+		AuthMethod: AuthMethodSession,
+		Grants:     Grants{Roles: claims.Roles},
+		TokenID:    claims.SessionID,
+		ExpiresAt:  claims.ExpiresAt.Time,
+	}), nil
+}
+
+func randomToken(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the key of a refresh token in stores. Refresh tokens are random, so they need no salt.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,402 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	grpc_middleware_auth "github.com/grpc-ecosystem/go-grpc-middleware/v2/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func writeKeyFile(t *testing.T, data []byte) string {
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return path
+}
+
+func pemKeyFile(t *testing.T, key interface{}) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return writeKeyFile(t, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func newTestTokens(t *testing.T, opts TokenOptions) *Tokens {
+	if opts.Issuer == "" {
+		opts.Issuer = "issuer"
+	}
+	if opts.Audience == "" {
+		opts.Audience = "audience"
+	}
+	if opts.TTL == 0 {
+		opts.TTL = time.Hour
+	}
+	if opts.RefreshTTL == 0 {
+		opts.RefreshTTL = 24 * time.Hour
+	}
+	tokens, err := NewTokens(opts)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return tokens
+}
+
+func TestTokens_success(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	for _, opts := range []TokenOptions{
+		{Algorithm: AlgorithmHS256},
+		{Algorithm: AlgorithmHS256, KeyFile: writeKeyFile(t, []byte("0123456789abcdef0123456789abcdef"))},
+		{Algorithm: AlgorithmRS256, KeyFile: pemKeyFile(t, rsaKey)},
+		{Algorithm: AlgorithmEdDSA, KeyFile: pemKeyFile(t, edKey)},
+	} {
+		tokens := newTestTokens(t, opts)
+
+		issued, err := tokens.Issue(context.TODO(), "hello", nil)
+		if err != nil {
+			t.Fatalf("%v: err %v; want <nil>", opts.Algorithm, err)
+		}
+		claims, err := tokens.Verify(issued.Token)
+
+		if err != nil {
+			t.Fatalf("%v: err %v; want <nil>", opts.Algorithm, err)
+		}
+		if claims.Subject != "hello" || claims.Issuer != "issuer" || !claims.VerifyAudience("audience", true) {
+			t.Errorf("%v: claims %+v; want subject hello, issuer issuer and audience audience", opts.Algorithm, claims)
+		}
+		if !claims.ExpiresAt.Time.Equal(issued.Expiration) {
+			t.Errorf("%v: expiry %v; want %v", opts.Algorithm, claims.ExpiresAt.Time, issued.Expiration)
+		}
+		if claims.ID == "" || claims.SessionID == "" {
+			t.Errorf("%v: token id %q, session id %q; want random ids", opts.Algorithm, claims.ID, claims.SessionID)
+		}
+		if issued.RefreshToken == "" || !issued.RefreshExpiration.After(issued.Expiration) {
+			t.Errorf("%v: refresh token %q expiring at %v; want token expiring after %v", opts.Algorithm, issued.RefreshToken, issued.RefreshExpiration, issued.Expiration)
+		}
+	}
+}
+
+func TestNewTokens_failure(t *testing.T) {
+	for _, opts := range []TokenOptions{
+		{Algorithm: "none", Issuer: "issuer", Audience: "audience", TTL: time.Hour, RefreshTTL: time.Hour},
+		{Algorithm: AlgorithmHS256, Issuer: "issuer", Audience: "audience", TTL: 0, RefreshTTL: time.Hour},
+		{Algorithm: AlgorithmHS256, Issuer: "issuer", Audience: "audience", TTL: time.Hour, RefreshTTL: 0},
+		{Algorithm: AlgorithmHS256, Audience: "audience", TTL: time.Hour, RefreshTTL: time.Hour},
+		{Algorithm: AlgorithmHS256, Issuer: "issuer", Audience: "audience", KeyFile: writeKeyFile(t, []byte("short")), TTL: time.Hour, RefreshTTL: time.Hour},
+		{Algorithm: AlgorithmRS256, Issuer: "issuer", Audience: "audience", TTL: time.Hour, RefreshTTL: time.Hour},
+		{Algorithm: AlgorithmEdDSA, Issuer: "issuer", Audience: "audience", KeyFile: writeKeyFile(t, []byte("invalid")), TTL: time.Hour, RefreshTTL: time.Hour},
+	} {
+		if _, err := NewTokens(opts); err == nil {
+			t.Errorf("%+v: err <nil>; want error", opts)
+		}
+	}
+}
+
+func TestTokens_Verify_failure(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	tokens := newTestTokens(t, TokenOptions{Algorithm: AlgorithmHS256, KeyFile: writeKeyFile(t, secret)})
+	valid := func() *Claims {
+		return &Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    "issuer",
+				Subject:   "hello",
+				Audience:  jwt.ClaimStrings{"audience"},
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			},
+			SessionID: "session",
+		}
+	}
+	sign := func(claims *Claims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+		if err != nil {
+			t.Fatalf("err %v; want <nil>", err)
+		}
+		return token
+	}
+	expired, otherIssuer, otherAudience, noExpiry, noSession := valid(), valid(), valid(), valid(), valid()
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	otherIssuer.Issuer = "other"
+	otherAudience.Audience = jwt.ClaimStrings{"other"}
+	noExpiry.ExpiresAt = nil
+	noSession.SessionID = ""
+	otherKey, err := jwt.NewWithClaims(jwt.SigningMethodHS256, valid()).SignedString([]byte("fedcba9876543210fedcba9876543210"))
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, valid()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	for name, token := range map[string]string{
+		"expired":        sign(expired),
+		"other issuer":   sign(otherIssuer),
+		"other audience": sign(otherAudience),
+		"no expiry":      sign(noExpiry),
+		"no session":     sign(noSession),
+		"other key":      otherKey,
+		"unsigned":       unsigned,
+		"malformed":      "worldhello",
+	} {
+		if _, err := tokens.Verify(token); err == nil {
+			t.Errorf("%v: err <nil>; want error", name)
+		}
+	}
+}
+
+func TestTokens_SessionAuth_success(t *testing.T) {
+	tokens := newTestTokens(t, TokenOptions{Algorithm: AlgorithmHS256})
+	issued, err := tokens.Issue(context.TODO(), "hello", []string{"user"})
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	ctx := metadata.NewIncomingContext(context.TODO(), metadata.Pairs("authorization", "bearer "+issued.Token))
+
+	gotCtx, gotErr := tokens.SessionAuth(ctx)
+
+	if gotErr != nil {
+		t.Fatalf("error %v; want <nil>", gotErr)
+	}
+	got := MustFromContext(gotCtx)
+	if got.Subject != "hello" || got.AuthMethod != AuthMethodSession {
+		t.Errorf("principal %+v; want hello of %v", got, AuthMethodSession)
+	}
+	if got.TokenID == "" || !got.ExpiresAt.Equal(issued.Expiration) {
+		t.Errorf("principal %+v; want session id and expiration %v", got, issued.Expiration)
+	}
+	if !reflect.DeepEqual(got.Roles, []string{"user"}) {
+		t.Errorf("roles %v; want [user]", got.Roles)
+	}
+}
+
+func TestTokens_SessionAuth_failureNotBearer(t *testing.T) {
+	tokens := newTestTokens(t, TokenOptions{Algorithm: AlgorithmHS256})
+	ctx := metadata.NewIncomingContext(context.TODO(), metadata.Pairs(
+		"authorization", "basic worldhello",
+	))
+	_, wantErr := grpc_middleware_auth.AuthFromMD(ctx, "bearer")
+
+	gotCtx, gotErr := tokens.SessionAuth(ctx)
+
+	if gotCtx != nil {
+		t.Errorf("context %v; want nil", gotCtx)
+	}
+	if gotErr == nil || gotErr.Error() != wantErr.Error() {
+		t.Errorf("error %v; want %v", gotErr, wantErr)
+	}
+}
+
+func TestTokens_SessionAuth_failureInvalidToken(t *testing.T) {
+	tokens := newTestTokens(t, TokenOptions{Algorithm: AlgorithmHS256})
+	ctx := metadata.NewIncomingContext(context.TODO(), metadata.Pairs(
+		"authorization", "bearer worldhello",
+	))
+
+	gotCtx, gotErr := tokens.SessionAuth(ctx)
+
+	if gotCtx != nil {
+		t.Errorf("context %v; want nil", gotCtx)
+	}
+	if status.Code(gotErr) != codes.Unauthenticated {
+		t.Errorf("code %v; want %v", status.Code(gotErr), codes.Unauthenticated)
+	}
+}
+
+func TestTokens_SessionAuth_failureRevoked(t *testing.T) {
+	tokens := newTestTokens(t, TokenOptions{Algorithm: AlgorithmHS256})
+	issued, err := tokens.Issue(context.TODO(), "hello", nil)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	claims, err := tokens.Verify(issued.Token)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if err := tokens.RevokeSession(context.TODO(), claims.SessionID); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	ctx := metadata.NewIncomingContext(context.TODO(), metadata.Pairs("authorization", "bearer "+issued.Token))
+
+	_, gotErr := tokens.SessionAuth(ctx)
+
+	if status.Code(gotErr) != codes.Unauthenticated {
+		t.Errorf("code %v; want %v", status.Code(gotErr), codes.Unauthenticated)
+	}
+}
+
+func TestTokens_Refresh(t *testing.T) {
+	tokens := newTestTokens(t, TokenOptions{Algorithm: AlgorithmHS256})
+	issued, err := tokens.Issue(context.TODO(), "hello", nil)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	refreshed, err := tokens.Refresh(context.TODO(), issued.RefreshToken)
+
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if refreshed.RefreshToken == issued.RefreshToken {
+		t.Errorf("refresh token %v; want rotated token", refreshed.RefreshToken)
+	}
+	before, err := tokens.Verify(issued.Token)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	after, err := tokens.Verify(refreshed.Token)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if after.Subject != "hello" || after.SessionID != before.SessionID {
+		t.Errorf("claims %+v; want subject hello and session %v", after, before.SessionID)
+	}
+	if _, err := tokens.Refresh(context.TODO(), "worldhello"); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("err %v; want %v", err, ErrInvalidRefreshToken)
+	}
+}
+
+func TestTokens_Refresh_lookup(t *testing.T) {
+	roles := map[string][]string{"hello": {"user"}}
+	tokens := newTestTokens(t, TokenOptions{Algorithm: AlgorithmHS256, Lookup: func(ctx context.Context, username string) ([]string, error) {
+		r, ok := roles[username]
+		if !ok {
+			return nil, ErrUserNotFound
+		}
+		return r, nil
+	}})
+	issued, err := tokens.Issue(context.TODO(), "hello", []string{"user", "admin"})
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	refreshed, err := tokens.Refresh(context.TODO(), issued.RefreshToken)
+
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if claims, err := tokens.Verify(refreshed.Token); err != nil || !reflect.DeepEqual(claims.Roles, []string{"user"}) {
+		t.Errorf("claims %+v, err %v; want current roles [user], <nil>", claims, err)
+	}
+	delete(roles, "hello")
+	if _, err := tokens.Refresh(context.TODO(), refreshed.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("err %v of deleted user; want %v", err, ErrInvalidRefreshToken)
+	}
+	ctx := metadata.NewIncomingContext(context.TODO(), metadata.Pairs("authorization", "bearer "+refreshed.Token))
+	if _, err := tokens.SessionAuth(ctx); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("code %v of token of deleted user; want %v", status.Code(err), codes.Unauthenticated)
+	}
+}
+
+func TestTokens_Refresh_sessionTTL(t *testing.T) {
+	tokens := newTestTokens(t, TokenOptions{Algorithm: AlgorithmHS256, TTL: time.Hour, RefreshTTL: 24 * time.Hour, SessionTTL: 2 * time.Hour})
+	issued, err := tokens.Issue(context.TODO(), "hello", nil)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if d := time.Until(issued.RefreshExpiration); d > 2*time.Hour || d < time.Hour {
+		t.Fatalf("refresh expiration in %v; want the end of the session in 2h", d)
+	}
+
+	refreshed, err := tokens.Refresh(context.TODO(), issued.RefreshToken)
+
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if refreshed.RefreshExpiration.After(issued.RefreshExpiration) {
+		t.Errorf("refresh expiration %v; want not after the end of the session %v", refreshed.RefreshExpiration, issued.RefreshExpiration)
+	}
+}
+
+func TestTokens_Refresh_reuse(t *testing.T) {
+	tokens := newTestTokens(t, TokenOptions{Algorithm: AlgorithmHS256})
+	issued, err := tokens.Issue(context.TODO(), "hello", nil)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	refreshed, err := tokens.Refresh(context.TODO(), issued.RefreshToken)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	_, gotErr := tokens.Refresh(context.TODO(), issued.RefreshToken)
+
+	if !errors.Is(gotErr, ErrRefreshTokenReused) {
+		t.Errorf("err %v; want %v", gotErr, ErrRefreshTokenReused)
+	}
+	if _, err := tokens.Refresh(context.TODO(), refreshed.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("err %v of refresh token of revoked session; want %v", err, ErrInvalidRefreshToken)
+	}
+	ctx := metadata.NewIncomingContext(context.TODO(), metadata.Pairs("authorization", "bearer "+refreshed.Token))
+	if _, err := tokens.SessionAuth(ctx); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("code %v of token of revoked session; want %v", status.Code(err), codes.Unauthenticated)
+	}
+}
+
+func TestTokens_RevokeUserSessions(t *testing.T) {
+	tokens := newTestTokens(t, TokenOptions{Algorithm: AlgorithmHS256})
+	for _, username := range []string{"hello", "hello", "world"} {
+		if _, err := tokens.Issue(context.TODO(), username, nil); err != nil {
+			t.Fatalf("err %v; want <nil>", err)
+		}
+	}
+	kept, err := tokens.Issue(context.TODO(), "hello", nil)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	keptClaims, err := tokens.Verify(kept.Token)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	got, err := tokens.RevokeUserSessions(context.TODO(), "hello", keptClaims.SessionID)
+
+	if got != 2 || err != nil {
+		t.Errorf("revoked %v, err %v; want 2, <nil>", got, err)
+	}
+	if got, err := tokens.RevokeUserSessions(context.TODO(), "hello", ""); got != 1 || err != nil {
+		t.Errorf("revoked %v, err %v including the kept session; want 1, <nil>", got, err)
+	}
+}
+
+func TestMemorySessionStore_sweep(t *testing.T) {
+	s := NewMemorySessionStore()
+	expired := RefreshToken{Hash: "expired", SessionID: "a", ExpiresAt: time.Now().Add(-time.Second)}
+	if err := s.AddRefreshToken(context.TODO(), expired); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if _, err := s.UseRefreshToken(context.TODO(), "expired"); !errors.Is(err, ErrRefreshTokenNotFound) {
+		t.Errorf("err %v of expired token; want %v", err, ErrRefreshTokenNotFound)
+	}
+
+	s.lastSweep = time.Now().Add(-sweepInterval)
+	if err := s.AddRefreshToken(context.TODO(), RefreshToken{Hash: "valid", SessionID: "b", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	if _, ok := s.refreshTokens["expired"]; ok || len(s.refreshTokens) != 1 {
+		t.Errorf("tokens %v; want only the valid token", s.refreshTokens)
+	}
+}
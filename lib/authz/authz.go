@@ -0,0 +1,79 @@
+package authz
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/zmzhang8/grpc_example/lib/auth"
+	"github.com/zmzhang8/grpc_example/lib/internal/reload"
+	"github.com/zmzhang8/grpc_example/lib/log"
+)
+
+// Authorizer authorizes calls with the policy in a file, which can be reloaded while serving.
+type Authorizer struct {
+	logger log.Logger
+	path   string
+
+	mu     sync.RWMutex
+	policy *Policy
+	hash   [sha256.Size]byte
+}
+
+func New(logger log.Logger, path string) *Authorizer {
+	return &Authorizer{logger: logger, path: path}
+}
+
+// Authorize checks the grants of the principal in ctx against the policy. Calls are denied until a policy is loaded.
+func (a *Authorizer) Authorize(ctx context.Context, fullMethod string) error {
+	a.mu.RLock()
+	policy := a.policy
+	a.mu.RUnlock()
+	if policy == nil {
+		return status.Error(codes.PermissionDenied, "Authorization policy is not loaded")
+	}
+	// anonymous callers have no grants
+	principal, _ := auth.FromContext(ctx)
+	return policy.Authorize(fullMethod, principal.Grants)
+}
+
+// Reload reads the policy file, and replaces the policy if the file has changed.
+// It reports whether the policy has been replaced.
+func (a *Authorizer) Reload() (bool, error) {
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return false, err
+	}
+	hash := sha256.Sum256(data)
+	a.mu.RLock()
+	unchanged := a.policy != nil && bytes.Equal(hash[:], a.hash[:])
+	a.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	policy, err := ParsePolicy(data)
+	if err != nil {
+		return false, err
+	}
+	a.mu.Lock()
+	a.policy = policy
+	a.hash = hash
+	a.mu.Unlock()
+	a.logger.Infow("Loaded authorization policy", "path", a.path, "rules", len(policy.Rules))
+	return true, nil
+}
+
+// Run reloads the policy every interval until ctx is done. Failed reloads keep the current policy.
+func (a *Authorizer) Run(ctx context.Context, interval time.Duration) {
+	reload.Every(ctx, interval, a.logger, "Failed to reload authorization policy", func(context.Context) error {
+		_, err := a.Reload()
+		return err
+	})
+}
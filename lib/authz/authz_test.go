@@ -0,0 +1,140 @@
+package authz
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/zmzhang8/grpc_example/lib/auth"
+	"github.com/zmzhang8/grpc_example/lib/log"
+)
+
+const testPolicy = `
+rules:
+  - methods: ["/grpc_example.v1.Account/*"]
+  - methods: ["/grpc_example.v1.RouteGuide/RouteChat"]
+    roles: [admin]
+  - methods: ["/grpc_example.v1.RouteGuide/*"]
+    roles: [user, admin]
+    scopes: [read, write]
+`
+
+func TestPolicy_Authorize(t *testing.T) {
+	p, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	user := auth.Grants{Roles: []string{"user"}, Scopes: []string{"read", "write"}}
+
+	for _, tc := range []struct {
+		method     string
+		grants     auth.Grants
+		wantReason string
+	}{
+		{"/grpc_example.v1.Account/Login", auth.Grants{}, ""},
+		{"/grpc_example.v1.RouteGuide/GetFeature", user, ""},
+		{"/grpc_example.v1.RouteGuide/RouteChat", user, "MISSING_ROLE"},
+		{"/grpc_example.v1.RouteGuide/RouteChat", auth.Grants{Roles: []string{"admin"}}, ""},
+		{"/grpc_example.v1.RouteGuide/GetFeature", auth.Grants{Roles: []string{"other"}, Scopes: user.Scopes}, "MISSING_ROLE"},
+		{"/grpc_example.v1.RouteGuide/GetFeature", auth.Grants{Roles: user.Roles, Scopes: []string{"read"}}, "MISSING_SCOPE"},
+		{"/grpc_example.v1.Greeter/SayHello", user, "NO_MATCHING_RULE"},
+	} {
+		err := p.Authorize(tc.method, tc.grants)
+
+		if tc.wantReason == "" {
+			if err != nil {
+				t.Errorf("%v %+v: err %v; want <nil>", tc.method, tc.grants, err)
+			}
+			continue
+		}
+		if got := denialReason(t, err); got != tc.wantReason {
+			t.Errorf("%v %+v: reason %v; want %v", tc.method, tc.grants, got, tc.wantReason)
+		}
+	}
+}
+
+func TestPolicy_Authorize_defaultAllow(t *testing.T) {
+	p, err := ParsePolicy([]byte(testPolicy + "default: allow\n"))
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	if err := p.Authorize("/grpc_example.v1.Greeter/SayHello", auth.Grants{}); err != nil {
+		t.Errorf("err %v; want <nil>", err)
+	}
+}
+
+func TestParsePolicy_invalid(t *testing.T) {
+	for name, data := range map[string]string{
+		"syntax":     "rules: [",
+		"default":    "default: maybe",
+		"no methods": "rules:\n  - roles: [admin]\n",
+		"pattern":    "rules:\n  - methods: [\"/grpc_example.v1.[/*\"]\n",
+		"relative":   "rules:\n  - methods: [\"grpc_example.v1.Greeter/*\"]\n",
+	} {
+		if _, err := ParsePolicy([]byte(data)); err == nil {
+			t.Errorf("%v: err <nil>; want error", name)
+		}
+	}
+}
+
+func TestAuthorizer_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	a := New(log.NewLogger(log.NewCore(false, os.Stdout, false)), path)
+	ctx := auth.WithPrincipal(context.TODO(), auth.Principal{Grants: auth.Grants{Roles: []string{"user"}}})
+	method := "/grpc_example.v1.Greeter/SayHello"
+
+	if err := a.Authorize(ctx, method); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("code %v before loading; want %v", status.Code(err), codes.PermissionDenied)
+	}
+	writePolicy(t, path, "rules:\n  - methods: [\"/grpc_example.v1.Greeter/*\"]\n    roles: [user]\n")
+	if reloaded, err := a.Reload(); !reloaded || err != nil {
+		t.Fatalf("reloaded %v, err %v; want true, <nil>", reloaded, err)
+	}
+	if err := a.Authorize(ctx, method); err != nil {
+		t.Errorf("err %v; want <nil>", err)
+	}
+	if reloaded, err := a.Reload(); reloaded || err != nil {
+		t.Errorf("reloaded %v, err %v of unchanged policy; want false, <nil>", reloaded, err)
+	}
+
+	writePolicy(t, path, "rules: [")
+	if _, err := a.Reload(); err == nil {
+		t.Errorf("err <nil> of invalid policy; want error")
+	}
+	if err := a.Authorize(ctx, method); err != nil {
+		t.Errorf("err %v after invalid policy; want <nil> of current policy", err)
+	}
+
+	writePolicy(t, path, "rules:\n  - methods: [\"/grpc_example.v1.Greeter/*\"]\n    roles: [admin]\n")
+	if _, err := a.Reload(); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if err := a.Authorize(ctx, method); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("code %v of changed policy; want %v", status.Code(err), codes.PermissionDenied)
+	}
+}
+
+func writePolicy(t *testing.T, path string, data string) {
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+}
+
+func denialReason(t *testing.T, err error) string {
+	st := status.Convert(err)
+	if st.Code() != codes.PermissionDenied {
+		t.Errorf("code %v; want %v", st.Code(), codes.PermissionDenied)
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return info.Reason
+		}
+	}
+	return ""
+}
@@ -0,0 +1,135 @@
+package authz
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+
+	"github.com/zmzhang8/grpc_example/lib/auth"
+)
+
+const (
+	DefaultAllow = "allow"
+	DefaultDeny  = "deny"
+
+	// Domain of the ErrorInfo details of denials.
+	errorDomain = "grpc_example"
+)
+
+// Policy maps full method names to the roles and scopes they require, e.g.
+//
+//	rules:
+//	  - methods: ["/grpc_example.v1.Account/*"]
+//	  - methods: ["/grpc_example.v1.RouteGuide/RecordRoute", "/grpc_example.v1.RouteGuide/RouteChat"]
+//	    roles: [admin]
+//	  - methods: ["/grpc_example.v1.*/*"]
+//	    roles: [user, admin]
+//	    scopes: [read]
+//	default: deny
+//
+// The first rule with a method pattern matching the method applies. Patterns use the syntax of path.Match,
+// so * does not match the slash between service and method. Callers need any of the roles and all of the scopes
+// of the rule; a rule without roles and scopes allows all callers. Methods matching no rule are denied,
+// unless default is allow.
+type Policy struct {
+	Rules   []Rule `yaml:"rules"`
+	Default string `yaml:"default"`
+}
+
+type Rule struct {
+	Methods []string `yaml:"methods"`
+	Roles   []string `yaml:"roles"`
+	Scopes  []string `yaml:"scopes"`
+}
+
+// ParsePolicy parses and validates a YAML or JSON policy.
+func ParsePolicy(data []byte) (*Policy, error) {
+	p := &Policy{}
+	if err := yaml.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	switch p.Default {
+	case "":
+		p.Default = DefaultDeny
+	case DefaultAllow, DefaultDeny:
+	default:
+		return nil, fmt.Errorf("invalid policy: default must be allow or deny, not %q", p.Default)
+	}
+	for i, rule := range p.Rules {
+		if len(rule.Methods) == 0 {
+			return nil, fmt.Errorf("invalid policy: rule %d has no methods", i)
+		}
+		for _, pattern := range rule.Methods {
+			if _, err := path.Match(pattern, ""); err != nil || !strings.HasPrefix(pattern, "/") {
+				return nil, fmt.Errorf("invalid policy: rule %d has invalid method pattern %q", i, pattern)
+			}
+		}
+	}
+	return p, nil
+}
+
+// Authorize returns nil if grants satisfy the rule of fullMethod, or a PermissionDenied error
+// with ErrorInfo details of the missing grants.
+func (p *Policy) Authorize(fullMethod string, grants auth.Grants) error {
+	rule := p.rule(fullMethod)
+	if rule == nil {
+		if p.Default == DefaultAllow {
+			return nil
+		}
+		return denied("NO_MATCHING_RULE", fullMethod, nil)
+	}
+	if len(rule.Roles) > 0 && !containsAny(grants.Roles, rule.Roles) {
+		return denied("MISSING_ROLE", fullMethod, map[string]string{"required_roles": strings.Join(rule.Roles, " ")})
+	}
+	var missing []string
+	for _, scope := range rule.Scopes {
+		if !containsAny(grants.Scopes, []string{scope}) {
+			missing = append(missing, scope)
+		}
+	}
+	if len(missing) > 0 {
+		return denied("MISSING_SCOPE", fullMethod, map[string]string{"missing_scopes": strings.Join(missing, " ")})
+	}
+	return nil
+}
+
+func (p *Policy) rule(fullMethod string) *Rule {
+	for i := range p.Rules {
+		for _, pattern := range p.Rules[i].Methods {
+			// patterns are validated when parsed
+			if ok, _ := path.Match(pattern, fullMethod); ok {
+				return &p.Rules[i]
+			}
+		}
+	}
+	return nil
+}
+
+func containsAny(values []string, wanted []string) bool {
+	for _, v := range values {
+		for _, w := range wanted {
+			if v == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func denied(reason string, fullMethod string, metadata map[string]string) error {
+	if metadata == nil {
+		metadata = make(map[string]string, 1)
+	}
+	metadata["method"] = fullMethod
+	st, err := status.New(codes.PermissionDenied, "Permission denied").
+		WithDetails(&errdetails.ErrorInfo{Reason: reason, Domain: errorDomain, Metadata: metadata})
+	if err != nil {
+		return status.Error(codes.PermissionDenied, "Permission denied")
+	}
+	return st.Err()
+}
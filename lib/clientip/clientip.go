@@ -0,0 +1,113 @@
+// Package clientip propagates the IP address of clients from the HTTP edge to gRPC servers in metadata,
+// because the peer of calls through the gateway is the gateway, and in-process calls have no IP address.
+package clientip
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"github.com/zmzhang8/grpc_example/lib/memconn"
+)
+
+// Metadata key of the client IP address. It is only trusted from in-process peers and trusted proxies, and the
+// gateway and the in-process handlers replace the values of clients.
+const MetadataKey = "x-client-ip"
+
+type contextKey struct{}
+
+// WithAddr returns a copy of ctx with the client address of the call.
+func WithAddr(ctx context.Context, addr netip.Addr) context.Context {
+	return context.WithValue(ctx, contextKey{}, addr)
+}
+
+// FromContext returns the client address of the call, or the invalid address if the client is unknown.
+func FromContext(ctx context.Context) netip.Addr {
+	addr, _ := ctx.Value(contextKey{}).(netip.Addr)
+	return addr
+}
+
+// FromRequest returns the IP address of the client of an HTTP request, or an empty string if it is unknown.
+func FromRequest(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return ""
+	}
+	return addr.Unmap().String()
+}
+
+// SetMetadata replaces the client address of md with the one of r, and removes it if it is unknown.
+func SetMetadata(md metadata.MD, r *http.Request) {
+	if addr := FromRequest(r); addr != "" {
+		md.Set(MetadataKey, addr)
+	} else {
+		md.Delete(MetadataKey)
+	}
+}
+
+// HeaderMatcher is the default incoming header matcher of the gateway, except that clients cannot set
+// the client address with a Grpc-Metadata-X-Client-Ip header.
+func HeaderMatcher(key string) (string, bool) {
+	name, ok := runtime.DefaultHeaderMatcher(key)
+	if ok && strings.EqualFold(name, MetadataKey) {
+		return "", false
+	}
+	return name, ok
+}
+
+// Resolver resolves the client addresses of calls.
+type Resolver struct {
+	trustedProxies []netip.Prefix
+}
+
+// NewResolver returns a resolver which trusts the client addresses of in-process peers and of peers in
+// trustedProxies, e.g. the address of the gateway.
+func NewResolver(trustedProxies []netip.Prefix) *Resolver {
+	return &Resolver{trustedProxies: trustedProxies}
+}
+
+// Resolve returns the client address in the metadata of trusted peers, or the address of other peers.
+// It returns the invalid address if the client cannot be attributed, e.g. a trusted peer did not set it.
+func (r *Resolver) Resolve(ctx context.Context) netip.Addr {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return netip.Addr{}
+	}
+	if memconn.IsAddr(p.Addr) {
+		return metadataAddr(ctx)
+	}
+	addrPort, err := netip.ParseAddrPort(p.Addr.String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr := addrPort.Addr().Unmap()
+	for _, proxy := range r.trustedProxies {
+		if proxy.Contains(addr) {
+			return metadataAddr(ctx)
+		}
+	}
+	return addr
+}
+
+func metadataAddr(ctx context.Context) netip.Addr {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(MetadataKey)
+	if len(values) != 1 {
+		return netip.Addr{}
+	}
+	addr, err := netip.ParseAddr(values[0])
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
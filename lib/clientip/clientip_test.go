@@ -0,0 +1,73 @@
+package clientip
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"github.com/zmzhang8/grpc_example/lib/memconn"
+)
+
+func TestResolver_Resolve(t *testing.T) {
+	resolver := NewResolver([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})
+	tcpPeer := func(addr string) *peer.Peer {
+		return &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(addr), Port: 443}}
+	}
+
+	for _, tc := range []struct {
+		name string
+		peer *peer.Peer
+		md   metadata.MD
+		want string
+	}{
+		{"peer", tcpPeer("192.0.2.1"), nil, "192.0.2.1"},
+		{"peer ignoring metadata", tcpPeer("192.0.2.1"), metadata.Pairs(MetadataKey, "198.51.100.1"), "192.0.2.1"},
+		{"IPv4-mapped peer", tcpPeer("::ffff:192.0.2.1"), nil, "192.0.2.1"},
+		{"trusted proxy", tcpPeer("10.0.0.1"), metadata.Pairs(MetadataKey, "198.51.100.1"), "198.51.100.1"},
+		{"trusted proxy without metadata", tcpPeer("10.0.0.1"), nil, "invalid IP"},
+		{"trusted proxy with two addresses", tcpPeer("10.0.0.1"), metadata.Pairs(MetadataKey, "198.51.100.1", MetadataKey, "198.51.100.2"), "invalid IP"},
+		{"in-process", &peer.Peer{Addr: memconn.Addr{}}, metadata.Pairs(MetadataKey, "198.51.100.1"), "198.51.100.1"},
+		{"in-process without metadata", &peer.Peer{Addr: memconn.Addr{}}, nil, "invalid IP"},
+		{"no peer", nil, metadata.Pairs(MetadataKey, "198.51.100.1"), "invalid IP"},
+	} {
+		ctx := metadata.NewIncomingContext(context.TODO(), tc.md)
+		if tc.peer != nil {
+			ctx = peer.NewContext(ctx, tc.peer)
+		}
+
+		if got := resolver.Resolve(ctx); got.String() != tc.want {
+			t.Errorf("%v: address %v; want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSetMetadata(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	md := metadata.Pairs(MetadataKey, "198.51.100.1")
+
+	SetMetadata(md, r)
+
+	if got := md.Get(MetadataKey); len(got) != 1 || got[0] != "192.0.2.1" {
+		t.Errorf("client address %v; want [192.0.2.1]", got)
+	}
+	r.RemoteAddr = "@"
+	SetMetadata(md, r)
+	if got := md.Get(MetadataKey); len(got) != 0 {
+		t.Errorf("client address %v; want none", got)
+	}
+}
+
+func TestHeaderMatcher(t *testing.T) {
+	if _, ok := HeaderMatcher("Grpc-Metadata-X-Client-Ip"); ok {
+		t.Errorf("matched Grpc-Metadata-X-Client-Ip; want not matched")
+	}
+	if got, ok := HeaderMatcher("Grpc-Metadata-X-Tenant"); !ok || got != "X-Tenant" {
+		t.Errorf("matched %v %v; want X-Tenant true", got, ok)
+	}
+}
@@ -0,0 +1,320 @@
+package connect
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+
+	"github.com/zmzhang8/grpc_example/lib/clientip"
+	"github.com/zmzhang8/grpc_example/lib/internal/rpcutil"
+)
+
+const (
+	// Same as the default maximum size of messages received by gRPC servers.
+	maxMessageSize = 4 << 20
+	// Smaller messages are sent uncompressed.
+	minCompressSize = 1024
+)
+
+// Handler serves the Connect protocol by calling the methods of a gRPC connection,
+// e.g. to an in-process server, so that calls run through the interceptors of the server.
+// Methods are resolved from the global protobuf registry with their paths, e.g. /grpc_example.v1.Greeter/SayHello.
+// Request headers are forwarded as metadata.
+type Handler struct {
+	conn grpc.ClientConnInterface
+}
+
+func NewHandler(conn grpc.ClientConnInterface) *Handler {
+	return &Handler{conn: conn}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	streaming := strings.HasPrefix(mediaType, streamContentTypePrefix)
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !IsConnectRequest(r) {
+		w.Header().Set("Accept-Post", "application/json, application/proto, application/connect+json, application/connect+proto")
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	method, err := findMethod(r.URL.Path)
+	if err != nil {
+		if streaming {
+			writeStreamError(w, mediaType, status.Convert(err), nil)
+		} else {
+			writeUnaryError(w, status.Convert(err))
+		}
+		return
+	}
+
+	if streaming {
+		h.serveStream(w, r, method, codecs[strings.TrimPrefix(mediaType, streamContentTypePrefix)])
+	} else if method.IsStreamingClient() || method.IsStreamingServer() {
+		writeUnaryError(w, status.Newf(codes.Unimplemented, "%s is a streaming method", r.URL.Path))
+	} else {
+		h.serveUnary(w, r, method, codecs[strings.TrimPrefix(mediaType, unaryContentTypePrefix)])
+	}
+}
+
+func findMethod(path string) (protoreflect.MethodDescriptor, error) {
+	serviceName, methodName, ok := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "unknown method %s", path)
+	}
+	desc, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(serviceName))
+	if err != nil {
+		return nil, status.Errorf(codes.Unimplemented, "unknown service %s", serviceName)
+	}
+	service, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "unknown service %s", serviceName)
+	}
+	method := service.Methods().ByName(protoreflect.Name(methodName))
+	if method == nil {
+		return nil, status.Errorf(codes.Unimplemented, "unknown method %s", path)
+	}
+	return method, nil
+}
+
+// callContext returns the context of a call with the timeout and metadata of the request.
+func callContext(r *http.Request) (context.Context, context.CancelFunc, error) {
+	md, err := requestMetadata(r.Header)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the in-process gRPC server trusts the client address of its peers, which must not be set by clients
+	clientip.SetMetadata(md, r)
+	ctx := metadata.NewOutgoingContext(r.Context(), md)
+	if value := r.Header.Get(TimeoutHeader); value != "" {
+		timeout, err := parseTimeout(value)
+		if err != nil {
+			return nil, nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		return ctx, cancel, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, cancel, nil
+}
+
+func (h *Handler) serveUnary(w http.ResponseWriter, r *http.Request, method protoreflect.MethodDescriptor, c codec) {
+	contentEncoding := r.Header.Get("Content-Encoding")
+	if err := checkEncoding(contentEncoding); err != nil {
+		writeUnaryError(w, status.Convert(err))
+		return
+	}
+	data, err := readAll(r.Body, maxMessageSize)
+	if err == nil && contentEncoding == gzipEncoding {
+		data, err = decompress(data, maxMessageSize)
+	}
+	if err != nil {
+		writeUnaryError(w, status.Convert(err))
+		return
+	}
+	req := rpcutil.NewMessage(method.Input())
+	if err := c.unmarshal(data, req); err != nil {
+		writeUnaryError(w, status.Newf(codes.InvalidArgument, "invalid %s message: %v", c.name, err))
+		return
+	}
+
+	ctx, cancel, err := callContext(r)
+	if err != nil {
+		writeUnaryError(w, status.Convert(err))
+		return
+	}
+	defer cancel()
+	resp := rpcutil.NewMessage(method.Output())
+	var header, trailer metadata.MD
+	err = h.conn.Invoke(ctx, r.URL.Path, req, resp, grpc.Header(&header), grpc.Trailer(&trailer))
+	setResponseMetadata(w.Header(), header, "")
+	setResponseMetadata(w.Header(), trailer, "Trailer-")
+	if err != nil {
+		writeUnaryError(w, status.Convert(err))
+		return
+	}
+
+	data, err = c.marshal(resp)
+	if err != nil {
+		writeUnaryError(w, status.Newf(codes.Internal, "failed to marshal response: %v", err))
+		return
+	}
+	if len(data) >= minCompressSize && negotiateEncoding(r.Header.Get("Accept-Encoding")) == gzipEncoding {
+		if compressed, err := compress(data); err == nil {
+			data = compressed
+			w.Header().Set("Content-Encoding", gzipEncoding)
+		}
+	}
+	w.Header().Set("Content-Type", unaryContentTypePrefix+c.name)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// Bidirectional streams over HTTP/1.1 are rejected, because request bodies cannot be read after responses start.
+func (h *Handler) serveStream(w http.ResponseWriter, r *http.Request, method protoreflect.MethodDescriptor, c codec) {
+	contentType := streamContentTypePrefix + c.name
+	requestEncoding := r.Header.Get(StreamContentEncodingHeader)
+	if err := checkEncoding(requestEncoding); err != nil {
+		writeStreamError(w, contentType, status.Convert(err), nil)
+		return
+	}
+	if method.IsStreamingClient() && method.IsStreamingServer() && r.ProtoMajor < 2 {
+		writeStreamError(w, contentType, status.New(codes.Unimplemented, "bidirectional streams require HTTP/2"), nil)
+		return
+	}
+
+	ctx, cancel, err := callContext(r)
+	if err != nil {
+		writeStreamError(w, contentType, status.Convert(err), nil)
+		return
+	}
+	defer cancel()
+	desc := &grpc.StreamDesc{
+		StreamName:    string(method.Name()),
+		ServerStreams: method.IsStreamingServer(),
+		ClientStreams: method.IsStreamingClient(),
+	}
+	stream, err := h.conn.NewStream(ctx, desc, r.URL.Path)
+	if err != nil {
+		writeStreamError(w, contentType, status.Convert(err), nil)
+		return
+	}
+
+	// requests are sent concurrently for bidirectional streams, and before receiving responses otherwise
+	sendErr := make(chan error, 1)
+	go func() {
+		err := sendRequests(r.Body, stream, method, c, requestEncoding == gzipEncoding)
+		if err != nil {
+			cancel()
+		}
+		sendErr <- err
+	}()
+	if !desc.ClientStreams || !desc.ServerStreams {
+		if err := <-sendErr; err != nil {
+			writeStreamError(w, contentType, status.Convert(err), nil)
+			return
+		}
+	}
+
+	header, _ := stream.Header()
+	setResponseMetadata(w.Header(), header, "")
+	compressResponses := negotiateEncoding(r.Header.Get(StreamAcceptEncodingHeader)) == gzipEncoding
+	if compressResponses {
+		w.Header().Set(StreamContentEncodingHeader, gzipEncoding)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	for {
+		resp := rpcutil.NewMessage(method.Output())
+		if err = stream.RecvMsg(resp); err != nil {
+			break
+		}
+		data, err := c.marshal(resp)
+		if err != nil {
+			cancel()
+			writeEndStream(w, status.Newf(codes.Internal, "failed to marshal response: %v", err), stream.Trailer())
+			return
+		}
+		flags := byte(0)
+		if compressResponses && len(data) >= minCompressSize {
+			if compressed, err := compress(data); err == nil {
+				data, flags = compressed, flagCompressed
+			}
+		}
+		if err := writeEnvelope(w, flags, data); err != nil {
+			return // client is gone
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	// invalid requests of bidirectional streams cancel the call
+	select {
+	case sendErr := <-sendErr:
+		if sendErr != nil {
+			err = sendErr
+		}
+	default:
+	}
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	writeEndStream(w, status.Convert(err), stream.Trailer())
+}
+
+// sendRequests sends the messages of the request body to the stream and closes the sending side.
+func sendRequests(body io.Reader, stream grpc.ClientStream, method protoreflect.MethodDescriptor, c codec, compressed bool) error {
+	count := 0
+	for {
+		flags, data, err := readEnvelope(body, maxMessageSize)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if flags&flagEndStream != 0 {
+			return status.Error(codes.InvalidArgument, "unexpected end-stream message in request")
+		}
+		if flags&flagCompressed != 0 {
+			if !compressed {
+				return status.Errorf(codes.InvalidArgument, "compressed message without %s", StreamContentEncodingHeader)
+			}
+			if data, err = decompress(data, maxMessageSize); err != nil {
+				return err
+			}
+		}
+		req := rpcutil.NewMessage(method.Input())
+		if err := c.unmarshal(data, req); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid %s message: %v", c.name, err)
+		}
+		if count++; count > 1 && !method.IsStreamingClient() {
+			return status.Error(codes.InvalidArgument, "more than one message in request")
+		}
+		if err := stream.SendMsg(req); err != nil {
+			// the server has ended the call, whose status is returned by RecvMsg
+			return nil
+		}
+	}
+	if count == 0 && !method.IsStreamingClient() {
+		return status.Error(codes.InvalidArgument, "missing request message")
+	}
+	return stream.CloseSend()
+}
+
+// writeStreamError responds with an end-stream message before the call starts.
+func writeStreamError(w http.ResponseWriter, contentType string, st *status.Status, trailer metadata.MD) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	writeEndStream(w, st, trailer)
+}
+
+func writeEndStream(w http.ResponseWriter, st *status.Status, trailer metadata.MD) {
+	msg := endStreamMessage{Metadata: metadataJSON(trailer)}
+	if st.Code() != codes.OK {
+		msg.Error = newWireError(st)
+	}
+	buf, _ := json.Marshal(msg)
+	writeEnvelope(w, flagEndStream, buf)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,390 @@
+package connect
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/zmzhang8/grpc_example/lib/clientip"
+	pb "github.com/zmzhang8/grpc_example/proto/v1"
+)
+
+type greeterServerMock struct {
+	pb.UnimplementedGreeterServer
+}
+
+func (s *greeterServerMock) SayHello(ctx context.Context, in *pb.HelloRequest) (*pb.HelloReply, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	grpc.SetHeader(ctx, metadata.Pairs(
+		"x-echo", strings.Join(md.Get("x-test"), ","),
+		"x-echo-client-ip", strings.Join(md.Get(clientip.MetadataKey), ","),
+	))
+	grpc.SetTrailer(ctx, metadata.Pairs("x-trailer", "done"))
+	if in.Name == "" {
+		st, _ := status.New(codes.InvalidArgument, "name is required").WithDetails(&errdetails.BadRequest{
+			FieldViolations: []*errdetails.BadRequest_FieldViolation{{Field: "name", Description: "required"}},
+		})
+		return nil, st.Err()
+	}
+	if _, ok := ctx.Deadline(); !ok && in.Name == "deadline" {
+		return nil, status.Error(codes.FailedPrecondition, "no deadline")
+	}
+	return &pb.HelloReply{Message: "Hello " + in.Name}, nil
+}
+
+type routeGuideServerMock struct {
+	pb.UnimplementedRouteGuideServer
+}
+
+func (s *routeGuideServerMock) ListFeatures(rect *pb.Rectangle, stream pb.RouteGuide_ListFeaturesServer) error {
+	for _, name := range []string{"a", "b"} {
+		if err := stream.Send(&pb.Feature{Name: name, Location: rect.Lo}); err != nil {
+			return err
+		}
+	}
+	stream.SetTrailer(metadata.Pairs("x-count", "2"))
+	return nil
+}
+
+func (s *routeGuideServerMock) RecordRoute(stream pb.RouteGuide_RecordRouteServer) error {
+	var count int32
+	for {
+		_, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(&pb.RouteSummary{PointCount: count})
+		}
+		if err != nil {
+			return err
+		}
+		count++
+	}
+}
+
+func (s *routeGuideServerMock) RouteChat(stream pb.RouteGuide_RouteChatServer) error {
+	for {
+		note, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(note); err != nil {
+			return err
+		}
+	}
+}
+
+func newTestHandler(t *testing.T) *Handler {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	pb.RegisterGreeterServer(server, &greeterServerMock{})
+	pb.RegisterRouteGuideServer(server, &routeGuideServerMock{})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return NewHandler(conn)
+}
+
+func newUnaryRequest(path string, contentType string, body []byte) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(ProtocolVersionHeader, "1")
+	return req
+}
+
+func envelopes(t *testing.T, c codec, messages ...proto.Message) []byte {
+	var buf bytes.Buffer
+	for _, msg := range messages {
+		data, err := c.marshal(msg)
+		if err != nil {
+			t.Fatalf("err %v; want <nil>", err)
+		}
+		writeEnvelope(&buf, 0, data)
+	}
+	return buf.Bytes()
+}
+
+// readStream returns the messages and the end-stream message of a stream response.
+func readStream(t *testing.T, body io.Reader, c codec, newMsg func() proto.Message) ([]proto.Message, endStreamMessage) {
+	var messages []proto.Message
+	for {
+		flags, data, err := readEnvelope(body, maxMessageSize)
+		if err != nil {
+			t.Fatalf("err %v; want end-stream message", err)
+		}
+		if flags&flagEndStream != 0 {
+			var end endStreamMessage
+			if err := json.Unmarshal(data, &end); err != nil {
+				t.Fatalf("err %v; want <nil>", err)
+			}
+			return messages, end
+		}
+		msg := newMsg()
+		if err := c.unmarshal(data, msg); err != nil {
+			t.Fatalf("err %v; want <nil>", err)
+		}
+		messages = append(messages, msg)
+	}
+}
+
+func TestIsConnectRequest(t *testing.T) {
+	tests := []struct {
+		contentType     string
+		protocolVersion string
+		want            bool
+	}{
+		{"application/json", "1", true},
+		{"application/proto", "1", true},
+		{"application/json; charset=utf-8", "1", true},
+		{"application/json", "", false},
+		{"application/connect+json", "", true},
+		{"application/connect+proto", "", true},
+		{"application/grpc", "", false},
+		{"application/xml", "1", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/grpc_example.v1.Greeter/SayHello", nil)
+		req.Header.Set("Content-Type", tt.contentType)
+		if tt.protocolVersion != "" {
+			req.Header.Set(ProtocolVersionHeader, tt.protocolVersion)
+		}
+
+		if got := IsConnectRequest(req); got != tt.want {
+			t.Errorf("IsConnectRequest(%q, %q) %v; want %v", tt.contentType, tt.protocolVersion, got, tt.want)
+		}
+	}
+}
+
+func TestHandler_unaryJSON(t *testing.T) {
+	h := newTestHandler(t)
+	req := newUnaryRequest("/grpc_example.v1.Greeter/SayHello", "application/json", []byte(`{"name":"world"}`))
+	req.Header.Set("X-Test", "value")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code %v; want %v; body %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	var reply pb.HelloReply
+	if err := protojson.Unmarshal(rec.Body.Bytes(), &reply); err != nil || reply.Message != "Hello world" {
+		t.Errorf("reply %v, err %v; want Hello world", &reply, err)
+	}
+	if got := rec.Header().Get("X-Echo"); got != "value" {
+		t.Errorf("header %v; want value", got)
+	}
+	if got := rec.Header().Get("Trailer-X-Trailer"); got != "done" {
+		t.Errorf("trailer %v; want done", got)
+	}
+}
+
+func TestHandler_clientAddr(t *testing.T) {
+	h := newTestHandler(t)
+	req := newUnaryRequest("/grpc_example.v1.Greeter/SayHello", "application/json", []byte(`{"name":"world"}`))
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Client-Ip", "198.51.100.1")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("X-Echo-Client-Ip"); got != "192.0.2.1" {
+		t.Errorf("client address %v; want 192.0.2.1", got)
+	}
+}
+
+func TestHandler_unaryProtoGzip(t *testing.T) {
+	h := newTestHandler(t)
+	data, _ := proto.Marshal(&pb.HelloRequest{Name: strings.Repeat("x", minCompressSize)})
+	compressed, _ := compress(data)
+	req := newUnaryRequest("/grpc_example.v1.Greeter/SayHello", "application/proto", compressed)
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code %v; want %v; body %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("content encoding %v; want gzip", got)
+	}
+	data, err := decompress(rec.Body.Bytes(), maxMessageSize)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	var reply pb.HelloReply
+	if err := proto.Unmarshal(data, &reply); err != nil || !strings.HasPrefix(reply.Message, "Hello x") {
+		t.Errorf("reply %v, err %v; want Hello x...", &reply, err)
+	}
+}
+
+func TestHandler_unaryError(t *testing.T) {
+	h := newTestHandler(t)
+	req := newUnaryRequest("/grpc_example.v1.Greeter/SayHello", "application/json", []byte(`{}`))
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("code %v; want %v", rec.Code, http.StatusBadRequest)
+	}
+	var got wireError
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if got.Code != "invalid_argument" || got.Message != "name is required" {
+		t.Errorf("error %+v; want invalid_argument: name is required", got)
+	}
+	if len(got.Details) != 1 || got.Details[0].Type != "google.rpc.BadRequest" {
+		t.Errorf("details %+v; want google.rpc.BadRequest", got.Details)
+	}
+}
+
+func TestHandler_unaryTimeout(t *testing.T) {
+	h := newTestHandler(t)
+	req := newUnaryRequest("/grpc_example.v1.Greeter/SayHello", "application/json", []byte(`{"name":"deadline"}`))
+	req.Header.Set(TimeoutHeader, "60000")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("code %v; want %v; body %s", rec.Code, http.StatusOK, rec.Body)
+	}
+}
+
+func TestHandler_unknownMethod(t *testing.T) {
+	h := newTestHandler(t)
+	req := newUnaryRequest("/grpc_example.v1.Greeter/Unknown", "application/json", []byte(`{}`))
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNotImplemented {
+		t.Errorf("code %v; want %v", rec.Code, http.StatusNotImplemented)
+	}
+}
+
+func TestHandler_serverStream(t *testing.T) {
+	h := newTestHandler(t)
+	c := codecs["json"]
+	req := httptest.NewRequest(http.MethodPost, "/grpc_example.v1.RouteGuide/ListFeatures",
+		bytes.NewReader(envelopes(t, c, &pb.Rectangle{Lo: &pb.Point{Latitude: 1}})))
+	req.Header.Set("Content-Type", "application/connect+json")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Content-Type"); got != "application/connect+json" {
+		t.Errorf("content type %v; want application/connect+json", got)
+	}
+	messages, end := readStream(t, rec.Body, c, func() proto.Message { return &pb.Feature{} })
+	if len(messages) != 2 || messages[1].(*pb.Feature).Name != "b" {
+		t.Errorf("messages %v; want features a and b", messages)
+	}
+	if end.Error != nil {
+		t.Errorf("error %+v; want <nil>", end.Error)
+	}
+	if got := end.Metadata["X-Count"]; len(got) != 1 || got[0] != "2" {
+		t.Errorf("metadata %v; want X-Count 2", end.Metadata)
+	}
+}
+
+func TestHandler_clientStream(t *testing.T) {
+	h := newTestHandler(t)
+	c := codecs["proto"]
+	req := httptest.NewRequest(http.MethodPost, "/grpc_example.v1.RouteGuide/RecordRoute",
+		bytes.NewReader(envelopes(t, c, &pb.Point{}, &pb.Point{}, &pb.Point{})))
+	req.Header.Set("Content-Type", "application/connect+proto")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	messages, end := readStream(t, rec.Body, c, func() proto.Message { return &pb.RouteSummary{} })
+	if len(messages) != 1 || messages[0].(*pb.RouteSummary).PointCount != 3 {
+		t.Errorf("messages %v; want summary of 3 points", messages)
+	}
+	if end.Error != nil {
+		t.Errorf("error %+v; want <nil>", end.Error)
+	}
+}
+
+func TestHandler_invalidStreamRequest(t *testing.T) {
+	h := newTestHandler(t)
+	req := httptest.NewRequest(http.MethodPost, "/grpc_example.v1.RouteGuide/RecordRoute", strings.NewReader("\x00\x00\x00"))
+	req.Header.Set("Content-Type", "application/connect+proto")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	_, end := readStream(t, rec.Body, codecs["proto"], func() proto.Message { return &pb.RouteSummary{} })
+	if end.Error == nil || end.Error.Code != "invalid_argument" {
+		t.Errorf("error %+v; want invalid_argument", end.Error)
+	}
+}
+
+func TestHandler_bidiStream(t *testing.T) {
+	server := httptest.NewUnstartedServer(newTestHandler(t))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	c := codecs["json"]
+	body := envelopes(t, c, &pb.RouteNote{Message: "a"}, &pb.RouteNote{Message: "b"})
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/grpc_example.v1.RouteGuide/RouteChat", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/connect+json")
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	defer resp.Body.Close()
+
+	messages, end := readStream(t, resp.Body, c, func() proto.Message { return &pb.RouteNote{} })
+	if len(messages) != 2 || messages[1].(*pb.RouteNote).Message != "b" {
+		t.Errorf("messages %v; want notes a and b", messages)
+	}
+	if end.Error != nil {
+		t.Errorf("error %+v; want <nil>", end.Error)
+	}
+}
+
+func TestHandler_bidiStreamOverHTTP1(t *testing.T) {
+	h := newTestHandler(t)
+	req := httptest.NewRequest(http.MethodPost, "/grpc_example.v1.RouteGuide/RouteChat", nil)
+	req.Header.Set("Content-Type", "application/connect+json")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	_, end := readStream(t, rec.Body, codecs["json"], func() proto.Message { return &pb.RouteNote{} })
+	if end.Error == nil || end.Error.Code != "unimplemented" {
+		t.Errorf("error %+v; want unimplemented", end.Error)
+	}
+}
@@ -0,0 +1,335 @@
+package connect
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// https://connectrpc.com/docs/protocol
+const (
+	ProtocolVersionHeader = "Connect-Protocol-Version"
+	TimeoutHeader         = "Connect-Timeout-Ms"
+	// Compression headers of streams. Unary calls use Content-Encoding and Accept-Encoding.
+	StreamContentEncodingHeader = "Connect-Content-Encoding"
+	StreamAcceptEncodingHeader  = "Connect-Accept-Encoding"
+
+	unaryContentTypePrefix  = "application/"
+	streamContentTypePrefix = "application/connect+"
+
+	flagCompressed = 0x01
+	flagEndStream  = 0x02
+
+	gzipEncoding     = "gzip"
+	identityEncoding = "identity"
+)
+
+// codec encodes messages of a content type, i.e. proto or json.
+type codec struct {
+	name      string
+	marshal   func(proto.Message) ([]byte, error)
+	unmarshal func([]byte, proto.Message) error
+}
+
+var codecs = map[string]codec{
+	"proto": {
+		name:      "proto",
+		marshal:   proto.Marshal,
+		unmarshal: proto.Unmarshal,
+	},
+	"json": {
+		name:      "json",
+		marshal:   protojson.Marshal,
+		unmarshal: protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal,
+	},
+}
+
+// IsConnectRequest reports whether the request uses the Connect protocol. Unary requests must have
+// the Connect-Protocol-Version header, which distinguishes them from gateway requests with the same path.
+func IsConnectRequest(r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if strings.HasPrefix(mediaType, streamContentTypePrefix) {
+		_, ok := codecs[strings.TrimPrefix(mediaType, streamContentTypePrefix)]
+		return ok
+	}
+	if r.Header.Get(ProtocolVersionHeader) == "" || !strings.HasPrefix(mediaType, unaryContentTypePrefix) {
+		return false
+	}
+	_, ok := codecs[strings.TrimPrefix(mediaType, unaryContentTypePrefix)]
+	return ok
+}
+
+// parseTimeout parses the Connect-Timeout-Ms header, which has at most 10 digits.
+func parseTimeout(s string) (time.Duration, error) {
+	if len(s) == 0 || len(s) > 10 {
+		return 0, fmt.Errorf("invalid %s %q", TimeoutHeader, s)
+	}
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || ms < 0 {
+		return 0, fmt.Errorf("invalid %s %q", TimeoutHeader, s)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// negotiateEncoding returns gzip if accepted, and identity otherwise.
+func negotiateEncoding(acceptEncoding string) string {
+	for _, encoding := range strings.Split(acceptEncoding, ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+		if strings.EqualFold(strings.TrimSpace(name), gzipEncoding) {
+			return gzipEncoding
+		}
+	}
+	return identityEncoding
+}
+
+func checkEncoding(encoding string) error {
+	if encoding == "" || encoding == identityEncoding || encoding == gzipEncoding {
+		return nil
+	}
+	return status.Errorf(codes.Unimplemented, "unsupported compression %q, supported: gzip, identity", encoding)
+}
+
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(data []byte, maxSize int64) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid gzip data: %v", err)
+	}
+	defer r.Close()
+	return readAll(r, maxSize)
+}
+
+// readAll reads at most maxSize bytes.
+func readAll(r io.Reader, maxSize int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to read message: %v", err)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, status.Errorf(codes.ResourceExhausted, "message larger than %d bytes", maxSize)
+	}
+	return data, nil
+}
+
+// readEnvelope reads a message of a stream, which is prefixed with one byte of flags and four bytes of length.
+// It returns io.EOF at the end of the stream.
+func readEnvelope(r io.Reader, maxSize int64) (byte, []byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, nil, io.EOF
+		}
+		return 0, nil, status.Errorf(codes.InvalidArgument, "invalid envelope: %v", err)
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if int64(size) > maxSize {
+		return 0, nil, status.Errorf(codes.ResourceExhausted, "message larger than %d bytes", maxSize)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, status.Errorf(codes.InvalidArgument, "invalid envelope: %v", err)
+	}
+	return prefix[0], data, nil
+}
+
+func writeEnvelope(w io.Writer, flags byte, data []byte) error {
+	var prefix [5]byte
+	prefix[0] = flags
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(data)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// Request headers which are not forwarded as gRPC metadata.
+var reservedHeaders = map[string]bool{
+	"accept-encoding":   true,
+	"connection":        true,
+	"content-encoding":  true,
+	"content-length":    true,
+	"content-type":      true,
+	"host":              true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"te":                true,
+	"trailer":           true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+// requestMetadata turns request headers into gRPC metadata. Values of binary headers,
+// i.e. with a -Bin suffix, are base64 encoded with or without padding.
+func requestMetadata(header http.Header) (metadata.MD, error) {
+	md := metadata.MD{}
+	for key, values := range header {
+		key = strings.ToLower(key)
+		if reservedHeaders[key] || strings.HasPrefix(key, "connect-") || strings.HasPrefix(key, "grpc-") {
+			continue
+		}
+		if !strings.HasSuffix(key, "-bin") {
+			md.Append(key, values...)
+			continue
+		}
+		for _, value := range values {
+			decoded, err := decodeBinaryHeader(value)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid binary header %s: %v", key, err)
+			}
+			md.Append(key, string(decoded))
+		}
+	}
+	return md, nil
+}
+
+func decodeBinaryHeader(value string) ([]byte, error) {
+	if len(value)%4 == 0 {
+		return base64.StdEncoding.DecodeString(value)
+	}
+	return base64.RawStdEncoding.DecodeString(value)
+}
+
+// setResponseMetadata adds gRPC metadata to response headers with a prefix, e.g. Trailer- for unary trailers.
+func setResponseMetadata(header http.Header, md metadata.MD, prefix string) {
+	for key, values := range md {
+		if key == "content-type" || strings.HasPrefix(key, "grpc-") || strings.HasPrefix(key, ":") {
+			continue
+		}
+		for _, value := range values {
+			if strings.HasSuffix(key, "-bin") {
+				value = base64.RawStdEncoding.EncodeToString([]byte(value))
+			}
+			header.Add(prefix+key, value)
+		}
+	}
+}
+
+// metadataJSON returns metadata in the format of the end-stream message.
+func metadataJSON(md metadata.MD) map[string][]string {
+	header := make(http.Header)
+	setResponseMetadata(header, md, "")
+	if len(header) == 0 {
+		return nil
+	}
+	return header
+}
+
+type wireError struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message,omitempty"`
+	Details []wireDetail `json:"details,omitempty"`
+}
+
+type wireDetail struct {
+	// Fully-qualified name of the message, e.g. google.rpc.BadRequest.
+	Type  string          `json:"type"`
+	Value string          `json:"value"`
+	Debug json.RawMessage `json:"debug,omitempty"`
+}
+
+type endStreamMessage struct {
+	Error    *wireError          `json:"error,omitempty"`
+	Metadata map[string][]string `json:"metadata,omitempty"`
+}
+
+var codeNames = map[codes.Code]string{
+	codes.Canceled:           "canceled",
+	codes.Unknown:            "unknown",
+	codes.InvalidArgument:    "invalid_argument",
+	codes.DeadlineExceeded:   "deadline_exceeded",
+	codes.NotFound:           "not_found",
+	codes.AlreadyExists:      "already_exists",
+	codes.PermissionDenied:   "permission_denied",
+	codes.ResourceExhausted:  "resource_exhausted",
+	codes.FailedPrecondition: "failed_precondition",
+	codes.Aborted:            "aborted",
+	codes.OutOfRange:         "out_of_range",
+	codes.Unimplemented:      "unimplemented",
+	codes.Internal:           "internal",
+	codes.Unavailable:        "unavailable",
+	codes.DataLoss:           "data_loss",
+	codes.Unauthenticated:    "unauthenticated",
+}
+
+// HTTP status codes of unary errors.
+var httpStatuses = map[codes.Code]int{
+	codes.Canceled:           499,
+	codes.Unknown:            http.StatusInternalServerError,
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.Aborted:            http.StatusConflict,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Internal:           http.StatusInternalServerError,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DataLoss:           http.StatusInternalServerError,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+}
+
+func newWireError(st *status.Status) *wireError {
+	code, ok := codeNames[st.Code()]
+	if !ok {
+		code = codeNames[codes.Unknown]
+	}
+	e := &wireError{Code: code, Message: st.Message()}
+	for _, detail := range st.Proto().GetDetails() {
+		typeName := detail.GetTypeUrl()
+		if i := strings.LastIndexByte(typeName, '/'); i >= 0 {
+			typeName = typeName[i+1:]
+		}
+		d := wireDetail{Type: typeName, Value: base64.RawStdEncoding.EncodeToString(detail.GetValue())}
+		if msg, err := detail.UnmarshalNew(); err == nil {
+			d.Debug, _ = protojson.Marshal(msg)
+		}
+		e.Details = append(e.Details, d)
+	}
+	return e
+}
+
+func writeUnaryError(w http.ResponseWriter, st *status.Status) {
+	httpStatus, ok := httpStatuses[st.Code()]
+	if !ok {
+		httpStatus = http.StatusInternalServerError
+	}
+	buf, _ := json.Marshal(newWireError(st))
+	w.Header().Del("Content-Encoding")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	w.Write(buf)
+}
@@ -0,0 +1,123 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+var errNotDocument = errors.New("value is not a protobuf message or stream chunk")
+
+// documentCodec converts protobuf messages from and to generic documents
+// (maps, slices and scalars) following the protobuf JSON mapping, so that
+// self-describing formats like MessagePack and CBOR share field names and
+// well-known type handling with the JSON API.
+type documentCodec struct {
+	marshalOptions   protojson.MarshalOptions
+	unmarshalOptions protojson.UnmarshalOptions
+}
+
+func newDocumentCodec(opts JSONOptions) documentCodec {
+	return documentCodec{
+		marshalOptions: protojson.MarshalOptions{
+			UseProtoNames:   opts.UseProtoNames,
+			UseEnumNumbers:  opts.UseEnumNumbers,
+			EmitUnpopulated: opts.EmitUnpopulated,
+		},
+		unmarshalOptions: protojson.UnmarshalOptions{
+			DiscardUnknown: opts.DiscardUnknown,
+		},
+	}
+}
+
+func (c documentCodec) toDocument(v interface{}) (interface{}, error) {
+	if msg, ok := v.(proto.Message); ok {
+		return c.messageToDocument(msg)
+	}
+
+	key, msg, ok := streamChunk(v)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", errNotDocument, v)
+	}
+	doc, err := c.messageToDocument(msg)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{key: doc}, nil
+}
+
+func (c documentCodec) messageToDocument(msg proto.Message) (interface{}, error) {
+	buf, err := c.marshalOptions.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return normalizeNumbers(doc), nil
+}
+
+func (c documentCodec) fromDocument(doc interface{}, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%w: %T", errNotDocument, v)
+	}
+
+	buf, err := json.Marshal(normalizeKeys(doc))
+	if err != nil {
+		return err
+	}
+	return c.unmarshalOptions.Unmarshal(buf, msg)
+}
+
+// normalizeNumbers converts json.Number values to int64 when possible, or float64 otherwise,
+// so that integers are encoded compactly.
+func normalizeNumbers(doc interface{}) interface{} {
+	switch value := doc.(type) {
+	case map[string]interface{}:
+		for k, v := range value {
+			value[k] = normalizeNumbers(v)
+		}
+	case []interface{}:
+		for i, v := range value {
+			value[i] = normalizeNumbers(v)
+		}
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		if f, err := value.Float64(); err == nil {
+			return f
+		}
+	}
+	return doc
+}
+
+// normalizeKeys converts maps with non-string keys, which some decoders produce, to maps with string keys.
+func normalizeKeys(doc interface{}) interface{} {
+	switch value := doc.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			m[fmt.Sprint(k)] = normalizeKeys(v)
+		}
+		return m
+	case map[string]interface{}:
+		for k, v := range value {
+			value[k] = normalizeKeys(v)
+		}
+	case []interface{}:
+		for i, v := range value {
+			value[i] = normalizeKeys(v)
+		}
+	}
+	return doc
+}
@@ -0,0 +1,118 @@
+package gateway
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	MIMEJSON       = "application/json"
+	MIMEJSONPretty = "application/json+pretty"
+
+	prettyQueryParam = "pretty"
+	prettyIndent     = "  "
+)
+
+type JSONOptions struct {
+	EmitUnpopulated bool
+	UseProtoNames   bool
+	UseEnumNumbers  bool
+	DiscardUnknown  bool
+	Multiline       bool
+}
+
+// DefaultJSONOptions returns the options used by runtime.NewServeMux when no marshaler is registered.
+// They are the defaults of the gateway JSON flags.
+func DefaultJSONOptions() JSONOptions {
+	return JSONOptions{
+		EmitUnpopulated: true,
+		DiscardUnknown:  true,
+	}
+}
+
+func NewJSONMarshaler(opts JSONOptions) runtime.Marshaler {
+	marshalOptions := protojson.MarshalOptions{
+		Multiline:       opts.Multiline,
+		UseProtoNames:   opts.UseProtoNames,
+		UseEnumNumbers:  opts.UseEnumNumbers,
+		EmitUnpopulated: opts.EmitUnpopulated,
+	}
+	if opts.Multiline {
+		marshalOptions.Indent = prettyIndent
+	}
+
+	return &runtime.HTTPBodyMarshaler{
+		Marshaler: &runtime.JSONPb{
+			MarshalOptions: marshalOptions,
+			UnmarshalOptions: protojson.UnmarshalOptions{
+				DiscardUnknown: opts.DiscardUnknown,
+			},
+		},
+	}
+}
+
+// JSONMarshalerOptions registers the JSON marshaler as the default marshaler
+// and a multiline variant which is selected by PrettyHandler.
+func JSONMarshalerOptions(opts JSONOptions) []runtime.ServeMuxOption {
+	prettyOpts := opts
+	prettyOpts.Multiline = true
+
+	return []runtime.ServeMuxOption{
+		runtime.WithMarshalerOption(runtime.MIMEWildcard, NewJSONMarshaler(opts)),
+		runtime.WithMarshalerOption(MIMEJSONPretty, NewJSONMarshaler(prettyOpts)),
+	}
+}
+
+// PrettyHandler selects the multiline JSON marshaler if the "pretty" query parameter is present,
+// e.g. ?pretty or ?pretty=true, and the request accepts JSON. Requests accepting other encodings, e.g.
+// MessagePack, keep their Accept header. The parameter is removed so that it is not parsed as a request field.
+func PrettyHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if _, ok := query[prettyQueryParam]; ok {
+			if isPretty(query.Get(prettyQueryParam)) && acceptsJSON(r.Header.Values("Accept")) {
+				r.Header.Set("Accept", MIMEJSONPretty)
+			}
+			query.Del(prettyQueryParam)
+			r.URL.RawQuery = query.Encode()
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// acceptsJSON reports whether all media ranges of the Accept header are JSON or wildcards.
+func acceptsJSON(values []string) bool {
+	for _, value := range values {
+		for _, mediaRange := range strings.Split(value, ",") {
+			mediaType, _, _ := strings.Cut(mediaRange, ";")
+			switch strings.ToLower(strings.TrimSpace(mediaType)) {
+			case "", MIMEJSON, "*/*", "application/*":
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isPretty(value string) bool {
+	if value == "" {
+		return true
+	}
+	pretty, err := strconv.ParseBool(value)
+	return err == nil && pretty
+}
+
+// BinaryMarshalerOptions registers marshalers for compact encodings, negotiated via the
+// Content-Type and Accept headers. MessagePack and CBOR follow the JSON field naming of opts.
+func BinaryMarshalerOptions(opts JSONOptions) []runtime.ServeMuxOption {
+	return []runtime.ServeMuxOption{
+		runtime.WithMarshalerOption(MIMEProtobuf, &ProtoMarshaler{}),
+		runtime.WithMarshalerOption(MIMEMsgpack, NewMsgpackMarshaler(opts)),
+		runtime.WithMarshalerOption(MIMECBOR, NewCBORMarshaler(opts)),
+	}
+}
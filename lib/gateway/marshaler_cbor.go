@@ -0,0 +1,68 @@
+package gateway
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+)
+
+const MIMECBOR = "application/cbor"
+
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+}.DecMode()
+
+// CBORMarshaler marshals messages in the CBOR format using the protobuf JSON mapping.
+// CBOR values are self-delimiting, so stream messages are simply concatenated.
+type CBORMarshaler struct {
+	codec documentCodec
+}
+
+func NewCBORMarshaler(opts JSONOptions) *CBORMarshaler {
+	return &CBORMarshaler{codec: newDocumentCodec(opts)}
+}
+
+func (*CBORMarshaler) ContentType(_ interface{}) string {
+	return MIMECBOR
+}
+
+func (m *CBORMarshaler) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := m.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *CBORMarshaler) Unmarshal(data []byte, v interface{}) error {
+	return m.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (m *CBORMarshaler) NewDecoder(r io.Reader) runtime.Decoder {
+	decoder := cborDecMode.NewDecoder(r)
+	return runtime.DecoderFunc(func(v interface{}) error {
+		var doc interface{}
+		if err := decoder.Decode(&doc); err != nil {
+			return err
+		}
+		return m.codec.fromDocument(doc, v)
+	})
+}
+
+func (m *CBORMarshaler) NewEncoder(w io.Writer) runtime.Encoder {
+	encoder := cbor.NewEncoder(w)
+	return runtime.EncoderFunc(func(v interface{}) error {
+		doc, err := m.codec.toDocument(v)
+		if err != nil {
+			return err
+		}
+		return encoder.Encode(doc)
+	})
+}
+
+func (*CBORMarshaler) Delimiter() []byte {
+	return []byte{}
+}
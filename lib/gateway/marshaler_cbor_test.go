@@ -0,0 +1,38 @@
+package gateway
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/zmzhang8/grpc_example/proto/v1"
+)
+
+func TestCBORMarshaler_roundTrip(t *testing.T) {
+	m := NewCBORMarshaler(DefaultJSONOptions())
+	want := &pb.Feature{Name: "test", Location: &pb.Point{Latitude: 409146138, Longitude: -746188906}}
+
+	buf, err := m.Marshal(want)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	got := &pb.Feature{}
+	err = m.Unmarshal(buf, got)
+
+	if err != nil {
+		t.Errorf("err %v; want <nil>", err)
+	}
+	if !proto.Equal(got, want) {
+		t.Errorf("feature %v; want %v", got, want)
+	}
+}
+
+func TestCBORMarshaler_unsupportedValue(t *testing.T) {
+	m := NewCBORMarshaler(DefaultJSONOptions())
+
+	_, err := m.Marshal("not a message")
+
+	if err == nil {
+		t.Errorf("err <nil>; want error")
+	}
+}
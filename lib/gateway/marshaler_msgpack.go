@@ -0,0 +1,63 @@
+package gateway
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const MIMEMsgpack = "application/msgpack"
+
+// MsgpackMarshaler marshals messages in the MessagePack format using the protobuf JSON mapping.
+// MessagePack values are self-delimiting, so stream messages are simply concatenated.
+type MsgpackMarshaler struct {
+	codec documentCodec
+}
+
+func NewMsgpackMarshaler(opts JSONOptions) *MsgpackMarshaler {
+	return &MsgpackMarshaler{codec: newDocumentCodec(opts)}
+}
+
+func (*MsgpackMarshaler) ContentType(_ interface{}) string {
+	return MIMEMsgpack
+}
+
+func (m *MsgpackMarshaler) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := m.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *MsgpackMarshaler) Unmarshal(data []byte, v interface{}) error {
+	return m.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (m *MsgpackMarshaler) NewDecoder(r io.Reader) runtime.Decoder {
+	decoder := msgpack.NewDecoder(r)
+	return runtime.DecoderFunc(func(v interface{}) error {
+		doc, err := decoder.DecodeInterfaceLoose()
+		if err != nil {
+			return err
+		}
+		return m.codec.fromDocument(doc, v)
+	})
+}
+
+func (m *MsgpackMarshaler) NewEncoder(w io.Writer) runtime.Encoder {
+	encoder := msgpack.NewEncoder(w)
+	return runtime.EncoderFunc(func(v interface{}) error {
+		doc, err := m.codec.toDocument(v)
+		if err != nil {
+			return err
+		}
+		return encoder.Encode(doc)
+	})
+}
+
+func (*MsgpackMarshaler) Delimiter() []byte {
+	return []byte{}
+}
@@ -0,0 +1,53 @@
+package gateway
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/zmzhang8/grpc_example/proto/v1"
+)
+
+func TestMsgpackMarshaler_roundTrip(t *testing.T) {
+	m := NewMsgpackMarshaler(DefaultJSONOptions())
+	want := &pb.Feature{Name: "test", Location: &pb.Point{Latitude: 409146138, Longitude: -746188906}}
+
+	buf, err := m.Marshal(want)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	got := &pb.Feature{}
+	err = m.Unmarshal(buf, got)
+
+	if err != nil {
+		t.Errorf("err %v; want <nil>", err)
+	}
+	if !proto.Equal(got, want) {
+		t.Errorf("feature %v; want %v", got, want)
+	}
+}
+
+func TestMsgpackMarshaler_stream(t *testing.T) {
+	m := NewMsgpackMarshaler(DefaultJSONOptions())
+	var buf bytes.Buffer
+	encoder := m.NewEncoder(&buf)
+	for _, name := range []string{"a", "b"} {
+		if err := encoder.Encode(map[string]interface{}{"result": &pb.Feature{Name: name}}); err != nil {
+			t.Fatalf("err %v; want <nil>", err)
+		}
+	}
+
+	decoder := msgpack.NewDecoder(&buf)
+	for _, wantName := range []string{"a", "b"} {
+		chunk, err := decoder.DecodeMap()
+		if err != nil {
+			t.Fatalf("err %v; want <nil>", err)
+		}
+		result, _ := chunk["result"].(map[string]interface{})
+		if result["name"] != wantName {
+			t.Errorf("name %v; want %v", result["name"], wantName)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	MIMEProtobuf = "application/x-protobuf"
+
+	frameFlagMessage byte = 0x00
+	frameFlagError   byte = 0x80
+	frameHeaderSize       = 5
+)
+
+// ProtoMarshaler marshals messages in the protobuf binary format.
+//
+// Unary responses are the plain encoded message. Each message of a server stream is framed
+// like gRPC: 1 byte of flags (0x00 for a message, 0x80 for a google.rpc.Status error),
+// a 4 byte big-endian length and the encoded message.
+type ProtoMarshaler struct{}
+
+func (*ProtoMarshaler) ContentType(_ interface{}) string {
+	return MIMEProtobuf
+}
+
+func (*ProtoMarshaler) Marshal(v interface{}) ([]byte, error) {
+	if msg, ok := v.(proto.Message); ok {
+		return proto.Marshal(msg)
+	}
+
+	key, msg, ok := streamChunk(v)
+	if !ok {
+		return nil, fmt.Errorf("cannot marshal %T as protobuf", v)
+	}
+	buf, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	flag := frameFlagMessage
+	if key == streamChunkError {
+		flag = frameFlagError
+	}
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(buf))
+	frame[0] = flag
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(buf)))
+	return append(frame, buf...), nil
+}
+
+func (*ProtoMarshaler) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal protobuf into %T", v)
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+// NewDecoder returns a decoder which reads the whole body as a single message.
+func (m *ProtoMarshaler) NewDecoder(r io.Reader) runtime.Decoder {
+	var done bool
+	return runtime.DecoderFunc(func(v interface{}) error {
+		if done {
+			return io.EOF
+		}
+		done = true
+		buf, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return m.Unmarshal(buf, v)
+	})
+}
+
+func (m *ProtoMarshaler) NewEncoder(w io.Writer) runtime.Encoder {
+	return runtime.EncoderFunc(func(v interface{}) error {
+		buf, err := m.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(buf)
+		return err
+	})
+}
+
+// Delimiter is empty because stream messages are length-prefixed.
+func (*ProtoMarshaler) Delimiter() []byte {
+	return []byte{}
+}
+
+const (
+	streamChunkResult = "result"
+	streamChunkError  = "error"
+)
+
+// streamChunk unwraps the envelope which runtime.ForwardResponseStream puts around stream messages.
+func streamChunk(v interface{}) (string, proto.Message, bool) {
+	switch chunk := v.(type) {
+	case map[string]interface{}:
+		if msg, ok := chunk[streamChunkResult].(proto.Message); ok && len(chunk) == 1 {
+			return streamChunkResult, msg, true
+		}
+	case map[string]proto.Message:
+		if msg, ok := chunk[streamChunkError]; ok && len(chunk) == 1 {
+			return streamChunkError, msg, true
+		}
+	}
+	return "", nil, false
+}
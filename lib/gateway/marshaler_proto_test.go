@@ -0,0 +1,64 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/zmzhang8/grpc_example/proto/v1"
+)
+
+func TestProtoMarshaler_roundTrip(t *testing.T) {
+	m := &ProtoMarshaler{}
+	want := &pb.Point{Latitude: 409146138, Longitude: -746188906}
+
+	buf, err := m.Marshal(want)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	got := &pb.Point{}
+	err = m.NewDecoder(bytes.NewReader(buf)).Decode(got)
+
+	if err != nil {
+		t.Errorf("err %v; want <nil>", err)
+	}
+	if !proto.Equal(got, want) {
+		t.Errorf("point %v; want %v", got, want)
+	}
+}
+
+func TestProtoMarshaler_streamChunk(t *testing.T) {
+	m := &ProtoMarshaler{}
+	msg := &pb.Point{Latitude: 1}
+	wantPayload, _ := proto.Marshal(msg)
+
+	buf, err := m.Marshal(map[string]interface{}{"result": msg})
+
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if buf[0] != frameFlagMessage {
+		t.Errorf("flag %v; want %v", buf[0], frameFlagMessage)
+	}
+	if length := binary.BigEndian.Uint32(buf[1:frameHeaderSize]); int(length) != len(wantPayload) {
+		t.Errorf("length %v; want %v", length, len(wantPayload))
+	}
+	if !bytes.Equal(buf[frameHeaderSize:], wantPayload) {
+		t.Errorf("payload %v; want %v", buf[frameHeaderSize:], wantPayload)
+	}
+}
+
+func TestProtoMarshaler_errorChunk(t *testing.T) {
+	m := &ProtoMarshaler{}
+
+	buf, err := m.Marshal(map[string]proto.Message{"error": &pb.Point{}})
+
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if buf[0] != frameFlagError {
+		t.Errorf("flag %v; want %v", buf[0], frameFlagError)
+	}
+}
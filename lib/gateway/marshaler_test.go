@@ -0,0 +1,91 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pb "github.com/zmzhang8/grpc_example/proto/v1"
+)
+
+func TestNewJSONMarshaler_emitUnpopulated(t *testing.T) {
+	opts := DefaultJSONOptions()
+	msg := pb.RouteSummary{PointCount: 1}
+	wantField := `"featureCount":0`
+
+	buf, err := NewJSONMarshaler(opts).Marshal(&msg)
+
+	if err != nil {
+		t.Errorf("err %v; want <nil>", err)
+	}
+	if !strings.Contains(strings.ReplaceAll(string(buf), " ", ""), wantField) {
+		t.Errorf("json %s; want field %v", buf, wantField)
+	}
+}
+
+func TestNewJSONMarshaler_useProtoNames(t *testing.T) {
+	opts := JSONOptions{UseProtoNames: true}
+	msg := pb.RouteSummary{PointCount: 1}
+	wantField := `"point_count":1`
+
+	buf, err := NewJSONMarshaler(opts).Marshal(&msg)
+
+	if err != nil {
+		t.Errorf("err %v; want <nil>", err)
+	}
+	if !strings.Contains(strings.ReplaceAll(string(buf), " ", ""), wantField) {
+		t.Errorf("json %s; want field %v", buf, wantField)
+	}
+}
+
+func TestNewJSONMarshaler_multiline(t *testing.T) {
+	opts := JSONOptions{Multiline: true}
+	msg := pb.RouteSummary{PointCount: 1}
+
+	buf, err := NewJSONMarshaler(opts).Marshal(&msg)
+
+	if err != nil {
+		t.Errorf("err %v; want <nil>", err)
+	}
+	if !strings.Contains(string(buf), "\n") {
+		t.Errorf("json %s; want multiline", buf)
+	}
+}
+
+func TestPrettyHandler(t *testing.T) {
+	for _, tc := range []struct {
+		url        string
+		accept     string
+		wantAccept string
+	}{
+		{"/v1/test?pretty", "", MIMEJSONPretty},
+		{"/v1/test?pretty=true", "", MIMEJSONPretty},
+		{"/v1/test?pretty", "application/json", MIMEJSONPretty},
+		{"/v1/test?pretty", "*/*", MIMEJSONPretty},
+		{"/v1/test?pretty", MIMEMsgpack, MIMEMsgpack},
+		{"/v1/test?pretty", MIMEProtobuf + ", */*;q=0.1", MIMEProtobuf + ", */*;q=0.1"},
+		{"/v1/test?pretty=false", "", ""},
+		{"/v1/test", "", ""},
+	} {
+		var gotAccept, gotQuery string
+		h := PrettyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotAccept = r.Header.Get("Accept")
+			gotQuery = r.URL.RawQuery
+		}))
+
+		req := httptest.NewRequest(http.MethodPost, tc.url, nil)
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		if gotAccept != tc.wantAccept {
+			t.Errorf("%v: accept %v; want %v", tc.url, gotAccept, tc.wantAccept)
+		}
+		if gotQuery != "" {
+			t.Errorf("%v: query %v; want empty", tc.url, gotQuery)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/zmzhang8/grpc_example/lib/internal/rpcutil"
+)
+
+// Same as the default maximum size of messages received by gRPC servers.
+const maxRequestSize = 4 << 20
+
+// request is a GraphQL request of POST bodies and subscribe messages of websockets.
+type request struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// Options of Handler.
+type Options struct {
+	// Reports whether the origin of a websocket handshake is allowed.
+	// Nil allows only the origin of the server.
+	WebsocketOriginFunc func(r *http.Request) bool
+	// Maximum size of websocket messages. Zero means the default of 4 MiB.
+	WebsocketReadLimit int64
+}
+
+// Handler serves queries and mutations over POST requests, and all operations including subscriptions
+// over websockets with the graphql-transport-ws protocol, see websocket.go.
+// The Authorization, X-Api-Key and X-Request-Id headers are forwarded as metadata.
+type Handler struct {
+	schema graphql.Schema
+	opts   Options
+}
+
+func NewHandler(schema graphql.Schema, opts Options) *Handler {
+	if opts.WebsocketReadLimit == 0 {
+		opts.WebsocketReadLimit = maxRequestSize
+	}
+	return &Handler{schema: schema, opts: opts}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		h.serveWebsocket(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		w.Header().Set("Accept-Post", "application/json")
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxRequestSize {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var req request
+	if err := json.Unmarshal(body, &req); err != nil || req.Query == "" {
+		writeJSON(w, http.StatusBadRequest, errorResult(errors.New("request must be a JSON object with a query")))
+		return
+	}
+
+	operation, err := operationType(req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResult(err))
+		return
+	}
+	if operation == ast.OperationTypeSubscription {
+		writeJSON(w, http.StatusBadRequest, errorResult(errors.New("subscriptions require a websocket connection")))
+		return
+	}
+	ctx := metadata.NewOutgoingContext(r.Context(), rpcutil.RequestMetadata(r))
+	writeJSON(w, http.StatusOK, h.do(ctx, req))
+}
+
+func (h *Handler) do(ctx context.Context, req request) *graphql.Result {
+	return graphql.Do(graphql.Params{
+		Schema:         h.schema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        ctx,
+	})
+}
+
+// operationType returns the type of the operation of a request, i.e. query, mutation or subscription.
+func operationType(req request) (string, error) {
+	document, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{Body: []byte(req.Query)})})
+	if err != nil {
+		return "", err
+	}
+	var operations []*ast.OperationDefinition
+	for _, definition := range document.Definitions {
+		if operation, ok := definition.(*ast.OperationDefinition); ok {
+			if req.OperationName == "" || operation.Name != nil && operation.Name.Value == req.OperationName {
+				operations = append(operations, operation)
+			}
+		}
+	}
+	switch {
+	case len(operations) == 0 && req.OperationName != "":
+		return "", errors.New("unknown operation " + req.OperationName)
+	case len(operations) != 1:
+		return "", errors.New("request must contain exactly one operation or an operationName")
+	}
+	return operations[0].Operation, nil
+}
+
+func errorResult(err error) *graphql.Result {
+	return &graphql.Result{Errors: gqlerrors.FormatErrors(err)}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(buf)
+}
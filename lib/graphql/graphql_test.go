@@ -0,0 +1,296 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"nhooyr.io/websocket"
+
+	pb "github.com/zmzhang8/grpc_example/proto/v1"
+)
+
+type routeGuideServerMock struct {
+	pb.UnimplementedRouteGuideServer
+}
+
+func (s *routeGuideServerMock) GetFeature(ctx context.Context, point *pb.Point) (*pb.Feature, error) {
+	if point.Latitude < 0 {
+		return nil, status.Error(codes.InvalidArgument, "invalid latitude")
+	}
+	return &pb.Feature{Name: "feature", Location: point}, nil
+}
+
+func (s *routeGuideServerMock) ListFeatures(rect *pb.Rectangle, stream pb.RouteGuide_ListFeaturesServer) error {
+	for _, name := range []string{"a", "b"} {
+		if err := stream.Send(&pb.Feature{Name: name, Location: rect.Lo}); err != nil {
+			return err
+		}
+	}
+	if rect.Hi != nil {
+		// blocks until the subscription is completed
+		<-stream.Context().Done()
+	}
+	return nil
+}
+
+type accountServerMock struct {
+	pb.UnimplementedAccountServer
+}
+
+func (s *accountServerMock) Login(ctx context.Context, in *pb.LoginRequest) (*pb.LoginResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	token := in.Username + ":" + strings.Join(md.Get("authorization"), ",")
+	return &pb.LoginResponse{Token: token, Expiration: timestamppb.New(time.Unix(0, 0))}, nil
+}
+
+type healthServerMock struct {
+	pb.UnimplementedHealthServer
+}
+
+func (s *healthServerMock) Check(ctx context.Context, in *pb.HealthCheckRequest) (*pb.HealthCheckResponse, error) {
+	return &pb.HealthCheckResponse{Status: pb.HealthCheckResponse_SERVING}, nil
+}
+
+func newTestHandler(t *testing.T) *Handler {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	pb.RegisterRouteGuideServer(server, &routeGuideServerMock{})
+	pb.RegisterAccountServer(server, &accountServerMock{})
+	pb.RegisterHealthServer(server, &healthServerMock{})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	services := []protoreflect.ServiceDescriptor{
+		pb.File_grpc_example_v1_route_guide_proto.Services().Get(0),
+		pb.File_grpc_example_v1_account_proto.Services().Get(0),
+		pb.File_grpc_example_v1_health_proto.Services().Get(0),
+	}
+	schema, err := NewSchema(conn, services, SchemaOptions{Mutations: []string{"grpc_example.v1.Account.Login"}})
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return NewHandler(schema, Options{})
+}
+
+func post(t *testing.T, h http.Handler, query string) (int, string) {
+	body, _ := json.Marshal(map[string]string{"query": query})
+	req := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer token")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code, rec.Body.String()
+}
+
+func TestHandler_query(t *testing.T) {
+	h := newTestHandler(t)
+	code, body := post(t, h, `{ routeGuideGetFeature(latitude: 1) { name location { latitude longitude } } }`)
+	want := `{"data":{"routeGuideGetFeature":{"location":{"latitude":1,"longitude":0},"name":"feature"}}}`
+	if code != http.StatusOK || body != want {
+		t.Errorf("status %d, body %s; want %d, %s", code, body, http.StatusOK, want)
+	}
+}
+
+func TestHandler_enum(t *testing.T) {
+	h := newTestHandler(t)
+	_, body := post(t, h, `{ healthCheck { status } }`)
+	if want := `{"data":{"healthCheck":{"status":"SERVING"}}}`; body != want {
+		t.Errorf("body %s; want %s", body, want)
+	}
+}
+
+func TestHandler_mutation(t *testing.T) {
+	h := newTestHandler(t)
+	_, body := post(t, h, `mutation { accountLogin(username: "user", password: "pass") { token expiration } }`)
+	want := `{"data":{"accountLogin":{"expiration":"1970-01-01T00:00:00Z","token":"user:Bearer token"}}}`
+	if body != want {
+		t.Errorf("body %s; want %s", body, want)
+	}
+	if _, body := post(t, h, `{ accountLogin(username: "user") { token } }`); !strings.Contains(body, `"errors"`) {
+		t.Errorf("body %s; want errors of mutations in queries", body)
+	}
+}
+
+func TestHandler_error(t *testing.T) {
+	h := newTestHandler(t)
+	_, body := post(t, h, `{ routeGuideGetFeature(latitude: -1) { name } }`)
+	var result struct {
+		Errors []struct {
+			Message    string                 `json:"message"`
+			Extensions map[string]interface{} `json:"extensions"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal([]byte(body), &result); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if len(result.Errors) != 1 || result.Errors[0].Message != "invalid latitude" || result.Errors[0].Extensions["code"] != "INVALID_ARGUMENT" {
+		t.Errorf("body %s; want error invalid latitude with code INVALID_ARGUMENT", body)
+	}
+}
+
+func TestHandler_invalidRequests(t *testing.T) {
+	h := newTestHandler(t)
+	for _, query := range []string{
+		`subscription { routeGuideListFeatures { name } }`,
+		`{ routeGuideGetFeature(`,
+		`query a { healthCheck { status } } query b { healthCheck { status } }`,
+	} {
+		if code, body := post(t, h, query); code != http.StatusBadRequest || !strings.Contains(body, `"errors"`) {
+			t.Errorf("%s: status %d, body %s; want %d with errors", query, code, body, http.StatusBadRequest)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/graphql", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status %d; want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestNewSchema_operationTypes(t *testing.T) {
+	h := newTestHandler(t)
+	_, body := post(t, h, `{ __schema { subscriptionType { fields { name } } mutationType { fields { name } } } }`)
+	want := `{"data":{"__schema":{"mutationType":{"fields":[{"name":"accountLogin"}]},"subscriptionType":{"fields":[{"name":"healthWatch"},{"name":"routeGuideListFeatures"}]}}}}`
+	if body != want {
+		t.Errorf("body %s; want %s", body, want)
+	}
+}
+
+// websocketClient speaks the graphql-transport-ws protocol.
+type websocketClient struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+func dialWebsocket(t *testing.T, h http.Handler) *websocketClient {
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), &websocket.DialOptions{
+		Subprotocols: []string{Subprotocol},
+	})
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	t.Cleanup(func() { conn.Close(websocket.StatusNormalClosure, "") })
+	return &websocketClient{t: t, conn: conn}
+}
+
+func (c *websocketClient) send(msg string) {
+	if err := c.conn.Write(context.Background(), websocket.MessageText, []byte(msg)); err != nil {
+		c.t.Fatalf("err %v; want <nil>", err)
+	}
+}
+
+func (c *websocketClient) recv() wsMessage {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, data, err := c.conn.Read(ctx)
+	if err != nil {
+		c.t.Fatalf("err %v; want <nil>", err)
+	}
+	var msg wsMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		c.t.Fatalf("message %s: err %v; want <nil>", data, err)
+	}
+	return msg
+}
+
+func (c *websocketClient) init(payload string) {
+	c.send(`{"type":"connection_init","payload":` + payload + `}`)
+	if msg := c.recv(); msg.Type != messageConnectionAck {
+		c.t.Fatalf("message %+v; want connection_ack", msg)
+	}
+}
+
+func TestWebsocket_subscription(t *testing.T) {
+	c := dialWebsocket(t, newTestHandler(t))
+	c.init(`{}`)
+	c.send(`{"id":"1","type":"subscribe","payload":{"query":"subscription { routeGuideListFeatures(lo: {latitude: 1}) { name location { latitude } } }"}}`)
+	for _, name := range []string{"a", "b"} {
+		msg := c.recv()
+		want := `{"data":{"routeGuideListFeatures":{"location":{"latitude":1},"name":"` + name + `"}}}`
+		if msg.ID != "1" || msg.Type != messageNext || string(msg.Payload) != want {
+			t.Fatalf("message %+v; want next %s", msg, want)
+		}
+	}
+	if msg := c.recv(); msg.ID != "1" || msg.Type != messageComplete {
+		t.Errorf("message %+v; want complete", msg)
+	}
+}
+
+func TestWebsocket_completeSubscription(t *testing.T) {
+	c := dialWebsocket(t, newTestHandler(t))
+	c.init(`{}`)
+	c.send(`{"id":"1","type":"subscribe","payload":{"query":"subscription { routeGuideListFeatures(hi: {}) { name } }"}}`)
+	c.recv()
+	c.recv()
+	c.send(`{"id":"1","type":"complete"}`)
+	// the id can be reused after the subscription is completed
+	c.send(`{"id":"1","type":"subscribe","payload":{"query":"{ healthCheck { status } }"}}`)
+	if msg := c.recv(); msg.Type != messageNext || string(msg.Payload) != `{"data":{"healthCheck":{"status":"SERVING"}}}` {
+		t.Errorf("message %+v; want next of the query", msg)
+	}
+	if msg := c.recv(); msg.Type != messageComplete {
+		t.Errorf("message %+v; want complete", msg)
+	}
+}
+
+func TestWebsocket_initPayload(t *testing.T) {
+	c := dialWebsocket(t, newTestHandler(t))
+	c.init(`{"Authorization":"Bearer init"}`)
+	c.send(`{"id":"1","type":"subscribe","payload":{"query":"mutation { accountLogin(username: \"user\") { token } }"}}`)
+	if msg := c.recv(); string(msg.Payload) != `{"data":{"accountLogin":{"token":"user:Bearer init"}}}` {
+		t.Errorf("message %+v; want the token of the init payload", msg)
+	}
+}
+
+func TestWebsocket_errors(t *testing.T) {
+	c := dialWebsocket(t, newTestHandler(t))
+	c.init(`{}`)
+	c.send(`{"id":"1","type":"subscribe","payload":{"query":"subscription { unknown }"}}`)
+	if msg := c.recv(); msg.ID != "1" || msg.Type != messageError {
+		t.Errorf("message %+v; want error", msg)
+	}
+	c.send(`{"type":"ping"}`)
+	if msg := c.recv(); msg.Type != messagePong {
+		t.Errorf("message %+v; want pong", msg)
+	}
+	c.send(`{"type":"connection_init"}`)
+	_, _, err := c.conn.Read(context.Background())
+	if status := websocket.CloseStatus(err); status != closeTooManyInitRequests {
+		t.Errorf("close status %v; want %v", status, closeTooManyInitRequests)
+	}
+}
+
+func TestWebsocket_unauthorized(t *testing.T) {
+	c := dialWebsocket(t, newTestHandler(t))
+	c.send(`{"id":"1","type":"subscribe","payload":{"query":"{ healthCheck { status } }"}}`)
+	_, _, err := c.conn.Read(context.Background())
+	if status := websocket.CloseStatus(err); status != closeUnauthorized {
+		t.Errorf("close status %v; want %v", status, closeUnauthorized)
+	}
+}
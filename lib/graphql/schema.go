@@ -0,0 +1,413 @@
+package graphql
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	"github.com/zmzhang8/grpc_example/lib/internal/rpcutil"
+)
+
+// JSON is the type of values without a GraphQL equivalent, e.g. maps, google.protobuf.Struct and messages without fields.
+var JSON = graphql.NewScalar(graphql.ScalarConfig{
+	Name:        "JSON",
+	Description: "A JSON value in the protobuf JSON format.",
+	Serialize:   func(value interface{}) interface{} { return value },
+	ParseValue:  func(value interface{}) interface{} { return value },
+	ParseLiteral: func(valueAST ast.Value) interface{} {
+		return literalValue(valueAST)
+	},
+})
+
+func literalValue(valueAST ast.Value) interface{} {
+	switch valueAST := valueAST.(type) {
+	case *ast.ObjectValue:
+		object := make(map[string]interface{})
+		for _, field := range valueAST.Fields {
+			object[field.Name.Value] = literalValue(field.Value)
+		}
+		return object
+	case *ast.ListValue:
+		list := make([]interface{}, 0, len(valueAST.Values))
+		for _, value := range valueAST.Values {
+			list = append(list, literalValue(value))
+		}
+		return list
+	case *ast.IntValue, *ast.FloatValue:
+		return json.Number(valueAST.GetValue().(string))
+	default:
+		return valueAST.GetValue()
+	}
+}
+
+// Scalar types of well-known messages, whose protobuf JSON format is not an object.
+var wellKnownTypes = map[protoreflect.FullName]graphql.Type{
+	"google.protobuf.Timestamp":   graphql.String,
+	"google.protobuf.Duration":    graphql.String,
+	"google.protobuf.FieldMask":   graphql.String,
+	"google.protobuf.StringValue": graphql.String,
+	"google.protobuf.BytesValue":  graphql.String,
+	"google.protobuf.BoolValue":   graphql.Boolean,
+	"google.protobuf.Int32Value":  graphql.Int,
+	"google.protobuf.UInt32Value": graphql.Float,
+	"google.protobuf.Int64Value":  graphql.String,
+	"google.protobuf.UInt64Value": graphql.String,
+	"google.protobuf.FloatValue":  graphql.Float,
+	"google.protobuf.DoubleValue": graphql.Float,
+	"google.protobuf.Struct":      JSON,
+	"google.protobuf.Value":       JSON,
+	"google.protobuf.ListValue":   JSON,
+	"google.protobuf.Any":         JSON,
+	"google.protobuf.Empty":       JSON,
+}
+
+// SchemaOptions of NewSchema.
+type SchemaOptions struct {
+	// Full names of unary methods which are mutations, e.g. grpc_example.v1.Account.Login.
+	// Other unary methods are queries.
+	Mutations []string
+}
+
+// schemaBuilder maps protobuf descriptors to GraphQL types. Types are cached by name,
+// and fields are built lazily so that recursive messages work.
+type schemaBuilder struct {
+	conn    grpc.ClientConnInterface
+	pkg     protoreflect.FullName
+	outputs map[protoreflect.FullName]graphql.Output
+	inputs  map[protoreflect.FullName]graphql.Input
+	enums   map[protoreflect.FullName]*graphql.Enum
+}
+
+// NewSchema builds a GraphQL schema whose fields call the methods of services over a gRPC connection.
+// Unary methods are queries or mutations and server streaming methods are subscriptions. Client and
+// bidirectional streaming methods are not supported. Fields are named after services and methods,
+// e.g. routeGuideGetFeature, their arguments are the fields of request messages, and types use the
+// names of the protobuf JSON format. Messages of other packages than the first service are prefixed with
+// their package, e.g. google_protobuf_Timestamp.
+func NewSchema(conn grpc.ClientConnInterface, services []protoreflect.ServiceDescriptor, opts SchemaOptions) (graphql.Schema, error) {
+	b := &schemaBuilder{
+		conn:    conn,
+		outputs: make(map[protoreflect.FullName]graphql.Output),
+		inputs:  make(map[protoreflect.FullName]graphql.Input),
+		enums:   make(map[protoreflect.FullName]*graphql.Enum),
+	}
+	if len(services) > 0 {
+		b.pkg = services[0].ParentFile().Package()
+	}
+	mutations := make(map[string]bool)
+	for _, name := range opts.Mutations {
+		mutations[name] = true
+	}
+
+	queryFields, mutationFields, subscriptionFields := graphql.Fields{}, graphql.Fields{}, graphql.Fields{}
+	for _, service := range services {
+		methods := service.Methods()
+		for i := 0; i < methods.Len(); i++ {
+			method := methods.Get(i)
+			name := fieldName(service, method)
+			switch {
+			case method.IsStreamingClient():
+				continue
+			case method.IsStreamingServer():
+				subscriptionFields[name] = b.subscriptionField(method)
+			case mutations[string(method.FullName())] && !isQuery(method):
+				mutationFields[name] = b.unaryField(method)
+			default:
+				queryFields[name] = b.unaryField(method)
+			}
+		}
+	}
+	if len(queryFields) == 0 {
+		return graphql.Schema{}, errors.New("no queries in services")
+	}
+
+	config := graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{Name: "Query", Fields: queryFields}),
+	}
+	if len(mutationFields) > 0 {
+		config.Mutation = graphql.NewObject(graphql.ObjectConfig{Name: "Mutation", Fields: mutationFields})
+	}
+	if len(subscriptionFields) > 0 {
+		config.Subscription = graphql.NewObject(graphql.ObjectConfig{Name: "Subscription", Fields: subscriptionFields})
+	}
+	return graphql.NewSchema(config)
+}
+
+// isQuery reports whether a method is marked as free of side effects, which makes it a query in any case.
+func isQuery(method protoreflect.MethodDescriptor) bool {
+	opts, ok := method.Options().(*descriptorpb.MethodOptions)
+	return ok && opts.GetIdempotencyLevel() == descriptorpb.MethodOptions_NO_SIDE_EFFECTS
+}
+
+// fieldName returns the name of the field of a method, e.g. routeGuideGetFeature.
+func fieldName(service protoreflect.ServiceDescriptor, method protoreflect.MethodDescriptor) string {
+	name := string(service.Name())
+	return strings.ToLower(name[:1]) + name[1:] + string(method.Name())
+}
+
+// typeName returns the GraphQL name of a message or enum, e.g. HealthCheckResponse_ServingStatus.
+func (b *schemaBuilder) typeName(desc protoreflect.Descriptor) string {
+	name := string(desc.FullName())
+	if pkg := string(b.pkg); pkg != "" && strings.HasPrefix(name, pkg+".") {
+		name = strings.TrimPrefix(name, pkg+".")
+	}
+	return strings.ReplaceAll(name, ".", "_")
+}
+
+func (b *schemaBuilder) unaryField(method protoreflect.MethodDescriptor) *graphql.Field {
+	return &graphql.Field{
+		Type: b.outputType(method.Output()),
+		Args: b.arguments(method.Input()),
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			in, err := newRequest(method, p.Args)
+			if err != nil {
+				return nil, err
+			}
+			out := rpcutil.NewMessage(method.Output())
+			if err := b.conn.Invoke(p.Context, rpcutil.MethodPath(method), in, out); err != nil {
+				return nil, newStatusError(err)
+			}
+			return messageValue(out)
+		},
+	}
+}
+
+// subscriptionField starts a server stream, whose messages are the payloads of the subscription.
+func (b *schemaBuilder) subscriptionField(method protoreflect.MethodDescriptor) *graphql.Field {
+	return &graphql.Field{
+		Type: b.outputType(method.Output()),
+		Args: b.arguments(method.Input()),
+		Subscribe: func(p graphql.ResolveParams) (interface{}, error) {
+			in, err := newRequest(method, p.Args)
+			if err != nil {
+				return nil, err
+			}
+			desc := &grpc.StreamDesc{StreamName: string(method.Name()), ServerStreams: true}
+			stream, err := b.conn.NewStream(p.Context, desc, rpcutil.MethodPath(method))
+			if err != nil {
+				return nil, newStatusError(err)
+			}
+			if err := stream.SendMsg(in); err != nil && !errors.Is(err, io.EOF) {
+				return nil, newStatusError(err)
+			}
+			if err := stream.CloseSend(); err != nil {
+				return nil, newStatusError(err)
+			}
+
+			payloads := make(chan interface{})
+			go func() {
+				defer close(payloads)
+				for {
+					var payload interface{}
+					out := rpcutil.NewMessage(method.Output())
+					if err := stream.RecvMsg(out); errors.Is(err, io.EOF) {
+						return
+					} else if err != nil {
+						payload = newStatusError(err)
+					} else if payload, err = messageValue(out); err != nil {
+						payload = err
+					}
+					select {
+					case payloads <- payload:
+					case <-p.Context.Done():
+						return
+					}
+					if _, ok := payload.(error); ok {
+						return
+					}
+				}
+			}()
+			return payloads, nil
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			if err, ok := p.Source.(error); ok {
+				return nil, err
+			}
+			return p.Source, nil
+		},
+	}
+}
+
+func (b *schemaBuilder) arguments(desc protoreflect.MessageDescriptor) graphql.FieldConfigArgument {
+	args := graphql.FieldConfigArgument{}
+	if _, ok := wellKnownTypes[desc.FullName()]; ok {
+		return args
+	}
+	fields := desc.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		args[field.JSONName()] = &graphql.ArgumentConfig{Type: b.fieldInputType(field)}
+	}
+	return args
+}
+
+func (b *schemaBuilder) outputType(desc protoreflect.MessageDescriptor) graphql.Output {
+	if t, ok := wellKnownTypes[desc.FullName()]; ok {
+		return t
+	}
+	if desc.Fields().Len() == 0 {
+		return JSON
+	}
+	if t, ok := b.outputs[desc.FullName()]; ok {
+		return t
+	}
+	t := graphql.NewObject(graphql.ObjectConfig{
+		Name: b.typeName(desc),
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			fields := graphql.Fields{}
+			for i := 0; i < desc.Fields().Len(); i++ {
+				field := desc.Fields().Get(i)
+				fields[field.JSONName()] = &graphql.Field{Type: b.fieldOutputType(field)}
+			}
+			return fields
+		}),
+	})
+	b.outputs[desc.FullName()] = t
+	return t
+}
+
+func (b *schemaBuilder) inputType(desc protoreflect.MessageDescriptor) graphql.Input {
+	if t, ok := wellKnownTypes[desc.FullName()]; ok {
+		return t
+	}
+	if desc.Fields().Len() == 0 {
+		return JSON
+	}
+	if t, ok := b.inputs[desc.FullName()]; ok {
+		return t
+	}
+	t := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: b.typeName(desc) + "Input",
+		Fields: graphql.InputObjectConfigFieldMapThunk(func() graphql.InputObjectConfigFieldMap {
+			fields := graphql.InputObjectConfigFieldMap{}
+			for i := 0; i < desc.Fields().Len(); i++ {
+				field := desc.Fields().Get(i)
+				fields[field.JSONName()] = &graphql.InputObjectFieldConfig{Type: b.fieldInputType(field)}
+			}
+			return fields
+		}),
+	})
+	b.inputs[desc.FullName()] = t
+	return t
+}
+
+func (b *schemaBuilder) fieldOutputType(field protoreflect.FieldDescriptor) graphql.Output {
+	if field.IsMap() {
+		return JSON
+	}
+	var t graphql.Output
+	if field.Kind() == protoreflect.MessageKind || field.Kind() == protoreflect.GroupKind {
+		t = b.outputType(field.Message())
+	} else {
+		t = b.scalarType(field)
+	}
+	if field.IsList() {
+		return graphql.NewList(t)
+	}
+	return t
+}
+
+func (b *schemaBuilder) fieldInputType(field protoreflect.FieldDescriptor) graphql.Input {
+	if field.IsMap() {
+		return JSON
+	}
+	var t graphql.Input
+	if field.Kind() == protoreflect.MessageKind || field.Kind() == protoreflect.GroupKind {
+		t = b.inputType(field.Message())
+	} else {
+		t = b.scalarType(field)
+	}
+	if field.IsList() {
+		return graphql.NewList(t)
+	}
+	return t
+}
+
+// scalarType follows the protobuf JSON format, e.g. 64-bit integers are strings.
+// Unsigned 32-bit integers are floats, because GraphQL integers are signed 32-bit integers.
+func (b *schemaBuilder) scalarType(field protoreflect.FieldDescriptor) graphql.Type {
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		return graphql.Boolean
+	case protoreflect.EnumKind:
+		return b.enumType(field.Enum())
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return graphql.Int
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.FloatKind, protoreflect.DoubleKind:
+		return graphql.Float
+	default:
+		// strings, bytes in base64 and 64-bit integers
+		return graphql.String
+	}
+}
+
+func (b *schemaBuilder) enumType(desc protoreflect.EnumDescriptor) *graphql.Enum {
+	if t, ok := b.enums[desc.FullName()]; ok {
+		return t
+	}
+	values := graphql.EnumValueConfigMap{}
+	for i := 0; i < desc.Values().Len(); i++ {
+		name := string(desc.Values().Get(i).Name())
+		values[name] = &graphql.EnumValueConfig{Value: name}
+	}
+	t := graphql.NewEnum(graphql.EnumConfig{Name: b.typeName(desc), Values: values})
+	b.enums[desc.FullName()] = t
+	return t
+}
+
+// newRequest returns the request message of a method from the arguments of a field.
+func newRequest(method protoreflect.MethodDescriptor, args map[string]interface{}) (proto.Message, error) {
+	in := rpcutil.NewMessage(method.Input())
+	data, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	if err := protojson.Unmarshal(data, in); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %w", err)
+	}
+	return in, nil
+}
+
+// messageValue returns the protobuf JSON format of a message as a value of the default resolvers.
+// Unpopulated fields are included, so that zero values are not null.
+func messageValue(msg proto.Message) (interface{}, error) {
+	data, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// statusError is an error of a gRPC call, whose code is in the extensions of the GraphQL error,
+// e.g. {"code": "INVALID_ARGUMENT"}.
+type statusError struct {
+	status *status.Status
+}
+
+func newStatusError(err error) error {
+	return &statusError{status: status.Convert(err)}
+}
+
+func (e *statusError) Error() string {
+	return e.status.Message()
+}
+
+func (e *statusError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": code.Code_name[int32(e.status.Code())]}
+}
@@ -0,0 +1,280 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"google.golang.org/grpc/metadata"
+	"nhooyr.io/websocket"
+
+	"github.com/zmzhang8/grpc_example/lib/internal/rpcutil"
+)
+
+// https://github.com/enisdenjo/graphql-ws/blob/master/PROTOCOL.md
+const (
+	Subprotocol = "graphql-transport-ws"
+
+	messageConnectionInit = "connection_init"
+	messageConnectionAck  = "connection_ack"
+	messagePing           = "ping"
+	messagePong           = "pong"
+	messageSubscribe      = "subscribe"
+	messageNext           = "next"
+	messageError          = "error"
+	messageComplete       = "complete"
+
+	closeBadRequest          websocket.StatusCode = 4400
+	closeUnauthorized        websocket.StatusCode = 4401
+	closeInitTimeout         websocket.StatusCode = 4408
+	closeSubscriberExists    websocket.StatusCode = 4409
+	closeTooManyInitRequests websocket.StatusCode = 4429
+
+	// Time to wait for connection_init after the handshake.
+	connectionInitTimeout = 10 * time.Second
+)
+
+type wsMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// wsSession serves the operations of a websocket connection. Each operation runs in its own goroutine,
+// and subscriptions run until their streams end or the client completes them.
+type wsSession struct {
+	h    *Handler
+	conn *websocket.Conn
+	// Canceled when the connection is closed.
+	ctx context.Context
+	md  metadata.MD
+	wg  sync.WaitGroup
+
+	writeMu sync.Mutex
+
+	mu           sync.Mutex
+	acknowledged bool
+	initialized  bool
+	operations   map[string]*operation
+}
+
+// operation is an operation in progress. Ids can be reused after operations are completed.
+type operation struct {
+	cancel context.CancelFunc
+}
+
+func (h *Handler) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	acceptOpts := &websocket.AcceptOptions{Subprotocols: []string{Subprotocol}}
+	if h.opts.WebsocketOriginFunc != nil {
+		if !h.opts.WebsocketOriginFunc(r) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		acceptOpts.InsecureSkipVerify = true
+	}
+	conn, err := websocket.Accept(w, r, acceptOpts)
+	if err != nil {
+		return // Accept has responded
+	}
+	if conn.Subprotocol() != Subprotocol {
+		conn.Close(websocket.StatusPolicyViolation, "subprotocol "+Subprotocol+" is required")
+		return
+	}
+	conn.SetReadLimit(h.opts.WebsocketReadLimit)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	s := &wsSession{
+		h:          h,
+		conn:       conn,
+		ctx:        ctx,
+		md:         rpcutil.RequestMetadata(r),
+		operations: make(map[string]*operation),
+	}
+	initTimer := time.AfterFunc(connectionInitTimeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if !s.initialized {
+			conn.Close(closeInitTimeout, "Connection initialisation timeout")
+		}
+	})
+	err = s.readLoop()
+	initTimer.Stop()
+	cancel()
+	s.wg.Wait()
+	if websocket.CloseStatus(err) == -1 {
+		conn.Close(websocket.StatusInternalError, "")
+	}
+}
+
+func (s *wsSession) readLoop() error {
+	for {
+		_, data, err := s.conn.Read(s.ctx)
+		if err != nil {
+			return err
+		}
+		var msg wsMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return s.conn.Close(closeBadRequest, "Invalid message received")
+		}
+		if err := s.handleMessage(&msg); err != nil {
+			return err
+		}
+	}
+}
+
+// handleMessage returns an error if the connection is closed.
+func (s *wsSession) handleMessage(msg *wsMessage) error {
+	switch msg.Type {
+	case messageConnectionInit:
+		return s.init(msg.Payload)
+	case messagePing:
+		s.write(&wsMessage{Type: messagePong})
+	case messagePong:
+	case messageSubscribe:
+		return s.subscribe(msg)
+	case messageComplete:
+		s.mu.Lock()
+		op, ok := s.operations[msg.ID]
+		delete(s.operations, msg.ID)
+		s.mu.Unlock()
+		if ok {
+			op.cancel()
+		}
+	default:
+		return s.conn.Close(closeBadRequest, "Invalid message received")
+	}
+	return nil
+}
+
+// init acknowledges the connection. An Authorization value in the payload overrides the header of the
+// handshake, because browsers cannot set headers of websockets.
+func (s *wsSession) init(payload json.RawMessage) error {
+	s.mu.Lock()
+	if s.initialized {
+		s.mu.Unlock()
+		return s.conn.Close(closeTooManyInitRequests, "Too many initialisation requests")
+	}
+	s.initialized = true
+	s.mu.Unlock()
+
+	var params map[string]interface{}
+	if len(payload) > 0 && json.Unmarshal(payload, &params) != nil {
+		return s.conn.Close(closeBadRequest, "Invalid connection_init payload")
+	}
+	for key, value := range params {
+		for _, header := range rpcutil.ForwardedHeaders {
+			if value, ok := value.(string); ok && http.CanonicalHeaderKey(key) == header {
+				s.md.Set(header, value)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.acknowledged = true
+	s.mu.Unlock()
+	s.write(&wsMessage{Type: messageConnectionAck})
+	return nil
+}
+
+func (s *wsSession) subscribe(msg *wsMessage) error {
+	s.mu.Lock()
+	if !s.acknowledged {
+		s.mu.Unlock()
+		return s.conn.Close(closeUnauthorized, "Unauthorized")
+	}
+	if _, ok := s.operations[msg.ID]; ok || msg.ID == "" {
+		s.mu.Unlock()
+		return s.conn.Close(closeSubscriberExists, "Subscriber for "+msg.ID+" already exists")
+	}
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(s.ctx, s.md))
+	op := &operation{cancel: cancel}
+	s.operations[msg.ID] = op
+	s.mu.Unlock()
+
+	var req request
+	if err := json.Unmarshal(msg.Payload, &req); err != nil || req.Query == "" {
+		cancel()
+		return s.conn.Close(closeBadRequest, "Invalid subscribe payload")
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer cancel()
+		if errs := s.execute(ctx, msg.ID, req); errs != nil {
+			payload, _ := json.Marshal(errs)
+			s.finish(msg.ID, op, &wsMessage{ID: msg.ID, Type: messageError, Payload: payload})
+		} else {
+			s.finish(msg.ID, op, &wsMessage{ID: msg.ID, Type: messageComplete})
+		}
+	}()
+	return nil
+}
+
+// execute sends the results of an operation as next messages, or returns the errors of invalid operations.
+func (s *wsSession) execute(ctx context.Context, id string, req request) []gqlerrors.FormattedError {
+	operation, err := operationType(req)
+	if err != nil {
+		return gqlerrors.FormatErrors(err)
+	}
+	if operation != ast.OperationTypeSubscription {
+		s.next(id, s.h.do(ctx, req))
+		return nil
+	}
+
+	results := graphql.Subscribe(graphql.Params{
+		Schema:         s.h.schema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        ctx,
+	})
+	first := true
+	for result := range results {
+		if first && result.Data == nil && result.HasErrors() {
+			// the subscription was not started, e.g. because of validation errors
+			for range results {
+			}
+			return result.Errors
+		}
+		first = false
+		s.next(id, result)
+	}
+	return nil
+}
+
+func (s *wsSession) next(id string, result *graphql.Result) {
+	payload, err := json.Marshal(result)
+	if err != nil {
+		payload, _ = json.Marshal(errorResult(err))
+	}
+	s.write(&wsMessage{ID: id, Type: messageNext, Payload: payload})
+}
+
+// finish sends the last message of an operation, unless the client has completed it.
+func (s *wsSession) finish(id string, op *operation, msg *wsMessage) {
+	s.mu.Lock()
+	ok := s.operations[id] == op
+	if ok {
+		delete(s.operations, id)
+	}
+	s.mu.Unlock()
+	if ok {
+		s.write(msg)
+	}
+}
+
+func (s *wsSession) write(msg *wsMessage) {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.conn.Write(s.ctx, websocket.MessageText, buf)
+}
@@ -0,0 +1,205 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	grpc_health "google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	HealthzPath = "/healthz"
+	ReadyzPath  = "/readyz"
+	LivezPath   = "/livez"
+
+	// Timeout of all checks of a probe.
+	checkTimeout = 5 * time.Second
+)
+
+var (
+	errStarting = errors.New("server is starting")
+	errDraining = errors.New("server is draining")
+)
+
+// Check returns an error if the server is unhealthy.
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Result of a single check.
+type Result struct {
+	Name string
+	Err  error
+}
+
+// Health holds the lifecycle of the server and its readiness checks.
+// It is the source of truth of grpc.health.v1.Health, grpc_example.v1.Health and the HTTP probes.
+// Servers are not ready until SetServing is called, and are not ready again after Drain is called.
+type Health struct {
+	grpcServer *grpc_health.Server
+
+	mu       sync.RWMutex
+	started  bool
+	draining bool
+	checks   []namedCheck
+}
+
+func New() *Health {
+	grpcServer := grpc_health.NewServer()
+	grpcServer.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	return &Health{grpcServer: grpcServer}
+}
+
+// GrpcServer returns the grpc.health.v1.Health server whose overall status follows the lifecycle.
+func (h *Health) GrpcServer() grpc_health_v1.HealthServer {
+	return h.grpcServer
+}
+
+// AddCheck adds a readiness check.
+func (h *Health) AddCheck(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, namedCheck{name: name, check: check})
+}
+
+// SetServing marks the end of startup.
+func (h *Health) SetServing() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.draining {
+		return
+	}
+	h.started = true
+	h.grpcServer.SetServingStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
+}
+
+// Drain marks the server as not ready, so that load balancers stop sending new requests before shutdown.
+func (h *Health) Drain() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.draining = true
+	h.grpcServer.Shutdown()
+}
+
+// Readiness runs the lifecycle and readiness checks.
+func (h *Health) Readiness(ctx context.Context) []Result {
+	h.mu.RLock()
+	var lifecycleErr error
+	if h.draining {
+		lifecycleErr = errDraining
+	} else if !h.started {
+		lifecycleErr = errStarting
+	}
+	checks := append([]namedCheck(nil), h.checks...)
+	h.mu.RUnlock()
+
+	results := []Result{{Name: "lifecycle", Err: lifecycleErr}}
+	for _, c := range checks {
+		results = append(results, Result{Name: c.name, Err: c.check(ctx)})
+	}
+	return results
+}
+
+// Liveness only reports whether the process can serve requests, so it does not fail during startup and drain.
+func (h *Health) Liveness(ctx context.Context) []Result {
+	return []Result{{Name: "ping"}}
+}
+
+// IsReady reports whether all readiness checks pass.
+func (h *Health) IsReady(ctx context.Context) bool {
+	return passed(h.Readiness(ctx))
+}
+
+// Handler serves /healthz and /readyz with the readiness checks, /livez with the liveness checks,
+// and lets other requests through. Add the ?verbose query parameter to list the result of each check.
+func (h *Health) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case HealthzPath, ReadyzPath:
+			serveProbe(w, r, strings.TrimPrefix(r.URL.Path, "/"), h.Readiness)
+		case LivezPath:
+			serveProbe(w, r, strings.TrimPrefix(r.URL.Path, "/"), h.Liveness)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func serveProbe(w http.ResponseWriter, r *http.Request, name string, probe func(context.Context) []Result) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+	results := probe(ctx)
+	ok := passed(results)
+
+	var body strings.Builder
+	if _, verbose := r.URL.Query()["verbose"]; verbose {
+		for _, result := range results {
+			if result.Err == nil {
+				fmt.Fprintf(&body, "[+]%s ok\n", result.Name)
+			} else {
+				fmt.Fprintf(&body, "[-]%s failed: %v\n", result.Name, result.Err)
+			}
+		}
+		if ok {
+			fmt.Fprintf(&body, "%s check passed\n", name)
+		} else {
+			fmt.Fprintf(&body, "%s check failed\n", name)
+		}
+	} else if ok {
+		body.WriteString("ok\n")
+	} else {
+		body.WriteString("failed\n")
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if r.Method != http.MethodHead {
+		w.Write([]byte(body.String()))
+	}
+}
+
+func passed(results []Result) bool {
+	for _, result := range results {
+		if result.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// ClientConnCheck fails if the connection to upstream servers is in transient failure or shut down.
+func ClientConnCheck(conn *grpc.ClientConn) Check {
+	return func(ctx context.Context) error {
+		switch state := conn.GetState(); state {
+		case connectivity.TransientFailure, connectivity.Shutdown:
+			return fmt.Errorf("connection is %v", state)
+		case connectivity.Idle:
+			// start connecting, so that later probes report failures of idle connections
+			conn.Connect()
+		}
+		return nil
+	}
+}
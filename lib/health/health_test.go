@@ -0,0 +1,94 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func serve(h *Health, method string, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.Handler(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	return rec
+}
+
+func grpcStatus(t *testing.T, h *Health) grpc_health_v1.HealthCheckResponse_ServingStatus {
+	resp, err := h.GrpcServer().Check(context.TODO(), &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return resp.GetStatus()
+}
+
+func TestHealth_lifecycle(t *testing.T) {
+	tests := []struct {
+		name       string
+		setup      func(h *Health)
+		wantReady  int
+		wantGrpc   grpc_health_v1.HealthCheckResponse_ServingStatus
+		wantReason string
+	}{
+		{"starting", func(h *Health) {}, http.StatusServiceUnavailable, grpc_health_v1.HealthCheckResponse_NOT_SERVING, errStarting.Error()},
+		{"serving", func(h *Health) { h.SetServing() }, http.StatusOK, grpc_health_v1.HealthCheckResponse_SERVING, ""},
+		{"draining", func(h *Health) { h.SetServing(); h.Drain() }, http.StatusServiceUnavailable, grpc_health_v1.HealthCheckResponse_NOT_SERVING, errDraining.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New()
+			tt.setup(h)
+
+			for _, path := range []string{HealthzPath, ReadyzPath} {
+				if rec := serve(h, http.MethodGet, path+"?verbose"); rec.Code != tt.wantReady {
+					t.Errorf("%v code %v; want %v", path, rec.Code, tt.wantReady)
+				} else if !strings.Contains(rec.Body.String(), tt.wantReason) {
+					t.Errorf("%v body %q; want %q", path, rec.Body.String(), tt.wantReason)
+				}
+			}
+			if rec := serve(h, http.MethodGet, LivezPath); rec.Code != http.StatusOK {
+				t.Errorf("%v code %v; want %v", LivezPath, rec.Code, http.StatusOK)
+			}
+			if got := grpcStatus(t, h); got != tt.wantGrpc {
+				t.Errorf("grpc status %v; want %v", got, tt.wantGrpc)
+			}
+		})
+	}
+}
+
+func TestHealth_failedCheck(t *testing.T) {
+	h := New()
+	h.SetServing()
+	h.AddCheck("database", func(ctx context.Context) error { return errors.New("unreachable") })
+
+	rec := serve(h, http.MethodGet, ReadyzPath+"?verbose")
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("code %v; want %v", rec.Code, http.StatusServiceUnavailable)
+	}
+	want := "[+]lifecycle ok\n[-]database failed: unreachable\nreadyz check failed\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("body %q; want %q", got, want)
+	}
+	if h.IsReady(context.TODO()) {
+		t.Errorf("ready true; want false")
+	}
+}
+
+func TestHealth_Handler(t *testing.T) {
+	h := New()
+	h.SetServing()
+
+	if rec := serve(h, http.MethodGet, ReadyzPath); rec.Body.String() != "ok\n" {
+		t.Errorf("body %q; want %q", rec.Body.String(), "ok\n")
+	}
+	if rec := serve(h, http.MethodPost, ReadyzPath); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("code %v; want %v", rec.Code, http.StatusMethodNotAllowed)
+	}
+	if rec := serve(h, http.MethodGet, "/other"); rec.Code != http.StatusNotFound {
+		t.Errorf("code %v; want %v", rec.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,26 @@
+// Package reload runs periodic reloads of state loaded from files or URLs, e.g. policies and keys.
+package reload
+
+import (
+	"context"
+	"time"
+
+	"github.com/zmzhang8/grpc_example/lib/log"
+)
+
+// Every calls reload every interval until ctx is done. Failed reloads are logged as warnings with msg,
+// and are expected to keep the current state.
+func Every(ctx context.Context, interval time.Duration, logger log.Logger, msg string, reload func(ctx context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := reload(ctx); err != nil && ctx.Err() == nil {
+				logger.Warnw(msg, "error", err)
+			}
+		}
+	}
+}
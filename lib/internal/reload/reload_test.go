@@ -0,0 +1,38 @@
+package reload
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/zmzhang8/grpc_example/lib/log"
+)
+
+func TestEvery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	logger := log.NewLogger(log.NewCore(false, os.Stdout, false))
+	calls := 0
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		Every(ctx, time.Millisecond, logger, "Failed to reload", func(ctx context.Context) error {
+			calls++
+			if calls == 3 {
+				cancel()
+			}
+			return errors.New("failed")
+		})
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("returned false after cancel; want true")
+	}
+	if calls != 3 {
+		t.Errorf("calls %v; want 3", calls)
+	}
+}
@@ -0,0 +1,42 @@
+// Package rpcutil has helpers of the handlers which call gRPC methods from descriptors, e.g. JSON-RPC and GraphQL.
+package rpcutil
+
+import (
+	"net/http"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/zmzhang8/grpc_example/lib/clientip"
+)
+
+// Headers forwarded as gRPC metadata.
+var ForwardedHeaders = []string{"Authorization", "X-Api-Key", "X-Request-Id"}
+
+// MethodPath returns the gRPC path of a method, e.g. /grpc_example.v1.Greeter/SayHello.
+func MethodPath(method protoreflect.MethodDescriptor) string {
+	return "/" + string(method.Parent().FullName()) + "/" + string(method.Name())
+}
+
+// NewMessage uses generated message types if they are linked, and dynamic messages otherwise.
+func NewMessage(desc protoreflect.MessageDescriptor) proto.Message {
+	if messageType, err := protoregistry.GlobalTypes.FindMessageByName(desc.FullName()); err == nil {
+		return messageType.New().Interface()
+	}
+	return dynamicpb.NewMessage(desc)
+}
+
+// RequestMetadata returns the forwarded headers and the client address of a request as gRPC metadata.
+func RequestMetadata(r *http.Request) metadata.MD {
+	md := metadata.MD{}
+	for _, key := range ForwardedHeaders {
+		if values := r.Header.Values(key); len(values) > 0 {
+			md.Append(key, values...)
+		}
+	}
+	clientip.SetMetadata(md, r)
+	return md
+}
@@ -0,0 +1,340 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/zmzhang8/grpc_example/lib/internal/rpcutil"
+)
+
+// https://www.jsonrpc.org/specification
+const (
+	version = "2.0"
+
+	ParseError     = -32700
+	InvalidRequest = -32600
+	MethodNotFound = -32601
+	InvalidParams  = -32602
+	InternalError  = -32603
+	// Errors returned by gRPC methods, whose data is the google.rpc.Status of the error.
+	ServerError = -32000
+
+	// Same as the default maximum size of messages received by gRPC servers.
+	maxRequestSize = 4 << 20
+	// Defaults of Options, which bound the work of a single request, e.g. password hashes of Account.Login calls.
+	defaultMaxBatchSize  = 100
+	defaultMaxBatchCalls = 4
+)
+
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	// nil for notifications, which have no response
+	ID json.RawMessage `json:"id,omitempty"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type notification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type Error struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func newError(code int, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// newStatusError maps errors of gRPC calls, keeping the status in the error data.
+func newStatusError(err error) *Error {
+	st := status.Convert(err)
+	code := ServerError
+	switch st.Code() {
+	case codes.InvalidArgument:
+		code = InvalidParams
+	case codes.Unimplemented:
+		code = MethodNotFound
+	}
+	e := newError(code, st.Message())
+	if e.Message == "" {
+		e.Message = st.Code().String()
+	}
+	if data, err := protojson.Marshal(st.Proto()); err == nil {
+		e.Data = data
+	} else {
+		// the details contain unknown types
+		e.Data, _ = protojson.Marshal(&spb.Status{Code: int32(st.Code()), Message: st.Message()})
+	}
+	return e
+}
+
+func (r *request) isNotification() bool {
+	return r.ID == nil
+}
+
+func (r *request) validate() *Error {
+	if r.JSONRPC != version || r.Method == "" {
+		return newError(InvalidRequest, "Invalid Request")
+	}
+	if r.ID != nil {
+		switch r.ID[0] {
+		case '"', 'n', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		default:
+			return newError(InvalidRequest, "id must be a string, number or null")
+		}
+	}
+	return nil
+}
+
+func newResponse(id json.RawMessage, result json.RawMessage, err *Error) *response {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	if err == nil && result == nil {
+		result = json.RawMessage("null")
+	}
+	return &response{JSONRPC: version, Result: result, Error: err, ID: id}
+}
+
+// Options of Handler.
+type Options struct {
+	// Reports whether the origin of a websocket handshake is allowed.
+	// Nil allows only the origin of the server.
+	WebsocketOriginFunc func(r *http.Request) bool
+	// Maximum size of websocket messages. Zero means the default of 4 MiB.
+	WebsocketReadLimit int64
+	// Maximum number of requests of a batch. Zero means the default of 100.
+	MaxBatchSize int
+	// Maximum number of concurrent calls of a batch. Zero means the default of 4.
+	MaxBatchCalls int
+}
+
+// Handler serves JSON-RPC 2.0 by calling the methods of services over a gRPC connection,
+// e.g. to an in-process server, so that calls run through the interceptors of the server.
+// Method names are the full names of methods, e.g. grpc_example.v1.Greeter.SayHello,
+// and params are request messages in the protobuf JSON format.
+//
+// POST requests support single and batch calls of unary methods.
+// Websocket connections also support streaming methods, see websocket.go.
+// The Authorization, X-Api-Key and X-Request-Id headers are forwarded as metadata.
+type Handler struct {
+	conn    grpc.ClientConnInterface
+	opts    Options
+	methods map[string]protoreflect.MethodDescriptor
+}
+
+func NewHandler(conn grpc.ClientConnInterface, services []protoreflect.ServiceDescriptor, opts Options) *Handler {
+	if opts.WebsocketReadLimit == 0 {
+		opts.WebsocketReadLimit = maxRequestSize
+	}
+	if opts.MaxBatchSize == 0 {
+		opts.MaxBatchSize = defaultMaxBatchSize
+	}
+	if opts.MaxBatchCalls == 0 {
+		opts.MaxBatchCalls = defaultMaxBatchCalls
+	}
+	h := &Handler{conn: conn, opts: opts, methods: make(map[string]protoreflect.MethodDescriptor)}
+	for _, service := range services {
+		methods := service.Methods()
+		for i := 0; i < methods.Len(); i++ {
+			h.methods[string(methods.Get(i).FullName())] = methods.Get(i)
+		}
+	}
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		h.serveWebsocket(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize+1))
+	if err != nil {
+		writeJSON(w, newResponse(nil, nil, newError(ParseError, "Parse error")))
+		return
+	}
+	if len(body) > maxRequestSize {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	ctx := metadata.NewOutgoingContext(r.Context(), rpcutil.RequestMetadata(r))
+
+	requests, batch, errResp := parseRequests(body, h.opts.MaxBatchSize)
+	if errResp != nil {
+		writeJSON(w, errResp)
+		return
+	}
+	responses := h.callAll(ctx, requests, rejectStream)
+	if len(responses) == 0 {
+		// only notifications
+		w.WriteHeader(http.StatusNoContent)
+	} else if batch {
+		writeJSON(w, responses)
+	} else {
+		writeJSON(w, responses[0])
+	}
+}
+
+// parseRequests splits a single request or a batch of at most maxBatchSize requests, which are decoded
+// by callAll so that errors of invalid requests are returned in order.
+func parseRequests(body []byte, maxBatchSize int) ([]json.RawMessage, bool, *response) {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var requests []json.RawMessage
+		if err := json.Unmarshal(body, &requests); err != nil {
+			return nil, true, newResponse(nil, nil, newError(ParseError, "Parse error"))
+		}
+		if len(requests) == 0 {
+			return nil, true, newResponse(nil, nil, newError(InvalidRequest, "empty batch"))
+		}
+		if len(requests) > maxBatchSize {
+			return nil, true, newResponse(nil, nil, newError(InvalidRequest, fmt.Sprintf("batch has more than %d requests", maxBatchSize)))
+		}
+		return requests, true, nil
+	}
+	if !json.Valid(body) {
+		return nil, false, newResponse(nil, nil, newError(ParseError, "Parse error"))
+	}
+	return []json.RawMessage{body}, false, nil
+}
+
+// callAll calls unary methods with at most MaxBatchCalls concurrent calls, and returns their responses in the order
+// of the requests without the responses of notifications. Streaming methods are handled by the stream function.
+func (h *Handler) callAll(
+	ctx context.Context,
+	requests []json.RawMessage,
+	stream func(*request, protoreflect.MethodDescriptor) *response,
+) []*response {
+	responses := make([]*response, len(requests))
+	calls := make(chan struct{}, h.opts.MaxBatchCalls)
+	var wg sync.WaitGroup
+	for i, raw := range requests {
+		req, errResp := decodeRequest(raw)
+		if errResp != nil {
+			responses[i] = errResp
+			continue
+		}
+		method, ok := h.methods[req.Method]
+		if !ok {
+			if !req.isNotification() {
+				responses[i] = newResponse(req.ID, nil, newError(MethodNotFound, "Method not found"))
+			}
+			continue
+		}
+		if method.IsStreamingClient() || method.IsStreamingServer() {
+			responses[i] = stream(req, method)
+			continue
+		}
+
+		wg.Add(1)
+		calls <- struct{}{}
+		go func(i int, req *request) {
+			defer func() {
+				<-calls
+				wg.Done()
+			}()
+			resp := h.callUnary(ctx, req, method)
+			if !req.isNotification() {
+				responses[i] = resp
+			}
+		}(i, req)
+	}
+	wg.Wait()
+
+	var results []*response
+	for _, resp := range responses {
+		if resp != nil {
+			results = append(results, resp)
+		}
+	}
+	return results
+}
+
+func decodeRequest(raw json.RawMessage) (*request, *response) {
+	var req request
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return nil, newResponse(nil, nil, newError(InvalidRequest, "Invalid Request"))
+	}
+	if err := req.validate(); err != nil {
+		return nil, newResponse(req.ID, nil, err)
+	}
+	return &req, nil
+}
+
+// rejectStream is the stream function of calls which cannot start streams, i.e. over HTTP or in batches.
+func rejectStream(req *request, method protoreflect.MethodDescriptor) *response {
+	if req.isNotification() {
+		return nil
+	}
+	return newResponse(req.ID, nil, newError(InvalidRequest, "streaming methods require a single request over a websocket connection"))
+}
+
+func (h *Handler) callUnary(ctx context.Context, req *request, method protoreflect.MethodDescriptor) *response {
+	in := rpcutil.NewMessage(method.Input())
+	if err := unmarshalParams(req.Params, in); err != nil {
+		return newResponse(req.ID, nil, err)
+	}
+	out := rpcutil.NewMessage(method.Output())
+	if err := h.conn.Invoke(ctx, rpcutil.MethodPath(method), in, out); err != nil {
+		return newResponse(req.ID, nil, newStatusError(err))
+	}
+	result, err := protojson.Marshal(out)
+	if err != nil {
+		return newResponse(req.ID, nil, newError(InternalError, err.Error()))
+	}
+	return newResponse(req.ID, result, nil)
+}
+
+// unmarshalParams accepts a message in the protobuf JSON format. Missing params are an empty message.
+func unmarshalParams(params json.RawMessage, msg proto.Message) *Error {
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+	if err := protojson.Unmarshal(params, msg); err != nil {
+		return newError(InvalidParams, "Invalid params: "+err.Error())
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
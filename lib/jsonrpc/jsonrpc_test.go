@@ -0,0 +1,375 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"nhooyr.io/websocket"
+
+	pb "github.com/zmzhang8/grpc_example/proto/v1"
+)
+
+type greeterServerMock struct {
+	pb.UnimplementedGreeterServer
+}
+
+func (s *greeterServerMock) SayHello(ctx context.Context, in *pb.HelloRequest) (*pb.HelloReply, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if in.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "name is required")
+	}
+	if in.Name == "auth" {
+		return &pb.HelloReply{Message: strings.Join(md.Get("authorization"), ",")}, nil
+	}
+	return &pb.HelloReply{Message: "Hello " + in.Name}, nil
+}
+
+type routeGuideServerMock struct {
+	pb.UnimplementedRouteGuideServer
+}
+
+func (s *routeGuideServerMock) ListFeatures(rect *pb.Rectangle, stream pb.RouteGuide_ListFeaturesServer) error {
+	for _, name := range []string{"a", "b"} {
+		if err := stream.Send(&pb.Feature{Name: name, Location: rect.Lo}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *routeGuideServerMock) RecordRoute(stream pb.RouteGuide_RecordRouteServer) error {
+	var count int32
+	for {
+		_, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(&pb.RouteSummary{PointCount: count})
+		}
+		if err != nil {
+			return err
+		}
+		count++
+	}
+}
+
+func (s *routeGuideServerMock) RouteChat(stream pb.RouteGuide_RouteChatServer) error {
+	for {
+		note, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(note); err != nil {
+			return err
+		}
+	}
+}
+
+func newTestHandler(t *testing.T) *Handler {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	pb.RegisterGreeterServer(server, &greeterServerMock{})
+	pb.RegisterRouteGuideServer(server, &routeGuideServerMock{})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	services := []protoreflect.ServiceDescriptor{
+		pb.File_grpc_example_v1_greeter_proto.Services().Get(0),
+		pb.File_grpc_example_v1_route_guide_proto.Services().Get(0),
+	}
+	return NewHandler(conn, services, Options{})
+}
+
+func post(t *testing.T, h http.Handler, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/jsonrpc", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer token")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+type testResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result"`
+	Error   *Error          `json:"error"`
+	ID      json.RawMessage `json:"id"`
+	// set by notifications
+	Method string        `json:"method"`
+	Params *streamParams `json:"params"`
+}
+
+func TestHandler_unary(t *testing.T) {
+	h := newTestHandler(t)
+	rec := post(t, h, `{"jsonrpc":"2.0","method":"grpc_example.v1.Greeter.SayHello","params":{"name":"world"},"id":1}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d; want %d", rec.Code, http.StatusOK)
+	}
+	var resp testResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if resp.JSONRPC != "2.0" || string(resp.ID) != "1" || resp.Error != nil || string(resp.Result) != `{"message":"Hello world"}` {
+		t.Errorf("response %s; want result {\"message\":\"Hello world\"} with id 1", rec.Body.String())
+	}
+}
+
+func TestHandler_metadata(t *testing.T) {
+	h := newTestHandler(t)
+	rec := post(t, h, `{"jsonrpc":"2.0","method":"grpc_example.v1.Greeter.SayHello","params":{"name":"auth"},"id":"a"}`)
+	var resp testResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if string(resp.Result) != `{"message":"Bearer token"}` {
+		t.Errorf("result %s; want {\"message\":\"Bearer token\"}", resp.Result)
+	}
+}
+
+func TestHandler_errors(t *testing.T) {
+	h := newTestHandler(t)
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{"jsonrpc":"2.0","method":"grpc_example.v1.Greeter.SayHello","params":{},"id":1}`, InvalidParams},
+		{`{"jsonrpc":"2.0","method":"grpc_example.v1.Greeter.SayHello","params":{"unknown":1},"id":1}`, InvalidParams},
+		{`{"jsonrpc":"2.0","method":"grpc_example.v1.Greeter.SayGoodbye","id":1}`, MethodNotFound},
+		{`{"jsonrpc":"2.0","method":"grpc_example.v1.RouteGuide.ListFeatures","params":{},"id":1}`, InvalidRequest},
+		{`{"jsonrpc":"1.0","method":"grpc_example.v1.Greeter.SayHello","id":1}`, InvalidRequest},
+		{`{"jsonrpc":"2.0","method":"grpc_example.v1.Greeter.SayHello","id":{}}`, InvalidRequest},
+		{`[]`, InvalidRequest},
+		{`{"jsonrpc":`, ParseError},
+	}
+	for _, test := range tests {
+		rec := post(t, h, test.body)
+		var resp testResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: err %v; want <nil>", test.body, err)
+		}
+		if resp.Error == nil || resp.Error.Code != test.code {
+			t.Errorf("%s: response %s; want error code %d", test.body, rec.Body.String(), test.code)
+		}
+	}
+}
+
+func TestHandler_statusData(t *testing.T) {
+	h := newTestHandler(t)
+	rec := post(t, h, `{"jsonrpc":"2.0","method":"grpc_example.v1.Greeter.SayHello","params":{},"id":1}`)
+	var resp testResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if resp.Error == nil || string(resp.Error.Data) != `{"code":3,"message":"name is required"}` {
+		t.Errorf("response %s; want the status in the error data", rec.Body.String())
+	}
+}
+
+func TestHandler_batch(t *testing.T) {
+	h := newTestHandler(t)
+	rec := post(t, h, `[
+		{"jsonrpc":"2.0","method":"grpc_example.v1.Greeter.SayHello","params":{"name":"a"},"id":1},
+		{"jsonrpc":"2.0","method":"grpc_example.v1.Greeter.SayHello","params":{"name":"b"}},
+		1,
+		{"jsonrpc":"2.0","method":"grpc_example.v1.Greeter.SayHello","params":{"name":"c"},"id":2}
+	]`)
+	var responses []testResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &responses); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if len(responses) != 3 {
+		t.Fatalf("responses %s; want 3 responses", rec.Body.String())
+	}
+	if string(responses[0].ID) != "1" || string(responses[0].Result) != `{"message":"Hello a"}` {
+		t.Errorf("response %+v; want Hello a with id 1", responses[0])
+	}
+	if responses[1].Error == nil || responses[1].Error.Code != InvalidRequest || string(responses[1].ID) != "null" {
+		t.Errorf("response %+v; want invalid request with id null", responses[1])
+	}
+	if string(responses[2].ID) != "2" || string(responses[2].Result) != `{"message":"Hello c"}` {
+		t.Errorf("response %+v; want Hello c with id 2", responses[2])
+	}
+}
+
+func TestHandler_batchSize(t *testing.T) {
+	h := newTestHandler(t)
+	call := `{"jsonrpc":"2.0","method":"grpc_example.v1.Greeter.SayHello","params":{"name":"a"},"id":1}`
+
+	rec := post(t, h, "["+strings.Repeat(call+",", defaultMaxBatchSize)+call+"]")
+
+	var resp testResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if resp.Error == nil || resp.Error.Code != InvalidRequest {
+		t.Errorf("response %s; want invalid request", rec.Body.String())
+	}
+}
+
+func TestHandler_notifications(t *testing.T) {
+	h := newTestHandler(t)
+	rec := post(t, h, `[{"jsonrpc":"2.0","method":"grpc_example.v1.Greeter.SayHello","params":{"name":"a"}}]`)
+	if rec.Code != http.StatusNoContent || rec.Body.Len() != 0 {
+		t.Errorf("status %d, body %q; want %d without body", rec.Code, rec.Body.String(), http.StatusNoContent)
+	}
+}
+
+func TestHandler_method(t *testing.T) {
+	h := newTestHandler(t)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jsonrpc", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status %d; want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+// websocketClient sends requests and reads responses of a websocket connection.
+type websocketClient struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+func dialWebsocket(t *testing.T, h http.Handler) *websocketClient {
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	t.Cleanup(func() { conn.Close(websocket.StatusNormalClosure, "") })
+	return &websocketClient{t: t, conn: conn}
+}
+
+func (c *websocketClient) send(request string) {
+	if err := c.conn.Write(context.Background(), websocket.MessageText, []byte(request)); err != nil {
+		c.t.Fatalf("err %v; want <nil>", err)
+	}
+}
+
+func (c *websocketClient) recv() testResponse {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, data, err := c.conn.Read(ctx)
+	if err != nil {
+		c.t.Fatalf("err %v; want <nil>", err)
+	}
+	var resp testResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		c.t.Fatalf("message %s: err %v; want <nil>", data, err)
+	}
+	return resp
+}
+
+func TestWebsocket_unary(t *testing.T) {
+	c := dialWebsocket(t, newTestHandler(t))
+	c.send(`{"jsonrpc":"2.0","method":"grpc_example.v1.Greeter.SayHello","params":{"name":"world"},"id":1}`)
+	if resp := c.recv(); string(resp.ID) != "1" || string(resp.Result) != `{"message":"Hello world"}` {
+		t.Errorf("response %+v; want Hello world with id 1", resp)
+	}
+}
+
+func TestWebsocket_serverStream(t *testing.T) {
+	c := dialWebsocket(t, newTestHandler(t))
+	c.send(`{"jsonrpc":"2.0","method":"grpc_example.v1.RouteGuide.ListFeatures","params":{"lo":{"latitude":1}},"id":"s"}`)
+	for _, name := range []string{"a", "b"} {
+		resp := c.recv()
+		want := `{"name":"` + name + `","location":{"latitude":1}}`
+		if resp.Method != StreamMessageMethod || resp.Params == nil || string(resp.Params.ID) != `"s"` || string(resp.Params.Message) != want {
+			t.Fatalf("notification %+v; want %s of stream \"s\"", resp, want)
+		}
+	}
+	if resp := c.recv(); string(resp.ID) != `"s"` || resp.Error != nil || string(resp.Result) != "null" {
+		t.Errorf("response %+v; want null result of stream \"s\"", resp)
+	}
+}
+
+func TestWebsocket_clientStream(t *testing.T) {
+	c := dialWebsocket(t, newTestHandler(t))
+	c.send(`{"jsonrpc":"2.0","method":"grpc_example.v1.RouteGuide.RecordRoute","params":{"latitude":1},"id":1}`)
+	c.send(`{"jsonrpc":"2.0","method":"stream.send","params":{"id":1,"message":{"latitude":2}}}`)
+	c.send(`{"jsonrpc":"2.0","method":"stream.close","params":{"id":1},"id":2}`)
+	if resp := c.recv(); string(resp.ID) != "2" || resp.Error != nil {
+		t.Fatalf("response %+v; want null result of stream.close", resp)
+	}
+	if resp := c.recv(); string(resp.ID) != "1" || string(resp.Result) != `{"pointCount":2}` {
+		t.Errorf("response %+v; want {\"pointCount\":2}", resp)
+	}
+}
+
+func TestWebsocket_bidiStream(t *testing.T) {
+	c := dialWebsocket(t, newTestHandler(t))
+	c.send(`{"jsonrpc":"2.0","method":"grpc_example.v1.RouteGuide.RouteChat","id":1}`)
+	c.send(`{"jsonrpc":"2.0","method":"stream.send","params":{"id":1,"message":{"message":"hi"}}}`)
+	if resp := c.recv(); resp.Method != StreamMessageMethod || string(resp.Params.Message) != `{"message":"hi"}` {
+		t.Fatalf("notification %+v; want {\"message\":\"hi\"}", resp)
+	}
+	c.send(`{"jsonrpc":"2.0","method":"stream.cancel","params":{"id":1}}`)
+	resp := c.recv()
+	if string(resp.ID) != "1" || resp.Error == nil || resp.Error.Code != ServerError {
+		t.Fatalf("response %+v; want error %d", resp, ServerError)
+	}
+	var st struct {
+		Code int `json:"code"`
+	}
+	if json.Unmarshal(resp.Error.Data, &st); st.Code != int(codes.Canceled) {
+		t.Errorf("status %s; want code %d", resp.Error.Data, codes.Canceled)
+	}
+}
+
+func TestWebsocket_streamErrors(t *testing.T) {
+	c := dialWebsocket(t, newTestHandler(t))
+	c.send(`{"jsonrpc":"2.0","method":"stream.send","params":{"id":1,"message":{}},"id":1}`)
+	if resp := c.recv(); resp.Error == nil || resp.Error.Code != InvalidParams {
+		t.Errorf("response %+v; want error %d of unknown streams", resp, InvalidParams)
+	}
+	c.send(`[{"jsonrpc":"2.0","method":"grpc_example.v1.RouteGuide.RouteChat","id":2}]`)
+	var responses []testResponse
+	_, data, _ := c.conn.Read(context.Background())
+	if json.Unmarshal(data, &responses); len(responses) != 1 || responses[0].Error == nil || responses[0].Error.Code != InvalidRequest {
+		t.Errorf("responses %s; want error %d of streams in batches", data, InvalidRequest)
+	}
+}
+
+func TestWebsocket_origin(t *testing.T) {
+	h := newTestHandler(t)
+	h.opts.WebsocketOriginFunc = func(r *http.Request) bool { return r.Header.Get("Origin") == "https://allowed.com" }
+	server := httptest.NewServer(h)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	for origin, ok := range map[string]bool{"https://allowed.com": true, "https://denied.com": false} {
+		header := http.Header{"Origin": {origin}}
+		conn, resp, err := websocket.Dial(context.Background(), url, &websocket.DialOptions{HTTPHeader: header})
+		if ok && err != nil {
+			t.Errorf("origin %s: err %v; want <nil>", origin, err)
+		}
+		if !ok && (err == nil || resp.StatusCode != http.StatusForbidden) {
+			t.Errorf("origin %s: err %v; want status %d", origin, err, http.StatusForbidden)
+		}
+		if conn != nil {
+			conn.Close(websocket.StatusNormalClosure, "")
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"nhooyr.io/websocket"
+
+	"github.com/zmzhang8/grpc_example/lib/internal/rpcutil"
+)
+
+// Methods of websocket connections which control streams. Their params are streamParams.
+const (
+	// Sends a message to a client or bidirectional stream.
+	StreamSendMethod = "stream.send"
+	// Closes the sending side of a client or bidirectional stream.
+	StreamCloseMethod = "stream.close"
+	// Cancels a stream.
+	StreamCancelMethod = "stream.cancel"
+	// Notification of a message of a server or bidirectional stream.
+	StreamMessageMethod = "stream.message"
+)
+
+// streamParams identifies a stream by the id of the request which started it.
+type streamParams struct {
+	ID      json.RawMessage `json:"id"`
+	Message json.RawMessage `json:"message,omitempty"`
+}
+
+// stream is a streaming call started by a request of a websocket connection.
+type stream struct {
+	method protoreflect.MethodDescriptor
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Messages to send, which is closed by stream.close. Both are only used by the read loop.
+	send   chan proto.Message
+	closed bool
+}
+
+// wsSession serves the requests of a websocket connection. Each text message is a request
+// or a batch of requests, and responses are sent as text messages in any order.
+//
+// A single request of a streaming method starts a stream identified by the id of the request.
+// Params of the request are the first message of the stream, and may be omitted for client and
+// bidirectional streams. Messages of server and bidirectional streams are sent as stream.message
+// notifications, and the stream ends with the response of the request, whose result is null,
+// or the response message of client streams.
+type wsSession struct {
+	h    *Handler
+	conn *websocket.Conn
+	// Canceled when the connection is closed.
+	ctx context.Context
+	wg  sync.WaitGroup
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[string]*stream
+}
+
+func (h *Handler) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	acceptOpts := &websocket.AcceptOptions{}
+	if h.opts.WebsocketOriginFunc != nil {
+		if !h.opts.WebsocketOriginFunc(r) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		acceptOpts.InsecureSkipVerify = true
+	}
+	conn, err := websocket.Accept(w, r, acceptOpts)
+	if err != nil {
+		return // Accept has responded
+	}
+	conn.SetReadLimit(h.opts.WebsocketReadLimit)
+
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(r.Context(), rpcutil.RequestMetadata(r)))
+	s := &wsSession{h: h, conn: conn, ctx: ctx, streams: make(map[string]*stream)}
+	err = s.readLoop()
+	cancel()
+	s.wg.Wait()
+	if websocket.CloseStatus(err) == -1 {
+		conn.Close(websocket.StatusInternalError, "")
+	}
+}
+
+func (s *wsSession) readLoop() error {
+	for {
+		messageType, data, err := s.conn.Read(s.ctx)
+		if err != nil {
+			return err
+		}
+		if messageType != websocket.MessageText {
+			return s.conn.Close(websocket.StatusUnsupportedData, "requests must be text messages")
+		}
+		s.handleMessage(data)
+	}
+}
+
+// handleMessage starts and controls streams in the order of messages, and calls unary methods concurrently.
+func (s *wsSession) handleMessage(data []byte) {
+	requests, batch, errResp := parseRequests(data, s.h.opts.MaxBatchSize)
+	if errResp != nil {
+		s.write(errResp)
+		return
+	}
+	if !batch {
+		req, errResp := decodeRequest(requests[0])
+		if errResp != nil {
+			s.write(errResp)
+			return
+		}
+		if resp, ok := s.handleStreamRequest(req); ok {
+			if resp != nil && !req.isNotification() {
+				s.write(resp)
+			}
+			return
+		}
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		responses := s.h.callAll(s.ctx, requests, rejectStream)
+		if len(responses) == 0 {
+			return
+		} else if batch {
+			s.write(responses)
+		} else {
+			s.write(responses[0])
+		}
+	}()
+}
+
+// handleStreamRequest handles requests which start or control streams, and reports whether req is one of them.
+// The response of a started stream is sent when it ends.
+func (s *wsSession) handleStreamRequest(req *request) (*response, bool) {
+	switch req.Method {
+	case StreamSendMethod, StreamCloseMethod, StreamCancelMethod:
+		return s.controlStream(req), true
+	}
+	method, ok := s.h.methods[req.Method]
+	if !ok || !(method.IsStreamingClient() || method.IsStreamingServer()) {
+		return nil, false
+	}
+	if req.isNotification() {
+		// streams without ids cannot be controlled or answered
+		return nil, true
+	}
+	return s.startStream(req, method), true
+}
+
+func (s *wsSession) startStream(req *request, method protoreflect.MethodDescriptor) *response {
+	var first proto.Message
+	if len(req.Params) > 0 && string(req.Params) != "null" || !method.IsStreamingClient() {
+		first = rpcutil.NewMessage(method.Input())
+		if err := unmarshalParams(req.Params, first); err != nil {
+			return newResponse(req.ID, nil, err)
+		}
+	}
+
+	key := streamKey(req.ID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.streams[key]; ok {
+		return newResponse(req.ID, nil, newError(InvalidRequest, "id of an active stream"))
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	desc := &grpc.StreamDesc{
+		StreamName:    string(method.Name()),
+		ServerStreams: method.IsStreamingServer(),
+		ClientStreams: method.IsStreamingClient(),
+	}
+	clientStream, err := s.h.conn.NewStream(ctx, desc, rpcutil.MethodPath(method))
+	if err != nil {
+		cancel()
+		return newResponse(req.ID, nil, newStatusError(err))
+	}
+	st := &stream{method: method, ctx: ctx, cancel: cancel, send: make(chan proto.Message)}
+	s.streams[key] = st
+
+	s.wg.Add(2)
+	go func() {
+		defer s.wg.Done()
+		sendMessages(clientStream, st, first)
+	}()
+	go func() {
+		defer s.wg.Done()
+		defer cancel()
+		resp := s.recvMessages(req.ID, clientStream, method)
+		s.mu.Lock()
+		delete(s.streams, key)
+		s.mu.Unlock()
+		s.write(resp)
+	}()
+	return nil
+}
+
+// sendMessages sends the first message and the messages of stream.send, and closes the sending side
+// after the first message of server streams, or on stream.close.
+func sendMessages(clientStream grpc.ClientStream, st *stream, first proto.Message) {
+	if first != nil {
+		if err := clientStream.SendMsg(first); err != nil {
+			return // the status is returned by RecvMsg
+		}
+	}
+	if !st.method.IsStreamingClient() {
+		clientStream.CloseSend()
+		return
+	}
+	for {
+		select {
+		case msg, ok := <-st.send:
+			if !ok {
+				clientStream.CloseSend()
+				return
+			}
+			if err := clientStream.SendMsg(msg); err != nil {
+				return
+			}
+		case <-st.ctx.Done():
+			return
+		}
+	}
+}
+
+// recvMessages sends the messages of server streams as notifications, and returns the final response.
+func (s *wsSession) recvMessages(id json.RawMessage, clientStream grpc.ClientStream, method protoreflect.MethodDescriptor) *response {
+	var last proto.Message
+	var err error
+	for {
+		msg := rpcutil.NewMessage(method.Output())
+		if err = clientStream.RecvMsg(msg); err != nil {
+			break
+		}
+		if !method.IsStreamingServer() {
+			last = msg
+			continue
+		}
+		data, err := protojson.Marshal(msg)
+		if err != nil {
+			return newResponse(id, nil, newError(InternalError, err.Error()))
+		}
+		s.write(&notification{
+			JSONRPC: version,
+			Method:  StreamMessageMethod,
+			Params:  streamParams{ID: id, Message: data},
+		})
+	}
+	if !errors.Is(err, io.EOF) {
+		return newResponse(id, nil, newStatusError(err))
+	}
+	if last == nil {
+		return newResponse(id, nil, nil)
+	}
+	result, err := protojson.Marshal(last)
+	if err != nil {
+		return newResponse(id, nil, newError(InternalError, err.Error()))
+	}
+	return newResponse(id, result, nil)
+}
+
+func (s *wsSession) controlStream(req *request) *response {
+	var params streamParams
+	if err := json.Unmarshal(req.Params, &params); err != nil || len(params.ID) == 0 {
+		return newResponse(req.ID, nil, newError(InvalidParams, "Invalid params: id of a stream is required"))
+	}
+	s.mu.Lock()
+	st, ok := s.streams[streamKey(params.ID)]
+	s.mu.Unlock()
+	if !ok {
+		return newResponse(req.ID, nil, newError(InvalidParams, "Invalid params: unknown stream"))
+	}
+
+	switch req.Method {
+	case StreamSendMethod:
+		if !st.method.IsStreamingClient() {
+			return newResponse(req.ID, nil, newError(InvalidRequest, "stream does not accept messages"))
+		}
+		msg := rpcutil.NewMessage(st.method.Input())
+		if err := unmarshalParams(params.Message, msg); err != nil {
+			return newResponse(req.ID, nil, err)
+		}
+		if st.closed {
+			return newResponse(req.ID, nil, newError(InvalidRequest, "stream is closed"))
+		}
+		select {
+		case st.send <- msg:
+		case <-st.ctx.Done():
+			return newResponse(req.ID, nil, newError(InvalidRequest, "stream has ended"))
+		}
+	case StreamCloseMethod:
+		if !st.method.IsStreamingClient() {
+			return newResponse(req.ID, nil, newError(InvalidRequest, "stream does not accept messages"))
+		}
+		if !st.closed {
+			st.closed = true
+			close(st.send)
+		}
+	case StreamCancelMethod:
+		st.cancel()
+	}
+	return newResponse(req.ID, nil, nil)
+}
+
+// write sends a response, a batch of responses or a notification.
+func (s *wsSession) write(v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.conn.Write(s.ctx, websocket.MessageText, buf)
+}
+
+// streamKey returns the key of a stream id, which must be sent in the same form as in the request.
+func streamKey(id json.RawMessage) string {
+	return string(bytes.TrimSpace(id))
+}
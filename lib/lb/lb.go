@@ -0,0 +1,95 @@
+package lb
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	_ "google.golang.org/grpc/health" // register client-side health checking
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+)
+
+// Load balancing policies.
+const (
+	RoundRobin   = "round_robin"
+	LeastRequest = "least_request"
+)
+
+const staticScheme = "static"
+
+type Options struct {
+	// RoundRobin or LeastRequest.
+	Policy string
+	// Check upstream health with grpc.health.v1.Health and only use serving upstreams.
+	HealthCheck bool
+	Outlier     OutlierOptions
+}
+
+// OutlierOptions configures ejection of upstreams which fail consecutively.
+type OutlierOptions struct {
+	// Number of consecutive failures before an upstream is ejected. Zero disables ejection.
+	ConsecutiveFailures int
+	// An upstream is ejected for BaseEjectionTime multiplied by the number of times it has been ejected.
+	BaseEjectionTime time.Duration
+	MaxEjectionTime  time.Duration
+	// Maximum percentage of upstreams which can be ejected at the same time.
+	MaxEjectionPercent int
+}
+
+// DialOptions returns the target and dial options which balance calls across endpoints.
+// A single endpoint is used as the dial target, e.g. dns:///grpc.example.com:8080 for all addresses of a DNS name.
+// Multiple endpoints are resolved statically.
+func DialOptions(endpoints []string, opts Options) (string, []grpc.DialOption, error) {
+	if len(endpoints) == 0 {
+		return "", nil, fmt.Errorf("no endpoint")
+	}
+
+	name, err := register(opts)
+	if err != nil {
+		return "", nil, err
+	}
+	dialOptions := []grpc.DialOption{
+		grpc.WithDefaultServiceConfig(serviceConfig(name, opts.HealthCheck)),
+	}
+
+	if len(endpoints) == 1 {
+		return endpoints[0], dialOptions, nil
+	}
+
+	addresses := make([]resolver.Address, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		addresses = append(addresses, resolver.Address{Addr: endpoint})
+	}
+	r := manual.NewBuilderWithScheme(staticScheme)
+	r.InitialState(resolver.State{Addresses: addresses})
+	dialOptions = append(dialOptions, grpc.WithResolvers(r))
+	return staticScheme + ":///" + strings.Join(endpoints, ","), dialOptions, nil
+}
+
+// register registers a balancer for the options and returns its name.
+func register(opts Options) (string, error) {
+	if opts.Policy != RoundRobin && opts.Policy != LeastRequest {
+		return "", fmt.Errorf("unknown load balancing policy %q", opts.Policy)
+	}
+
+	name := "grpc_example_" + opts.Policy
+	balancer.Register(base.NewBalancerBuilder(
+		name,
+		newPickerBuilder(opts.Policy, opts.Outlier),
+		base.Config{HealthCheck: opts.HealthCheck},
+	))
+	return name, nil
+}
+
+func serviceConfig(balancerName string, healthCheck bool) string {
+	config := fmt.Sprintf(`{"loadBalancingConfig": [{%q: {}}]`, balancerName)
+	if healthCheck {
+		// empty service name checks the overall health of the server
+		config += `, "healthCheckConfig": {"serviceName": ""}`
+	}
+	return config + "}"
+}
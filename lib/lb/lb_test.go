@@ -0,0 +1,72 @@
+package lb
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+)
+
+func startHealthServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	server := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+func TestDialOptions_invalidPolicy(t *testing.T) {
+	_, _, err := DialOptions([]string{"localhost:8080"}, Options{Policy: "random"})
+
+	if err == nil {
+		t.Errorf("err <nil>; want error")
+	}
+}
+
+func TestDialOptions_singleEndpoint(t *testing.T) {
+	target, _, err := DialOptions([]string{"dns:///localhost:8080"}, Options{Policy: RoundRobin})
+
+	if err != nil {
+		t.Errorf("err %v; want <nil>", err)
+	}
+	if target != "dns:///localhost:8080" {
+		t.Errorf("target %v; want dns:///localhost:8080", target)
+	}
+}
+
+func TestDialOptions_multipleEndpoints(t *testing.T) {
+	endpoints := []string{startHealthServer(t), startHealthServer(t)}
+	target, dialOptions, err := DialOptions(endpoints, Options{Policy: RoundRobin, HealthCheck: true})
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	conn, err := grpc.Dial(target, append(dialOptions, grpc.WithTransportCredentials(insecure.NewCredentials()))...)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	defer conn.Close()
+	client := grpc_health_v1.NewHealthClient(conn)
+	peers := make(map[string]bool)
+
+	for i := 0; i < 10; i++ {
+		var p peer.Peer
+		_, err := client.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{}, grpc.WaitForReady(true), grpc.Peer(&p))
+		if err != nil {
+			t.Fatalf("err %v; want <nil>", err)
+		}
+		peers[p.Addr.String()] = true
+	}
+
+	if len(peers) != 2 {
+		t.Errorf("peers %v; want both endpoints", peers)
+	}
+}
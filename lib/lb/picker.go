@@ -0,0 +1,164 @@
+package lb
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Status codes which count as upstream failures for outlier ejection.
+var failureCodes = map[codes.Code]bool{
+	codes.Unknown:          true,
+	codes.DeadlineExceeded: true,
+	codes.Internal:         true,
+	codes.Unavailable:      true,
+	codes.DataLoss:         true,
+}
+
+// subConnStats outlives pickers, which are rebuilt whenever the set of ready SubConns changes.
+type subConnStats struct {
+	inflight int64 // accessed atomically
+
+	mu                  sync.Mutex
+	consecutiveFailures int
+	ejections           int
+	ejectedUntil        time.Time
+}
+
+func (s *subConnStats) isEjected(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return now.Before(s.ejectedUntil)
+}
+
+type pickerBuilder struct {
+	policy  string
+	outlier OutlierOptions
+
+	mu    sync.Mutex
+	stats map[balancer.SubConn]*subConnStats
+}
+
+func newPickerBuilder(policy string, outlier OutlierOptions) *pickerBuilder {
+	return &pickerBuilder{
+		policy:  policy,
+		outlier: outlier,
+		stats:   make(map[balancer.SubConn]*subConnStats),
+	}
+}
+
+func (b *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p := &picker{builder: b, next: uint32(rand.Intn(len(info.ReadySCs)))}
+	stats := make(map[balancer.SubConn]*subConnStats, len(info.ReadySCs))
+	for sc := range info.ReadySCs {
+		s, ok := b.stats[sc]
+		if !ok {
+			s = &subConnStats{}
+		}
+		stats[sc] = s
+		p.subConns = append(p.subConns, sc)
+		p.stats = append(p.stats, s)
+	}
+	b.stats = stats // forget SubConns which are not ready anymore
+	return p
+}
+
+type picker struct {
+	builder  *pickerBuilder
+	subConns []balancer.SubConn
+	stats    []*subConnStats
+	next     uint32 // accessed atomically
+}
+
+func (p *picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	now := time.Now()
+	candidates := make([]int, 0, len(p.subConns))
+	for i, s := range p.stats {
+		if !s.isEjected(now) {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		// all upstreams are ejected, which is better than failing every call
+		for i := range p.subConns {
+			candidates = append(candidates, i)
+		}
+	}
+
+	var i int
+	if p.builder.policy == LeastRequest && len(candidates) > 1 {
+		// power of two random choices
+		a := candidates[rand.Intn(len(candidates))]
+		b := candidates[rand.Intn(len(candidates))]
+		i = a
+		if atomic.LoadInt64(&p.stats[b].inflight) < atomic.LoadInt64(&p.stats[a].inflight) {
+			i = b
+		}
+	} else {
+		i = candidates[int(atomic.AddUint32(&p.next, 1))%len(candidates)]
+	}
+
+	s := p.stats[i]
+	atomic.AddInt64(&s.inflight, 1)
+	return balancer.PickResult{
+		SubConn: p.subConns[i],
+		Done: func(done balancer.DoneInfo) {
+			atomic.AddInt64(&s.inflight, -1)
+			p.record(s, done.Err)
+		},
+	}, nil
+}
+
+// record counts consecutive failures and ejects the upstream when the threshold is reached.
+func (p *picker) record(s *subConnStats, err error) {
+	outlier := p.builder.outlier
+	if outlier.ConsecutiveFailures <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	if err == nil || !failureCodes[status.Code(err)] {
+		s.consecutiveFailures = 0
+		s.mu.Unlock()
+		return
+	}
+	s.consecutiveFailures++
+	shouldEject := s.consecutiveFailures >= outlier.ConsecutiveFailures
+	s.mu.Unlock()
+	if !shouldEject || !p.canEject() {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ejections++
+	ejectionTime := outlier.BaseEjectionTime * time.Duration(s.ejections)
+	if outlier.MaxEjectionTime > 0 && ejectionTime > outlier.MaxEjectionTime {
+		ejectionTime = outlier.MaxEjectionTime
+	}
+	s.ejectedUntil = time.Now().Add(ejectionTime)
+	s.consecutiveFailures = 0
+}
+
+func (p *picker) canEject() bool {
+	now := time.Now()
+	ejected := 0
+	for _, s := range p.stats {
+		if s.isEjected(now) {
+			ejected++
+		}
+	}
+	return (ejected+1)*100 <= p.builder.outlier.MaxEjectionPercent*len(p.stats)
+}
@@ -0,0 +1,131 @@
+package lb
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type subConnMock struct {
+	balancer.SubConn
+	name string
+}
+
+func buildPicker(b *pickerBuilder, subConns ...*subConnMock) balancer.Picker {
+	info := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+	for _, sc := range subConns {
+		info.ReadySCs[sc] = base.SubConnInfo{}
+	}
+	return b.Build(info)
+}
+
+func pick(t *testing.T, p balancer.Picker) (*subConnMock, func(balancer.DoneInfo)) {
+	result, err := p.Pick(balancer.PickInfo{})
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return result.SubConn.(*subConnMock), result.Done
+}
+
+func TestPicker_roundRobin(t *testing.T) {
+	a, b := &subConnMock{name: "a"}, &subConnMock{name: "b"}
+	p := buildPicker(newPickerBuilder(RoundRobin, OutlierOptions{}), a, b)
+	counts := make(map[string]int)
+
+	for i := 0; i < 10; i++ {
+		sc, done := pick(t, p)
+		done(balancer.DoneInfo{})
+		counts[sc.name]++
+	}
+
+	if counts["a"] != 5 || counts["b"] != 5 {
+		t.Errorf("counts %v; want 5 each", counts)
+	}
+}
+
+func TestPicker_leastRequest(t *testing.T) {
+	a, b := &subConnMock{name: "a"}, &subConnMock{name: "b"}
+	p := buildPicker(newPickerBuilder(LeastRequest, OutlierOptions{}), a, b)
+	busy, _ := pick(t, p)
+	for i := 0; i < 10; i++ {
+		// keep the first upstream busy
+		if sc, done := pick(t, p); sc != busy {
+			done(balancer.DoneInfo{})
+		}
+	}
+	counts := make(map[string]int)
+
+	for i := 0; i < 20; i++ {
+		sc, done := pick(t, p)
+		done(balancer.DoneInfo{})
+		counts[sc.name]++
+	}
+
+	if counts[busy.name] > 10 {
+		t.Errorf("counts %v; want fewer picks of busy upstream %v", counts, busy.name)
+	}
+}
+
+func TestPicker_outlierEjection(t *testing.T) {
+	a, b := &subConnMock{name: "a"}, &subConnMock{name: "b"}
+	builder := newPickerBuilder(RoundRobin, OutlierOptions{
+		ConsecutiveFailures: 2,
+		BaseEjectionTime:    time.Minute,
+		MaxEjectionPercent:  50,
+	})
+	p := buildPicker(builder, a, b)
+	failures := 0
+	for failures < 2 {
+		if sc, done := pick(t, p); sc == a {
+			done(balancer.DoneInfo{Err: status.Error(codes.Unavailable, "")})
+			failures++
+		} else {
+			done(balancer.DoneInfo{})
+		}
+	}
+
+	// stats survive rebuilding the picker
+	p = buildPicker(builder, a, b)
+	for i := 0; i < 10; i++ {
+		if sc, _ := pick(t, p); sc == a {
+			t.Fatalf("picked ejected upstream %v", sc.name)
+		}
+	}
+}
+
+func TestPicker_maxEjectionPercent(t *testing.T) {
+	a, b := &subConnMock{name: "a"}, &subConnMock{name: "b"}
+	p := buildPicker(newPickerBuilder(RoundRobin, OutlierOptions{
+		ConsecutiveFailures: 1,
+		BaseEjectionTime:    time.Minute,
+		MaxEjectionPercent:  50,
+	}), a, b)
+
+	for i := 0; i < 10; i++ {
+		_, done := pick(t, p)
+		done(balancer.DoneInfo{Err: status.Error(codes.Unavailable, "")})
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		sc, _ := pick(t, p)
+		counts[sc.name]++
+	}
+
+	if len(counts) != 1 {
+		t.Errorf("counts %v; want exactly one ejected upstream", counts)
+	}
+}
+
+func TestPicker_noSubConn(t *testing.T) {
+	p := buildPicker(newPickerBuilder(RoundRobin, OutlierOptions{}))
+
+	_, err := p.Pick(balancer.PickInfo{})
+
+	if err != balancer.ErrNoSubConnAvailable {
+		t.Errorf("err %v; want %v", err, balancer.ErrNoSubConnAvailable)
+	}
+}
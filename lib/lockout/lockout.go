@@ -0,0 +1,192 @@
+package lockout
+
+import (
+	"context"
+	"time"
+)
+
+// Attempts are the failed attempts of a key since it was reset or its failures expired, and the attempts
+// which have begun and not ended yet, e.g. of concurrent logins.
+type Attempts struct {
+	Failures    int
+	Pending     int
+	LastFailure time.Time
+}
+
+// Store keeps attempts by key. Servers sharing a store, e.g. one backed by Redis, share lockouts.
+// Attempts expire ttl after their last change.
+type Store interface {
+	// Begin adds a pending attempt at time, and returns the updated attempts.
+	Begin(ctx context.Context, key string, at time.Time, ttl time.Duration) (Attempts, error)
+	// End removes a pending attempt, records a failure at time if it failed, and returns the updated attempts.
+	End(ctx context.Context, key string, at time.Time, ttl time.Duration, failed bool) (Attempts, error)
+	// Reset forgets the failures of key. Pending attempts are kept.
+	Reset(ctx context.Context, key string) error
+}
+
+// Limits of failed attempts of a username or a client.
+type Limits struct {
+	// Failures before attempts are delayed. Later failures double the delay.
+	FreeAttempts int
+	// Failures before attempts are locked out for the lockout duration. Zero disables the lockout.
+	LockoutAfter int
+}
+
+type Options struct {
+	User   Limits
+	Client Limits
+	// Delay after the first failure beyond the free attempts.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Failures are also forgotten after the lockout duration without failures.
+	LockoutDuration time.Duration
+}
+
+// Lockout of a username or a client, which has just started.
+type Lockout struct {
+	// Key of the username or the client, e.g. user:hello or client:192.0.2.1.
+	Key      string
+	Failures int
+	Until    time.Time
+}
+
+// Guard delays and locks out attempts of usernames and clients, e.g. client IP addresses, after failures.
+type Guard struct {
+	store Store
+	opts  Options
+}
+
+func NewGuard(store Store, opts Options) *Guard {
+	return &Guard{store: store, opts: opts}
+}
+
+// Attempt is an attempt of a username and a client, which counts as pending until it ends with Failure,
+// Success or Release. Methods of a nil attempt do nothing.
+type Attempt struct {
+	g        *Guard
+	username string
+	client   string
+	ended    bool
+}
+
+// Begin reserves an attempt, or returns how long the attempt must wait. Attempts beyond the free attempts wait
+// while other attempts are pending, so that concurrent attempts cannot all pass before their failures are counted.
+func (g *Guard) Begin(ctx context.Context, username string, client string) (*Attempt, time.Duration, error) {
+	now := time.Now()
+	a := &Attempt{g: g, username: username, client: client}
+	var begun []limitedKey
+	var wait time.Duration
+	for _, k := range g.keys(username, client) {
+		attempts, err := g.store.Begin(ctx, k.key, now, g.opts.LockoutDuration)
+		if err != nil {
+			g.end(ctx, begun, now, false)
+			return nil, 0, err
+		}
+		begun = append(begun, k)
+		if w := g.wait(attempts, k.limits, now); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		_, err := g.end(ctx, begun, now, false)
+		return nil, wait, err
+	}
+	return a, 0, nil
+}
+
+// Failure ends the attempt as failed, and returns the lockouts which it has started.
+func (a *Attempt) Failure(ctx context.Context) ([]Lockout, error) {
+	if a == nil || a.ended {
+		return nil, nil
+	}
+	a.ended = true
+	return a.g.end(ctx, a.g.keys(a.username, a.client), time.Now(), true)
+}
+
+// Success ends the attempt, and resets the failures of the username. Failures of the client are kept, so that
+// a client cannot reset its failures with its own account.
+func (a *Attempt) Success(ctx context.Context) error {
+	if a == nil || a.ended {
+		return nil
+	}
+	a.ended = true
+	if _, err := a.g.end(ctx, a.g.keys(a.username, a.client), time.Now(), false); err != nil {
+		return err
+	}
+	return a.g.store.Reset(ctx, userKey(a.username))
+}
+
+// Release ends the attempt without counting it, e.g. after an internal error, unless it has already ended.
+func (a *Attempt) Release(ctx context.Context) error {
+	if a == nil || a.ended {
+		return nil
+	}
+	a.ended = true
+	_, err := a.g.end(ctx, a.g.keys(a.username, a.client), time.Now(), false)
+	return err
+}
+
+// end ends pending attempts of keys, and returns the lockouts which failures have started.
+func (g *Guard) end(ctx context.Context, keys []limitedKey, now time.Time, failed bool) ([]Lockout, error) {
+	var lockouts []Lockout
+	var firstErr error
+	for _, k := range keys {
+		attempts, err := g.store.End(ctx, k.key, now, g.opts.LockoutDuration, failed)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if failed && k.limits.LockoutAfter > 0 && attempts.Failures == k.limits.LockoutAfter {
+			lockouts = append(lockouts, Lockout{Key: k.key, Failures: attempts.Failures, Until: g.blockedUntil(attempts, k.limits)})
+		}
+	}
+	return lockouts, firstErr
+}
+
+// wait returns how long an attempt must wait after attempts, which include the attempt itself as pending.
+func (g *Guard) wait(attempts Attempts, limits Limits, now time.Time) time.Duration {
+	if wait := g.blockedUntil(attempts, limits).Sub(now); wait > 0 {
+		return wait
+	}
+	if attempts.Pending > 1 && attempts.Failures+attempts.Pending-1 >= limits.FreeAttempts {
+		return g.opts.Backoff
+	}
+	return 0
+}
+
+// blockedUntil returns the end of the delay or lockout after attempts.
+func (g *Guard) blockedUntil(attempts Attempts, limits Limits) time.Time {
+	if limits.LockoutAfter > 0 && attempts.Failures >= limits.LockoutAfter {
+		return attempts.LastFailure.Add(g.opts.LockoutDuration)
+	}
+	if attempts.Failures < limits.FreeAttempts || attempts.Failures == 0 {
+		return time.Time{}
+	}
+	delay := g.opts.Backoff
+	for i := limits.FreeAttempts; i < attempts.Failures && delay < g.opts.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > g.opts.MaxBackoff {
+		delay = g.opts.MaxBackoff
+	}
+	return attempts.LastFailure.Add(delay)
+}
+
+type limitedKey struct {
+	key    string
+	limits Limits
+}
+
+func (g *Guard) keys(username string, client string) []limitedKey {
+	keys := []limitedKey{{userKey(username), g.opts.User}}
+	if client != "" {
+		keys = append(keys, limitedKey{"client:" + client, g.opts.Client})
+	}
+	return keys
+}
+
+func userKey(username string) string {
+	return "user:" + username
+}
@@ -0,0 +1,171 @@
+package lockout
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func newTestGuard() *Guard {
+	return NewGuard(NewMemoryStore(), Options{
+		User:            Limits{FreeAttempts: 2, LockoutAfter: 5},
+		Client:          Limits{FreeAttempts: 3, LockoutAfter: 0},
+		Backoff:         time.Second,
+		MaxBackoff:      3 * time.Second,
+		LockoutDuration: time.Hour,
+	})
+}
+
+// fail records a failed attempt, which must not wait.
+func fail(t *testing.T, g *Guard, username string, client string) []Lockout {
+	attempt, wait, err := g.Begin(context.TODO(), username, client)
+	if err != nil || wait != 0 {
+		t.Fatalf("wait %v, err %v; want 0, <nil>", wait, err)
+	}
+	lockouts, err := attempt.Failure(context.TODO())
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return lockouts
+}
+
+// check returns how long an attempt must wait, and releases the attempt.
+func check(t *testing.T, g *Guard, username string, client string) time.Duration {
+	attempt, wait, err := g.Begin(context.TODO(), username, client)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if err := attempt.Release(context.TODO()); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return wait
+}
+
+func TestGuard_backoff(t *testing.T) {
+	g := newTestGuard()
+
+	for failures, want := range []time.Duration{0, 0, time.Second, 2 * time.Second, 3 * time.Second} {
+		wait := check(t, g, "hello", "")
+
+		if wait > want || wait < want-time.Second/2 {
+			t.Errorf("%d failures: wait %v; want %v", failures, wait, want)
+		}
+		if _, err := g.store.End(context.TODO(), userKey("hello"), time.Now(), time.Hour, true); err != nil {
+			t.Fatalf("err %v; want <nil>", err)
+		}
+	}
+}
+
+func TestGuard_lockout(t *testing.T) {
+	g := newTestGuard()
+	for i := 0; i < 4; i++ {
+		g.store.End(context.TODO(), userKey("hello"), time.Now().Add(-time.Minute), time.Hour, true)
+	}
+
+	lockouts := fail(t, g, "hello", "")
+
+	if len(lockouts) != 1 || lockouts[0].Key != "user:hello" || lockouts[0].Failures != 5 {
+		t.Fatalf("lockouts %+v; want lockout of user:hello after 5 failures", lockouts)
+	}
+	if wait := check(t, g, "hello", ""); wait < time.Hour-time.Minute {
+		t.Errorf("wait %v; want about %v", wait, time.Hour)
+	}
+	if wait := check(t, g, "world", ""); wait != 0 {
+		t.Errorf("wait %v of other username; want 0", wait)
+	}
+}
+
+func TestGuard_client(t *testing.T) {
+	g := newTestGuard()
+	for _, username := range []string{"a", "b", "c"} {
+		fail(t, g, username, "10.0.0.1")
+	}
+
+	if wait := check(t, g, "e", "10.0.0.1"); wait <= 0 {
+		t.Errorf("wait %v of client; want delay", wait)
+	}
+	if wait := check(t, g, "e", "10.0.0.2"); wait != 0 {
+		t.Errorf("wait %v of other client; want 0", wait)
+	}
+	attempt, _, err := g.Begin(context.TODO(), "e", "10.0.0.2")
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if err := attempt.Success(context.TODO()); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if wait := check(t, g, "e", "10.0.0.1"); wait <= 0 {
+		t.Errorf("wait %v of client after success of other client; want delay", wait)
+	}
+}
+
+func TestGuard_Success(t *testing.T) {
+	g := newTestGuard()
+	fail(t, g, "hello", "")
+	fail(t, g, "hello", "")
+	g.store.End(context.TODO(), userKey("hello"), time.Now().Add(-time.Minute), time.Hour, true)
+	if wait := check(t, g, "hello", ""); wait != 0 {
+		t.Fatalf("wait %v; want 0", wait)
+	}
+	attempt, _, err := g.Begin(context.TODO(), "hello", "")
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	if err := attempt.Success(context.TODO()); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	if got, _ := g.store.Begin(context.TODO(), userKey("hello"), time.Now(), time.Hour); got.Failures != 0 || got.Pending != 1 {
+		t.Errorf("attempts %+v; want 1 pending", got)
+	}
+}
+
+func TestGuard_concurrent(t *testing.T) {
+	g := newTestGuard()
+	var attempts []*Attempt
+	for i := 0; i < 5; i++ {
+		attempt, wait, err := g.Begin(context.TODO(), "hello", "")
+		if err != nil {
+			t.Fatalf("err %v; want <nil>", err)
+		}
+		if wait == 0 {
+			attempts = append(attempts, attempt)
+		}
+	}
+
+	if len(attempts) != 2 {
+		t.Fatalf("allowed %d concurrent attempts; want 2 free attempts", len(attempts))
+	}
+	for _, attempt := range attempts {
+		attempt.Failure(context.TODO())
+	}
+	if wait := check(t, g, "hello", ""); wait <= 0 {
+		t.Errorf("wait %v after free attempts; want delay", wait)
+	}
+}
+
+func TestMemoryStore_expiry(t *testing.T) {
+	s := NewMemoryStore()
+	if _, err := s.End(context.TODO(), "hello", time.Now().Add(-time.Hour), time.Minute, true); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	if got, err := s.Begin(context.TODO(), "hello", time.Now(), time.Minute); got.Failures != 0 || err != nil {
+		t.Errorf("attempts %+v, err %v; want no failures, <nil>", got, err)
+	}
+}
+
+func TestMemoryStore_sweep(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now()
+	s.End(context.TODO(), "expired", now.Add(-time.Hour), time.Minute, true)
+	s.End(context.TODO(), "valid", now, time.Minute, true)
+
+	s.lastSweep = now.Add(-sweepInterval)
+	s.Begin(context.TODO(), "other", now, time.Minute)
+
+	if _, ok := s.attempts["expired"]; ok || len(s.attempts) != 2 {
+		t.Errorf("attempts %v; want valid and other", s.attempts)
+	}
+}
@@ -0,0 +1,101 @@
+package lockout
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Attempts are read as none once they have expired, and a write deletes all expired attempts if the last
+// sweep is older than sweepInterval, so that writes do not scan the map.
+const sweepInterval = time.Minute
+
+// MemoryStore keeps attempts in memory, so they are lost on restart and not shared by servers.
+type MemoryStore struct {
+	mu        sync.Mutex
+	attempts  map[string]memoryAttempts
+	lastSweep time.Time
+}
+
+type memoryAttempts struct {
+	Attempts
+	expiresAt time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{attempts: make(map[string]memoryAttempts)}
+}
+
+func (s *MemoryStore) Begin(ctx context.Context, key string, at time.Time, ttl time.Duration) (Attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(at)
+	a := s.get(key, at)
+	a.Pending++
+	// pending attempts keep failures, which otherwise expire ttl after the last failure
+	if a.expiresAt.Before(at.Add(ttl)) {
+		a.expiresAt = at.Add(ttl)
+	}
+	s.attempts[key] = a
+	return a.Attempts, nil
+}
+
+func (s *MemoryStore) End(ctx context.Context, key string, at time.Time, ttl time.Duration, failed bool) (Attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(at)
+	a := s.get(key, at)
+	if a.Pending > 0 {
+		a.Pending--
+	}
+	if failed {
+		a.Failures++
+		a.LastFailure = at
+	}
+	switch {
+	case a.Pending == 0 && a.Failures == 0:
+		delete(s.attempts, key)
+		return a.Attempts, nil
+	case a.Pending == 0:
+		a.expiresAt = a.LastFailure.Add(ttl)
+	case a.expiresAt.Before(at.Add(ttl)):
+		a.expiresAt = at.Add(ttl)
+	}
+	s.attempts[key] = a
+	return a.Attempts, nil
+}
+
+func (s *MemoryStore) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.attempts[key]
+	if !ok || a.Pending == 0 {
+		delete(s.attempts, key)
+		return nil
+	}
+	a.Failures = 0
+	a.LastFailure = time.Time{}
+	s.attempts[key] = a
+	return nil
+}
+
+// get returns the attempts of key, or none if they have expired.
+func (s *MemoryStore) get(key string, now time.Time) memoryAttempts {
+	a, ok := s.attempts[key]
+	if !ok || !now.Before(a.expiresAt) {
+		return memoryAttempts{}
+	}
+	return a
+}
+
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, a := range s.attempts {
+		if !now.Before(a.expiresAt) {
+			delete(s.attempts, key)
+		}
+	}
+}
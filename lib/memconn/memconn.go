@@ -0,0 +1,79 @@
+// Package memconn provides an in-memory net.Listener, which serves connections of the same process without
+// opening a socket, e.g. calls of the JSON-RPC and GraphQL handlers to the gRPC server.
+package memconn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// Network is the network name of the addresses of connections.
+const Network = "memory"
+
+// Addr is the address of both ends of in-memory connections.
+type Addr struct{}
+
+func (Addr) Network() string { return Network }
+func (Addr) String() string  { return "in-process" }
+
+// IsAddr reports whether addr is the address of an in-memory connection.
+func IsAddr(addr net.Addr) bool {
+	_, ok := addr.(Addr)
+	return ok
+}
+
+// Listener accepts connections dialed with DialContext.
+type Listener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func Listen() *Listener {
+	return &Listener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return Addr{}
+}
+
+// DialContext returns the client end of a new connection, whose server end is returned by Accept.
+func (l *Listener) DialContext(ctx context.Context) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- &conn{server}:
+		return &conn{client}, nil
+	case <-l.done:
+		client.Close()
+		server.Close()
+		return nil, errors.New("memconn: listener closed")
+	case <-ctx.Done():
+		client.Close()
+		server.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// conn replaces the addresses of net.Pipe, so that servers can tell in-memory peers.
+type conn struct {
+	net.Conn
+}
+
+func (c *conn) LocalAddr() net.Addr  { return Addr{} }
+func (c *conn) RemoteAddr() net.Addr { return Addr{} }
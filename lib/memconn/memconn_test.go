@@ -0,0 +1,62 @@
+package memconn
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+)
+
+func TestListener_grpc(t *testing.T) {
+	listener := Listen()
+	server := grpc.NewServer(grpc.UnaryInterceptor(func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if p, ok := peer.FromContext(ctx); !ok || !IsAddr(p.Addr) {
+			t.Errorf("peer %v; want in-memory address", p)
+		}
+		return handler(ctx, req)
+	}))
+	grpc_health_v1.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(listener)
+	defer server.Stop()
+	conn, err := grpc.Dial("passthrough:///in-process",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		t.Errorf("status %v; want %v", resp.Status, grpc_health_v1.HealthCheckResponse_SERVING)
+	}
+}
+
+func TestListener_Close(t *testing.T) {
+	listener := Listen()
+	listener.Close()
+
+	if _, err := listener.Accept(); err != net.ErrClosed {
+		t.Errorf("err %v; want %v", err, net.ErrClosed)
+	}
+	if _, err := listener.DialContext(context.Background()); err == nil {
+		t.Errorf("err <nil>; want error")
+	}
+}
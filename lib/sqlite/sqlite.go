@@ -0,0 +1,28 @@
+// Package sqlite opens the SQLite database which the SQLite stores share, e.g. of users and API keys.
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	// pure Go driver, so that the server can be built without cgo
+	_ "modernc.org/sqlite"
+)
+
+// Writers wait up to 5 seconds for the lock of the database, instead of failing
+// with SQLITE_BUSY, and WAL lets readers run along with a writer.
+const pragmas = "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+
+// Open opens the database at path, which is created if it does not exist. Stores do not close the database,
+// so its owner closes it after the stores are done.
+func Open(path string) (*sql.DB, error) {
+	if path == "" {
+		return nil, errors.New("path of the SQLite database must not be empty")
+	}
+	// the driver reads pragmas from the query of the path
+	if strings.Contains(path, "?") {
+		return nil, errors.New("path of the SQLite database must not contain '?'")
+	}
+	return sql.Open("sqlite", path+pragmas)
+}
@@ -0,0 +1,47 @@
+package sqlite
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestOpen_concurrentWrites(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("CREATE TABLE items (id INTEGER PRIMARY KEY)"); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 50)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = db.Exec("INSERT INTO items (id) VALUES (?)", i)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("%v: err %v; want <nil>", i, err)
+		}
+	}
+	var mode string
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil || mode != "wal" {
+		t.Errorf("journal mode %q, err %v; want wal, <nil>", mode, err)
+	}
+}
+
+func TestOpen_invalidPath(t *testing.T) {
+	for _, path := range []string{"", "test.db?mode=ro"} {
+		if _, err := Open(path); err == nil {
+			t.Errorf("%q: err <nil>; want error", path)
+		}
+	}
+}
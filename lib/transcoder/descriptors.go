@@ -0,0 +1,140 @@
+package transcoder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	// register google.api.http, so that it is parsed from the options of methods
+	_ "google.golang.org/genproto/googleapis/api/annotations"
+)
+
+// Source returns the descriptors of the services to transcode.
+type Source func(ctx context.Context) (*descriptorpb.FileDescriptorSet, error)
+
+// FileSource reads a binary FileDescriptorSet with all imports, e.g. generated by
+// protoc --include_imports --descriptor_set_out=descriptors.pb.
+func FileSource(path string) Source {
+	return func(ctx context.Context) (*descriptorpb.FileDescriptorSet, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		set := &descriptorpb.FileDescriptorSet{}
+		if err := proto.Unmarshal(data, set); err != nil {
+			return nil, fmt.Errorf("invalid descriptor set %s: %w", path, err)
+		}
+		return set, nil
+	}
+}
+
+// ReflectionSource fetches the descriptors of all services of an upstream server with server reflection.
+func ReflectionSource(conn grpc.ClientConnInterface) Source {
+	return func(ctx context.Context) (*descriptorpb.FileDescriptorSet, error) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		stream, err := grpc_reflection_v1alpha.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer stream.CloseSend()
+
+		resp, err := reflectionRequest(stream, &grpc_reflection_v1alpha.ServerReflectionRequest{
+			MessageRequest: &grpc_reflection_v1alpha.ServerReflectionRequest_ListServices{},
+		})
+		if err != nil {
+			return nil, err
+		}
+		files := make(map[string]*descriptorpb.FileDescriptorProto)
+		for _, service := range resp.GetListServicesResponse().GetService() {
+			if strings.HasPrefix(service.GetName(), "grpc.reflection.") {
+				continue
+			}
+			resp, err := reflectionRequest(stream, &grpc_reflection_v1alpha.ServerReflectionRequest{
+				MessageRequest: &grpc_reflection_v1alpha.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: service.GetName()},
+			})
+			if err != nil {
+				return nil, err
+			}
+			if err := addFiles(files, resp); err != nil {
+				return nil, err
+			}
+		}
+
+		// servers may omit dependencies which they have sent before
+		for missing := missingDependencies(files); len(missing) > 0; missing = missingDependencies(files) {
+			for _, name := range missing {
+				if files[name] != nil {
+					continue
+				}
+				resp, err := reflectionRequest(stream, &grpc_reflection_v1alpha.ServerReflectionRequest{
+					MessageRequest: &grpc_reflection_v1alpha.ServerReflectionRequest_FileByFilename{FileByFilename: name},
+				})
+				if err != nil {
+					return nil, err
+				}
+				if err := addFiles(files, resp); err != nil {
+					return nil, err
+				}
+				if files[name] == nil {
+					return nil, fmt.Errorf("server reflection did not return %s", name)
+				}
+			}
+		}
+
+		// sorted, so that unchanged descriptors are equal
+		set := &descriptorpb.FileDescriptorSet{}
+		for _, file := range files {
+			set.File = append(set.File, file)
+		}
+		sort.Slice(set.File, func(i, j int) bool { return set.File[i].GetName() < set.File[j].GetName() })
+		return set, nil
+	}
+}
+
+func reflectionRequest(
+	stream grpc_reflection_v1alpha.ServerReflection_ServerReflectionInfoClient,
+	req *grpc_reflection_v1alpha.ServerReflectionRequest,
+) (*grpc_reflection_v1alpha.ServerReflectionResponse, error) {
+	if err := stream.Send(req); err != nil {
+		return nil, err
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if errResp := resp.GetErrorResponse(); errResp != nil {
+		return nil, fmt.Errorf("server reflection: %s", errResp.GetErrorMessage())
+	}
+	return resp, nil
+}
+
+func addFiles(files map[string]*descriptorpb.FileDescriptorProto, resp *grpc_reflection_v1alpha.ServerReflectionResponse) error {
+	for _, data := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+		file := &descriptorpb.FileDescriptorProto{}
+		if err := proto.Unmarshal(data, file); err != nil {
+			return fmt.Errorf("invalid file descriptor of server reflection: %w", err)
+		}
+		files[file.GetName()] = file
+	}
+	return nil
+}
+
+func missingDependencies(files map[string]*descriptorpb.FileDescriptorProto) []string {
+	var missing []string
+	for _, file := range files {
+		for _, dependency := range file.GetDependency() {
+			if files[dependency] == nil {
+				missing = append(missing, dependency)
+			}
+		}
+	}
+	return missing
+}
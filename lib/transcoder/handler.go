@@ -0,0 +1,209 @@
+package transcoder
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/utilities"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// responseBodyMessage marshals a field of a response as the response body, like messages of generated
+// gateway code with a response_body.
+type responseBodyMessage struct {
+	proto.Message
+	field protoreflect.FieldDescriptor
+}
+
+func (m responseBodyMessage) XXX_ResponseBody() interface{} {
+	return m.ProtoReflect().Get(m.field).Message().Interface()
+}
+
+// handler works like the handlers of generated gateway code.
+func (t *Transcoder) handler(mux *runtime.ServeMux, b binding) runtime.HandlerFunc {
+	rpcMethod := "/" + string(b.method.Parent().FullName()) + "/" + string(b.method.Name())
+	desc := &grpc.StreamDesc{
+		StreamName:    string(b.method.Name()),
+		ServerStreams: b.method.IsStreamingServer(),
+		ClientStreams: b.method.IsStreamingClient(),
+	}
+	return func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		inboundMarshaler, outboundMarshaler := runtime.MarshalerForRequest(mux, r)
+		ctx, err := runtime.AnnotateContext(ctx, mux, r, rpcMethod, runtime.WithHTTPPathPattern(b.pattern))
+		if err != nil {
+			runtime.HTTPError(ctx, mux, outboundMarshaler, w, r, err)
+			return
+		}
+
+		var md runtime.ServerMetadata
+		if desc.ClientStreams {
+			stream, err := t.conn.NewStream(ctx, desc, rpcMethod)
+			if err != nil {
+				runtime.HTTPError(ctx, mux, outboundMarshaler, w, r, err)
+				return
+			}
+			t.serveClientStream(ctx, mux, inboundMarshaler, outboundMarshaler, w, r, b, stream, cancel)
+			return
+		}
+
+		in := dynamicpb.NewMessage(b.method.Input())
+		if err := decodeRequest(r, inboundMarshaler, in, b, pathParams); err != nil {
+			runtime.HTTPError(ctx, mux, outboundMarshaler, w, r, err)
+			return
+		}
+
+		if desc.ServerStreams {
+			stream, err := t.conn.NewStream(ctx, desc, rpcMethod)
+			if err == nil {
+				err = stream.SendMsg(in)
+			}
+			if err == nil {
+				err = stream.CloseSend()
+			}
+			if err == nil {
+				md.HeaderMD, err = stream.Header()
+			}
+			if err != nil {
+				runtime.HTTPError(ctx, mux, outboundMarshaler, w, r, err)
+				return
+			}
+			ctx = runtime.NewServerMetadataContext(ctx, md)
+			runtime.ForwardResponseStream(ctx, mux, outboundMarshaler, w, r, recvFunc(stream, b), mux.GetForwardResponseOptions()...)
+			return
+		}
+
+		out := dynamicpb.NewMessage(b.method.Output())
+		err = t.conn.Invoke(ctx, rpcMethod, in, out, grpc.Header(&md.HeaderMD), grpc.Trailer(&md.TrailerMD))
+		ctx = runtime.NewServerMetadataContext(ctx, md)
+		if err != nil {
+			runtime.HTTPError(ctx, mux, outboundMarshaler, w, r, err)
+			return
+		}
+		runtime.ForwardResponseMessage(ctx, mux, outboundMarshaler, w, r, responseMessage(out, b), mux.GetForwardResponseOptions()...)
+	}
+}
+
+// serveClientStream sends the messages of the request body, e.g. newline-delimited JSON.
+// Bidirectional streams send them concurrently with forwarding responses.
+func (t *Transcoder) serveClientStream(
+	ctx context.Context,
+	mux *runtime.ServeMux,
+	inboundMarshaler, outboundMarshaler runtime.Marshaler,
+	w http.ResponseWriter,
+	r *http.Request,
+	b binding,
+	stream grpc.ClientStream,
+	cancel context.CancelFunc,
+) {
+	send := func() error {
+		decoder := inboundMarshaler.NewDecoder(r.Body)
+		for {
+			msg := dynamicpb.NewMessage(b.method.Input())
+			if err := decoder.Decode(msg); errors.Is(err, io.EOF) {
+				return stream.CloseSend()
+			} else if err != nil {
+				return status.Errorf(codes.InvalidArgument, "%v", err)
+			}
+			if err := stream.SendMsg(msg); err != nil {
+				// the server has ended the call, whose status is returned by RecvMsg
+				return nil
+			}
+		}
+	}
+
+	var md runtime.ServerMetadata
+	if !b.method.IsStreamingServer() {
+		err := send()
+		out := dynamicpb.NewMessage(b.method.Output())
+		if err == nil {
+			err = stream.RecvMsg(out)
+		}
+		md.HeaderMD, _ = stream.Header()
+		md.TrailerMD = stream.Trailer()
+		ctx = runtime.NewServerMetadataContext(ctx, md)
+		if err != nil {
+			runtime.HTTPError(ctx, mux, outboundMarshaler, w, r, err)
+			return
+		}
+		runtime.ForwardResponseMessage(ctx, mux, outboundMarshaler, w, r, responseMessage(out, b), mux.GetForwardResponseOptions()...)
+		return
+	}
+
+	go func() {
+		if err := send(); err != nil {
+			t.logger.Infow("Failed to send request stream", "method", b.method.FullName(), "error", err)
+			cancel()
+		}
+	}()
+	header, err := stream.Header()
+	if err != nil {
+		runtime.HTTPError(ctx, mux, outboundMarshaler, w, r, err)
+		return
+	}
+	md.HeaderMD = header
+	ctx = runtime.NewServerMetadataContext(ctx, md)
+	runtime.ForwardResponseStream(ctx, mux, outboundMarshaler, w, r, recvFunc(stream, b), mux.GetForwardResponseOptions()...)
+}
+
+func recvFunc(stream grpc.ClientStream, b binding) func() (proto.Message, error) {
+	return func() (proto.Message, error) {
+		out := dynamicpb.NewMessage(b.method.Output())
+		if err := stream.RecvMsg(out); err != nil {
+			return nil, err
+		}
+		return responseMessage(out, b), nil
+	}
+}
+
+func responseMessage(out proto.Message, b binding) proto.Message {
+	if b.responseBody != nil {
+		return responseBodyMessage{Message: out, field: b.responseBody}
+	}
+	return out
+}
+
+// decodeRequest populates the request message from the body, path parameters and query parameters.
+// Query parameters are ignored if the whole message is the body.
+func decodeRequest(r *http.Request, marshaler runtime.Marshaler, msg proto.Message, b binding, pathParams map[string]string) error {
+	if b.bodyAll || b.body != nil {
+		target := msg
+		if b.body != nil {
+			target = msg.ProtoReflect().Mutable(b.body).Message().Interface()
+		}
+		if err := marshaler.NewDecoder(r.Body).Decode(target); err != nil && !errors.Is(err, io.EOF) {
+			return status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	}
+
+	var filter [][]string
+	for key, value := range pathParams {
+		if err := runtime.PopulateFieldFromPath(msg, key, value); err != nil {
+			return status.Errorf(codes.InvalidArgument, "type mismatch, parameter: %s, error: %v", key, err)
+		}
+		filter = append(filter, strings.Split(key, "."))
+	}
+	if b.bodyAll {
+		return nil
+	}
+	if b.body != nil {
+		filter = append(filter, []string{string(b.body.Name())})
+	}
+	if err := r.ParseForm(); err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	if err := runtime.PopulateQueryParameters(msg, r.Form, utilities.NewDoubleArray(filter)); err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	return nil
+}
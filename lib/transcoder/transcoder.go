@@ -0,0 +1,185 @@
+package transcoder
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/zmzhang8/grpc_example/lib/internal/reload"
+	"github.com/zmzhang8/grpc_example/lib/log"
+)
+
+// binding maps an HTTP method and path template to a gRPC method, following google.api.http.
+type binding struct {
+	method  protoreflect.MethodDescriptor
+	verb    string
+	pattern string
+	// Field of the request message which is the request body, * for the whole message, or empty for no body.
+	body protoreflect.FieldDescriptor
+	// The whole request message is the request body.
+	bodyAll bool
+	// Field of the response message which is the response body, or nil for the whole message.
+	responseBody protoreflect.FieldDescriptor
+}
+
+// Transcoder serves REST/JSON requests by calling methods of services loaded at runtime, without
+// generated gateway code. Methods are bound to paths with their google.api.http annotations, or to the
+// default path of the gateway, e.g. POST /grpc_example.v1.Greeter/SayHello, without annotations.
+//
+// Routes are served by a runtime.ServeMux, so that the marshalers, error handlers and forward
+// response options of the gateway apply. Messages are dynamic, so forward response options must
+// not depend on generated types.
+type Transcoder struct {
+	logger log.Logger
+	conn   grpc.ClientConnInterface
+	source Source
+	// Creates an empty mux with the options of the gateway.
+	newMux func() *runtime.ServeMux
+
+	mu   sync.RWMutex
+	mux  *runtime.ServeMux
+	hash [sha256.Size]byte
+}
+
+func New(logger log.Logger, conn grpc.ClientConnInterface, source Source, newMux func() *runtime.ServeMux) *Transcoder {
+	return &Transcoder{logger: logger, conn: conn, source: source, newMux: newMux}
+}
+
+func (t *Transcoder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.mu.RLock()
+	mux := t.mux
+	t.mu.RUnlock()
+	if mux == nil {
+		http.Error(w, "descriptors are not loaded", http.StatusServiceUnavailable)
+		return
+	}
+	mux.ServeHTTP(w, r)
+}
+
+// Reload loads the descriptors from the source, and replaces the routes if the descriptors have changed.
+// It reports whether the routes have been replaced.
+func (t *Transcoder) Reload(ctx context.Context) (bool, error) {
+	set, err := t.source(ctx)
+	if err != nil {
+		return false, err
+	}
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(set)
+	if err != nil {
+		return false, err
+	}
+	hash := sha256.Sum256(data)
+	t.mu.RLock()
+	unchanged := t.mux != nil && bytes.Equal(hash[:], t.hash[:])
+	t.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return false, fmt.Errorf("invalid descriptors: %w", err)
+	}
+	mux := t.newMux()
+	routes := 0
+	var routeErr error
+	files.RangeFiles(func(file protoreflect.FileDescriptor) bool {
+		for i := 0; i < file.Services().Len(); i++ {
+			methods := file.Services().Get(i).Methods()
+			for j := 0; j < methods.Len(); j++ {
+				for _, b := range bindings(methods.Get(j)) {
+					if err := mux.HandlePath(b.verb, b.pattern, t.handler(mux, b)); err != nil {
+						routeErr = fmt.Errorf("invalid path of %s: %w", b.method.FullName(), err)
+						return false
+					}
+					routes++
+				}
+			}
+		}
+		return true
+	})
+	if routeErr != nil {
+		return false, routeErr
+	}
+
+	t.mu.Lock()
+	t.mux = mux
+	t.hash = hash
+	t.mu.Unlock()
+	t.logger.Infow("Loaded gateway routes", "files", len(set.GetFile()), "routes", routes)
+	return true, nil
+}
+
+// Run reloads the descriptors every interval until ctx is done. Failed reloads keep the current routes.
+func (t *Transcoder) Run(ctx context.Context, interval time.Duration) {
+	reload.Every(ctx, interval, t.logger, "Failed to reload gateway descriptors", func(ctx context.Context) error {
+		_, err := t.Reload(ctx)
+		return err
+	})
+}
+
+// bindings returns the bindings of the google.api.http annotation and its additional bindings,
+// or the default binding. Bindings with body fields which are not messages are skipped.
+func bindings(method protoreflect.MethodDescriptor) []binding {
+	rule, _ := proto.GetExtension(method.Options(), annotations.E_Http).(*annotations.HttpRule)
+	if rule == nil || rule.GetPattern() == nil {
+		return []binding{{
+			method:  method,
+			verb:    http.MethodPost,
+			pattern: "/" + string(method.Parent().FullName()) + "/" + string(method.Name()),
+			bodyAll: true,
+		}}
+	}
+
+	var result []binding
+	for _, rule := range append([]*annotations.HttpRule{rule}, rule.GetAdditionalBindings()...) {
+		b := binding{method: method, bodyAll: rule.GetBody() == "*"}
+		switch pattern := rule.GetPattern().(type) {
+		case *annotations.HttpRule_Get:
+			b.verb, b.pattern = http.MethodGet, pattern.Get
+		case *annotations.HttpRule_Put:
+			b.verb, b.pattern = http.MethodPut, pattern.Put
+		case *annotations.HttpRule_Post:
+			b.verb, b.pattern = http.MethodPost, pattern.Post
+		case *annotations.HttpRule_Delete:
+			b.verb, b.pattern = http.MethodDelete, pattern.Delete
+		case *annotations.HttpRule_Patch:
+			b.verb, b.pattern = http.MethodPatch, pattern.Patch
+		case *annotations.HttpRule_Custom:
+			b.verb, b.pattern = pattern.Custom.GetKind(), pattern.Custom.GetPath()
+		default:
+			continue
+		}
+		if body := rule.GetBody(); body != "" && body != "*" {
+			if b.body = messageField(method.Input(), body); b.body == nil {
+				continue
+			}
+		}
+		if responseBody := rule.GetResponseBody(); responseBody != "" {
+			if b.responseBody = messageField(method.Output(), responseBody); b.responseBody == nil {
+				continue
+			}
+		}
+		result = append(result, b)
+	}
+	return result
+}
+
+// messageField returns a singular message field by name.
+func messageField(desc protoreflect.MessageDescriptor, name string) protoreflect.FieldDescriptor {
+	field := desc.Fields().ByName(protoreflect.Name(name))
+	if field == nil || field.Message() == nil || field.IsList() || field.IsMap() {
+		return nil
+	}
+	return field
+}
@@ -0,0 +1,292 @@
+package transcoder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	"github.com/zmzhang8/grpc_example/lib/log"
+	pb "github.com/zmzhang8/grpc_example/proto/v1"
+)
+
+type greeterServerMock struct {
+	pb.UnimplementedGreeterServer
+}
+
+func (s *greeterServerMock) SayHello(ctx context.Context, in *pb.HelloRequest) (*pb.HelloReply, error) {
+	return &pb.HelloReply{Message: "Hello " + in.Name}, nil
+}
+
+type routeGuideServerMock struct {
+	pb.UnimplementedRouteGuideServer
+}
+
+func (s *routeGuideServerMock) ListFeatures(rect *pb.Rectangle, stream pb.RouteGuide_ListFeaturesServer) error {
+	for _, name := range []string{"a", "b"} {
+		if err := stream.Send(&pb.Feature{Name: name, Location: rect.Lo}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *routeGuideServerMock) RecordRoute(stream pb.RouteGuide_RecordRouteServer) error {
+	var count int32
+	for {
+		_, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(&pb.RouteSummary{PointCount: count})
+		}
+		if err != nil {
+			return err
+		}
+		count++
+	}
+}
+
+func newTestConn(t *testing.T) *grpc.ClientConn {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	pb.RegisterGreeterServer(server, &greeterServerMock{})
+	pb.RegisterRouteGuideServer(server, &routeGuideServerMock{})
+	reflection.Register(server)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func newTestTranscoder(conn grpc.ClientConnInterface, source Source) *Transcoder {
+	logger := log.NewLogger(log.NewCore(false, os.Stdout, false))
+	return New(logger, conn, source, func() *runtime.ServeMux { return runtime.NewServeMux() })
+}
+
+// descriptorSet returns the files with all their imports.
+func descriptorSet(files ...protoreflect.FileDescriptor) *descriptorpb.FileDescriptorSet {
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := make(map[string]bool)
+	var add func(file protoreflect.FileDescriptor)
+	add = func(file protoreflect.FileDescriptor) {
+		if seen[file.Path()] {
+			return
+		}
+		seen[file.Path()] = true
+		for i := 0; i < file.Imports().Len(); i++ {
+			add(file.Imports().Get(i).FileDescriptor)
+		}
+		set.File = append(set.File, protodesc.ToFileDescriptorProto(file))
+	}
+	for _, file := range files {
+		add(file)
+	}
+	return set
+}
+
+// annotatedGreeterSet binds SayHello to GET /v1/hello/{name}.
+func annotatedGreeterSet() *descriptorpb.FileDescriptorSet {
+	set := descriptorSet(annotations.File_google_api_annotations_proto, pb.File_grpc_example_v1_greeter_proto)
+	greeter := set.File[len(set.File)-1]
+	greeter.Dependency = append(greeter.Dependency, "google/api/annotations.proto")
+	method := greeter.Service[0].Method[0]
+	if method.Options == nil {
+		method.Options = &descriptorpb.MethodOptions{}
+	}
+	proto.SetExtension(method.Options, annotations.E_Http, &annotations.HttpRule{
+		Pattern: &annotations.HttpRule_Get{Get: "/v1/hello/{name}"},
+	})
+	return set
+}
+
+func writeSet(t *testing.T, path string, set *descriptorpb.FileDescriptorSet) {
+	data, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+}
+
+func serve(h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestTranscoder_notLoaded(t *testing.T) {
+	tr := newTestTranscoder(newTestConn(t), nil)
+
+	rec := serve(tr, http.MethodPost, "/grpc_example.v1.Greeter/SayHello", `{"name":"world"}`)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("code %v; want %v", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestTranscoder_defaultPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "descriptors.pb")
+	writeSet(t, path, descriptorSet(pb.File_grpc_example_v1_greeter_proto))
+	tr := newTestTranscoder(newTestConn(t), FileSource(path))
+	if _, err := tr.Reload(context.TODO()); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	rec := serve(tr, http.MethodPost, "/grpc_example.v1.Greeter/SayHello", `{"name":"world"}`)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code %v; want %v", rec.Code, http.StatusOK)
+	}
+	if want := `{"message":"Hello world"}`; rec.Body.String() != want {
+		t.Errorf("body %v; want %v", rec.Body.String(), want)
+	}
+}
+
+func TestTranscoder_httpAnnotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "descriptors.pb")
+	writeSet(t, path, annotatedGreeterSet())
+	tr := newTestTranscoder(newTestConn(t), FileSource(path))
+	if _, err := tr.Reload(context.TODO()); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	rec := serve(tr, http.MethodGet, "/v1/hello/world", "")
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code %v; want %v", rec.Code, http.StatusOK)
+	}
+	if want := `{"message":"Hello world"}`; rec.Body.String() != want {
+		t.Errorf("body %v; want %v", rec.Body.String(), want)
+	}
+	if rec := serve(tr, http.MethodPost, "/grpc_example.v1.Greeter/SayHello", `{}`); rec.Code != http.StatusNotFound {
+		t.Errorf("code of default path %v; want %v", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestTranscoder_reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "descriptors.pb")
+	writeSet(t, path, descriptorSet(pb.File_grpc_example_v1_greeter_proto))
+	tr := newTestTranscoder(newTestConn(t), FileSource(path))
+	if changed, err := tr.Reload(context.TODO()); !changed || err != nil {
+		t.Fatalf("changed %v, err %v; want true, <nil>", changed, err)
+	}
+	if changed, err := tr.Reload(context.TODO()); changed || err != nil {
+		t.Fatalf("changed %v, err %v of unchanged descriptors; want false, <nil>", changed, err)
+	}
+
+	writeSet(t, path, annotatedGreeterSet())
+	if changed, err := tr.Reload(context.TODO()); !changed || err != nil {
+		t.Fatalf("changed %v, err %v; want true, <nil>", changed, err)
+	}
+	if rec := serve(tr, http.MethodGet, "/v1/hello/world", ""); rec.Code != http.StatusOK {
+		t.Errorf("code %v; want %v", rec.Code, http.StatusOK)
+	}
+
+	// invalid descriptors keep the current routes
+	if err := os.WriteFile(path, []byte("invalid"), 0o600); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if _, err := tr.Reload(context.TODO()); err == nil {
+		t.Errorf("err <nil>; want error")
+	}
+	if rec := serve(tr, http.MethodGet, "/v1/hello/world", ""); rec.Code != http.StatusOK {
+		t.Errorf("code %v; want %v", rec.Code, http.StatusOK)
+	}
+}
+
+func TestReflectionSource(t *testing.T) {
+	conn := newTestConn(t)
+	tr := newTestTranscoder(conn, ReflectionSource(conn))
+	if _, err := tr.Reload(context.TODO()); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	rec := serve(tr, http.MethodPost, "/grpc_example.v1.Greeter/SayHello", `{"name":"world"}`)
+
+	if want := `{"message":"Hello world"}`; rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("code %v, body %v; want %v, %v", rec.Code, rec.Body.String(), http.StatusOK, want)
+	}
+	if rec := serve(tr, http.MethodPost, "/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo", `{}`); rec.Code != http.StatusNotFound {
+		t.Errorf("code of reflection %v; want %v", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestTranscoder_serverStream(t *testing.T) {
+	conn := newTestConn(t)
+	tr := newTestTranscoder(conn, ReflectionSource(conn))
+	if _, err := tr.Reload(context.TODO()); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	rec := serve(tr, http.MethodPost, "/grpc_example.v1.RouteGuide/ListFeatures", `{"lo":{"latitude":1}}`)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code %v; want %v", rec.Code, http.StatusOK)
+	}
+	var names []string
+	decoder := json.NewDecoder(rec.Body)
+	for decoder.More() {
+		var chunk struct {
+			Result struct {
+				Name     string
+				Location struct{ Latitude int32 }
+			}
+		}
+		if err := decoder.Decode(&chunk); err != nil {
+			t.Fatalf("err %v; want <nil>", err)
+		}
+		if chunk.Result.Location.Latitude != 1 {
+			t.Errorf("latitude %v; want 1", chunk.Result.Location.Latitude)
+		}
+		names = append(names, chunk.Result.Name)
+	}
+	if got := strings.Join(names, ","); got != "a,b" {
+		t.Errorf("names %v; want a,b", got)
+	}
+}
+
+func TestTranscoder_clientStream(t *testing.T) {
+	conn := newTestConn(t)
+	tr := newTestTranscoder(conn, ReflectionSource(conn))
+	if _, err := tr.Reload(context.TODO()); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	rec := serve(tr, http.MethodPost, "/grpc_example.v1.RouteGuide/RecordRoute", `{"latitude":1}`+"\n"+`{"latitude":2}`)
+
+	var summary struct{ PointCount int32 }
+	if err := json.Unmarshal(rec.Body.Bytes(), &summary); rec.Code != http.StatusOK || err != nil {
+		t.Fatalf("code %v, err %v; want %v, <nil>", rec.Code, err, http.StatusOK)
+	}
+	if summary.PointCount != 2 {
+		t.Errorf("point count %v; want 2", summary.PointCount)
+	}
+}
@@ -0,0 +1,88 @@
+package user
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+type usersFile struct {
+	Users []User `yaml:"users"`
+}
+
+// FileStore is a read-only store of users loaded from a YAML or JSON file. Changes of users return ErrReadOnly,
+// as they would be lost on restart.
+type FileStore struct {
+	users *MemoryStore
+}
+
+// NewFileStore loads users from a YAML or JSON file, e.g.
+//
+//	users:
+//	  - username: hello
+//	    password_hash: $2a$10$...
+//
+// The file is read once, so changes of the file require a restart. Users with TOTP are rejected, because
+// the use of their codes could not be recorded.
+func NewFileStore(path string) (*FileStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// JSON is a subset of YAML
+	var file usersFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid users file %s: %w", path, err)
+	}
+	seen := make(map[string]bool, len(file.Users))
+	for i, u := range file.Users {
+		if u.Username == "" {
+			return nil, fmt.Errorf("invalid users file %s: user %d has no username", path, i)
+		}
+		if seen[u.Username] {
+			return nil, fmt.Errorf("invalid users file %s: duplicate user %s", path, u.Username)
+		}
+		seen[u.Username] = true
+		if err := ValidateHash(u.PasswordHash); err != nil {
+			return nil, fmt.Errorf("invalid users file %s: user %s: %w", path, u.Username, err)
+		}
+		if u.TOTPSecret != "" || len(u.RecoveryCodes) > 0 {
+			return nil, fmt.Errorf("invalid users file %s: user %s: TOTP is not supported by read-only stores", path, u.Username)
+		}
+	}
+	return &FileStore{users: NewMemoryStore(file.Users...)}, nil
+}
+
+func (s *FileStore) Get(ctx context.Context, username string) (*User, error) {
+	return s.users.Get(ctx, username)
+}
+
+func (s *FileStore) Create(ctx context.Context, u User) error {
+	return ErrReadOnly
+}
+
+func (s *FileStore) Delete(ctx context.Context, username string) error {
+	return ErrReadOnly
+}
+
+func (s *FileStore) SetPasswordHash(ctx context.Context, username string, hash string) error {
+	return ErrReadOnly
+}
+
+func (s *FileStore) SetTOTPSecret(ctx context.Context, username string, secret string) error {
+	return ErrReadOnly
+}
+
+func (s *FileStore) ConfirmTOTP(ctx context.Context, username string, secret string, step int64, recoveryCodes []string) error {
+	return ErrReadOnly
+}
+
+func (s *FileStore) UseTOTPStep(ctx context.Context, username string, oldStep int64, newStep int64) error {
+	return ErrReadOnly
+}
+
+func (s *FileStore) SetRecoveryCodes(ctx context.Context, username string, oldCodes []string, newCodes []string) error {
+	return ErrReadOnly
+}
@@ -0,0 +1,124 @@
+package user
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryStore keeps users in memory, e.g. for local development and tests.
+type MemoryStore struct {
+	mu    sync.RWMutex
+	users map[string]User
+}
+
+func NewMemoryStore(users ...User) *MemoryStore {
+	s := &MemoryStore{users: make(map[string]User, len(users))}
+	for _, u := range users {
+		s.users[u.Username] = u
+	}
+	return s
+}
+
+func (s *MemoryStore) Get(ctx context.Context, username string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[username]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &u, nil
+}
+
+func (s *MemoryStore) Create(ctx context.Context, u User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[u.Username]; ok {
+		return ErrAlreadyExists
+	}
+	s.users[u.Username] = u
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[username]; !ok {
+		return ErrNotFound
+	}
+	delete(s.users, username)
+	return nil
+}
+
+func (s *MemoryStore) SetPasswordHash(ctx context.Context, username string, hash string) error {
+	return s.update(username, func(u *User) error {
+		u.PasswordHash = hash
+		return nil
+	})
+}
+
+func (s *MemoryStore) SetTOTPSecret(ctx context.Context, username string, secret string) error {
+	return s.update(username, func(u *User) error {
+		if u.TOTPConfirmed {
+			return ErrConflict
+		}
+		u.TOTPSecret = secret
+		return nil
+	})
+}
+
+func (s *MemoryStore) ConfirmTOTP(ctx context.Context, username string, secret string, step int64, recoveryCodes []string) error {
+	return s.update(username, func(u *User) error {
+		if u.TOTPConfirmed || u.TOTPSecret != secret {
+			return ErrConflict
+		}
+		u.TOTPConfirmed, u.TOTPLastStep, u.RecoveryCodes = true, step, recoveryCodes
+		return nil
+	})
+}
+
+func (s *MemoryStore) UseTOTPStep(ctx context.Context, username string, oldStep int64, newStep int64) error {
+	return s.update(username, func(u *User) error {
+		if u.TOTPLastStep != oldStep {
+			return ErrConflict
+		}
+		u.TOTPLastStep = newStep
+		return nil
+	})
+}
+
+func (s *MemoryStore) SetRecoveryCodes(ctx context.Context, username string, oldCodes []string, newCodes []string) error {
+	return s.update(username, func(u *User) error {
+		if !equalStrings(u.RecoveryCodes, oldCodes) {
+			return ErrConflict
+		}
+		u.RecoveryCodes = newCodes
+		return nil
+	})
+}
+
+// update changes the user by change, unless change returns an error.
+func (s *MemoryStore) update(username string, change func(u *User) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := change(&u); err != nil {
+		return err
+	}
+	s.users[username] = u
+	return nil
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
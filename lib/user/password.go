@@ -0,0 +1,151 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Algorithms of password hashes.
+const (
+	AlgorithmBcrypt   = "bcrypt"
+	AlgorithmArgon2id = "argon2id"
+)
+
+// Parameters of new argon2id hashes, as recommended by RFC 9106 for memory-constrained environments.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 4
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+var errInvalidHash = errors.New("invalid password hash")
+
+// Hasher hashes new passwords with an algorithm, and verifies hashes of both algorithms.
+type Hasher struct {
+	algorithm string
+	// Hash of a random password with algorithm, which is verified for unknown users.
+	dummyHash string
+}
+
+func NewHasher(algorithm string) (*Hasher, error) {
+	if algorithm != AlgorithmBcrypt && algorithm != AlgorithmArgon2id {
+		return nil, fmt.Errorf("invalid password hash algorithm %q", algorithm)
+	}
+	h := &Hasher{algorithm: algorithm}
+	password := make([]byte, 16)
+	if _, err := rand.Read(password); err != nil {
+		return nil, err
+	}
+	var err error
+	if h.dummyHash, err = h.Hash(string(password)); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Hash returns the hash of a new password.
+func (h *Hasher) Hash(password string) (string, error) {
+	if h.algorithm == AlgorithmBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify reports whether password matches hash in constant time.
+func (h *Hasher) Verify(hash string, password string) (bool, error) {
+	if algorithmOf(hash) == AlgorithmArgon2id {
+		return verifyArgon2id(hash, password)
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", errInvalidHash, err)
+	}
+	return true, nil
+}
+
+// VerifyDummy verifies password against a fixed hash of the algorithm of new passwords, so that unknown users
+// take as long as known users with hashes of that algorithm.
+func (h *Hasher) VerifyDummy(password string) {
+	h.Verify(h.dummyHash, password)
+}
+
+func algorithmOf(hash string) string {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return AlgorithmArgon2id
+	}
+	return AlgorithmBcrypt
+}
+
+// ValidateHash returns an error if hash is not a bcrypt or argon2id hash.
+func ValidateHash(hash string) error {
+	if algorithmOf(hash) == AlgorithmArgon2id {
+		_, err := parseArgon2id(hash)
+		return err
+	}
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidHash, err)
+	}
+	return nil
+}
+
+type argon2idHash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// parseArgon2id parses a hash in the format $argon2id$v=19$m=65536,t=3,p=4$salt$key.
+func parseArgon2id(hash string) (*argon2idHash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, errInvalidHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, errInvalidHash
+	}
+	h := &argon2idHash{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil || h.time == 0 || h.threads == 0 {
+		return nil, errInvalidHash
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, errInvalidHash
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, errInvalidHash
+	}
+	return h, nil
+}
+
+func verifyArgon2id(hash string, password string) (bool, error) {
+	h, err := parseArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+	key := argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(h.key, key) == 1, nil
+}
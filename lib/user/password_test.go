@@ -0,0 +1,71 @@
+package user
+
+import (
+	"testing"
+)
+
+func TestHasher(t *testing.T) {
+	for _, algorithm := range []string{AlgorithmBcrypt, AlgorithmArgon2id} {
+		h, err := NewHasher(algorithm)
+		if err != nil {
+			t.Fatalf("%v: err %v; want <nil>", algorithm, err)
+		}
+
+		hash, err := h.Hash("world")
+		if err != nil {
+			t.Fatalf("%v: err %v; want <nil>", algorithm, err)
+		}
+
+		if err := ValidateHash(hash); err != nil {
+			t.Errorf("%v: err %v; want <nil>", algorithm, err)
+		}
+		if ok, err := h.Verify(hash, "world"); !ok || err != nil {
+			t.Errorf("%v: ok %v, err %v; want true, <nil>", algorithm, ok, err)
+		}
+		if ok, err := h.Verify(hash, "earth"); ok || err != nil {
+			t.Errorf("%v: ok %v, err %v of wrong password; want false, <nil>", algorithm, ok, err)
+		}
+		if got := algorithmOf(h.dummyHash); got != algorithm {
+			t.Errorf("%v: algorithm %v of dummy hash; want %v", algorithm, got, algorithm)
+		}
+	}
+}
+
+func TestHasher_verifyOtherAlgorithm(t *testing.T) {
+	bcryptHasher, err := NewHasher(AlgorithmBcrypt)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	argon2idHasher, err := NewHasher(AlgorithmArgon2id)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	hash, err := argon2idHasher.Hash("world")
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	if ok, err := bcryptHasher.Verify(hash, "world"); !ok || err != nil {
+		t.Errorf("ok %v, err %v; want true, <nil>", ok, err)
+	}
+}
+
+func TestNewHasher_invalidAlgorithm(t *testing.T) {
+	if _, err := NewHasher("md5"); err == nil {
+		t.Errorf("err <nil>; want error")
+	}
+}
+
+func TestValidateHash_invalid(t *testing.T) {
+	for _, hash := range []string{
+		"",
+		"world",
+		"$argon2id$v=19$m=65536,t=3,p=4$salt",
+		"$argon2id$v=18$m=65536,t=3,p=4$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=19$m=65536,t=0,p=4$c2FsdHNhbHQ$a2V5",
+	} {
+		if err := ValidateHash(hash); err == nil {
+			t.Errorf("%q: err <nil>; want error", hash)
+		}
+	}
+}
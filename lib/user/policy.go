@@ -0,0 +1,71 @@
+package user
+
+import (
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxUsernameLength = 64
+	// bcrypt ignores longer passwords
+	maxPasswordBytes = 72
+)
+
+// PasswordPolicy is checked by registration and password changes.
+type PasswordPolicy struct {
+	MinLength int
+	// Minimum number of character classes: lowercase letters, uppercase letters, digits and others.
+	MinClasses int
+}
+
+// Validate returns descriptions of the violations of the policy, or nil if the password satisfies it.
+func (p PasswordPolicy) Validate(password string) []string {
+	var violations []string
+	if n := utf8.RuneCountInString(password); n < p.MinLength {
+		violations = append(violations, fmt.Sprintf("must be at least %d characters long", p.MinLength))
+	}
+	if len(password) > maxPasswordBytes {
+		violations = append(violations, fmt.Sprintf("must be at most %d bytes long", maxPasswordBytes))
+	}
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	if lower+upper+digit+other < p.MinClasses {
+		violations = append(violations, fmt.Sprintf("must contain at least %d of lowercase letters, uppercase letters, digits and other characters", p.MinClasses))
+	}
+	return violations
+}
+
+// ValidateUsername returns descriptions of the problems of a new username, or nil if it is valid. Usernames are
+// restricted to ASCII, so that users cannot register lookalikes of other usernames.
+func ValidateUsername(username string) []string {
+	if username == "" {
+		return []string{"is required"}
+	}
+	var violations []string
+	if len(username) > maxUsernameLength {
+		violations = append(violations, fmt.Sprintf("must be at most %d characters long", maxUsernameLength))
+	}
+	for _, r := range username {
+		if !isASCIILetterOrDigit(r) && r != '.' && r != '_' && r != '-' {
+			violations = append(violations, "must only contain ASCII letters, digits, '.', '_' and '-'")
+			break
+		}
+	}
+	return violations
+}
+
+func isASCIILetterOrDigit(r rune) bool {
+	return 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9'
+}
@@ -0,0 +1,42 @@
+package user
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicy_Validate(t *testing.T) {
+	p := PasswordPolicy{MinLength: 8, MinClasses: 2}
+
+	for password, want := range map[string]int{
+		"Password":               0,
+		"password1":              0,
+		"pass wörd":              0,
+		"Pass1":                  1,
+		"password":               1,
+		"pass":                   2,
+		strings.Repeat("Ab", 37): 1,
+	} {
+		if got := p.Validate(password); len(got) != want {
+			t.Errorf("%q: violations %v; want %d", password, got, want)
+		}
+	}
+}
+
+func TestValidateUsername(t *testing.T) {
+	for username, valid := range map[string]bool{
+		"hello":                 true,
+		"hello.world_1-2":       true,
+		"":                      false,
+		"hello world":           false,
+		"hello/world":           false,
+		"h\u0435llo":            false,
+		"h\u00e9llo":            false,
+		"\uff48ello":            false,
+		strings.Repeat("a", 65): false,
+	} {
+		if got := ValidateUsername(username); (len(got) == 0) != valid {
+			t.Errorf("%q: violations %v; want valid %v", username, got, valid)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/zmzhang8/grpc_example/lib/log"
+)
+
+var ErrInvalidResetToken = errors.New("invalid password reset token")
+
+// Notifier delivers password reset tokens to users, e.g. by email.
+type Notifier interface {
+	NotifyPasswordReset(ctx context.Context, username string, token string, expiration time.Time) error
+}
+
+// LogNotifier logs password reset tokens instead of delivering them, for local development.
+// Anyone who can read the logs can reset passwords.
+type LogNotifier struct {
+	logger log.Logger
+}
+
+func NewLogNotifier(logger log.Logger) *LogNotifier {
+	return &LogNotifier{logger: logger}
+}
+
+func (n *LogNotifier) NotifyPasswordReset(ctx context.Context, username string, token string, expiration time.Time) error {
+	n.logger.Infow("Password reset requested", "username", username, "reset_token", token, "expiration", expiration)
+	return nil
+}
+
+// ResetTokens issues single-use password reset tokens, which are kept in memory.
+type ResetTokens struct {
+	tokens *singleUseTokens
+}
+
+func NewResetTokens(ttl time.Duration) *ResetTokens {
+	return &ResetTokens{tokens: newSingleUseTokens(ttl)}
+}
+
+// Issue returns a new reset token of username, which replaces earlier ones.
+func (r *ResetTokens) Issue(username string) (string, time.Time, error) {
+	return r.tokens.issue(username, "")
+}
+
+// IssueDummy returns a reset token which is not kept, so that requests of unknown users do the same work as the
+// ones of known users.
+func (r *ResetTokens) IssueDummy() (string, time.Time, error) {
+	token, err := newSingleUseToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, time.Now().Add(r.tokens.ttl), nil
+}
+
+// Use consumes a reset token, and returns its username or ErrInvalidResetToken.
+func (r *ResetTokens) Use(token string) (string, error) {
+	t, ok := r.tokens.use(token)
+	if !ok {
+		return "", ErrInvalidResetToken
+	}
+	return t.username, nil
+}
+
+// singleUseTokens are random tokens of usernames, which are kept in memory.
+type singleUseTokens struct {
+	ttl    time.Duration
+	mu     sync.Mutex
+	tokens map[string]singleUseToken // by hash
+}
+
+type singleUseToken struct {
+	username string
+	// State of the user which the token is bound to, if any.
+	binding   string
+	expiresAt time.Time
+}
+
+func newSingleUseTokens(ttl time.Duration) *singleUseTokens {
+	return &singleUseTokens{ttl: ttl, tokens: make(map[string]singleUseToken)}
+}
+
+// issue returns a new token of username, which replaces earlier ones.
+func (r *singleUseTokens) issue(username string, binding string) (string, time.Time, error) {
+	token, err := newSingleUseToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiration := time.Now().Add(r.ttl)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for hash, t := range r.tokens {
+		if t.username == username || !now.Before(t.expiresAt) {
+			delete(r.tokens, hash)
+		}
+	}
+	r.tokens[hashSingleUseToken(token)] = singleUseToken{username: username, binding: binding, expiresAt: expiration}
+	return token, expiration, nil
+}
+
+// get returns a token without consuming it, or false if the token is unknown or expired.
+func (r *singleUseTokens) get(token string) (singleUseToken, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.tokens[hashSingleUseToken(token)]
+	if !ok || !time.Now().Before(t.expiresAt) {
+		return singleUseToken{}, false
+	}
+	return t, true
+}
+
+// use consumes a token, and returns it, or false if the token is unknown or expired.
+func (r *singleUseTokens) use(token string) (singleUseToken, bool) {
+	hash := hashSingleUseToken(token)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.tokens[hash]
+	if !ok {
+		return singleUseToken{}, false
+	}
+	delete(r.tokens, hash)
+	if !time.Now().Before(t.expiresAt) {
+		return singleUseToken{}, false
+	}
+	return t, true
+}
+
+func newSingleUseToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashSingleUseToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,146 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS users (
+	username TEXT PRIMARY KEY,
+	password_hash TEXT NOT NULL,
+	roles TEXT NOT NULL DEFAULT '',
+	totp_secret TEXT NOT NULL DEFAULT '',
+	totp_confirmed INTEGER NOT NULL DEFAULT 0,
+	totp_last_step INTEGER NOT NULL DEFAULT 0,
+	recovery_codes TEXT NOT NULL DEFAULT ''
+)`
+
+// columns of tables created before the columns existed
+var sqliteAddedColumns = []struct {
+	name       string
+	definition string
+}{
+	{"roles", "TEXT NOT NULL DEFAULT ''"},
+	{"totp_secret", "TEXT NOT NULL DEFAULT ''"},
+	{"totp_confirmed", "INTEGER NOT NULL DEFAULT 0"},
+	{"totp_last_step", "INTEGER NOT NULL DEFAULT 0"},
+	{"recovery_codes", "TEXT NOT NULL DEFAULT ''"},
+}
+
+const sqliteColumns = "username, password_hash, roles, totp_secret, totp_confirmed, totp_last_step, recovery_codes"
+
+// SQLiteStore keeps users in the users table of a SQLite database. Roles and hashes of recovery codes are
+// space-separated.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore creates the users table in db if it does not exist. db is opened by sqlite.Open.
+func NewSQLiteStore(ctx context.Context, db *sql.DB) (*SQLiteStore, error) {
+	if _, err := db.ExecContext(ctx, sqliteSchema); err != nil {
+		return nil, err
+	}
+	for _, column := range sqliteAddedColumns {
+		if _, err := db.ExecContext(ctx, "SELECT "+column.name+" FROM users LIMIT 0"); err == nil {
+			continue
+		}
+		if _, err := db.ExecContext(ctx, "ALTER TABLE users ADD COLUMN "+column.name+" "+column.definition); err != nil {
+			return nil, err
+		}
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Get(ctx context.Context, username string) (*User, error) {
+	u := &User{}
+	var roles, recoveryCodes string
+	err := s.db.QueryRowContext(ctx, "SELECT "+sqliteColumns+" FROM users WHERE username = ?", username).
+		Scan(&u.Username, &u.PasswordHash, &roles, &u.TOTPSecret, &u.TOTPConfirmed, &u.TOTPLastStep, &recoveryCodes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.Roles = splitFields(roles)
+	u.RecoveryCodes = splitFields(recoveryCodes)
+	return u, nil
+}
+
+func (s *SQLiteStore) Create(ctx context.Context, u User) error {
+	// INSERT OR IGNORE, so that an existing user is not an error of the driver
+	result, err := s.db.ExecContext(ctx, "INSERT OR IGNORE INTO users ("+sqliteColumns+") VALUES (?, ?, ?, ?, ?, ?, ?)",
+		u.Username, u.PasswordHash, strings.Join(u.Roles, " "),
+		u.TOTPSecret, u.TOTPConfirmed, u.TOTPLastStep, strings.Join(u.RecoveryCodes, " "))
+	return checkAffected(result, err, ErrAlreadyExists)
+}
+
+func (s *SQLiteStore) Delete(ctx context.Context, username string) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM users WHERE username = ?", username)
+	return checkAffected(result, err, ErrNotFound)
+}
+
+func (s *SQLiteStore) SetPasswordHash(ctx context.Context, username string, hash string) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE users SET password_hash = ? WHERE username = ?", hash, username)
+	return checkAffected(result, err, ErrNotFound)
+}
+
+func (s *SQLiteStore) SetTOTPSecret(ctx context.Context, username string, secret string) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE users SET totp_secret = ? WHERE username = ? AND totp_confirmed = 0", secret, username)
+	return s.checkSet(ctx, result, err, username)
+}
+
+func (s *SQLiteStore) ConfirmTOTP(ctx context.Context, username string, secret string, step int64, recoveryCodes []string) error {
+	result, err := s.db.ExecContext(ctx, `UPDATE users SET totp_confirmed = 1, totp_last_step = ?, recovery_codes = ?
+		WHERE username = ? AND totp_secret = ? AND totp_confirmed = 0`,
+		step, strings.Join(recoveryCodes, " "), username, secret)
+	return s.checkSet(ctx, result, err, username)
+}
+
+func (s *SQLiteStore) UseTOTPStep(ctx context.Context, username string, oldStep int64, newStep int64) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE users SET totp_last_step = ? WHERE username = ? AND totp_last_step = ?", newStep, username, oldStep)
+	return s.checkSet(ctx, result, err, username)
+}
+
+func (s *SQLiteStore) SetRecoveryCodes(ctx context.Context, username string, oldCodes []string, newCodes []string) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE users SET recovery_codes = ? WHERE username = ? AND recovery_codes = ?",
+		strings.Join(newCodes, " "), username, strings.Join(oldCodes, " "))
+	return s.checkSet(ctx, result, err, username)
+}
+
+// checkSet returns ErrConflict if a compare-and-set statement changed no rows of an existing user,
+// or ErrNotFound if the user does not exist.
+func (s *SQLiteStore) checkSet(ctx context.Context, result sql.Result, err error, username string) error {
+	if err := checkAffected(result, err, ErrConflict); !errors.Is(err, ErrConflict) {
+		return err
+	}
+	if _, err := s.Get(ctx, username); err != nil {
+		return err
+	}
+	return ErrConflict
+}
+
+// splitFields returns nil instead of an empty slice for empty strings.
+func splitFields(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Fields(s)
+}
+
+// checkAffected returns errNone if the statement changed no rows.
+func checkAffected(result sql.Result, err error, errNone error) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNone
+	}
+	return nil
+}
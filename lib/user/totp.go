@@ -0,0 +1,199 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters of RFC 6238, which are the defaults of authenticator apps.
+const (
+	totpDigits     = 6
+	totpPeriod     = 30 * time.Second
+	totpSecretSize = 20
+	// Codes of the steps before and after the current one are accepted, for clocks out of sync.
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+	recoveryCodeSize  = 5 // bytes of each half
+)
+
+var (
+	ErrInvalidTOTPCode  = errors.New("invalid one-time code")
+	ErrInvalidChallenge = errors.New("invalid login challenge")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a random base32 secret.
+func NewTOTPSecret() (string, error) {
+	b := make([]byte, totpSecretSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// TOTPURI returns the otpauth:// provisioning URI of a secret, which authenticator apps import from a QR code.
+func TOTPURI(issuer string, username string, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(int(totpPeriod/time.Second)))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + username,
+		RawQuery: query.Encode(),
+	}
+	return u.String()
+}
+
+// TOTPCode returns the code of secret at now, e.g. for clients and tests.
+func TOTPCode(secret string, now time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return totpCode(key, now.Unix()/int64(totpPeriod/time.Second)), nil
+}
+
+// VerifyTOTP checks a code of secret at now, and returns the time step of the code. Codes of steps up to
+// lastStep are rejected, so that a code cannot be used twice.
+func VerifyTOTP(secret string, code string, now time.Time, lastStep int64) (int64, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return 0, err
+	}
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return 0, ErrInvalidTOTPCode
+	}
+	current := now.Unix() / int64(totpPeriod/time.Second)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, nil
+		}
+	}
+	return 0, ErrInvalidTOTPCode
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return nil, fmt.Errorf("invalid TOTP secret: %w", err)
+	}
+	return key, nil
+}
+
+// totpCode returns the HOTP code of RFC 4226 of a counter.
+func totpCode(key []byte, counter int64) string {
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// NewRecoveryCodes returns new recovery codes, and their hashes, which are stored instead of the codes.
+func NewRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 2*recoveryCodeSize)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := hex.EncodeToString(b[:recoveryCodeSize]) + "-" + hex.EncodeToString(b[recoveryCodeSize:])
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// UseRecoveryCode returns the hashes without the hash of code, or ErrInvalidTOTPCode if code is not one of them.
+func UseRecoveryCode(hashes []string, code string) ([]string, error) {
+	hash := hashRecoveryCode(code)
+	for i, h := range hashes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			remaining := make([]string, 0, len(hashes)-1)
+			remaining = append(remaining, hashes[:i]...)
+			return append(remaining, hashes[i+1:]...), nil
+		}
+	}
+	return nil, ErrInvalidTOTPCode
+}
+
+// LoginChallenges issues single-use challenges of users who have entered their password, and still need to enter
+// a one-time code. They are kept in memory.
+type LoginChallenges struct {
+	tokens *singleUseTokens
+}
+
+func NewLoginChallenges(ttl time.Duration) *LoginChallenges {
+	return &LoginChallenges{tokens: newSingleUseTokens(ttl)}
+}
+
+// Issue returns a new challenge of u, which replaces earlier ones. The challenge is bound to the password hash
+// and the TOTP secret of u, so that it is invalid for a changed user, e.g. a new user with the same name.
+func (c *LoginChallenges) Issue(u *User) (string, time.Time, error) {
+	return c.tokens.issue(u.Username, challengeBinding(u))
+}
+
+// Username returns the username of a challenge without consuming it, or ErrInvalidChallenge.
+func (c *LoginChallenges) Username(challenge string) (string, error) {
+	t, ok := c.tokens.get(challenge)
+	if !ok {
+		return "", ErrInvalidChallenge
+	}
+	return t.username, nil
+}
+
+// Check returns ErrInvalidChallenge if the challenge is not a challenge of u, without consuming it,
+// so that wrong codes can be corrected.
+func (c *LoginChallenges) Check(challenge string, u *User) error {
+	t, ok := c.tokens.get(challenge)
+	if !ok || t.username != u.Username || t.binding != challengeBinding(u) {
+		return ErrInvalidChallenge
+	}
+	return nil
+}
+
+// Use consumes a challenge of u, or returns ErrInvalidChallenge.
+func (c *LoginChallenges) Use(challenge string, u *User) error {
+	t, ok := c.tokens.use(challenge)
+	if !ok || t.username != u.Username || t.binding != challengeBinding(u) {
+		return ErrInvalidChallenge
+	}
+	return nil
+}
+
+func challengeBinding(u *User) string {
+	sum := sha256.Sum256([]byte(u.PasswordHash + "\x00" + u.TOTPSecret))
+	return hex.EncodeToString(sum[:])
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
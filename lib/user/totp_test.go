@@ -0,0 +1,111 @@
+package user
+
+import (
+	"encoding/base32"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// RFC 6238 test secret, whose SHA-1 code at 59 seconds is 94287082 with 8 digits
+var testTOTPSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestVerifyTOTP(t *testing.T) {
+	now := time.Unix(59, 0)
+
+	step, err := VerifyTOTP(testTOTPSecret, "287082", now, 0)
+
+	if step != 1 || err != nil {
+		t.Errorf("step %v, err %v; want 1, <nil>", step, err)
+	}
+	if _, err := VerifyTOTP(testTOTPSecret, "287082", now, step); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Errorf("err %v of used code; want %v", err, ErrInvalidTOTPCode)
+	}
+	if _, err := VerifyTOTP(testTOTPSecret, "287082", now.Add(totpPeriod), 0); err != nil {
+		t.Errorf("err %v of previous step; want <nil>", err)
+	}
+	for _, code := range []string{"287083", "28708", ""} {
+		if _, err := VerifyTOTP(testTOTPSecret, code, now, 0); !errors.Is(err, ErrInvalidTOTPCode) {
+			t.Errorf("%q: err %v; want %v", code, err, ErrInvalidTOTPCode)
+		}
+	}
+}
+
+func TestNewTOTPSecret(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	code, err := TOTPCode(secret, time.Now())
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	if _, err := VerifyTOTP(secret, code, time.Now(), 0); err != nil {
+		t.Errorf("err %v; want <nil>", err)
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	u, err := url.Parse(TOTPURI("grpc_example", "hello", "SECRET"))
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/grpc_example:hello" {
+		t.Errorf("uri %v; want otpauth://totp/grpc_example:hello", u)
+	}
+	if got := u.Query().Get("secret"); got != "SECRET" {
+		t.Errorf("secret %v; want SECRET", got)
+	}
+	if got := u.Query().Get("issuer"); got != "grpc_example" {
+		t.Errorf("issuer %v; want grpc_example", got)
+	}
+}
+
+func TestUseRecoveryCode(t *testing.T) {
+	codes, hashes, err := NewRecoveryCodes()
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	remaining, err := UseRecoveryCode(hashes, codes[0])
+
+	if err != nil || len(remaining) != len(hashes)-1 {
+		t.Errorf("%v remaining, err %v; want %v, <nil>", len(remaining), err, len(hashes)-1)
+	}
+	if _, err := UseRecoveryCode(remaining, codes[0]); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Errorf("err %v of used code; want %v", err, ErrInvalidTOTPCode)
+	}
+	if _, err := UseRecoveryCode(remaining, codes[1]); err != nil {
+		t.Errorf("err %v; want <nil>", err)
+	}
+}
+
+func TestLoginChallenges(t *testing.T) {
+	c := NewLoginChallenges(time.Hour)
+	u := testUser(t, "hello", "world")
+	u.TOTPSecret, u.TOTPConfirmed = testTOTPSecret, true
+	challenge, _, err := c.Issue(&u)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	other := testUser(t, "hello", "world")
+
+	if username, err := c.Username(challenge); username != "hello" || err != nil {
+		t.Errorf("username %v, err %v; want hello, <nil>", username, err)
+	}
+	if err := c.Check(challenge, &other); !errors.Is(err, ErrInvalidChallenge) {
+		t.Errorf("err %v of other user with the same name; want %v", err, ErrInvalidChallenge)
+	}
+	if err := c.Check(challenge, &u); err != nil {
+		t.Errorf("err %v; want <nil>", err)
+	}
+	if err := c.Use(challenge, &u); err != nil {
+		t.Errorf("err %v; want <nil>", err)
+	}
+	if err := c.Use(challenge, &u); !errors.Is(err, ErrInvalidChallenge) {
+		t.Errorf("err %v of used challenge; want %v", err, ErrInvalidChallenge)
+	}
+}
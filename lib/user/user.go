@@ -0,0 +1,80 @@
+package user
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrNotFound           = errors.New("user not found")
+	ErrAlreadyExists      = errors.New("user already exists")
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	// ErrConflict is returned by compare-and-set changes of users if the compared state has changed,
+	// e.g. by a concurrent call.
+	ErrConflict = errors.New("user has been changed concurrently")
+	// ErrReadOnly is returned by changes of users of read-only stores, e.g. FileStore.
+	ErrReadOnly = errors.New("users are read-only")
+)
+
+type User struct {
+	Username string `json:"username" yaml:"username"`
+	// bcrypt hash, or argon2id hash in the PHC string format.
+	PasswordHash string `json:"password_hash" yaml:"password_hash"`
+	// Roles checked by authorization policies, e.g. admin.
+	Roles []string `json:"roles,omitempty" yaml:"roles,omitempty"`
+	// Base32 secret of TOTP second-factor authentication, which is required once it is confirmed.
+	TOTPSecret    string `json:"totp_secret,omitempty" yaml:"totp_secret,omitempty"`
+	TOTPConfirmed bool   `json:"totp_confirmed,omitempty" yaml:"totp_confirmed,omitempty"`
+	// Time step of the last used code, so that codes cannot be reused.
+	TOTPLastStep int64 `json:"-" yaml:"-"`
+	// SHA-256 hashes of unused recovery codes.
+	RecoveryCodes []string `json:"recovery_codes,omitempty" yaml:"recovery_codes,omitempty"`
+}
+
+// HasTOTP reports whether logins of the user require a one-time code.
+func (u *User) HasTOTP() bool {
+	return u.TOTPSecret != "" && u.TOTPConfirmed
+}
+
+// UserStore looks up and manages users by name. Changes of existing users only write the changed fields,
+// and return ErrNotFound if the user does not exist.
+type UserStore interface {
+	// Get returns ErrNotFound if the user does not exist.
+	Get(ctx context.Context, username string) (*User, error)
+	// Create returns ErrAlreadyExists if the user exists.
+	Create(ctx context.Context, u User) error
+	// Delete returns ErrNotFound if the user does not exist.
+	Delete(ctx context.Context, username string) error
+	SetPasswordHash(ctx context.Context, username string, hash string) error
+	// SetTOTPSecret replaces an unconfirmed TOTP secret, or returns ErrConflict if TOTP is confirmed.
+	SetTOTPSecret(ctx context.Context, username string, secret string) error
+	// ConfirmTOTP confirms the TOTP secret along with the time step of its first code and the hashes of
+	// recovery codes. It returns ErrConflict if the secret has been replaced or confirmed.
+	ConfirmTOTP(ctx context.Context, username string, secret string, step int64, recoveryCodes []string) error
+	// UseTOTPStep replaces the time step of the last used code, or returns ErrConflict if it is not oldStep.
+	UseTOTPStep(ctx context.Context, username string, oldStep int64, newStep int64) error
+	// SetRecoveryCodes replaces the hashes of unused recovery codes, or returns ErrConflict if they are not
+	// oldCodes.
+	SetRecoveryCodes(ctx context.Context, username string, oldCodes []string, newCodes []string) error
+}
+
+// Authenticate returns the user if the password matches, or ErrInvalidCredentials.
+// Unknown users are checked against a dummy hash by VerifyDummy, so that they take the same time as wrong passwords.
+func Authenticate(ctx context.Context, store UserStore, hasher *Hasher, username string, password string) (*User, error) {
+	u, err := store.Get(ctx, username)
+	if errors.Is(err, ErrNotFound) {
+		hasher.VerifyDummy(password)
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	ok, err := hasher.Verify(u.PasswordHash, password)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	return u, nil
+}
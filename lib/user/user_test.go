@@ -0,0 +1,300 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/zmzhang8/grpc_example/lib/sqlite"
+)
+
+func testUser(t *testing.T, username string, password string) User {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return User{Username: username, PasswordHash: string(hash)}
+}
+
+func newTestHasher(t *testing.T) *Hasher {
+	h, err := NewHasher(AlgorithmBcrypt)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return h
+}
+
+func TestAuthenticate(t *testing.T) {
+	store := NewMemoryStore(testUser(t, "hello", "world"))
+	h := newTestHasher(t)
+
+	for _, tc := range []struct {
+		username string
+		password string
+		wantErr  error
+	}{
+		{"hello", "world", nil},
+		{"hello", "earth", ErrInvalidCredentials},
+		{"unknown", "world", ErrInvalidCredentials},
+	} {
+		u, err := Authenticate(context.TODO(), store, h, tc.username, tc.password)
+
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("%v/%v: err %v; want %v", tc.username, tc.password, err, tc.wantErr)
+		}
+		if tc.wantErr == nil && (u == nil || u.Username != tc.username) {
+			t.Errorf("%v/%v: user %v; want %v", tc.username, tc.password, u, tc.username)
+		}
+	}
+}
+
+func TestMemoryStore_Get(t *testing.T) {
+	store := NewMemoryStore(testUser(t, "hello", "world"))
+
+	u, err := store.Get(context.TODO(), "hello")
+
+	if err != nil || u.Username != "hello" {
+		t.Errorf("user %v, err %v; want hello, <nil>", u, err)
+	}
+	if _, err := store.Get(context.TODO(), "unknown"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("err %v; want %v", err, ErrNotFound)
+	}
+}
+
+func TestNewFileStore(t *testing.T) {
+	u := testUser(t, "hello", "world")
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"users.yaml": "users:\n  - username: hello\n    password_hash: " + u.PasswordHash + "\n",
+		"users.json": `{"users": [{"username": "hello", "password_hash": "` + u.PasswordHash + `"}]}`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("err %v; want <nil>", err)
+		}
+
+		store, err := NewFileStore(path)
+		if err != nil {
+			t.Fatalf("%v: err %v; want <nil>", name, err)
+		}
+
+		if got, err := store.Get(context.TODO(), "hello"); err != nil || got.PasswordHash != u.PasswordHash {
+			t.Errorf("%v: user %v, err %v; want %v, <nil>", name, got, err, u)
+		}
+		if err := store.SetPasswordHash(context.TODO(), "hello", u.PasswordHash); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("%v: err %v; want %v", name, err, ErrReadOnly)
+		}
+		if err := store.Create(context.TODO(), testUser(t, "world", "hello")); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("%v: err %v; want %v", name, err, ErrReadOnly)
+		}
+	}
+}
+
+func TestNewFileStore_invalid(t *testing.T) {
+	u := testUser(t, "hello", "world")
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"syntax.yaml":    "users: [",
+		"username.yaml":  "users:\n  - password_hash: " + u.PasswordHash + "\n",
+		"duplicate.yaml": "users:\n  - {username: hello, password_hash: " + u.PasswordHash + "}\n  - {username: hello, password_hash: " + u.PasswordHash + "}\n",
+		"hash.yaml":      "users:\n  - {username: hello, password_hash: world}\n",
+		"totp.yaml":      "users:\n  - {username: hello, password_hash: " + u.PasswordHash + ", totp_secret: JBSWY3DPEHPK3PXP}\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("err %v; want <nil>", err)
+		}
+
+		if _, err := NewFileStore(path); err == nil {
+			t.Errorf("%v: err <nil>; want error", name)
+		}
+	}
+}
+
+// newTestSQLiteStore returns a store of a new database, which is closed when the test ends.
+func newTestSQLiteStore(t *testing.T) *SQLiteStore {
+	db, err := sqlite.Open(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	store, err := NewSQLiteStore(context.TODO(), db)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return store
+}
+
+func TestSQLiteStore_Get(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	u := testUser(t, "hello", "world")
+	u.Roles = []string{"admin", "user"}
+	if _, err := store.db.Exec("INSERT INTO users (username, password_hash, roles) VALUES (?, ?, ?)", u.Username, u.PasswordHash, "admin user"); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	got, err := store.Get(context.TODO(), "hello")
+
+	if err != nil || !reflect.DeepEqual(*got, u) {
+		t.Errorf("user %v, err %v; want %v, <nil>", got, err, u)
+	}
+	if _, err := store.Get(context.TODO(), "unknown"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("err %v; want %v", err, ErrNotFound)
+	}
+}
+
+func TestStores_write(t *testing.T) {
+	sqliteStore := newTestSQLiteStore(t)
+
+	for name, store := range map[string]UserStore{"memory": NewMemoryStore(), "sqlite": sqliteStore} {
+		u := testUser(t, "hello", "world")
+		u.Roles = []string{"user"}
+		if err := store.Create(context.TODO(), u); err != nil {
+			t.Fatalf("%v: err %v; want <nil>", name, err)
+		}
+		if err := store.Create(context.TODO(), u); !errors.Is(err, ErrAlreadyExists) {
+			t.Errorf("%v: err %v of existing user; want %v", name, err, ErrAlreadyExists)
+		}
+
+		u.PasswordHash = testUser(t, "hello", "earth").PasswordHash
+		if err := store.SetPasswordHash(context.TODO(), "hello", u.PasswordHash); err != nil {
+			t.Errorf("%v: err %v; want <nil>", name, err)
+		}
+		if got, err := store.Get(context.TODO(), "hello"); err != nil || !reflect.DeepEqual(*got, u) {
+			t.Errorf("%v: user %v, err %v; want %v, <nil>", name, got, err, u)
+		}
+
+		if err := store.Delete(context.TODO(), "hello"); err != nil {
+			t.Errorf("%v: err %v; want <nil>", name, err)
+		}
+		if err := store.SetPasswordHash(context.TODO(), "hello", u.PasswordHash); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%v: err %v of deleted user; want %v", name, err, ErrNotFound)
+		}
+		if err := store.UseTOTPStep(context.TODO(), "hello", 0, 1); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%v: err %v of deleted user; want %v", name, err, ErrNotFound)
+		}
+		if err := store.Delete(context.TODO(), "hello"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%v: err %v of deleted user; want %v", name, err, ErrNotFound)
+		}
+	}
+}
+
+func TestStores_compareAndSet(t *testing.T) {
+	sqliteStore := newTestSQLiteStore(t)
+
+	for name, store := range map[string]UserStore{"memory": NewMemoryStore(), "sqlite": sqliteStore} {
+		if err := store.Create(context.TODO(), testUser(t, "hello", "world")); err != nil {
+			t.Fatalf("%v: err %v; want <nil>", name, err)
+		}
+		if err := store.SetTOTPSecret(context.TODO(), "hello", testTOTPSecret); err != nil {
+			t.Fatalf("%v: err %v; want <nil>", name, err)
+		}
+
+		if err := store.ConfirmTOTP(context.TODO(), "hello", "OTHER", 1, nil); !errors.Is(err, ErrConflict) {
+			t.Errorf("%v: err %v of replaced secret; want %v", name, err, ErrConflict)
+		}
+		if err := store.ConfirmTOTP(context.TODO(), "hello", testTOTPSecret, 1, []string{"a", "b"}); err != nil {
+			t.Errorf("%v: err %v; want <nil>", name, err)
+		}
+		if err := store.ConfirmTOTP(context.TODO(), "hello", testTOTPSecret, 1, nil); !errors.Is(err, ErrConflict) {
+			t.Errorf("%v: err %v of confirmed secret; want %v", name, err, ErrConflict)
+		}
+		if err := store.SetTOTPSecret(context.TODO(), "hello", "OTHER"); !errors.Is(err, ErrConflict) {
+			t.Errorf("%v: err %v of confirmed secret; want %v", name, err, ErrConflict)
+		}
+		if err := store.UseTOTPStep(context.TODO(), "hello", 1, 2); err != nil {
+			t.Errorf("%v: err %v; want <nil>", name, err)
+		}
+		if err := store.UseTOTPStep(context.TODO(), "hello", 1, 3); !errors.Is(err, ErrConflict) {
+			t.Errorf("%v: err %v of used step; want %v", name, err, ErrConflict)
+		}
+		if err := store.SetRecoveryCodes(context.TODO(), "hello", []string{"a", "b"}, []string{"b"}); err != nil {
+			t.Errorf("%v: err %v; want <nil>", name, err)
+		}
+		if err := store.SetRecoveryCodes(context.TODO(), "hello", []string{"a", "b"}, []string{"a"}); !errors.Is(err, ErrConflict) {
+			t.Errorf("%v: err %v of used code; want %v", name, err, ErrConflict)
+		}
+		got, err := store.Get(context.TODO(), "hello")
+		if err != nil || !got.HasTOTP() || got.TOTPLastStep != 2 || !reflect.DeepEqual(got.RecoveryCodes, []string{"b"}) {
+			t.Errorf("%v: user %+v, err %v; want confirmed TOTP, step 2 and code b, <nil>", name, got, err)
+		}
+	}
+}
+
+func TestResetTokens(t *testing.T) {
+	r := NewResetTokens(time.Hour)
+	earlier, _, err := r.Issue("hello")
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	token, _, err := r.Issue("hello")
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	username, err := r.Use(token)
+
+	if username != "hello" || err != nil {
+		t.Errorf("username %v, err %v; want hello, <nil>", username, err)
+	}
+	if _, err := r.Use(token); !errors.Is(err, ErrInvalidResetToken) {
+		t.Errorf("err %v of used token; want %v", err, ErrInvalidResetToken)
+	}
+	if _, err := r.Use(earlier); !errors.Is(err, ErrInvalidResetToken) {
+		t.Errorf("err %v of replaced token; want %v", err, ErrInvalidResetToken)
+	}
+}
+
+func TestResetTokens_expired(t *testing.T) {
+	r := NewResetTokens(-time.Second)
+	token, _, err := r.Issue("hello")
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	if _, err := r.Use(token); !errors.Is(err, ErrInvalidResetToken) {
+		t.Errorf("err %v; want %v", err, ErrInvalidResetToken)
+	}
+}
+
+func TestResetTokens_IssueDummy(t *testing.T) {
+	r := NewResetTokens(time.Hour)
+	token, expiration, err := r.IssueDummy()
+	if err != nil || token == "" || !expiration.After(time.Now()) {
+		t.Fatalf("token %q, expiration %v, err %v; want token, later expiration, <nil>", token, expiration, err)
+	}
+
+	if _, err := r.Use(token); !errors.Is(err, ErrInvalidResetToken) {
+		t.Errorf("err %v; want %v", err, ErrInvalidResetToken)
+	}
+}
+
+func TestNewSQLiteStore_addRoles(t *testing.T) {
+	db, err := sqlite.Open(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	defer db.Close()
+	u := testUser(t, "hello", "world")
+	if _, err := db.Exec("CREATE TABLE users (username TEXT PRIMARY KEY, password_hash TEXT NOT NULL)"); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	if _, err := db.Exec("INSERT INTO users (username, password_hash) VALUES (?, ?)", u.Username, u.PasswordHash); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	store, err := NewSQLiteStore(context.TODO(), db)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	if got, err := store.Get(context.TODO(), "hello"); err != nil || !reflect.DeepEqual(*got, u) {
+		t.Errorf("user %v, err %v; want %v, <nil>", got, err, u)
+	}
+}
@@ -3,12 +3,18 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware/v2"
 	grpc_middleware_auth "github.com/grpc-ecosystem/go-grpc-middleware/v2/auth"
@@ -19,17 +25,40 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
-	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
 
 	handler "github.com/zmzhang8/grpc_example/handler/v1"
 	"github.com/zmzhang8/grpc_example/lib/auth"
+	"github.com/zmzhang8/grpc_example/lib/authz"
+	"github.com/zmzhang8/grpc_example/lib/clientip"
+	"github.com/zmzhang8/grpc_example/lib/connect"
+	"github.com/zmzhang8/grpc_example/lib/gateway"
+	"github.com/zmzhang8/grpc_example/lib/graphql"
+	"github.com/zmzhang8/grpc_example/lib/health"
+	"github.com/zmzhang8/grpc_example/lib/jsonrpc"
+	"github.com/zmzhang8/grpc_example/lib/lb"
+	"github.com/zmzhang8/grpc_example/lib/lockout"
 	"github.com/zmzhang8/grpc_example/lib/log"
+	"github.com/zmzhang8/grpc_example/lib/memconn"
+	"github.com/zmzhang8/grpc_example/lib/sqlite"
+	"github.com/zmzhang8/grpc_example/lib/transcoder"
+	"github.com/zmzhang8/grpc_example/lib/user"
+	middleware_access_log "github.com/zmzhang8/grpc_example/middleware/access_log"
+	middleware_authz "github.com/zmzhang8/grpc_example/middleware/authz"
+	middleware_client_ip "github.com/zmzhang8/grpc_example/middleware/client_ip"
+	middleware_compression "github.com/zmzhang8/grpc_example/middleware/compression"
+	middleware_cors "github.com/zmzhang8/grpc_example/middleware/cors"
+	middleware_http_cache "github.com/zmzhang8/grpc_example/middleware/http_cache"
 	middleware_logging "github.com/zmzhang8/grpc_example/middleware/logging"
 	middleware_recovery "github.com/zmzhang8/grpc_example/middleware/recovery"
+	middleware_session "github.com/zmzhang8/grpc_example/middleware/session"
 	middleware_skip "github.com/zmzhang8/grpc_example/middleware/skip"
+	middleware_timeout "github.com/zmzhang8/grpc_example/middleware/timeout"
 	middleware_trace_id "github.com/zmzhang8/grpc_example/middleware/trace_id"
 	pb "github.com/zmzhang8/grpc_example/proto/v1"
 )
@@ -39,9 +68,102 @@ func main() {
 		debug              = flag.Bool("debug", false, "Enable debug")
 		port               = flag.Int("port", 8080, "Listen port")
 		mode               = flag.String("mode", "grpc", "Server mode. Value should be one of grpc, gateway, gateway-hybrid and web-hybrid.\nIf gateway or gateway-hybrid is selected, grpc-server-endpoint must also be specified.")
-		grpcServerEndpoint = flag.String("grpc-server-endpoint", "", "gRPC server endpoint")
+		grpcServerEndpoint = flag.String("grpc-server-endpoint", "", "gRPC server endpoint. Use comma-separated endpoints or a DNS name, e.g. dns:///grpc.example.com:8080, to balance calls across servers.")
 		tlsCert            = flag.String("tls_cert", "", "TLS certificate")
 		tlsKey             = flag.String("tls_key", "", "TLS key")
+
+		authTokenAlgorithm = flag.String("auth-token-algorithm", auth.AlgorithmHS256, "Auth: signing algorithm of session tokens. Value should be one of HS256, RS256 and EdDSA.")
+		authTokenKeyFile   = flag.String("auth-token-key-file", "", "Auth: file of the HS256 secret, or of the PEM-encoded RSA or Ed25519 private key. If empty, a random HS256 secret is used and tokens are only valid until restart.")
+		authTokenIssuer    = flag.String("auth-token-issuer", "grpc_example", "Auth: issuer of session tokens")
+		authTokenAudience  = flag.String("auth-token-audience", "grpc_example", "Auth: audience of session tokens")
+		authTokenTTL       = flag.Duration("auth-token-ttl", time.Hour, "Auth: lifetime of session tokens")
+		authRefreshTTL     = flag.Duration("auth-refresh-token-ttl", 30*24*time.Hour, "Auth: lifetime of refresh tokens, which is renewed on refresh")
+		authSessionTTL     = flag.Duration("auth-session-ttl", 90*24*time.Hour, "Auth: lifetime of sessions since login, after which refresh tokens are rejected and users log in again")
+		authAPIKeyStore    = flag.String("auth-api-key-store", "memory", "Auth: store of API keys. Value should be one of memory and sqlite. Keys of the memory store are lost on restart.")
+
+		authOIDCJWKS                = flag.String("auth-oidc-jwks", "", "Auth: path or http(s) URL of the JWKS of an external identity provider, whose bearer tokens are accepted along with session tokens. Empty disables external tokens.")
+		authOIDCJWKSRefreshInterval = flag.Duration("auth-oidc-jwks-refresh-interval", 15*time.Minute, "Auth: how often auth-oidc-jwks is reloaded. Zero disables reloading.")
+		authOIDCIssuer              = flag.String("auth-oidc-issuer", "", "Auth: issuer of external tokens")
+		authOIDCAudience            = flag.String("auth-oidc-audience", "grpc_example", "Auth: audience of external tokens")
+		authOIDCClockSkew           = flag.Duration("auth-oidc-clock-skew", time.Minute, "Auth: tolerance of the exp and nbf checks of external tokens")
+		authOIDCSubjectClaim        = flag.String("auth-oidc-subject-claim", "sub", "Auth: claim of the user of external tokens. Nested claims are separated by dots.")
+		authOIDCRolesClaim          = flag.String("auth-oidc-roles-claim", "", "Auth: claim of the roles of external tokens, e.g. realm_access.roles. Empty maps no roles.")
+		authOIDCScopesClaim         = flag.String("auth-oidc-scopes-claim", "scope", "Auth: claim of the scopes of external tokens. Empty maps no scopes.")
+		authOIDCTenantClaim         = flag.String("auth-oidc-tenant-claim", "", "Auth: claim of the tenant of external tokens. Empty maps no tenant.")
+
+		loginFreeAttempts       = flag.Int("login-free-attempts", 3, "Login: failed logins of a username before logins are delayed. Later failures double the delay.")
+		loginLockoutAfter       = flag.Int("login-lockout-after", 10, "Login: failed logins of a username before it is locked out. Zero disables the lockout.")
+		loginClientFreeAttempts = flag.Int("login-client-free-attempts", 20, "Login: failed logins of a client IP address before logins are delayed")
+		loginClientLockoutAfter = flag.Int("login-client-lockout-after", 100, "Login: failed logins of a client IP address before it is locked out. Zero disables the lockout.")
+		loginBackoff            = flag.Duration("login-backoff", time.Second, "Login: delay after the first failure beyond the free attempts. Zero disables brute-force protection.")
+		loginMaxBackoff         = flag.Duration("login-max-backoff", time.Minute, "Login: maximum delay of logins")
+		loginLockoutDuration    = flag.Duration("login-lockout-duration", 15*time.Minute, "Login: duration of lockouts. Failures are also forgotten after this duration without failures.")
+
+		authzPolicy               = flag.String("authz-policy", "", "Authz: YAML or JSON file of the authorization policy mapping methods to required roles and scopes. If empty, authenticated calls are not authorized further.")
+		authzPolicyReloadInterval = flag.Duration("authz-policy-reload-interval", 30*time.Second, "Authz: how often authz-policy is reloaded. The policy is replaced when the file changes. Zero disables reloading.")
+
+		sqlitePath = flag.String("sqlite-path", "", "SQLite: path of the database of the sqlite user and API key stores, which is created if it does not exist")
+
+		userStore              = flag.String("user-store", "memory", "Users: store of users. Value should be one of memory, file and sqlite.\nThe memory store only has the demo user hello with password world and role user.")
+		userStorePath          = flag.String("user-store-path", "", "Users: path of the YAML or JSON users file of the file store")
+		userPasswordHash       = flag.String("user-password-hash", user.AlgorithmBcrypt, "Users: hash algorithm of new passwords. Value should be one of bcrypt and argon2id. Both are verified.")
+		userPasswordMinLength  = flag.Int("user-password-min-length", 8, "Users: minimum length of new passwords")
+		userPasswordMinClasses = flag.Int("user-password-min-classes", 2, "Users: minimum number of character classes of new passwords, i.e. lowercase letters, uppercase letters, digits and others")
+		userResetTokenTTL      = flag.Duration("user-reset-token-ttl", 15*time.Minute, "Users: lifetime of password reset tokens, which are logged instead of sent to users")
+		userTOTPIssuer         = flag.String("user-totp-issuer", "grpc_example", "Users: issuer of TOTP provisioning URIs, which authenticator apps show")
+		userTOTPChallengeTTL   = flag.Duration("user-totp-challenge-ttl", 5*time.Minute, "Users: lifetime of login challenges of users with TOTP, who still need to enter a one-time code")
+
+		gatewayEmitUnpopulated = flag.Bool("gateway-emit-unpopulated", gateway.DefaultJSONOptions().EmitUnpopulated, "Gateway JSON: emit fields with zero values")
+		gatewayUseProtoNames   = flag.Bool("gateway-use-proto-names", gateway.DefaultJSONOptions().UseProtoNames, "Gateway JSON: use proto field names instead of lowerCamelCase names")
+		gatewayUseEnumNumbers  = flag.Bool("gateway-use-enum-numbers", gateway.DefaultJSONOptions().UseEnumNumbers, "Gateway JSON: emit enum values as numbers")
+		gatewayDiscardUnknown  = flag.Bool("gateway-discard-unknown", gateway.DefaultJSONOptions().DiscardUnknown, "Gateway JSON: ignore unknown fields in requests")
+		gatewayMultiline       = flag.Bool("gateway-multiline", gateway.DefaultJSONOptions().Multiline, "Gateway JSON: emit multiline output. Clients can also use the ?pretty query parameter.")
+
+		gatewayCompression         = flag.Bool("gateway-compression", true, "Gateway: compress responses with gzip, br or zstd according to Accept-Encoding, and accept compressed requests")
+		gatewayCompressionMinSize  = flag.Int("gateway-compression-min-size", 1024, "Gateway: minimum size in bytes of compressed responses. Streaming responses are always compressed.")
+		gatewayMaxDecompressedSize = flag.Int64("gateway-max-decompressed-size", 4<<20, "Gateway: maximum size in bytes of decompressed request bodies")
+
+		gatewayCacheControl = flag.String("gateway-cache-control",
+			"/grpc_example.v1.RouteGuide/GetFeature=private, no-cache",
+			"Gateway: semicolon-separated Cache-Control values of read-only unary methods, in the format path=value. Responses of these methods get ETags and support If-None-Match.")
+
+		gatewayTimeout       = flag.Duration("gateway-timeout", 30*time.Second, "Gateway: default deadline of gRPC calls. Clients can set Grpc-Timeout or X-Request-Timeout headers. Zero means no deadline.")
+		gatewayRouteTimeouts = flag.String("gateway-route-timeouts", "/grpc_example.v1.Health/Watch=0", "Gateway: semicolon-separated default deadlines of methods, in the format path=duration")
+		gatewayMaxTimeout    = flag.Duration("gateway-max-timeout", 5*time.Minute, "Gateway: maximum deadline requested by clients. Zero means no limit.")
+
+		gatewaySessionCookie         = flag.Bool("gateway-session-cookie", false, "Gateway: set an HttpOnly session cookie on login, authenticate requests with it, and require the X-CSRF-Token header of state-changing requests")
+		gatewaySessionCookieName     = flag.String("gateway-session-cookie-name", middleware_session.DefaultCookieName, "Gateway: name of the session cookie")
+		gatewaySessionCookieDomain   = flag.String("gateway-session-cookie-domain", "", "Gateway: domain of the session cookie")
+		gatewaySessionCookieSecure   = flag.Bool("gateway-session-cookie-secure", true, "Gateway: only send the session cookie over HTTPS")
+		gatewaySessionCookieSameSite = flag.String("gateway-session-cookie-same-site", "strict", "Gateway: SameSite attribute of the session cookie. Value should be one of strict, lax and none.")
+		gatewayLogoutPath            = flag.String("gateway-logout-path", middleware_session.DefaultLogoutPath, "Gateway: path of the logout endpoint which clears the session cookie")
+
+		gatewayDescriptors               = flag.String("gateway-descriptors", "", "Gateway: transcode the services of a binary FileDescriptorSet file, or of the upstream server reflection if the value is reflection, instead of the generated services.\nMethods without google.api.http annotations are served at POST /package.Service/Method.")
+		gatewayDescriptorsReloadInterval = flag.Duration("gateway-descriptors-reload-interval", 30*time.Second, "Gateway: how often gateway-descriptors are reloaded. Routes are replaced when the descriptors change. Zero disables reloading.")
+
+		grpcLbPolicy                  = flag.String("grpc-lb-policy", "round_robin", "Gateway upstream load balancing policy. Value should be one of round_robin and least_request.")
+		grpcHealthCheck               = flag.Bool("grpc-health-check", true, "Gateway upstream: only use servers which report SERVING via grpc.health.v1.Health")
+		grpcOutlierFailures           = flag.Int("grpc-outlier-consecutive-failures", 5, "Gateway upstream: eject a server after consecutive failures. Zero disables ejection.")
+		grpcOutlierBaseEjectionTime   = flag.Duration("grpc-outlier-base-ejection-time", 30*time.Second, "Gateway upstream: base ejection time, multiplied by the number of ejections")
+		grpcOutlierMaxEjectionTime    = flag.Duration("grpc-outlier-max-ejection-time", 5*time.Minute, "Gateway upstream: maximum ejection time")
+		grpcOutlierMaxEjectionPercent = flag.Int("grpc-outlier-max-ejection-percent", 50, "Gateway upstream: maximum percentage of ejected servers")
+		grpcTrustedProxies            = flag.String("grpc-trusted-proxies", "127.0.0.1,::1", "gRPC: comma-separated addresses or CIDRs of gateways, whose x-client-ip metadata is used as the client address, e.g. of login lockouts and API key networks. The client address of other peers is the peer address.")
+
+		httpReadHeaderTimeout = flag.Duration("http-read-header-timeout", 10*time.Second, "HTTP: timeout of reading request headers")
+		httpIdleTimeout       = flag.Duration("http-idle-timeout", 2*time.Minute, "HTTP: timeout of idle keep-alive connections")
+
+		grpcWebWebsockets            = flag.Bool("grpc-web-websockets", true, "gRPC-Web: enable the websocket transport, which supports client-side and bidirectional streams")
+		grpcWebWebsocketPingInterval = flag.Duration("grpc-web-websocket-ping-interval", 30*time.Second, "gRPC-Web: interval of websocket pings which keep idle streams alive. Zero disables pings, and intervals shorter than one second are ignored.")
+		grpcWebWebsocketReadLimit    = flag.Int64("grpc-web-websocket-read-limit", 4<<20, "gRPC-Web: maximum size in bytes of websocket messages")
+
+		shutdownDrainDelay = flag.Duration("shutdown-drain-delay", 5*time.Second, "After SIGINT or SIGTERM, how long readiness fails before servers shut down")
+
+		corsAllowedOrigins   = flag.String("cors-allowed-origins", "*", "CORS: comma-separated allowed origins of gateway and gRPC-Web requests. Wildcards are supported, e.g. https://*.example.com")
+		corsAllowedMethods   = flag.String("cors-allowed-methods", "GET,POST,PUT,PATCH,DELETE", "CORS: comma-separated allowed methods")
+		corsAllowedHeaders   = flag.String("cors-allowed-headers", "Accept,Authorization,Content-Type,Content-Encoding,X-Requested-With,X-Request-Id,X-Api-Key,X-Request-Timeout,Grpc-Timeout,X-CSRF-Token,Connect-Protocol-Version,Connect-Timeout-Ms", "CORS: comma-separated allowed request headers")
+		corsExposedHeaders   = flag.String("cors-exposed-headers", "Grpc-Metadata-Trace-Id,X-Request-Id,X-CSRF-Token", "CORS: comma-separated response headers exposed to browsers")
+		corsAllowCredentials = flag.Bool("cors-allow-credentials", false, "CORS: allow requests with credentials. It requires explicit cors-allowed-origins instead of *.")
+		corsMaxAge           = flag.Duration("cors-max-age", 10*time.Minute, "CORS: how long preflight results can be cached")
 	)
 	flag.Parse()
 
@@ -60,29 +182,218 @@ func main() {
 		}
 	}
 
+	corsMiddleware, err := middleware_cors.New(logger, middleware_cors.Options{
+		AllowedOrigins:   splitList(*corsAllowedOrigins),
+		AllowedMethods:   splitList(*corsAllowedMethods),
+		AllowedHeaders:   splitList(*corsAllowedHeaders),
+		ExposedHeaders:   splitList(*corsExposedHeaders),
+		AllowCredentials: *corsAllowCredentials,
+		MaxAge:           *corsMaxAge,
+	})
+	if err != nil {
+		logger.Fatalw("Invalid CORS options", "error", err)
+	}
+
+	cachePolicies, err := middleware_http_cache.ParsePolicies(*gatewayCacheControl)
+	if err != nil {
+		logger.Fatalw("Invalid gateway-cache-control", "error", err)
+	}
+
+	routeTimeouts, err := middleware_timeout.ParseRouteTimeouts(*gatewayRouteTimeouts)
+	if err != nil {
+		logger.Fatalw("Invalid gateway-route-timeouts", "error", err)
+	}
+
+	httpOpts := httpServerOptions{
+		readHeaderTimeout: *httpReadHeaderTimeout,
+		idleTimeout:       *httpIdleTimeout,
+	}
+
+	gatewayOpts := gatewayOptions{
+		jsonOptions: gateway.JSONOptions{
+			EmitUnpopulated: *gatewayEmitUnpopulated,
+			UseProtoNames:   *gatewayUseProtoNames,
+			UseEnumNumbers:  *gatewayUseEnumNumbers,
+			DiscardUnknown:  *gatewayDiscardUnknown,
+			Multiline:       *gatewayMultiline,
+		},
+		cors:          corsMiddleware,
+		cachePolicies: cachePolicies,
+		lbOptions: lb.Options{
+			Policy:      *grpcLbPolicy,
+			HealthCheck: *grpcHealthCheck,
+			Outlier: lb.OutlierOptions{
+				ConsecutiveFailures: *grpcOutlierFailures,
+				BaseEjectionTime:    *grpcOutlierBaseEjectionTime,
+				MaxEjectionTime:     *grpcOutlierMaxEjectionTime,
+				MaxEjectionPercent:  *grpcOutlierMaxEjectionPercent,
+			},
+		},
+		timeout: middleware_timeout.Options{
+			DefaultTimeout: *gatewayTimeout,
+			RouteTimeouts:  routeTimeouts,
+			MaxTimeout:     *gatewayMaxTimeout,
+		},
+		descriptors:               *gatewayDescriptors,
+		descriptorsReloadInterval: *gatewayDescriptorsReloadInterval,
+	}
+	if *gatewayCompression {
+		gatewayOpts.compression = &middleware_compression.Options{
+			MinSize:             *gatewayCompressionMinSize,
+			MaxDecompressedSize: *gatewayMaxDecompressedSize,
+		}
+	}
+
+	if *gatewaySessionCookie {
+		sameSite, err := middleware_session.ParseSameSite(*gatewaySessionCookieSameSite)
+		if err != nil {
+			logger.Fatalw("Invalid gateway-session-cookie-same-site", "error", err)
+		}
+		gatewayOpts.session = middleware_session.New(logger, middleware_session.Options{
+			CookieName: *gatewaySessionCookieName,
+			Domain:     *gatewaySessionCookieDomain,
+			Secure:     *gatewaySessionCookieSecure,
+			SameSite:   sameSite,
+			LogoutPath: *gatewayLogoutPath,
+			// origins with wildcards are ignored
+			WebsocketOrigins: splitList(*corsAllowedOrigins),
+		})
+	}
+
+	var authOpts authOptions
+	if *mode != "gateway" {
+		if authOpts.trustedProxies, err = auth.ParseNetworks(splitList(*grpcTrustedProxies)); err != nil {
+			logger.Fatalw("Invalid grpc-trusted-proxies", "error", err)
+		}
+		if authOpts.account.Hasher, err = user.NewHasher(*userPasswordHash); err != nil {
+			logger.Fatalw("Invalid user-password-hash", "error", err)
+		}
+		authOpts.account.Policy = user.PasswordPolicy{MinLength: *userPasswordMinLength, MinClasses: *userPasswordMinClasses}
+		authOpts.account.ResetTokens = user.NewResetTokens(*userResetTokenTTL)
+		authOpts.account.Notifier = user.NewLogNotifier(logger)
+		authOpts.account.LoginChallenges = user.NewLoginChallenges(*userTOTPChallengeTTL)
+		authOpts.account.TOTPIssuer = *userTOTPIssuer
+		// the sqlite stores share one database
+		var db *sql.DB
+		if *userStore == "sqlite" || *authAPIKeyStore == "sqlite" {
+			if *sqlitePath == "" {
+				logger.Fatal("sqlite-path must be specified with sqlite stores")
+			}
+			if db, err = sqlite.Open(*sqlitePath); err != nil {
+				logger.Fatalw("Failed to open SQLite database", "error", err)
+			}
+			defer db.Close()
+		}
+		if authOpts.users, err = createUserStore(*userStore, *userStorePath, db, authOpts.account.Hasher); err != nil {
+			logger.Fatalw("Failed to create user store", "error", err)
+		}
+		authOpts.tokens, err = auth.NewTokens(auth.TokenOptions{
+			Algorithm:  *authTokenAlgorithm,
+			KeyFile:    *authTokenKeyFile,
+			Issuer:     *authTokenIssuer,
+			Audience:   *authTokenAudience,
+			TTL:        *authTokenTTL,
+			RefreshTTL: *authRefreshTTL,
+			SessionTTL: *authSessionTTL,
+			// refreshed tokens have the current roles of users, and sessions of deleted users end
+			Lookup: func(ctx context.Context, username string) ([]string, error) {
+				u, err := authOpts.users.Get(ctx, username)
+				if errors.Is(err, user.ErrNotFound) {
+					return nil, auth.ErrUserNotFound
+				}
+				if err != nil {
+					return nil, err
+				}
+				return u.Roles, nil
+			},
+		})
+		if err != nil {
+			logger.Fatalw("Invalid auth token options", "error", err)
+		}
+		if *authTokenKeyFile == "" {
+			logger.Warn("auth-token-key-file is not specified. Session tokens are only valid until restart.")
+		}
+		apiKeyStore, err := createAPIKeyStore(*authAPIKeyStore, db)
+		if err != nil {
+			logger.Fatalw("Failed to create API key store", "error", err)
+		}
+		authOpts.account.APIKeys = auth.NewAPIKeys(apiKeyStore)
+		if *loginBackoff > 0 {
+			authOpts.account.LoginGuard = lockout.NewGuard(lockout.NewMemoryStore(), lockout.Options{
+				User:            lockout.Limits{FreeAttempts: *loginFreeAttempts, LockoutAfter: *loginLockoutAfter},
+				Client:          lockout.Limits{FreeAttempts: *loginClientFreeAttempts, LockoutAfter: *loginClientLockoutAfter},
+				Backoff:         *loginBackoff,
+				MaxBackoff:      *loginMaxBackoff,
+				LockoutDuration: *loginLockoutDuration,
+			})
+		}
+		if *authOIDCJWKS != "" {
+			// AuthOr routes tokens by issuer, so session tokens would be verified as external tokens
+			if *authOIDCIssuer == *authTokenIssuer {
+				logger.Fatal("auth-oidc-issuer must differ from auth-token-issuer")
+			}
+			authOpts.oidc, err = auth.NewOIDC(logger, auth.OIDCOptions{
+				JWKS:         *authOIDCJWKS,
+				Issuer:       *authOIDCIssuer,
+				Audience:     *authOIDCAudience,
+				ClockSkew:    *authOIDCClockSkew,
+				SubjectClaim: *authOIDCSubjectClaim,
+				RolesClaim:   *authOIDCRolesClaim,
+				ScopesClaim:  *authOIDCScopesClaim,
+				TenantClaim:  *authOIDCTenantClaim,
+			})
+			if err != nil {
+				logger.Fatalw("Invalid auth OIDC options", "error", err)
+			}
+			if err := authOpts.oidc.Reload(context.Background()); err != nil {
+				logger.Fatalw("Failed to load auth-oidc-jwks", "error", err)
+			}
+		}
+		if *authzPolicy != "" {
+			authOpts.authorizer = authz.New(logger, *authzPolicy)
+			if _, err := authOpts.authorizer.Reload(); err != nil {
+				logger.Fatalw("Failed to load authz-policy", "error", err)
+			}
+		}
+	}
+
+	serverHealth := health.New()
+	ctx := drainOnSignal(logger, serverHealth, *shutdownDrainDelay)
+	if authOpts.oidc != nil && *authOIDCJWKSRefreshInterval > 0 {
+		go authOpts.oidc.Run(ctx, *authOIDCJWKSRefreshInterval)
+	}
+	if authOpts.authorizer != nil && *authzPolicyReloadInterval > 0 {
+		go authOpts.authorizer.Run(ctx, *authzPolicyReloadInterval)
+	}
+
 	if *mode == "grpc" {
-		grpcServer := createGrpcServer(logger, tlsConfig, *debug)
-		if err := runGrpcServer(logger, grpcServer, *port); err != nil {
+		grpcServer := createGrpcServer(logger, tlsConfig, serverHealth, authOpts, *debug)
+		if err := runGrpcServer(ctx, logger, grpcServer, serverHealth, *port); err != nil {
 			logger.Fatalw("gRPC server failed to serve", "error", err)
 		}
 	} else if *mode == "gateway" {
 		if *grpcServerEndpoint == "" {
 			logger.Fatal("grpc-server-endpoint must be specified")
 		}
-		if err := runGatewayServer(logger, *grpcServerEndpoint, *port, tlsConfig, *debug); err != nil {
+		if err := runGatewayServer(ctx, logger, serverHealth, *grpcServerEndpoint, *port, tlsConfig, httpOpts, gatewayOpts, *debug); err != nil {
 			logger.Fatalw("gRPC-Gateway server failed to serve", "error", err)
 		}
 	} else if *mode == "gateway-hybrid" {
 		if *grpcServerEndpoint == "" {
 			logger.Fatal("grpc-server-endpoint must be specified")
 		}
-		grpcServer := createGrpcServer(logger, tlsConfig, *debug)
-		if err := runGrpcGatewayHybridServer(logger, grpcServer, *grpcServerEndpoint, *port, tlsConfig, *debug); err != nil {
+		grpcServer := createGrpcServer(logger, tlsConfig, serverHealth, authOpts, *debug)
+		if err := runGrpcGatewayHybridServer(ctx, logger, serverHealth, grpcServer, *grpcServerEndpoint, *port, tlsConfig, httpOpts, gatewayOpts, *debug); err != nil {
 			logger.Fatal("gRPC and gRPC-Gateway Hybrid server failed to serve", "error", err)
 		}
 	} else if *mode == "web-hybrid" {
-		grpcServer := createGrpcServer(logger, tlsConfig, *debug)
-		if err := runGrpcWebHybridServer(logger, grpcServer, *port, tlsConfig); err != nil {
+		grpcServer := createGrpcServer(logger, tlsConfig, serverHealth, authOpts, *debug)
+		webOpts := grpcWebOptions{
+			websockets:            *grpcWebWebsockets,
+			websocketPingInterval: *grpcWebWebsocketPingInterval,
+			websocketReadLimit:    *grpcWebWebsocketReadLimit,
+		}
+		if err := runGrpcWebHybridServer(ctx, logger, serverHealth, grpcServer, *port, tlsConfig, httpOpts, webOpts, corsMiddleware); err != nil {
 			logger.Fatalw("gRPC and gRPC-Web hybrid server failed to serve", "error", err)
 		}
 	} else {
@@ -90,6 +401,139 @@ func main() {
 	}
 }
 
+// Options of gRPC-Gateway servers.
+type gatewayOptions struct {
+	jsonOptions   gateway.JSONOptions
+	cors          *middleware_cors.Cors
+	compression   *middleware_compression.Options // nil if disabled
+	cachePolicies middleware_http_cache.Policies
+	timeout       middleware_timeout.Options
+	lbOptions     lb.Options
+	session       *middleware_session.Session // nil if disabled
+	// Empty for the generated services, reflection, or the path of a FileDescriptorSet.
+	descriptors               string
+	descriptorsReloadInterval time.Duration
+}
+
+// Maximum time to wait for in-flight requests on shutdown.
+const shutdownTimeout = 30 * time.Second
+
+// Paths of the JSON-RPC 2.0 and GraphQL endpoints of the hybrid servers.
+const (
+	jsonrpcPath = "/jsonrpc"
+	graphqlPath = "/graphql"
+)
+
+// Options of authentication and of the Account service.
+type authOptions struct {
+	tokens *auth.Tokens
+	users  user.UserStore
+	// Options of account management
+	account handler.AccountOptions
+	// nil if external tokens are disabled
+	oidc *auth.OIDC
+	// nil if authorization is disabled
+	authorizer *authz.Authorizer
+	// Peers whose client address metadata is trusted, besides in-process peers
+	trustedProxies []netip.Prefix
+}
+
+// Options of gRPC-Web servers.
+type grpcWebOptions struct {
+	websockets            bool
+	websocketPingInterval time.Duration
+	websocketReadLimit    int64
+}
+
+// Options of HTTP servers.
+type httpServerOptions struct {
+	readHeaderTimeout time.Duration
+	idleTimeout       time.Duration
+}
+
+// Wrap gateway HTTP handlers with the common middlewares.
+func (opts gatewayOptions) wrapHandler(logger log.Logger, h http.Handler) http.Handler {
+	if opts.session != nil {
+		h = opts.session.Handler(h)
+	}
+	h = middleware_timeout.Handler(opts.timeout, h)
+	h = middleware_http_cache.Handler(opts.cachePolicies, h)
+	if opts.compression != nil {
+		h = middleware_compression.Handler(logger, *opts.compression, h)
+	}
+	h = opts.cors.Handler(h)
+	return middleware_access_log.Handler(logger, h)
+}
+
+// Split a comma-separated flag value.
+func splitList(s string) []string {
+	var values []string
+	for _, value := range strings.Split(s, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// Return a context which is canceled after SIGINT or SIGTERM, once readiness has failed for drainDelay.
+// A second signal terminates the process immediately.
+func drainOnSignal(logger log.Logger, serverHealth *health.Health, drainDelay time.Duration) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		logger.Infow("Draining before shutdown", "signal", sig.String(), "delay", drainDelay.String())
+		serverHealth.Drain()
+		time.Sleep(drainDelay)
+		cancel()
+	}()
+	return ctx
+}
+
+// Serve HTTP requests until ctx is canceled, then shut down gracefully.
+// gRPC servers served by ServeHTTP cannot be stopped gracefully, so they are shut down with the HTTP server.
+func serveHTTP(ctx context.Context, logger log.Logger, server *http.Server, serverHealth *health.Health) error {
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		logger.Error("Server failed to listen at ", server.Addr)
+		return err
+	}
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Warnw("Server failed to shut down gracefully", "error", err)
+		}
+	}()
+
+	serverHealth.SetServing()
+	if server.TLSConfig != nil {
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		<-shutdownDone
+		logger.Info("Server shut down")
+		return nil
+	}
+	return err
+}
+
+// Stop gRPC server gracefully, and forcibly after the shutdown timeout, e.g. if streams are still open.
+func stopGrpcServer(grpcServer *grpc.Server) {
+	timer := time.AfterFunc(shutdownTimeout, grpcServer.Stop)
+	defer timer.Stop()
+	grpcServer.GracefulStop()
+}
+
 func loadTlsCert(tlsCert, tlsKey string) (*tls.Config, error) {
 	cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
 	if err != nil {
@@ -102,8 +546,10 @@ func loadTlsCert(tlsCert, tlsKey string) (*tls.Config, error) {
 
 // Run standalone gRPC server.
 func runGrpcServer(
+	ctx context.Context,
 	logger log.Logger,
 	grpcServer *grpc.Server,
+	serverHealth *health.Health,
 	port int,
 ) error {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
@@ -112,158 +558,242 @@ func runGrpcServer(
 		return err
 	}
 
+	go func() {
+		<-ctx.Done()
+		stopGrpcServer(grpcServer)
+	}()
+
 	logger.Info("gRPC server is listening at port ", port)
-	return grpcServer.Serve(listener)
+	serverHealth.SetServing()
+	if err := grpcServer.Serve(listener); err != nil {
+		return err
+	}
+	logger.Info("Server shut down")
+	return nil
 }
 
 // Run standalone gRPC-Gateway server - a reverse-proxy server which translates a RESTful HTTP API into gRPC.
 // The gateway server should be used with a gRPC server.
 // https://github.com/grpc-ecosystem/grpc-gateway
 func runGatewayServer(
+	ctx context.Context,
 	logger log.Logger,
+	serverHealth *health.Health,
 	grpcServerEndpoint string,
 	port int,
 	tlsConfig *tls.Config,
+	httpOpts httpServerOptions,
+	opts gatewayOptions,
 	useSwagger bool,
 ) error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
 	grpcServerTlsEnabled := tlsConfig != nil
-	gatewayMux, err := createGatewayMux(logger, grpcServerEndpoint, grpcServerTlsEnabled, ctx)
+	gatewayMux, err := createGatewayMux(logger, serverHealth, grpcServerEndpoint, grpcServerTlsEnabled, opts, ctx)
 	if err != nil {
 		logger.Error("Failed to create gateway mux")
 		return err
 	}
 
-	var httpHandler http.Handler = gatewayMux
+	var httpHandler http.Handler = gateway.PrettyHandler(gatewayMux)
 	if useSwagger {
 		fileServer := http.FileServer(http.Dir("./third_party/swagger_ui"))
+		gatewayHandler := httpHandler
 		httpHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if strings.HasPrefix(r.URL.Path, "/swagger/") {
 				http.StripPrefix("/swagger/", fileServer).ServeHTTP(w, r)
 			} else {
-				gatewayMux.ServeHTTP(w, r)
+				gatewayHandler.ServeHTTP(w, r)
 			}
 		})
 	}
 
+	httpHandler = serverHealth.Handler(opts.wrapHandler(logger, httpHandler))
+
 	logger.Info("gRPC-Gateway server is listening at port ", port)
 	server := &http.Server{
-		Addr:      fmt.Sprintf(":%d", port),
-		Handler:   httpHandler,
-		TLSConfig: tlsConfig,
-	}
-	if tlsConfig != nil {
-		return server.ListenAndServeTLS("", "")
-	} else {
-		return server.ListenAndServe()
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           httpHandler,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: httpOpts.readHeaderTimeout,
+		IdleTimeout:       httpOpts.idleTimeout,
 	}
+	return serveHTTP(ctx, logger, server, serverHealth)
 }
 
 // Run gRPC server and gRPC-Gateway server together on the same port using mux.
+// Connect requests are served as well. Unary Connect requests must have the Connect-Protocol-Version header,
+// because their paths are the same as the paths of the gateway. JSON-RPC 2.0 is served at /jsonrpc and GraphQL at /graphql.
 // https://github.com/philips/grpc-gateway-example
 func runGrpcGatewayHybridServer(
+	ctx context.Context,
 	logger log.Logger,
+	serverHealth *health.Health,
 	grpcServer *grpc.Server,
 	grpcServerEndpoint string,
 	port int,
 	tlsConfig *tls.Config,
+	httpOpts httpServerOptions,
+	opts gatewayOptions,
 	useSwagger bool,
 ) error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
 	grpcServerTlsEnabled := tlsConfig != nil
-	gatewayMux, err := createGatewayMux(logger, grpcServerEndpoint, grpcServerTlsEnabled, ctx)
+	gatewayMux, err := createGatewayMux(logger, serverHealth, grpcServerEndpoint, grpcServerTlsEnabled, opts, ctx)
+	if err != nil {
+		return err
+	}
+
+	connectConn, err := dialInProcess(grpcServer, tlsConfig)
 	if err != nil {
+		logger.Error("Failed to dial in-process gRPC server")
 		return err
 	}
+	connectHandler := middleware_access_log.Handler(logger, opts.cors.Handler(connect.NewHandler(connectConn)))
 
 	mux := http.NewServeMux()
-	mux.Handle("/", gatewayMux)
+	mux.Handle("/", gateway.PrettyHandler(gatewayMux))
+	mux.Handle(jsonrpcPath, jsonrpc.NewHandler(connectConn, registeredServices(grpcServer), jsonrpc.Options{
+		WebsocketOriginFunc: opts.cors.WebsocketOriginAllowed,
+	}))
+	graphqlHandler, err := createGraphqlHandler(connectConn, graphql.Options{WebsocketOriginFunc: opts.cors.WebsocketOriginAllowed})
+	if err != nil {
+		logger.Error("Failed to create GraphQL schema")
+		return err
+	}
+	mux.Handle(graphqlPath, graphqlHandler)
 
 	if useSwagger {
 		fileServer := http.FileServer(http.Dir("./third_party/swagger_ui"))
 		mux.Handle("/swagger/", http.StripPrefix("/swagger/", fileServer))
+		mux.Handle("/graphiql/", http.StripPrefix("/graphiql/", http.FileServer(http.Dir("./third_party/graphiql"))))
 	}
 
 	httpHandler := func(grpcServer *grpc.Server, httpHandler http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+				// the peer address of gRPC requests is the client, which cannot set another client address
+				r.Header.Del(clientip.MetadataKey)
 				grpcServer.ServeHTTP(w, r)
+			} else if connect.IsConnectRequest(r) {
+				connectHandler.ServeHTTP(w, r)
 			} else {
 				httpHandler.ServeHTTP(w, r)
 			}
 		})
-	}(grpcServer, mux)
+	}(grpcServer, serverHealth.Handler(opts.wrapHandler(logger, mux)))
 
 	// https://stackoverflow.com/questions/69542087/why-am-i-getting-connection-connection-closed-before-server-preface-received-in
 	httpHandler = h2c.NewHandler(httpHandler, &http2.Server{})
 
 	logger.Info("gRPC and gRPC-Gateway Hybrid server is listening at port ", port)
 	server := &http.Server{
-		Addr:      fmt.Sprintf(":%d", port),
-		Handler:   httpHandler,
-		TLSConfig: tlsConfig,
-	}
-	if tlsConfig != nil {
-		return server.ListenAndServeTLS("", "")
-	} else {
-		return server.ListenAndServe()
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           httpHandler,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: httpOpts.readHeaderTimeout,
+		IdleTimeout:       httpOpts.idleTimeout,
 	}
+	return serveHTTP(ctx, logger, server, serverHealth)
 }
 
 // Run gRPC server and gRPC-Web server together on the same port using mux.
-// Note that this server only supports unary calls and server-side streams.
+// Client-side and bidirectional streams need the websocket transport of gRPC-Web.
+// Connect requests are served as well, including bidirectional streams over HTTP/2, JSON-RPC 2.0 at /jsonrpc and GraphQL at /graphql.
 // https://pkg.go.dev/github.com/improbable-eng/grpc-web/go/grpcweb
 func runGrpcWebHybridServer(
+	ctx context.Context,
 	logger log.Logger,
+	serverHealth *health.Health,
 	grpcServer *grpc.Server,
 	port int,
 	tlsConfig *tls.Config,
+	httpOpts httpServerOptions,
+	webOpts grpcWebOptions,
+	cors *middleware_cors.Cors,
 ) error {
+	httpHandler, err := createGrpcWebHybridHandler(logger, serverHealth, grpcServer, tlsConfig, webOpts, cors)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("gRPC and gRPC-Web Hybrid server is listening at port ", port)
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           httpHandler,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: httpOpts.readHeaderTimeout,
+		IdleTimeout:       httpOpts.idleTimeout,
+	}
+	return serveHTTP(ctx, logger, server, serverHealth)
+}
+
+func createGrpcWebHybridHandler(
+	logger log.Logger,
+	serverHealth *health.Health,
+	grpcServer *grpc.Server,
+	tlsConfig *tls.Config,
+	webOpts grpcWebOptions,
+	cors *middleware_cors.Cors,
+) (http.Handler, error) {
 	grpcWebServer := grpcweb.WrapServer(grpcServer,
-		grpcweb.WithOriginFunc(func(origin string) bool {
-			return true // allow all origins
-		}),
+		grpcweb.WithOriginFunc(cors.OriginAllowed),
+		grpcweb.WithAllowedRequestHeaders(append(cors.AllowedHeaders(), "X-Grpc-Web", "X-User-Agent", "Grpc-Timeout")),
+		grpcweb.WithWebsockets(webOpts.websockets),
+		grpcweb.WithWebsocketOriginFunc(cors.WebsocketOriginAllowed),
+		grpcweb.WithWebsocketPingInterval(webOpts.websocketPingInterval),
+		grpcweb.WithWebsocketsMessageReadLimit(webOpts.websocketReadLimit),
 	)
 
+	connectConn, err := dialInProcess(grpcServer, tlsConfig)
+	if err != nil {
+		logger.Error("Failed to dial in-process gRPC server")
+		return nil, err
+	}
+	connectHandler := middleware_access_log.Handler(logger, cors.Handler(connect.NewHandler(connectConn)))
+
 	mux := http.NewServeMux()
 	mux.Handle("/", grpcWebServer)
+	mux.Handle(jsonrpcPath, cors.Handler(jsonrpc.NewHandler(connectConn, registeredServices(grpcServer), jsonrpc.Options{
+		WebsocketOriginFunc: cors.WebsocketOriginAllowed,
+		WebsocketReadLimit:  webOpts.websocketReadLimit,
+	})))
+	graphqlHandler, err := createGraphqlHandler(connectConn, graphql.Options{
+		WebsocketOriginFunc: cors.WebsocketOriginAllowed,
+		WebsocketReadLimit:  webOpts.websocketReadLimit,
+	})
+	if err != nil {
+		logger.Error("Failed to create GraphQL schema")
+		return nil, err
+	}
+	mux.Handle(graphqlPath, cors.Handler(graphqlHandler))
 
 	httpHandler := func(wrappedGrpcServer *grpcweb.WrappedGrpcServer, httpHandler http.Handler) http.Handler {
+		grpcWebHandler := middleware_access_log.Handler(logger, wrappedGrpcServer)
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if wrappedGrpcServer.IsGrpcWebRequest(r) {
+			// gRPC and gRPC-Web requests are served with the address of the client as the peer address, which is
+			// trusted for loopback clients, so that they cannot set another client address
+			r.Header.Del(clientip.MetadataKey)
+			if wrappedGrpcServer.IsGrpcWebRequest(r) || webOpts.websockets && wrappedGrpcServer.IsGrpcWebSocketRequest(r) {
 				// handle gRPC-Web requests
-				wrappedGrpcServer.ServeHTTP(w, r)
+				grpcWebHandler.ServeHTTP(w, r)
 			} else if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
 				// handle regular gRPC requests
 				wrappedGrpcServer.ServeHTTP(w, r)
+			} else if connect.IsConnectRequest(r) || r.Method == http.MethodOptions && !wrappedGrpcServer.IsAcceptableGrpcCorsRequest(r) {
+				// handle Connect requests and their CORS preflight requests
+				connectHandler.ServeHTTP(w, r)
 			} else {
 				httpHandler.ServeHTTP(w, r)
 			}
 		})
-	}(grpcWebServer, mux)
+	}(grpcWebServer, serverHealth.Handler(middleware_access_log.Handler(logger, mux)))
 	// https://stackoverflow.com/questions/69542087/why-am-i-getting-connection-connection-closed-before-server-preface-received-in
-	httpHandler = h2c.NewHandler(httpHandler, &http2.Server{})
-
-	logger.Info("gRPC and gRPC-Web Hybrid server is listening at port ", port)
-	server := &http.Server{
-		Addr:      fmt.Sprintf(":%d", port),
-		Handler:   httpHandler,
-		TLSConfig: tlsConfig,
-	}
-	if tlsConfig != nil {
-		return server.ListenAndServeTLS("", "")
-	} else {
-		return server.ListenAndServe()
-	}
+	return h2c.NewHandler(httpHandler, &http2.Server{}), nil
 }
 
 func createGrpcServer(
 	logger log.Logger,
 	tlsConfig *tls.Config,
+	serverHealth *health.Health,
+	authOpts authOptions,
 	enableReflection bool,
 ) *grpc.Server {
 	var credsOption grpc.ServerOption = grpc.EmptyServerOption{}
@@ -274,30 +804,56 @@ func createGrpcServer(
 	loggerFunc := func(ctx context.Context, logger log.Logger) log.Logger {
 		return logger.With("trace-id", middleware_trace_id.MustGetTraceID(ctx))
 	}
+	// Log the subject of calls after authentication
+	principalLoggerFunc := func(ctx context.Context, logger log.Logger) log.Logger {
+		principal, ok := auth.FromContext(ctx)
+		if !ok || principal.Subject == "" {
+			return logger
+		}
+		return logger.With("auth.subject", principal.Subject, "auth.method", principal.AuthMethod)
+	}
+	clientIPResolver := clientip.NewResolver(authOpts.trustedProxies)
 	skipAuthFunc := func(ctx context.Context, service string, method string) bool {
 		return service == grpc_reflection_v1alpha.ServerReflection_ServiceDesc.ServiceName ||
 			service == grpc_health_v1.Health_ServiceDesc.ServiceName
 	}
+	streamInterceptors := []grpc.StreamServerInterceptor{
+		middleware_trace_id.StreamServerInterceptor(),
+		middleware_logging.StreamServerInterceptor(logger, loggerFunc),
+		middleware_recovery.StreamServerInterceptor(logger),
+		middleware_client_ip.StreamServerInterceptor(clientIPResolver),
+		middleware_skip.StreamServerInterceptor(
+			grpc_middleware_auth.StreamServerInterceptor(auth.RejectAll),
+			skipAuthFunc,
+		),
+		middleware_logging.UpdateStreamServerInterceptor(principalLoggerFunc),
+	}
+	unaryInterceptors := []grpc.UnaryServerInterceptor{
+		middleware_trace_id.UnaryServerInterceptor(),
+		middleware_logging.UnaryServerInterceptor(logger, loggerFunc),
+		middleware_recovery.UnaryServerInterceptor(logger),
+		middleware_client_ip.UnaryServerInterceptor(clientIPResolver),
+		middleware_skip.UnaryServerInterceptor(
+			grpc_middleware_auth.UnaryServerInterceptor(auth.RejectAll),
+			skipAuthFunc,
+		),
+		middleware_logging.UpdateUnaryServerInterceptor(principalLoggerFunc),
+	}
+	// Authorize after authentication, which puts the principals of callers into the context
+	if authOpts.authorizer != nil {
+		streamInterceptors = append(streamInterceptors, middleware_skip.StreamServerInterceptor(
+			middleware_authz.StreamServerInterceptor(authOpts.authorizer),
+			skipAuthFunc,
+		))
+		unaryInterceptors = append(unaryInterceptors, middleware_skip.UnaryServerInterceptor(
+			middleware_authz.UnaryServerInterceptor(authOpts.authorizer),
+			skipAuthFunc,
+		))
+	}
 	server := grpc.NewServer(
 		credsOption,
-		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(
-			middleware_trace_id.StreamServerInterceptor(),
-			middleware_logging.StreamServerInterceptor(logger, loggerFunc),
-			middleware_recovery.StreamServerInterceptor(logger),
-			middleware_skip.StreamServerInterceptor(
-				grpc_middleware_auth.StreamServerInterceptor(auth.RejectAll),
-				skipAuthFunc,
-			),
-		)),
-		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
-			middleware_trace_id.UnaryServerInterceptor(),
-			middleware_logging.UnaryServerInterceptor(logger, loggerFunc),
-			middleware_recovery.UnaryServerInterceptor(logger),
-			middleware_skip.UnaryServerInterceptor(
-				grpc_middleware_auth.UnaryServerInterceptor(auth.RejectAll),
-				skipAuthFunc,
-			),
-		)),
+		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(streamInterceptors...)),
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(unaryInterceptors...)),
 	)
 
 	// Register reflection service
@@ -306,23 +862,124 @@ func createGrpcServer(
 	}
 
 	// Register health service
-	grpc_health_v1.RegisterHealthServer(server, health.NewServer())
+	grpc_health_v1.RegisterHealthServer(server, serverHealth.GrpcServer())
 
 	// Register custom services
-	pb.RegisterHealthServer(server, handler.NewHealthServer())
-	pb.RegisterGreeterServer(server, handler.NewGreeterServer())
-	pb.RegisterRouteGuideServer(server, handler.NewRouteGuideServer())
-	pb.RegisterAccountServer(server, handler.NewAccountServer())
+	pb.RegisterHealthServer(server, handler.NewHealthServer(serverHealth))
+	authFunc := authOpts.tokens.SessionAuth
+	if authOpts.oidc != nil {
+		authFunc = authOpts.oidc.AuthOr(authFunc)
+	}
+	if authOpts.account.APIKeys != nil {
+		authFunc = authOpts.account.APIKeys.AuthOr(authFunc)
+	}
+	pb.RegisterGreeterServer(server, handler.NewGreeterServer(authFunc))
+	pb.RegisterRouteGuideServer(server, handler.NewRouteGuideServer(authFunc))
+	pb.RegisterAccountServer(server, handler.NewAccountServer(authOpts.tokens, authOpts.users, authOpts.account))
 
 	return server
 }
 
+// Create the API key store of the auth-api-key-store flag. db is the database of the sqlite store.
+func createAPIKeyStore(kind string, db *sql.DB) (auth.APIKeyStore, error) {
+	switch kind {
+	case "memory":
+		return auth.NewMemoryAPIKeyStore(), nil
+	case "sqlite":
+		return auth.NewSQLiteAPIKeyStore(context.Background(), db)
+	default:
+		return nil, fmt.Errorf("invalid API key store %q", kind)
+	}
+}
+
+// Create the user store of the user-store flag. The memory store has the demo user hello with password world
+// and role user. path is the users file of the file store, and db is the database of the sqlite store.
+func createUserStore(kind string, path string, db *sql.DB, hasher *user.Hasher) (user.UserStore, error) {
+	switch kind {
+	case "memory":
+		hash, err := hasher.Hash("world")
+		if err != nil {
+			return nil, err
+		}
+		return user.NewMemoryStore(user.User{Username: "hello", PasswordHash: hash, Roles: []string{"user"}}), nil
+	case "file":
+		return user.NewFileStore(path)
+	case "sqlite":
+		return user.NewSQLiteStore(context.Background(), db)
+	default:
+		return nil, fmt.Errorf("invalid user store %q", kind)
+	}
+}
+
+// Descriptors of the services registered in grpcServer, which are served by the JSON-RPC endpoint.
+func registeredServices(grpcServer *grpc.Server) []protoreflect.ServiceDescriptor {
+	var services []protoreflect.ServiceDescriptor
+	for name := range grpcServer.GetServiceInfo() {
+		desc, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(name))
+		if service, ok := desc.(protoreflect.ServiceDescriptor); err == nil && ok {
+			services = append(services, service)
+		}
+	}
+	return services
+}
+
+// GraphQL API of the custom services. The Account methods changing state are the only mutations.
+func createGraphqlHandler(conn grpc.ClientConnInterface, opts graphql.Options) (*graphql.Handler, error) {
+	services := []protoreflect.ServiceDescriptor{
+		pb.File_grpc_example_v1_route_guide_proto.Services().ByName("RouteGuide"),
+		pb.File_grpc_example_v1_greeter_proto.Services().ByName("Greeter"),
+		pb.File_grpc_example_v1_account_proto.Services().ByName("Account"),
+		pb.File_grpc_example_v1_health_proto.Services().ByName("Health"),
+	}
+	schema, err := graphql.NewSchema(conn, services, graphql.SchemaOptions{
+		Mutations: []string{
+			"grpc_example.v1.Account.Login",
+			"grpc_example.v1.Account.Refresh",
+			"grpc_example.v1.Account.Logout",
+			"grpc_example.v1.Account.RevokeSessions",
+			"grpc_example.v1.Account.Register",
+			"grpc_example.v1.Account.ChangePassword",
+			"grpc_example.v1.Account.RequestPasswordReset",
+			"grpc_example.v1.Account.ResetPassword",
+			"grpc_example.v1.Account.DeleteAccount",
+			"grpc_example.v1.Account.CreateApiKey",
+			"grpc_example.v1.Account.RevokeApiKey",
+			"grpc_example.v1.Account.EnrollTOTP",
+			"grpc_example.v1.Account.ConfirmTOTP",
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return graphql.NewHandler(schema, opts), nil
+}
+
+// Dial gRPC server in process over an in-memory connection, so that calls run through its interceptors.
+func dialInProcess(grpcServer *grpc.Server, tlsConfig *tls.Config) (*grpc.ClientConn, error) {
+	listener := memconn.Listen()
+	go grpcServer.Serve(listener)
+
+	credsOption := grpc.WithTransportCredentials(insecure.NewCredentials())
+	if tlsConfig != nil {
+		// the server certificate is not verified because the connection never leaves the process
+		credsOption = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{InsecureSkipVerify: true}))
+	}
+	return grpc.Dial("passthrough:///in-process",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		credsOption,
+	)
+}
+
 func createGatewayMux(
 	logger log.Logger,
+	serverHealth *health.Health,
 	grpcServerEndpoint string,
 	grpcServerTlsEnabled bool,
+	opts gatewayOptions,
 	ctx context.Context,
-) (*runtime.ServeMux, error) {
+) (http.Handler, error) {
 	credsOption := grpc.WithTransportCredentials(insecure.NewCredentials())
 	if grpcServerTlsEnabled {
 		creds := credentials.NewTLS(&tls.Config{
@@ -331,13 +988,62 @@ func createGatewayMux(
 		credsOption = grpc.WithTransportCredentials(creds)
 	}
 
-	clientConn, err := grpc.DialContext(ctx, grpcServerEndpoint, credsOption)
+	target, dialOptions, err := lb.DialOptions(splitList(grpcServerEndpoint), opts.lbOptions)
+	if err != nil {
+		logger.Error("Invalid grpc-server-endpoint ", grpcServerEndpoint)
+		return nil, err
+	}
+
+	clientConn, err := grpc.DialContext(ctx, target, append(dialOptions, credsOption)...)
 	if err != nil {
 		logger.Error("Failed to dail ", grpcServerEndpoint)
 		return nil, err
 	}
+	serverHealth.AddCheck("grpc-upstream", health.ClientConnCheck(clientConn))
+
+	var muxOptions []runtime.ServeMuxOption
+	muxOptions = append(muxOptions, gateway.JSONMarshalerOptions(opts.jsonOptions)...)
+	muxOptions = append(muxOptions, gateway.BinaryMarshalerOptions(opts.jsonOptions)...)
+	muxOptions = append(muxOptions, runtime.WithErrorHandler(middleware_timeout.ErrorHandler))
+	muxOptions = append(muxOptions, runtime.WithForwardResponseOption(middleware_http_cache.ForwardResponseOption))
+	if opts.session != nil {
+		muxOptions = append(muxOptions, runtime.WithForwardResponseOption(opts.session.ForwardResponseOption))
+	}
+	muxOptions = append(muxOptions, runtime.WithMetadata(func(ctx context.Context, r *http.Request) metadata.MD {
+		md := metadata.MD{}
+		// forward the request id so that the trace id of the gRPC call matches the HTTP access log
+		if requestId := r.Header.Get(middleware_access_log.RequestIDHeader); requestId != "" {
+			md.Set(middleware_trace_id.RequestIDMetadataKey, requestId)
+		}
+		if apiKey := r.Header.Get(auth.APIKeyHeader); apiKey != "" {
+			md.Set(auth.APIKeyHeader, apiKey)
+		}
+		// the gRPC server trusts the client address from the gateway, and HeaderMatcher drops the one of clients
+		clientip.SetMetadata(md, r)
+		return md
+	}))
+	muxOptions = append(muxOptions, runtime.WithIncomingHeaderMatcher(clientip.HeaderMatcher))
+	newMux := func() *runtime.ServeMux {
+		return runtime.NewServeMux(muxOptions...)
+	}
+
+	if opts.descriptors != "" {
+		source := transcoder.FileSource(opts.descriptors)
+		if opts.descriptors == "reflection" {
+			source = transcoder.ReflectionSource(clientConn)
+		}
+		t := transcoder.New(logger, clientConn, source, newMux)
+		if _, err := t.Reload(ctx); err != nil {
+			logger.Error("Failed to load gateway descriptors ", opts.descriptors)
+			return nil, err
+		}
+		if opts.descriptorsReloadInterval > 0 {
+			go t.Run(ctx, opts.descriptorsReloadInterval)
+		}
+		return t, nil
+	}
 
-	gatewayMux := runtime.NewServeMux()
+	gatewayMux := newMux()
 	for _, f := range []func(context.Context, *runtime.ServeMux, *grpc.ClientConn) error{
 		pb.RegisterHealthHandler,
 		pb.RegisterGreeterHandler,
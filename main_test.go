@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"nhooyr.io/websocket"
+
+	handler "github.com/zmzhang8/grpc_example/handler/v1"
+	"github.com/zmzhang8/grpc_example/lib/auth"
+	"github.com/zmzhang8/grpc_example/lib/health"
+	"github.com/zmzhang8/grpc_example/lib/lb"
+	"github.com/zmzhang8/grpc_example/lib/lockout"
+	"github.com/zmzhang8/grpc_example/lib/log"
+	"github.com/zmzhang8/grpc_example/lib/sqlite"
+	"github.com/zmzhang8/grpc_example/lib/user"
+	middleware_cors "github.com/zmzhang8/grpc_example/middleware/cors"
+	pb "github.com/zmzhang8/grpc_example/proto/v1"
+)
+
+var testGrpcWebOptions = grpcWebOptions{
+	websockets:            true,
+	websocketPingInterval: 30 * time.Second,
+	websocketReadLimit:    4 << 20,
+}
+
+func newTestLogger() log.Logger {
+	return log.NewLogger(log.NewCore(false, os.Stdout, false))
+}
+
+func newTestTokens(t *testing.T) *auth.Tokens {
+	tokens, err := auth.NewTokens(auth.TokenOptions{Algorithm: auth.AlgorithmHS256, Issuer: "test", Audience: "test", TTL: time.Hour, RefreshTTL: time.Hour})
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return tokens
+}
+
+// startGrpcWebServer serves the gRPC-Web hybrid handler of grpcServer.
+func startGrpcWebServer(t *testing.T, grpcServer *grpc.Server, webOpts grpcWebOptions) *httptest.Server {
+	logger := newTestLogger()
+	serverHealth := health.New()
+	serverHealth.SetServing()
+	cors, err := middleware_cors.New(logger, middleware_cors.Options{
+		AllowedOrigins: []string{"https://allowed.example"},
+		AllowedHeaders: []string{"Authorization", "Content-Type"},
+	})
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	h, err := createGrpcWebHybridHandler(logger, serverHealth, grpcServer, nil, webOpts, cors)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	server := httptest.NewServer(h)
+	t.Cleanup(func() {
+		server.Close()
+		grpcServer.Stop()
+	})
+	return server
+}
+
+// newRouteGuideGrpcServer returns a server without auth interceptors.
+func newRouteGuideGrpcServer() *grpc.Server {
+	grpcServer := grpc.NewServer()
+	pb.RegisterRouteGuideServer(grpcServer, handler.NewRouteGuideServer(auth.AllowAll))
+	return grpcServer
+}
+
+// grpcWebsocketClient speaks the websocket transport of gRPC-Web.
+// Each client message is prefixed with 0 (data) or 1 (end of client stream), and
+// the server response is a sequence of gRPC-Web frames split over websocket messages.
+type grpcWebsocketClient struct {
+	t       *testing.T
+	conn    *websocket.Conn
+	buf     bytes.Buffer
+	trailer http.Header
+}
+
+func dialGrpcWebsocket(t *testing.T, serverURL string, method string, origin string) (*grpcWebsocketClient, *http.Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	header := http.Header{}
+	if origin != "" {
+		header.Set("Origin", origin)
+	}
+	conn, resp, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(serverURL, "http")+method, &websocket.DialOptions{
+		Subprotocols: []string{"grpc-websockets"},
+		HTTPHeader:   header,
+	})
+	if err != nil {
+		return nil, resp, err
+	}
+	t.Cleanup(func() { conn.Close(websocket.StatusNormalClosure, "") })
+
+	c := &grpcWebsocketClient{t: t, conn: conn}
+	c.write([]byte("content-type: application/grpc-web+proto\r\nx-grpc-web: 1\r\n\r\n"))
+	return c, resp, nil
+}
+
+func (c *grpcWebsocketClient) write(data []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.conn.Write(ctx, websocket.MessageBinary, data); err != nil {
+		c.t.Fatalf("err %v; want <nil>", err)
+	}
+}
+
+func (c *grpcWebsocketClient) send(msg proto.Message) {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		c.t.Fatalf("err %v; want <nil>", err)
+	}
+	frame := make([]byte, 6, 6+len(data))
+	binary.BigEndian.PutUint32(frame[2:], uint32(len(data)))
+	c.write(append(frame, data...))
+}
+
+func (c *grpcWebsocketClient) closeSend() {
+	c.write([]byte{1})
+}
+
+// readFull reads n bytes of the response, which can span websocket messages.
+func (c *grpcWebsocketClient) readFull(n int) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for c.buf.Len() < n {
+		_, data, err := c.conn.Read(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.buf.Write(data)
+	}
+	return c.buf.Next(n), nil
+}
+
+// recv reads the next message, skipping headers. It returns false and sets the trailer at the end of the response.
+func (c *grpcWebsocketClient) recv(msg proto.Message) (bool, error) {
+	for {
+		prefix, err := c.readFull(5)
+		if err != nil {
+			return false, err
+		}
+		data, err := c.readFull(int(binary.BigEndian.Uint32(prefix[1:])))
+		if err != nil {
+			return false, err
+		}
+		if prefix[0]&0x80 == 0 {
+			return true, proto.Unmarshal(data, msg)
+		}
+		header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(append(data, "\r\n"...)))).ReadMIMEHeader()
+		if err != nil {
+			return false, err
+		}
+		if header.Get("Grpc-Status") != "" {
+			c.trailer = http.Header(header)
+			return false, nil
+		}
+	}
+}
+
+func (c *grpcWebsocketClient) mustRecv(msg proto.Message) {
+	if ok, err := c.recv(msg); !ok || err != nil {
+		c.t.Fatalf("received %v, err %v, trailer %v; want message", ok, err, c.trailer)
+	}
+}
+
+func (c *grpcWebsocketClient) mustRecvTrailer(wantStatus string) {
+	var msg pb.RouteNote
+	if ok, err := c.recv(&msg); ok || err != nil {
+		c.t.Fatalf("received %v, err %v; want trailer", ok, err)
+	}
+	if got := c.trailer.Get("Grpc-Status"); got != wantStatus {
+		c.t.Errorf("grpc-status %v (%v); want %v", got, c.trailer.Get("Grpc-Message"), wantStatus)
+	}
+}
+
+func TestGrpcWebHybrid_websocketClientStream(t *testing.T) {
+	server := startGrpcWebServer(t, newRouteGuideGrpcServer(), testGrpcWebOptions)
+	c, _, err := dialGrpcWebsocket(t, server.URL, "/grpc_example.v1.RouteGuide/RecordRoute", "")
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	for i := int32(0); i < 3; i++ {
+		c.send(&pb.Point{Latitude: 409146138 + i, Longitude: -746188906})
+	}
+	c.closeSend()
+
+	var summary pb.RouteSummary
+	c.mustRecv(&summary)
+	if summary.PointCount != 3 {
+		t.Errorf("point count %v; want 3", summary.PointCount)
+	}
+	c.mustRecvTrailer("0")
+}
+
+func TestGrpcWebHybrid_websocketBidiStream(t *testing.T) {
+	server := startGrpcWebServer(t, newRouteGuideGrpcServer(), testGrpcWebOptions)
+	c, _, err := dialGrpcWebsocket(t, server.URL, "/grpc_example.v1.RouteGuide/RouteChat", "")
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	location := &pb.Point{Latitude: 1, Longitude: 2}
+
+	// each response is received before the next request is sent
+	c.send(&pb.RouteNote{Location: location, Message: "first"})
+	var note pb.RouteNote
+	c.mustRecv(&note)
+	if note.Message != "first" {
+		t.Errorf("message %v; want first", note.Message)
+	}
+	c.send(&pb.RouteNote{Location: location, Message: "second"})
+	for _, want := range []string{"first", "second"} {
+		c.mustRecv(&note)
+		if note.Message != want {
+			t.Errorf("message %v; want %v", note.Message, want)
+		}
+	}
+	c.closeSend()
+
+	c.mustRecvTrailer("0")
+}
+
+func TestGrpcWebHybrid_websocketInterceptors(t *testing.T) {
+	server := startGrpcWebServer(t, createGrpcServer(newTestLogger(), nil, health.New(), authOptions{tokens: newTestTokens(t)}, false), testGrpcWebOptions)
+	c, _, err := dialGrpcWebsocket(t, server.URL, "/grpc_example.v1.RouteGuide/RouteChat", "")
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	c.send(&pb.RouteNote{Location: &pb.Point{}, Message: "note"})
+	c.closeSend()
+
+	c.mustRecvTrailer("16") // Unauthenticated
+}
+
+func TestGrpcWebHybrid_websocketOrigin(t *testing.T) {
+	server := startGrpcWebServer(t, newRouteGuideGrpcServer(), testGrpcWebOptions)
+
+	for _, tc := range []struct {
+		origin  string
+		wantErr bool
+	}{
+		{"https://allowed.example", false},
+		{server.URL, false},
+		{"https://evil.example", true},
+	} {
+		_, resp, err := dialGrpcWebsocket(t, server.URL, "/grpc_example.v1.RouteGuide/RouteChat", tc.origin)
+
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%v: err %v; want error %v", tc.origin, err, tc.wantErr)
+		}
+		if tc.wantErr && (resp == nil || resp.StatusCode != http.StatusForbidden) {
+			t.Errorf("%v: response %v; want %v", tc.origin, resp, http.StatusForbidden)
+		}
+	}
+}
+
+func TestGrpcWebHybrid_websocketReadLimit(t *testing.T) {
+	webOpts := testGrpcWebOptions
+	webOpts.websocketReadLimit = 64
+	server := startGrpcWebServer(t, newRouteGuideGrpcServer(), webOpts)
+	c, _, err := dialGrpcWebsocket(t, server.URL, "/grpc_example.v1.RouteGuide/RouteChat", "")
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	c.send(&pb.RouteNote{Location: &pb.Point{}, Message: strings.Repeat("x", 128)})
+
+	var note pb.RouteNote
+	if _, err := c.recv(&note); websocket.CloseStatus(err) != websocket.StatusMessageTooBig {
+		t.Errorf("err %v; want close status %v", err, websocket.StatusMessageTooBig)
+	}
+}
+
+func TestGrpcWebHybrid_websocketsDisabled(t *testing.T) {
+	webOpts := testGrpcWebOptions
+	webOpts.websockets = false
+	server := startGrpcWebServer(t, newRouteGuideGrpcServer(), webOpts)
+
+	_, _, err := dialGrpcWebsocket(t, server.URL, "/grpc_example.v1.RouteGuide/RouteChat", "")
+
+	if err == nil {
+		t.Errorf("err <nil>; want error")
+	}
+}
+
+// startGatewayServer serves the gateway of grpcServer, which is served over TCP on a loopback address.
+func startGatewayServer(t *testing.T, grpcServer *grpc.Server) http.Handler {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	go grpcServer.Serve(listener)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		grpcServer.Stop()
+	})
+	gatewayMux, err := createGatewayMux(newTestLogger(), health.New(), listener.Addr().String(), false, gatewayOptions{
+		lbOptions: lb.Options{Policy: lb.RoundRobin},
+	}, ctx)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return gatewayMux
+}
+
+func TestCreateStores_sqlite(t *testing.T) {
+	db, err := sqlite.Open(filepath.Join(t.TempDir(), "grpc_example.db"))
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	defer db.Close()
+	hasher, err := user.NewHasher(user.AlgorithmBcrypt)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	users, err := createUserStore("sqlite", "", db, hasher)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	apiKeyStore, err := createAPIKeyStore("sqlite", db)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	if err := users.Create(context.TODO(), user.User{Username: "hello", PasswordHash: "hash"}); err != nil {
+		t.Errorf("err %v of user store; want <nil>", err)
+	}
+	if _, _, err := auth.NewAPIKeys(apiKeyStore).Create(context.TODO(), "hello", nil, time.Time{}, nil); err != nil {
+		t.Errorf("err %v of API key store; want <nil>", err)
+	}
+}
+
+func TestGateway_loginClientLockout(t *testing.T) {
+	hasher, err := user.NewHasher(user.AlgorithmBcrypt)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	users, err := createUserStore("memory", "", nil, hasher)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	authOpts := authOptions{
+		tokens:         newTestTokens(t),
+		users:          users,
+		trustedProxies: []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")},
+	}
+	authOpts.account.Hasher = hasher
+	authOpts.account.LoginGuard = lockout.NewGuard(lockout.NewMemoryStore(), lockout.Options{
+		User:            lockout.Limits{FreeAttempts: 10},
+		Client:          lockout.Limits{FreeAttempts: 2, LockoutAfter: 2},
+		Backoff:         time.Second,
+		MaxBackoff:      time.Minute,
+		LockoutDuration: time.Hour,
+	})
+	gatewayMux := startGatewayServer(t, createGrpcServer(newTestLogger(), nil, health.New(), authOpts, false))
+	login := func(remoteAddr string, username string, spoofed string) int {
+		req := httptest.NewRequest(http.MethodPost, "/grpc_example.v1.Account/Login", strings.NewReader(`{"username":"`+username+`","password":"earth"}`))
+		req.RemoteAddr = remoteAddr
+		if spoofed != "" {
+			req.Header.Set("Grpc-Metadata-X-Client-Ip", spoofed)
+		}
+		rec := httptest.NewRecorder()
+		gatewayMux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// failures of different usernames add up for the client, but not for other clients claiming its address
+	for _, username := range []string{"a", "b"} {
+		if code := login("192.0.2.1:1234", username, ""); code != http.StatusUnauthorized {
+			t.Fatalf("code %v; want %v", code, http.StatusUnauthorized)
+		}
+	}
+
+	if code := login("192.0.2.1:1234", "c", ""); code != http.StatusTooManyRequests {
+		t.Errorf("code %v of locked out client; want %v", code, http.StatusTooManyRequests)
+	}
+	if code := login("192.0.2.2:1234", "c", "192.0.2.1"); code != http.StatusUnauthorized {
+		t.Errorf("code %v of other client; want %v", code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,113 @@
+package access_log
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/zmzhang8/grpc_example/lib/log"
+	middleware_trace_id "github.com/zmzhang8/grpc_example/middleware/trace_id"
+)
+
+const RequestIDHeader = "X-Request-Id"
+
+// Handler logs HTTP requests. It accepts the request id from the X-Request-Id header or generates one,
+// and sets it in both the request and response headers so that it can be forwarded as the
+// x-request-id metadata, which the trace id interceptor uses as the trace id.
+func Handler(logger log.Logger, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now().UTC()
+
+		requestId := r.Header.Get(RequestIDHeader)
+		if !middleware_trace_id.IsValidTraceID(requestId) {
+			requestId = uuid.NewString()
+		}
+		r.Header.Set(RequestIDHeader, requestId)
+		w.Header().Set(RequestIDHeader, requestId)
+
+		wrapped := &responseWriter{ResponseWriter: w}
+		h.ServeHTTP(wrapped, r)
+
+		if wrapped.status == 0 {
+			wrapped.status = http.StatusOK
+		}
+		duration := float64(time.Since(startTime)) / float64(time.Millisecond)
+		stats := []interface{}{
+			"trace-id", requestId,
+			"http.method", r.Method,
+			"http.path", r.URL.Path,
+			"http.status", wrapped.status,
+			"http.bytes", wrapped.bytes,
+			"http.start_time", startTime,
+			"http.duration_ms", duration,
+			"http.user_agent", r.UserAgent(),
+			"http.remote_addr", r.RemoteAddr,
+		}
+		logwStatusToLevel(logger, wrapped.status, "Finished HTTP request", stats...)
+	})
+}
+
+func logwStatusToLevel(
+	logger log.Logger,
+	status int,
+	msg string,
+	keysAndValues ...interface{},
+) {
+	switch {
+	case status >= http.StatusInternalServerError:
+		logger.Errorw(msg, keysAndValues...)
+	case status == http.StatusTooManyRequests:
+		logger.Warnw(msg, keysAndValues...)
+	default:
+		logger.Infow(msg, keysAndValues...)
+	}
+}
+
+// responseWriter records the status code and the number of bytes written.
+// It keeps http.Flusher and http.Hijacker working for streaming responses and websockets.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,67 @@
+package access_log
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/zmzhang8/grpc_example/lib/log"
+)
+
+func TestHandler_generateRequestID(t *testing.T) {
+	logger := log.NewLogger(log.NewCore(false, os.Stdout, false))
+	var gotHeader string
+	h := Handler(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeader = r.Header.Get(RequestIDHeader)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/unknown", nil))
+
+	if gotHeader == "" {
+		t.Errorf("request id empty; want generated")
+	}
+	if got := rec.Header().Get(RequestIDHeader); got != gotHeader {
+		t.Errorf("response request id %v; want %v", got, gotHeader)
+	}
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("code %v; want %v", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestHandler_acceptRequestID(t *testing.T) {
+	logger := log.NewLogger(log.NewCore(false, os.Stdout, false))
+	var gotHeader string
+	h := Handler(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeader = r.Header.Get(RequestIDHeader)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(RequestIDHeader, "dummy")
+
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if gotHeader != "dummy" {
+		t.Errorf("request id %v; want dummy", gotHeader)
+	}
+}
+
+func TestResponseWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &responseWriter{ResponseWriter: rec}
+
+	w.Write([]byte("hello"))
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Flush()
+
+	if w.status != http.StatusOK {
+		t.Errorf("status %v; want %v", w.status, http.StatusOK)
+	}
+	if w.bytes != 5 {
+		t.Errorf("bytes %v; want 5", w.bytes)
+	}
+	if !rec.Flushed {
+		t.Errorf("flushed false; want true")
+	}
+}
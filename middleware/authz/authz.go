@@ -0,0 +1,39 @@
+package authz
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+
+	"github.com/zmzhang8/grpc_example/lib/authz"
+)
+
+// UnaryServerInterceptor authorizes calls after authentication, which puts the principal of the caller into the context.
+func UnaryServerInterceptor(authorizer *authz.Authorizer) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if err := authorizer.Authorize(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor authorizes streams after authentication, which puts the principal of the caller into the context.
+func StreamServerInterceptor(authorizer *authz.Authorizer) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		if err := authorizer.Authorize(stream.Context(), info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, stream)
+	}
+}
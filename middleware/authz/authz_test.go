@@ -0,0 +1,75 @@
+package authz
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/zmzhang8/grpc_example/lib/auth"
+	"github.com/zmzhang8/grpc_example/lib/authz"
+	"github.com/zmzhang8/grpc_example/lib/log"
+	"github.com/zmzhang8/grpc_example/test"
+)
+
+func newTestAuthorizer(t *testing.T) *authz.Authorizer {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	policy := "rules:\n  - methods: [\"/grpc_example.v1.Greeter/*\"]\n    roles: [user]\n"
+	if err := os.WriteFile(path, []byte(policy), 0o600); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	a := authz.New(log.NewLogger(log.NewCore(false, os.Stdout, false)), path)
+	if _, err := a.Reload(); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return a
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	interceptor := UnaryServerInterceptor(newTestAuthorizer(t))
+	info := grpc.UnaryServerInfo{FullMethod: "/grpc_example.v1.Greeter/SayHello"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "world", nil
+	}
+
+	for _, tc := range []struct {
+		roles    []string
+		wantCode codes.Code
+	}{
+		{[]string{"user"}, codes.OK},
+		{[]string{"other"}, codes.PermissionDenied},
+		{nil, codes.PermissionDenied},
+	} {
+		ctx := auth.WithPrincipal(context.TODO(), auth.Principal{Grants: auth.Grants{Roles: tc.roles}})
+
+		resp, err := interceptor(ctx, nil, &info, handler)
+
+		if status.Code(err) != tc.wantCode {
+			t.Errorf("%v: code %v; want %v", tc.roles, status.Code(err), tc.wantCode)
+		}
+		if tc.wantCode == codes.OK && resp != "world" {
+			t.Errorf("%v: resp %v; want world", tc.roles, resp)
+		}
+	}
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	interceptor := StreamServerInterceptor(newTestAuthorizer(t))
+	info := grpc.StreamServerInfo{FullMethod: "/grpc_example.v1.Greeter/SayHello"}
+	called := false
+	handler := func(srv interface{}, stream grpc.ServerStream) error {
+		called = true
+		return nil
+	}
+	stream := test.ServerStreamMock{Ctx: auth.WithPrincipal(context.TODO(), auth.Principal{Grants: auth.Grants{Roles: []string{"other"}}})}
+
+	err := interceptor(nil, stream, &info, handler)
+
+	if status.Code(err) != codes.PermissionDenied || called {
+		t.Errorf("code %v, called %v; want %v, false", status.Code(err), called, codes.PermissionDenied)
+	}
+}
@@ -0,0 +1,36 @@
+package client_ip
+
+import (
+	"context"
+
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware/v2"
+	"google.golang.org/grpc"
+
+	"github.com/zmzhang8/grpc_example/lib/clientip"
+)
+
+// UnaryServerInterceptor puts the client address of calls into the context, e.g. for login lockouts.
+func UnaryServerInterceptor(resolver *clientip.Resolver) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		return handler(clientip.WithAddr(ctx, resolver.Resolve(ctx)), req)
+	}
+}
+
+func StreamServerInterceptor(resolver *clientip.Resolver) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		wrapped := grpc_middleware.WrapServerStream(stream)
+		wrapped.WrappedContext = clientip.WithAddr(stream.Context(), resolver.Resolve(stream.Context()))
+
+		return handler(srv, wrapped)
+	}
+}
@@ -0,0 +1,51 @@
+package client_ip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+
+	"github.com/zmzhang8/grpc_example/lib/clientip"
+	"github.com/zmzhang8/grpc_example/test"
+)
+
+func peerContext() context.Context {
+	return peer.NewContext(context.TODO(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}})
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	info := grpc.UnaryServerInfo{}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		if got := clientip.FromContext(ctx); got.String() != "192.0.2.1" {
+			return nil, errors.New(got.String())
+		}
+		return nil, nil
+	}
+
+	_, err := UnaryServerInterceptor(clientip.NewResolver(nil))(peerContext(), nil, &info, handler)
+
+	if err != nil {
+		t.Errorf("err %v; want <nil>", err)
+	}
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	stream := test.ServerStreamMock{Ctx: peerContext()}
+	info := grpc.StreamServerInfo{}
+	handler := func(srv interface{}, stream grpc.ServerStream) error {
+		if got := clientip.FromContext(stream.Context()); got.String() != "192.0.2.1" {
+			return errors.New(got.String())
+		}
+		return nil
+	}
+
+	err := StreamServerInterceptor(clientip.NewResolver(nil))(nil, &stream, &info, handler)
+
+	if err != nil {
+		t.Errorf("err %v; want <nil>", err)
+	}
+}
@@ -0,0 +1,313 @@
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/zmzhang8/grpc_example/lib/log"
+)
+
+const (
+	Gzip     = "gzip"
+	Brotli   = "br"
+	Zstd     = "zstd"
+	identity = "identity"
+)
+
+// Supported encodings in the order of server preference.
+var encodings = []string{Zstd, Brotli, Gzip}
+
+type Options struct {
+	// Responses smaller than MinSize bytes are sent uncompressed.
+	// Streaming responses are compressed as soon as they are flushed.
+	MinSize int
+	// Maximum size of a decompressed request body. Zero means no limit.
+	MaxDecompressedSize int64
+}
+
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+var encoderPools = map[string]*sync.Pool{
+	Gzip: {New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}},
+	Brotli: {New: func() interface{} {
+		return brotli.NewWriterLevel(nil, brotli.DefaultCompression)
+	}},
+	Zstd: {New: func() interface{} {
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return w
+	}},
+}
+
+// Handler compresses responses according to the Accept-Encoding header and
+// decompresses request bodies according to the Content-Encoding header.
+func Handler(logger log.Logger, opts Options, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if contentEncoding := r.Header.Get("Content-Encoding"); contentEncoding != "" {
+			body, err := newDecoder(strings.ToLower(strings.TrimSpace(contentEncoding)), r.Body)
+			if errors.Is(err, errUnsupportedEncoding) {
+				logger.Infow("Unsupported request encoding", "encoding", contentEncoding)
+				http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+				return
+			}
+			if err != nil {
+				logger.Infow("Malformed request body", "encoding", contentEncoding, "error", err)
+				http.Error(w, "malformed request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer body.Close()
+			r.Body = body
+			if opts.MaxDecompressedSize > 0 {
+				r.Body = http.MaxBytesReader(w, body, opts.MaxDecompressedSize)
+			}
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiate(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: opts.MinSize}
+		defer cw.Close()
+		h.ServeHTTP(cw, r)
+	})
+}
+
+// negotiate returns the preferred supported encoding of an Accept-Encoding header,
+// or an empty string if the response should not be compressed.
+func negotiate(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			if parsed, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64); err == nil {
+				q = parsed
+			}
+		}
+		qualities[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range encodings {
+		q, ok := qualities[encoding]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// newDecoder returns a decoder of a request body, which has decoded the first byte, so that malformed bodies
+// are reported before the request is handled. Later corruption is returned by reads of the body.
+func newDecoder(encoding string, r io.ReadCloser) (io.ReadCloser, error) {
+	var decoder io.ReadCloser
+	switch encoding {
+	case identity:
+		return r, nil
+	case Gzip:
+		gzipReader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		decoder = gzipReader
+	case Brotli:
+		decoder = io.NopCloser(brotli.NewReader(r))
+	case Zstd:
+		zstdReader, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		decoder = zstdReader.IOReadCloser()
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnsupportedEncoding, encoding)
+	}
+	buffered := bufio.NewReader(decoder)
+	if _, err := buffered.Peek(1); err != nil && err != io.EOF {
+		decoder.Close()
+		return nil, err
+	}
+	return &decodedBody{Reader: buffered, Closer: decoder}, nil
+}
+
+type decodedBody struct {
+	*bufio.Reader
+	io.Closer
+}
+
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType == "" // unknown content types are compressed
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "json"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "xml"),
+		strings.HasSuffix(mediaType, "javascript"),
+		mediaType == "application/x-protobuf",
+		mediaType == "application/msgpack",
+		mediaType == "application/cbor",
+		mediaType == "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// compressWriter buffers the response until MinSize bytes are written or the response is flushed,
+// then decides whether to compress it.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status   int
+	buf      bytes.Buffer
+	decided  bool
+	encoder  encoder
+	hijacked bool
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.decided {
+		w.buf.Write(b)
+		if w.buf.Len() < w.minSize {
+			return len(b), nil
+		}
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// start writes the header and the buffered data, compressed if allowed.
+func (w *compressWriter) start(compress bool) error {
+	w.decided = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	header := w.Header()
+	if compress &&
+		header.Get("Content-Encoding") == "" &&
+		w.status != http.StatusNoContent &&
+		w.status != http.StatusNotModified &&
+		isCompressible(header.Get("Content-Type")) {
+		header.Set("Content-Encoding", w.encoding)
+		header.Del("Content-Length")
+		w.encoder = encoderPools[w.encoding].Get().(encoder)
+		w.encoder.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if w.encoder != nil {
+		_, err = w.encoder.Write(w.buf.Bytes())
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf.Bytes())
+	}
+	w.buf.Reset()
+	return err
+}
+
+// Flush compresses and sends the data written so far, so that each stream message reaches the client.
+func (w *compressWriter) Flush() {
+	if w.hijacked {
+		return
+	}
+	if !w.decided {
+		w.start(true)
+	}
+	if w.encoder != nil {
+		w.encoder.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressWriter) Close() error {
+	if w.hijacked {
+		return nil
+	}
+	if !w.decided {
+		if w.status == 0 && w.buf.Len() == 0 {
+			return nil // nothing was written, let the server send the default response
+		}
+		if err := w.start(w.buf.Len() >= w.minSize); err != nil {
+			return err
+		}
+	}
+	if w.encoder == nil {
+		return nil
+	}
+	err := w.encoder.Close()
+	encoderPools[w.encoding].Put(w.encoder)
+	w.encoder = nil
+	return err
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	w.hijacked = true
+	return h.Hijack()
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
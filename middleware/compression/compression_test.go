@@ -0,0 +1,177 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/zmzhang8/grpc_example/lib/log"
+)
+
+func newTestHandler(opts Options, h http.Handler) http.Handler {
+	logger := log.NewLogger(log.NewCore(false, os.Stdout, false))
+	return Handler(logger, opts, h)
+}
+
+func TestNegotiate(t *testing.T) {
+	for _, tc := range []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"gzip", Gzip},
+		{"gzip, br", Brotli},
+		{"gzip, br, zstd", Zstd},
+		{"gzip;q=1.0, br;q=0.5", Gzip},
+		{"*", Zstd},
+		{"zstd;q=0, *", Brotli},
+		{"deflate", ""},
+	} {
+		if got := negotiate(tc.acceptEncoding); got != tc.want {
+			t.Errorf("%v: encoding %v; want %v", tc.acceptEncoding, got, tc.want)
+		}
+	}
+}
+
+func TestHandler_compressResponse(t *testing.T) {
+	body := strings.Repeat(`{"name":"feature"}`, 100)
+	h := newTestHandler(Options{MinSize: 100}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Content-Encoding"); got != Gzip {
+		t.Fatalf("content encoding %v; want %v", got, Gzip)
+	}
+	reader, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	got, _ := io.ReadAll(reader)
+	if string(got) != body {
+		t.Errorf("body %v; want %v", string(got), body)
+	}
+}
+
+func TestHandler_smallResponse(t *testing.T) {
+	h := newTestHandler(Options{MinSize: 100}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, "{}")
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("content encoding %v; want empty", got)
+	}
+	if got := rec.Body.String(); got != "{}" {
+		t.Errorf("body %v; want {}", got)
+	}
+}
+
+func TestHandler_streamFlush(t *testing.T) {
+	flushed := make(chan int, 1)
+	rec := httptest.NewRecorder()
+	h := newTestHandler(Options{MinSize: 1024}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"result":{}}`+"\n")
+		w.(http.Flusher).Flush()
+		flushed <- rec.Body.Len()
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	h.ServeHTTP(rec, req)
+
+	if got := <-flushed; got == 0 {
+		t.Errorf("flushed bytes 0; want > 0")
+	}
+	if got := rec.Header().Get("Content-Encoding"); got != Gzip {
+		t.Errorf("content encoding %v; want %v", got, Gzip)
+	}
+}
+
+func TestHandler_decompressRequest(t *testing.T) {
+	var compressed bytes.Buffer
+	encoder, _ := zstd.NewWriter(&compressed)
+	io.WriteString(encoder, `{"name":"world"}`)
+	encoder.Close()
+	var gotBody string
+	h := newTestHandler(Options{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		gotBody = string(b)
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/", &compressed)
+	req.Header.Set("Content-Encoding", Zstd)
+
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if gotBody != `{"name":"world"}` {
+		t.Errorf("body %v; want %v", gotBody, `{"name":"world"}`)
+	}
+}
+
+func TestHandler_decompressedSizeLimit(t *testing.T) {
+	var compressed bytes.Buffer
+	encoder := gzip.NewWriter(&compressed)
+	io.WriteString(encoder, strings.Repeat("a", 1000))
+	encoder.Close()
+	var gotErr error
+	h := newTestHandler(Options{MaxDecompressedSize: 100}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, gotErr = io.ReadAll(r.Body)
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/", &compressed)
+	req.Header.Set("Content-Encoding", Gzip)
+
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if gotErr == nil {
+		t.Errorf("err <nil>; want error")
+	}
+}
+
+func TestHandler_malformedRequestBody(t *testing.T) {
+	for _, encoding := range []string{Gzip, Brotli, Zstd} {
+		called := false
+		h := newTestHandler(Options{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		}))
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("malformed data", 10)))
+		req.Header.Set("Content-Encoding", encoding)
+		rec := httptest.NewRecorder()
+
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest || called {
+			t.Errorf("%v: code %v, called %v; want %v, false", encoding, rec.Code, called, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestHandler_unsupportedRequestEncoding(t *testing.T) {
+	h := newTestHandler(Options{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("data"))
+	req.Header.Set("Content-Encoding", "compress")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("code %v; want %v", rec.Code, http.StatusUnsupportedMediaType)
+	}
+}
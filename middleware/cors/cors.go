@@ -0,0 +1,206 @@
+package cors
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zmzhang8/grpc_example/lib/log"
+)
+
+const wildcard = "*"
+
+type Options struct {
+	// Allowed origins, e.g. https://example.com. "*" allows any origin, and a "*" within
+	// an origin matches any characters except "/", e.g. https://*.example.com.
+	AllowedOrigins []string
+	// Allowed methods of preflight requests.
+	AllowedMethods []string
+	// Allowed headers of preflight requests. "*" allows any header.
+	AllowedHeaders []string
+	// Response headers which can be read by browsers.
+	ExposedHeaders []string
+	// Allow requests with credentials such as cookies and authorization headers.
+	// It requires explicit allowed origins instead of "*".
+	AllowCredentials bool
+	// How long the results of a preflight request can be cached. Zero means no header is sent.
+	MaxAge time.Duration
+}
+
+type Cors struct {
+	logger            log.Logger
+	allowedOrigins    []string
+	allowAllOrigins   bool
+	allowedMethods    map[string]bool
+	allowedHeaders    map[string]bool
+	allowAllHeaders   bool
+	allowedHeaderList []string
+	allowedHeaderStr  string
+	exposedHeaderStr  string
+	allowCredentials  bool
+	maxAge            string
+}
+
+// New returns an error if credentials are allowed from any origin, which would let any site read responses
+// of credentialed requests, e.g. with session cookies.
+func New(logger log.Logger, opts Options) (*Cors, error) {
+	c := &Cors{
+		logger:           logger,
+		allowedMethods:   make(map[string]bool),
+		allowedHeaders:   make(map[string]bool),
+		exposedHeaderStr: strings.Join(opts.ExposedHeaders, ", "),
+		allowCredentials: opts.AllowCredentials,
+	}
+	for _, origin := range opts.AllowedOrigins {
+		if origin == wildcard {
+			if opts.AllowCredentials {
+				return nil, errors.New(`credentials cannot be allowed from origin "*"`)
+			}
+			c.allowAllOrigins = true
+		}
+		c.allowedOrigins = append(c.allowedOrigins, strings.ToLower(origin))
+	}
+	for _, method := range opts.AllowedMethods {
+		c.allowedMethods[strings.ToUpper(method)] = true
+	}
+	for _, header := range opts.AllowedHeaders {
+		if header == wildcard {
+			c.allowAllHeaders = true
+		}
+		c.allowedHeaders[http.CanonicalHeaderKey(header)] = true
+	}
+	c.allowedHeaderList = append([]string(nil), opts.AllowedHeaders...)
+	c.allowedHeaderStr = strings.Join(opts.AllowedHeaders, ", ")
+	if opts.MaxAge > 0 {
+		c.maxAge = strconv.Itoa(int(opts.MaxAge / time.Second))
+	}
+	return c, nil
+}
+
+// OriginAllowed reports whether the origin is allowed and logs rejected origins.
+// It can be used as the origin function of gRPC-Web.
+func (c *Cors) OriginAllowed(origin string) bool {
+	if c.isOriginAllowed(origin) {
+		return true
+	}
+	c.logger.Infow("Rejected CORS origin", "origin", origin)
+	return false
+}
+
+// WebsocketOriginAllowed reports whether the origin of a websocket handshake is the origin of the server
+// or is allowed. Websockets are not subject to CORS, so browsers rely on servers to check origins.
+// Handshakes without an Origin header, e.g. from non-browser clients, are allowed.
+// It can be used as the websocket origin function of gRPC-Web.
+func (c *Cors) WebsocketOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return c.OriginAllowed(origin)
+}
+
+// AllowedHeaders returns the allowed request headers.
+func (c *Cors) AllowedHeaders() []string {
+	return append([]string(nil), c.allowedHeaderList...)
+}
+
+func (c *Cors) isOriginAllowed(origin string) bool {
+	if c.allowAllOrigins {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, pattern := range c.allowedOrigins {
+		if pattern == origin {
+			return true
+		}
+		if strings.Contains(pattern, wildcard) {
+			if matched, err := path.Match(pattern, origin); err == nil && matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *Cors) areHeadersAllowed(requestHeaders string) bool {
+	if c.allowAllHeaders || requestHeaders == "" {
+		return true
+	}
+	for _, header := range strings.Split(requestHeaders, ",") {
+		header = http.CanonicalHeaderKey(strings.TrimSpace(header))
+		if header != "" && !c.allowedHeaders[header] {
+			return false
+		}
+	}
+	return true
+}
+
+// Handler handles preflight requests and adds CORS headers to actual requests.
+// Requests without an Origin header are passed through.
+func (c *Cors) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			c.handlePreflight(w, r, origin)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if origin != "" && c.OriginAllowed(origin) {
+			c.setAllowOrigin(w, origin)
+			if c.exposedHeaderStr != "" {
+				w.Header().Set("Access-Control-Expose-Headers", c.exposedHeaderStr)
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (c *Cors) handlePreflight(w http.ResponseWriter, r *http.Request, origin string) {
+	headers := w.Header()
+	headers.Add("Vary", "Origin")
+	headers.Add("Vary", "Access-Control-Request-Method")
+	headers.Add("Vary", "Access-Control-Request-Headers")
+
+	method := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+	requestHeaders := r.Header.Get("Access-Control-Request-Headers")
+	if origin == "" || !c.OriginAllowed(origin) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if !c.allowedMethods[method] || !c.areHeadersAllowed(requestHeaders) {
+		c.logger.Infow("Rejected CORS preflight", "origin", origin, "method", method, "headers", requestHeaders)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	c.setAllowOrigin(w, origin)
+	headers.Set("Access-Control-Allow-Methods", method)
+	if requestHeaders != "" {
+		if c.allowAllHeaders {
+			headers.Set("Access-Control-Allow-Headers", requestHeaders)
+		} else {
+			headers.Set("Access-Control-Allow-Headers", c.allowedHeaderStr)
+		}
+	}
+	if c.maxAge != "" {
+		headers.Set("Access-Control-Max-Age", c.maxAge)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *Cors) setAllowOrigin(w http.ResponseWriter, origin string) {
+	// The request origin is echoed instead of "*", which browsers reject for credentialed requests.
+	// New rejects credentials with "*", so only explicitly allowed origins get credentials.
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if c.allowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
@@ -0,0 +1,167 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/zmzhang8/grpc_example/lib/log"
+)
+
+func newTestCors(t *testing.T, opts Options) *Cors {
+	logger := log.NewLogger(log.NewCore(false, os.Stdout, false))
+	c, err := New(logger, opts)
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return c
+}
+
+func TestOriginAllowed(t *testing.T) {
+	c := newTestCors(t, Options{AllowedOrigins: []string{"https://example.com", "https://*.example.org"}})
+	for _, tc := range []struct {
+		origin string
+		want   bool
+	}{
+		{"https://example.com", true},
+		{"https://EXAMPLE.com", true},
+		{"https://app.example.org", true},
+		{"https://example.org", false},
+		{"http://example.com", false},
+		{"https://evil.com", false},
+	} {
+		if got := c.OriginAllowed(tc.origin); got != tc.want {
+			t.Errorf("%v: allowed %v; want %v", tc.origin, got, tc.want)
+		}
+	}
+}
+
+func TestOriginAllowed_wildcard(t *testing.T) {
+	c := newTestCors(t, Options{AllowedOrigins: []string{"*"}})
+
+	if !c.OriginAllowed("https://any.com") {
+		t.Errorf("allowed false; want true")
+	}
+}
+
+func TestWebsocketOriginAllowed(t *testing.T) {
+	c := newTestCors(t, Options{AllowedOrigins: []string{"https://example.com"}})
+	for _, tc := range []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://server.local:8080", true},
+		{"https://example.com", true},
+		{"https://evil.com", false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://server.local:8080/", nil)
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+
+		if got := c.WebsocketOriginAllowed(req); got != tc.want {
+			t.Errorf("%q: allowed %v; want %v", tc.origin, got, tc.want)
+		}
+	}
+}
+
+func TestHandler_preflight(t *testing.T) {
+	c := newTestCors(t, Options{
+		AllowedOrigins:   []string{"https://example.com"},
+		AllowedMethods:   []string{"POST"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		AllowCredentials: true,
+		MaxAge:           time.Minute,
+	})
+	called := false
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+	req := httptest.NewRequest(http.MethodOptions, "/v1/test", nil)
+	req.Header.Set("Origin", "https://example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "content-type, authorization")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if called {
+		t.Errorf("called true; want false")
+	}
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("code %v; want %v", rec.Code, http.StatusNoContent)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://example.com" {
+		t.Errorf("allow origin %v; want https://example.com", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("allow credentials %v; want true", got)
+	}
+	if got := rec.Header().Get("Access-Control-Max-Age"); got != "60" {
+		t.Errorf("max age %v; want 60", got)
+	}
+}
+
+func TestHandler_preflightRejected(t *testing.T) {
+	c := newTestCors(t, Options{
+		AllowedOrigins: []string{"https://example.com"},
+		AllowedMethods: []string{"POST"},
+		AllowedHeaders: []string{"Content-Type"},
+	})
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tc := range []struct {
+		origin  string
+		method  string
+		headers string
+	}{
+		{"https://evil.com", "POST", ""},
+		{"https://example.com", "DELETE", ""},
+		{"https://example.com", "POST", "X-Custom"},
+	} {
+		req := httptest.NewRequest(http.MethodOptions, "/v1/test", nil)
+		req.Header.Set("Origin", tc.origin)
+		req.Header.Set("Access-Control-Request-Method", tc.method)
+		req.Header.Set("Access-Control-Request-Headers", tc.headers)
+		rec := httptest.NewRecorder()
+
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%v: code %v; want %v", tc, rec.Code, http.StatusForbidden)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("%v: allow origin %v; want empty", tc, got)
+		}
+	}
+}
+
+func TestHandler_actualRequest(t *testing.T) {
+	c := newTestCors(t, Options{
+		AllowedOrigins: []string{"https://example.com"},
+		ExposedHeaders: []string{"Grpc-Metadata-Trace-Id"},
+	})
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest(http.MethodPost, "/v1/test", nil)
+	req.Header.Set("Origin", "https://example.com")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://example.com" {
+		t.Errorf("allow origin %v; want https://example.com", got)
+	}
+	if got := rec.Header().Get("Access-Control-Expose-Headers"); got != "Grpc-Metadata-Trace-Id" {
+		t.Errorf("expose headers %v; want Grpc-Metadata-Trace-Id", got)
+	}
+}
+
+func TestNew_wildcardCredentials(t *testing.T) {
+	logger := log.NewLogger(log.NewCore(false, os.Stdout, false))
+
+	_, err := New(logger, Options{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+
+	if err == nil {
+		t.Errorf("err <nil>; want error")
+	}
+}
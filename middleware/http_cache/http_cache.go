@@ -0,0 +1,178 @@
+package http_cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+)
+
+type contextKey struct{}
+
+// Cache-Control values of gateway paths, e.g. /grpc_example.v1.RouteGuide/GetFeature.
+// Only read-only unary methods should be configured, because responses are buffered to
+// compute ETags and requests with a matching If-None-Match header get 304 Not Modified,
+// even though gateway routes use POST. Streamed responses are not buffered and get no ETag.
+type Policies map[string]string
+
+// ParsePolicies parses policies in the format "path=cache-control;path=cache-control".
+func ParsePolicies(s string) (Policies, error) {
+	policies := make(Policies)
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		path, cacheControl, ok := strings.Cut(item, "=")
+		if !ok || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid cache policy %q", item)
+		}
+		policies[strings.TrimSpace(path)] = strings.TrimSpace(cacheControl)
+	}
+	return policies, nil
+}
+
+type state struct {
+	hash     hash.Hash
+	messages int
+}
+
+// ForwardResponseOption hashes the deterministic protobuf encoding of each response message.
+// It should be registered with runtime.WithForwardResponseOption.
+func ForwardResponseOption(ctx context.Context, w http.ResponseWriter, msg proto.Message) error {
+	s, ok := ctx.Value(contextKey{}).(*state)
+	if !ok || msg == nil {
+		return nil
+	}
+
+	buf, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	var length [binary.MaxVarintLen64]byte
+	s.hash.Write(length[:binary.PutUvarint(length[:], uint64(len(buf)))])
+	s.hash.Write(buf)
+	s.messages++
+	return nil
+}
+
+// Handler sets ETag and Cache-Control headers for paths with a policy and
+// responds 304 Not Modified if the ETag matches the If-None-Match header.
+func Handler(policies Policies, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cacheControl, ok := policies[r.URL.Path]
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		s := &state{hash: sha256.New()}
+		r = r.WithContext(context.WithValue(r.Context(), contextKey{}, s))
+		bw := &bufferedWriter{ResponseWriter: w}
+		h.ServeHTTP(bw, r)
+		if bw.streaming {
+			return
+		}
+
+		status := bw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		header := w.Header()
+		if status != http.StatusOK || s.messages == 0 {
+			w.WriteHeader(status)
+			w.Write(bw.buf.Bytes())
+			return
+		}
+
+		// weak because the ETag identifies the message, not the encoding of the representation
+		etag := `W/"` + hex.EncodeToString(s.hash.Sum(nil)[:16]) + `"`
+		header.Set("ETag", etag)
+		header.Set("Cache-Control", cacheControl)
+		// the encoding depends on Accept, and the message on the caller, who is authenticated by the
+		// Authorization header or the session cookie
+		header.Add("Vary", "Accept")
+		header.Add("Vary", "Authorization")
+		header.Add("Vary", "Cookie")
+		header.Del("Transfer-Encoding")
+		if matchETag(r.Header.Get("If-None-Match"), etag) {
+			header.Del("Content-Type")
+			header.Del("Content-Length")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		header.Set("Content-Length", strconv.Itoa(bw.buf.Len()))
+		w.WriteHeader(status)
+		w.Write(bw.buf.Bytes())
+	})
+}
+
+// matchETag uses the weak comparison of If-None-Match.
+func matchETag(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedWriter holds the whole response until its ETag is known. The first Flush, e.g. of a server stream,
+// sends the response so far and passes the rest through, so that streams are neither held in memory nor
+// get an ETag, which would be wrong if the stream fails partway.
+type bufferedWriter struct {
+	http.ResponseWriter
+	status    int
+	buf       bytes.Buffer
+	streaming bool
+}
+
+func (w *bufferedWriter) WriteHeader(status int) {
+	if w.streaming {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *bufferedWriter) Write(b []byte) (int, error) {
+	if w.streaming {
+		return w.ResponseWriter.Write(b)
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.buf.Write(b)
+}
+
+func (w *bufferedWriter) Flush() {
+	if !w.streaming {
+		w.streaming = true
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.buf.Bytes())
+		w.buf = bytes.Buffer{}
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
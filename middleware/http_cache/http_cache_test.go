@@ -0,0 +1,165 @@
+package http_cache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+
+	pb "github.com/zmzhang8/grpc_example/proto/v1"
+)
+
+const getFeaturePath = "/grpc_example.v1.RouteGuide/GetFeature"
+
+type routeGuideServerMock struct {
+	pb.UnimplementedRouteGuideServer
+	name string
+}
+
+func (s *routeGuideServerMock) GetFeature(ctx context.Context, point *pb.Point) (*pb.Feature, error) {
+	return &pb.Feature{Name: s.name, Location: point}, nil
+}
+
+func newTestHandler(t *testing.T, server pb.RouteGuideServer) http.Handler {
+	mux := runtime.NewServeMux(runtime.WithForwardResponseOption(ForwardResponseOption))
+	if err := pb.RegisterRouteGuideHandlerServer(context.TODO(), mux, server); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	return Handler(Policies{getFeaturePath: "private, no-cache"}, mux)
+}
+
+func serve(h http.Handler, path string, ifNoneMatch string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"latitude":1,"longitude":2}`))
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestParsePolicies(t *testing.T) {
+	policies, err := ParsePolicies("/a/B=private, no-cache; /c/D=public, max-age=60")
+
+	if err != nil {
+		t.Errorf("err %v; want <nil>", err)
+	}
+	if got := policies["/a/B"]; got != "private, no-cache" {
+		t.Errorf("policy %v; want private, no-cache", got)
+	}
+	if got := policies["/c/D"]; got != "public, max-age=60" {
+		t.Errorf("policy %v; want public, max-age=60", got)
+	}
+}
+
+func TestParsePolicies_failure(t *testing.T) {
+	_, err := ParsePolicies("no-path")
+
+	if err == nil {
+		t.Errorf("err <nil>; want error")
+	}
+}
+
+func TestHandler_etag(t *testing.T) {
+	h := newTestHandler(t, &routeGuideServerMock{name: "feature"})
+
+	rec := serve(h, getFeaturePath, "")
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code %v; want %v", rec.Code, http.StatusOK)
+	}
+	etag := rec.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Errorf("etag %v; want weak etag", etag)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "private, no-cache" {
+		t.Errorf("cache control %v; want private, no-cache", got)
+	}
+	if got := strings.Join(rec.Header().Values("Vary"), ", "); got != "Accept, Authorization, Cookie" {
+		t.Errorf("vary %v; want Accept, Authorization, Cookie", got)
+	}
+	if !strings.Contains(rec.Body.String(), "feature") {
+		t.Errorf("body %v; want feature", rec.Body.String())
+	}
+
+	rec = serve(h, getFeaturePath, etag)
+
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("code %v; want %v", rec.Code, http.StatusNotModified)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("body %v; want empty", rec.Body.String())
+	}
+	if got := rec.Header().Values("Vary"); len(got) == 0 {
+		t.Errorf("vary %v of not modified; want Accept, Authorization, Cookie", got)
+	}
+}
+
+func TestHandler_etagChanged(t *testing.T) {
+	oldEtag := serve(newTestHandler(t, &routeGuideServerMock{name: "old"}), getFeaturePath, "").Header().Get("ETag")
+	h := newTestHandler(t, &routeGuideServerMock{name: "new"})
+
+	rec := serve(h, getFeaturePath, oldEtag)
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("code %v; want %v", rec.Code, http.StatusOK)
+	}
+	if rec.Header().Get("ETag") == oldEtag {
+		t.Errorf("etag %v; want changed", oldEtag)
+	}
+}
+
+func TestHandler_noPolicy(t *testing.T) {
+	h := Handler(Policies{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rec := serve(h, getFeaturePath, "")
+
+	if got := rec.Header().Get("ETag"); got != "" {
+		t.Errorf("etag %v; want empty", got)
+	}
+}
+
+func TestHandler_stream(t *testing.T) {
+	var flushed string
+	var rec *httptest.ResponseRecorder
+	h := Handler(Policies{getFeaturePath: "no-cache"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		flushed = rec.Body.String()
+		w.Write([]byte("second"))
+	}))
+	rec = httptest.NewRecorder()
+
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, getFeaturePath, nil))
+
+	if flushed != "first" {
+		t.Errorf("flushed %q; want first", flushed)
+	}
+	if got := rec.Body.String(); got != "firstsecond" {
+		t.Errorf("body %q; want firstsecond", got)
+	}
+	if got := rec.Header().Get("ETag"); got != "" {
+		t.Errorf("etag %v; want empty", got)
+	}
+}
+
+func TestMatchETag(t *testing.T) {
+	for _, tc := range []struct {
+		ifNoneMatch string
+		want        bool
+	}{
+		{`W/"abc"`, true},
+		{`"abc"`, true},
+		{`"xyz", W/"abc"`, true},
+		{`*`, true},
+		{`"xyz"`, false},
+		{``, false},
+	} {
+		if got := matchETag(tc.ifNoneMatch, `W/"abc"`); got != tc.want {
+			t.Errorf("%v: match %v; want %v", tc.ifNoneMatch, got, tc.want)
+		}
+	}
+}
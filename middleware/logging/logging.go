@@ -15,6 +15,13 @@ import (
 
 type contextKey struct{}
 
+// logger of the finished call log, which interceptors after authentication can replace
+type callContextKey struct{}
+
+type callLogger struct {
+	logger log.Logger
+}
+
 type LoggerFunc func(ctx context.Context, logger log.Logger) log.Logger
 
 func ContextKey() contextKey {
@@ -41,7 +48,9 @@ func UnaryServerInterceptor(logger log.Logger, loggerFunc LoggerFunc) grpc.Unary
 		if loggerFunc != nil {
 			contextLogger = loggerFunc(ctx, logger)
 		}
+		call := &callLogger{logger: contextLogger}
 		newCtx := context.WithValue(ctx, contextKey{}, contextLogger)
+		newCtx = context.WithValue(newCtx, callContextKey{}, call)
 
 		service, method := splitServiceMethod(info.FullMethod)
 		stats := []interface{}{
@@ -58,7 +67,7 @@ func UnaryServerInterceptor(logger log.Logger, loggerFunc LoggerFunc) grpc.Unary
 			"grpc.code", code,
 			"grpc.duration_ms", duration,
 		)
-		logwCodeToLevel(contextLogger, code, "Finished unary call", stats...)
+		logwCodeToLevel(call.logger, code, "Finished unary call", stats...)
 
 		return resp, err
 	}
@@ -77,7 +86,9 @@ func StreamServerInterceptor(logger log.Logger, loggerFunc LoggerFunc) grpc.Stre
 		if loggerFunc != nil {
 			contextLogger = loggerFunc(ctx, logger)
 		}
+		call := &callLogger{logger: contextLogger}
 		newCtx := context.WithValue(ctx, contextKey{}, contextLogger)
+		newCtx = context.WithValue(newCtx, callContextKey{}, call)
 		wrapped := grpc_middleware.WrapServerStream(stream)
 		wrapped.WrappedContext = newCtx
 
@@ -96,12 +107,50 @@ func StreamServerInterceptor(logger log.Logger, loggerFunc LoggerFunc) grpc.Stre
 			"grpc.code", code,
 			"grpc.duration_ms", duration,
 		)
-		logwCodeToLevel(contextLogger, code, "Finished stream call", stats...)
+		logwCodeToLevel(call.logger, code, "Finished stream call", stats...)
 
 		return err
 	}
 }
 
+// UpdateUnaryServerInterceptor replaces the logger of calls with the logger of loggerFunc, e.g. with fields of
+// the caller after authentication. The finished call log of UnaryServerInterceptor uses the replaced logger.
+func UpdateUnaryServerInterceptor(loggerFunc LoggerFunc) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		return handler(updateLogger(ctx, loggerFunc), req)
+	}
+}
+
+// UpdateStreamServerInterceptor replaces the logger of streams with the logger of loggerFunc, e.g. with fields of
+// the caller after authentication. The finished call log of StreamServerInterceptor uses the replaced logger.
+func UpdateStreamServerInterceptor(loggerFunc LoggerFunc) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		wrapped := grpc_middleware.WrapServerStream(stream)
+		wrapped.WrappedContext = updateLogger(stream.Context(), loggerFunc)
+		return handler(srv, wrapped)
+	}
+}
+
+// updateLogger returns ctx with the logger of loggerFunc. It returns ctx if the call has no logger.
+func updateLogger(ctx context.Context, loggerFunc LoggerFunc) context.Context {
+	call, ok := ctx.Value(callContextKey{}).(*callLogger)
+	if !ok {
+		return ctx
+	}
+	call.logger = loggerFunc(ctx, call.logger)
+	return context.WithValue(ctx, contextKey{}, call.logger)
+}
+
 func splitServiceMethod(fullMethod string) (string, string) {
 	service := path.Dir(fullMethod)[1:]
 	method := path.Base(fullMethod)
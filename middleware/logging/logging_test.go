@@ -72,3 +72,58 @@ func TestStreamServerInterceptor(t *testing.T) {
 		t.Errorf("err %v; want <nil>", err)
 	}
 }
+
+func TestUpdateUnaryServerInterceptor(t *testing.T) {
+	logger := log.NewLogger(log.NewCore(false, os.Stdout, false))
+	info := grpc.UnaryServerInfo{
+		FullMethod: "/test.TestServer/Hello",
+	}
+	var updated log.Logger
+	loggerFunc := func(ctx context.Context, logger log.Logger) log.Logger {
+		updated = logger.With("subject", "hello")
+		return updated
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		if MustGetLogger(ctx) != updated {
+			return nil, errors.New("")
+		}
+		return nil, nil
+	}
+	update := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return UpdateUnaryServerInterceptor(loggerFunc)(ctx, req, &info, handler)
+	}
+
+	_, err := UnaryServerInterceptor(logger, nil)(context.TODO(), nil, &info, update)
+
+	if err != nil {
+		t.Errorf("err %v; want <nil>", err)
+	}
+}
+
+func TestUpdateStreamServerInterceptor(t *testing.T) {
+	logger := log.NewLogger(log.NewCore(false, os.Stdout, false))
+	stream := test.ServerStreamMock{Ctx: context.TODO()}
+	info := grpc.StreamServerInfo{
+		FullMethod: "/test.TestServer/Hello",
+	}
+	var updated log.Logger
+	loggerFunc := func(ctx context.Context, logger log.Logger) log.Logger {
+		updated = logger.With("subject", "hello")
+		return updated
+	}
+	handler := func(srv interface{}, stream grpc.ServerStream) error {
+		if MustGetLogger(stream.Context()) != updated {
+			return errors.New("")
+		}
+		return nil
+	}
+	update := func(srv interface{}, stream grpc.ServerStream) error {
+		return UpdateStreamServerInterceptor(loggerFunc)(srv, stream, &info, handler)
+	}
+
+	err := StreamServerInterceptor(logger, nil)(nil, stream, &info, update)
+
+	if err != nil {
+		t.Errorf("err %v; want <nil>", err)
+	}
+}
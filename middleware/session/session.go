@@ -0,0 +1,265 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/zmzhang8/grpc_example/lib/log"
+)
+
+const (
+	DefaultCookieName     = "session"
+	DefaultCSRFCookieName = "csrf_token"
+	DefaultCSRFHeader     = "X-CSRF-Token"
+	DefaultLoginPath      = "/grpc_example.v1.Account/Login"
+	DefaultLogoutPath     = "/session/logout"
+)
+
+type Options struct {
+	// Name of the HttpOnly cookie holding the session token.
+	CookieName string
+	// Name of the cookie holding the CSRF token. It is readable by scripts, which must
+	// send its value in the CSRFHeader of state-changing requests (double submit cookie).
+	CSRFCookieName string
+	CSRFHeader     string
+	// Cookie attributes. Secure should only be disabled for local development over HTTP.
+	Domain   string
+	Path     string
+	Secure   bool
+	SameSite http.SameSite
+	// Gateway path of the login method. Its response sets the cookies.
+	LoginPath string
+	// Path of the endpoint which clears the cookies.
+	LogoutPath string
+	// Origins of other sites whose websocket handshakes are authenticated by the cookie, e.g. https://example.com.
+	// Websockets are not subject to CORS or CSRF tokens, so the cookie of cross-origin handshakes is ignored
+	// unless their origin is listed. Origins with wildcards, e.g. *, are ignored.
+	WebsocketOrigins []string
+}
+
+// ParseSameSite parses the SameSite attribute of cookies, i.e. strict, lax or none.
+func ParseSameSite(s string) (http.SameSite, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	default:
+		return 0, fmt.Errorf("invalid SameSite %q", s)
+	}
+}
+
+// loginResponse is implemented by responses of the login method, e.g. grpc_example.v1.LoginResponse.
+type loginResponse interface {
+	GetToken() string
+	GetExpiration() *timestamppb.Timestamp
+}
+
+// loginFields returns the token and expiration of a login response. Messages without generated
+// types, e.g. of the dynamic gateway, are read by field names.
+func loginFields(msg proto.Message) (string, *timestamppb.Timestamp) {
+	if resp, ok := msg.(loginResponse); ok {
+		return resp.GetToken(), resp.GetExpiration()
+	}
+	m := msg.ProtoReflect()
+	fields := m.Descriptor().Fields()
+	token := fields.ByName("token")
+	if token == nil || token.Kind() != protoreflect.StringKind || token.IsList() {
+		return "", nil
+	}
+	expiration := fields.ByName("expiration")
+	if expiration == nil || expiration.Message() == nil || expiration.IsList() ||
+		expiration.Message().FullName() != "google.protobuf.Timestamp" || !m.Has(expiration) {
+		return m.Get(token).String(), nil
+	}
+	ts := m.Get(expiration).Message()
+	tsFields := ts.Descriptor().Fields()
+	return m.Get(token).String(), &timestamppb.Timestamp{
+		Seconds: ts.Get(tsFields.ByName("seconds")).Int(),
+		Nanos:   int32(ts.Get(tsFields.ByName("nanos")).Int()),
+	}
+}
+
+// Session translates session cookies of browsers into bearer tokens of gateway calls.
+type Session struct {
+	logger log.Logger
+	opts   Options
+}
+
+func New(logger log.Logger, opts Options) *Session {
+	if opts.CookieName == "" {
+		opts.CookieName = DefaultCookieName
+	}
+	if opts.CSRFCookieName == "" {
+		opts.CSRFCookieName = DefaultCSRFCookieName
+	}
+	if opts.CSRFHeader == "" {
+		opts.CSRFHeader = DefaultCSRFHeader
+	}
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+	if opts.SameSite == 0 {
+		opts.SameSite = http.SameSiteStrictMode
+	}
+	if opts.LoginPath == "" {
+		opts.LoginPath = DefaultLoginPath
+	}
+	if opts.LogoutPath == "" {
+		opts.LogoutPath = DefaultLogoutPath
+	}
+	return &Session{logger: logger, opts: opts}
+}
+
+// CSRFHeader returns the request header of CSRF tokens, which should be allowed by CORS.
+func (s *Session) CSRFHeader() string {
+	return s.opts.CSRFHeader
+}
+
+// ForwardResponseOption sets the session and CSRF cookies of successful logins.
+// It should be registered with runtime.WithForwardResponseOption.
+func (s *Session) ForwardResponseOption(ctx context.Context, w http.ResponseWriter, msg proto.Message) error {
+	if pattern, ok := runtime.HTTPPathPattern(ctx); !ok || pattern != s.opts.LoginPath {
+		return nil
+	}
+	token, expiration := loginFields(msg)
+	if token == "" {
+		return nil
+	}
+
+	csrfToken, err := newCSRFToken()
+	if err != nil {
+		return err
+	}
+	var expires time.Time
+	if expiration != nil {
+		expires = expiration.AsTime()
+	}
+	http.SetCookie(w, s.cookie(s.opts.CookieName, token, expires, true))
+	http.SetCookie(w, s.cookie(s.opts.CSRFCookieName, csrfToken, expires, false))
+	w.Header().Set(s.opts.CSRFHeader, csrfToken)
+	return nil
+}
+
+// Handler sets the authorization header from the session cookie, checks CSRF tokens of
+// state-changing requests authenticated by the cookie, and serves the logout endpoint.
+// An explicit authorization header takes precedence over the cookie.
+func (s *Session) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == s.opts.LogoutPath {
+			s.logout(w, r)
+			return
+		}
+
+		cookie, err := r.Cookie(s.opts.CookieName)
+		if err != nil || cookie.Value == "" || r.Header.Get("Authorization") != "" || r.URL.Path == s.opts.LoginPath {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if !s.checkCSRF(r) {
+			s.logger.Infow("Rejected request with invalid CSRF token", "path", r.URL.Path)
+			http.Error(w, "invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		if isWebsocket(r) && !s.websocketOriginAllowed(r) {
+			s.logger.Infow("Ignored session cookie of cross-origin websocket", "path", r.URL.Path, "origin", r.Header.Get("Origin"))
+			h.ServeHTTP(w, r)
+			return
+		}
+		r.Header.Set("Authorization", "Bearer "+cookie.Value)
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *Session) logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if cookie, err := r.Cookie(s.opts.CookieName); err == nil && cookie.Value != "" && !s.checkCSRF(r) {
+		s.logger.Infow("Rejected logout with invalid CSRF token")
+		http.Error(w, "invalid CSRF token", http.StatusForbidden)
+		return
+	}
+	http.SetCookie(w, s.expiredCookie(s.opts.CookieName, true))
+	http.SetCookie(w, s.expiredCookie(s.opts.CSRFCookieName, false))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkCSRF reports whether safe methods are used or the CSRF header matches the CSRF cookie.
+func (s *Session) checkCSRF(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	cookie, err := r.Cookie(s.opts.CSRFCookieName)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	header := r.Header.Get(s.opts.CSRFHeader)
+	return subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) == 1
+}
+
+func isWebsocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// websocketOriginAllowed reports whether a websocket handshake has no Origin header, e.g. of a non-browser
+// client, or is from the origin of the server or from one of WebsocketOrigins.
+func (s *Session) websocketOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range s.opts.WebsocketOrigins {
+		if !strings.Contains(allowed, "*") && strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Session) cookie(name string, value string, expires time.Time, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     s.opts.Path,
+		Domain:   s.opts.Domain,
+		Expires:  expires,
+		Secure:   s.opts.Secure,
+		HttpOnly: httpOnly,
+		SameSite: s.opts.SameSite,
+	}
+}
+
+func (s *Session) expiredCookie(name string, httpOnly bool) *http.Cookie {
+	c := s.cookie(name, "", time.Unix(0, 0), httpOnly)
+	c.MaxAge = -1
+	return c
+}
+
+func newCSRFToken() (string, error) {
+	var buf [32]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf[:]), nil
+}
@@ -0,0 +1,222 @@
+package session
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/zmzhang8/grpc_example/lib/log"
+	pb "github.com/zmzhang8/grpc_example/proto/v1"
+)
+
+type accountServerMock struct {
+	pb.UnimplementedAccountServer
+}
+
+func (s *accountServerMock) Login(ctx context.Context, in *pb.LoginRequest) (*pb.LoginResponse, error) {
+	return &pb.LoginResponse{Token: "token", Expiration: timestamppb.New(time.Now().Add(time.Hour))}, nil
+}
+
+func newTestSession() *Session {
+	return New(log.NewLogger(log.NewCore(false, os.Stdout, false)), Options{Secure: true})
+}
+
+func findCookie(cookies []*http.Cookie, name string) *http.Cookie {
+	for _, c := range cookies {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestParseSameSite(t *testing.T) {
+	sameSite, err := ParseSameSite("Lax")
+
+	if err != nil {
+		t.Errorf("err %v; want <nil>", err)
+	}
+	if sameSite != http.SameSiteLaxMode {
+		t.Errorf("same site %v; want %v", sameSite, http.SameSiteLaxMode)
+	}
+	if _, err := ParseSameSite("unknown"); err == nil {
+		t.Errorf("err <nil>; want error")
+	}
+}
+
+func TestForwardResponseOption_login(t *testing.T) {
+	s := newTestSession()
+	mux := runtime.NewServeMux(runtime.WithForwardResponseOption(s.ForwardResponseOption))
+	if err := pb.RegisterAccountHandlerServer(context.TODO(), mux, &accountServerMock{}); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, DefaultLoginPath, strings.NewReader(`{"username":"hello","password":"world"}`))
+	rec := httptest.NewRecorder()
+
+	s.Handler(mux).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code %v; want %v", rec.Code, http.StatusOK)
+	}
+	cookies := rec.Result().Cookies()
+	session := findCookie(cookies, DefaultCookieName)
+	if session == nil || session.Value != "token" || !session.HttpOnly || !session.Secure || session.SameSite != http.SameSiteStrictMode {
+		t.Errorf("session cookie %v; want secure HttpOnly SameSite=Strict cookie with token", session)
+	}
+	csrf := findCookie(cookies, DefaultCSRFCookieName)
+	if csrf == nil || csrf.Value == "" || csrf.HttpOnly {
+		t.Fatalf("csrf cookie %v; want cookie readable by scripts", csrf)
+	}
+	if got := rec.Header().Get(DefaultCSRFHeader); got != csrf.Value {
+		t.Errorf("csrf header %v; want %v", got, csrf.Value)
+	}
+}
+
+func TestForwardResponseOption_dynamicLogin(t *testing.T) {
+	s := newTestSession()
+	expiration := time.Now().Add(time.Hour).Truncate(time.Second)
+	resp := dynamicpb.NewMessage((&pb.LoginResponse{}).ProtoReflect().Descriptor())
+	data, _ := proto.Marshal(&pb.LoginResponse{Token: "token", Expiration: timestamppb.New(expiration)})
+	if err := proto.Unmarshal(data, resp); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	ctx := runtime.NewServerMetadataContext(context.TODO(), runtime.ServerMetadata{})
+	ctx, err := runtime.AnnotateContext(ctx, runtime.NewServeMux(), httptest.NewRequest(http.MethodPost, DefaultLoginPath, nil),
+		DefaultLoginPath, runtime.WithHTTPPathPattern(DefaultLoginPath))
+	if err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+	rec := httptest.NewRecorder()
+
+	if err := s.ForwardResponseOption(ctx, rec, resp); err != nil {
+		t.Fatalf("err %v; want <nil>", err)
+	}
+
+	session := findCookie(rec.Result().Cookies(), DefaultCookieName)
+	if session == nil || session.Value != "token" || !session.Expires.Equal(expiration) {
+		t.Errorf("session cookie %v; want cookie with token expiring at %v", session, expiration)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		csrfHeader    string
+		wantCode      int
+		wantAuth      string
+	}{
+		{"valid csrf token", "", "csrf", http.StatusOK, "Bearer token"},
+		{"missing csrf token", "", "", http.StatusForbidden, ""},
+		{"invalid csrf token", "", "other", http.StatusForbidden, ""},
+		{"authorization header", "Bearer header", "", http.StatusOK, "Bearer header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotAuth string
+			h := newTestSession().Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotAuth = r.Header.Get("Authorization")
+			}))
+			req := httptest.NewRequest(http.MethodPost, "/grpc_example.v1.Greeter/SayHello", nil)
+			req.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: "token"})
+			req.AddCookie(&http.Cookie{Name: DefaultCSRFCookieName, Value: "csrf"})
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			if tt.csrfHeader != "" {
+				req.Header.Set(DefaultCSRFHeader, tt.csrfHeader)
+			}
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Errorf("code %v; want %v", rec.Code, tt.wantCode)
+			}
+			if gotAuth != tt.wantAuth {
+				t.Errorf("authorization %q; want %q", gotAuth, tt.wantAuth)
+			}
+		})
+	}
+}
+
+func TestHandler_websocket(t *testing.T) {
+	tests := []struct {
+		name     string
+		origin   string
+		wantAuth string
+	}{
+		{"same origin", "http://example.com", "Bearer token"},
+		{"listed origin", "https://app.example.org", "Bearer token"},
+		{"cross origin", "https://evil.example.net", ""},
+		{"wildcard origin", "https://any.example.org", ""},
+		{"without origin", "", "Bearer token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(log.NewLogger(log.NewCore(false, os.Stdout, false)), Options{
+				WebsocketOrigins: []string{"https://app.example.org", "https://*.example.org", "*"},
+			})
+			var gotAuth string
+			h := s.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotAuth = r.Header.Get("Authorization")
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/jsonrpc", nil)
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			req.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: "token"})
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if gotAuth != tt.wantAuth {
+				t.Errorf("authorization %q; want %q", gotAuth, tt.wantAuth)
+			}
+		})
+	}
+}
+
+func TestHandler_logout(t *testing.T) {
+	h := newTestSession().Handler(http.NotFoundHandler())
+	req := httptest.NewRequest(http.MethodPost, DefaultLogoutPath, nil)
+	req.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: "token"})
+	req.AddCookie(&http.Cookie{Name: DefaultCSRFCookieName, Value: "csrf"})
+	req.Header.Set(DefaultCSRFHeader, "csrf")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("code %v; want %v", rec.Code, http.StatusNoContent)
+	}
+	for _, name := range []string{DefaultCookieName, DefaultCSRFCookieName} {
+		if c := findCookie(rec.Result().Cookies(), name); c == nil || c.MaxAge >= 0 {
+			t.Errorf("cookie %v %v; want cleared cookie", name, c)
+		}
+	}
+}
+
+func TestHandler_logoutWithoutCSRFToken(t *testing.T) {
+	h := newTestSession().Handler(http.NotFoundHandler())
+	req := httptest.NewRequest(http.MethodPost, DefaultLogoutPath, nil)
+	req.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: "token"})
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("code %v; want %v", rec.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,194 @@
+package timeout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Timeout header for REST clients, e.g. "1.5" (seconds) or "1500ms".
+	RequestTimeoutHeader = "X-Request-Timeout"
+	// gRPC timeout header, e.g. "1500m", which the gateway turns into the context deadline.
+	GrpcTimeoutHeader = "Grpc-Timeout"
+
+	problemContentType = "application/problem+json"
+)
+
+type Options struct {
+	// Timeout of requests without a timeout header. Zero means no timeout.
+	DefaultTimeout time.Duration
+	// Timeouts of gateway paths overriding DefaultTimeout, e.g. /grpc_example.v1.Health/Watch.
+	// Zero means no timeout.
+	RouteTimeouts map[string]time.Duration
+	// Upper bound of timeouts requested by clients. Zero means no limit.
+	MaxTimeout time.Duration
+}
+
+// ParseRouteTimeouts parses route timeouts in the format "path=duration;path=duration".
+func ParseRouteTimeouts(s string) (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration)
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		path, value, ok := strings.Cut(item, "=")
+		if !ok || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid route timeout %q", item)
+		}
+		d, err := parseDuration(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid route timeout %q: %w", item, err)
+		}
+		timeouts[strings.TrimSpace(path)] = d
+	}
+	return timeouts, nil
+}
+
+// Handler sets the Grpc-Timeout header from the X-Request-Timeout header or the route default,
+// so that the gateway sets the deadline of the gRPC call.
+func Handler(opts Options, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout, ok := opts.DefaultTimeout, false
+		if routeTimeout, found := opts.RouteTimeouts[r.URL.Path]; found {
+			timeout = routeTimeout
+		}
+
+		if value := r.Header.Get(GrpcTimeoutHeader); value != "" {
+			d, err := decodeGrpcTimeout(value)
+			if err == nil && d <= 0 {
+				err = fmt.Errorf("invalid value %q", value)
+			}
+			if err != nil {
+				writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid %s header: %v", GrpcTimeoutHeader, err))
+				return
+			}
+			timeout, ok = d, true
+		} else if value := r.Header.Get(RequestTimeoutHeader); value != "" {
+			d, err := parseDuration(value)
+			if err != nil || d <= 0 {
+				writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid %s header: %q", RequestTimeoutHeader, value))
+				return
+			}
+			timeout, ok = d, true
+		}
+		if ok && opts.MaxTimeout > 0 && timeout > opts.MaxTimeout {
+			timeout = opts.MaxTimeout
+		}
+
+		r.Header.Del(RequestTimeoutHeader)
+		if timeout > 0 {
+			r.Header.Set(GrpcTimeoutHeader, encodeGrpcTimeout(timeout))
+		} else {
+			r.Header.Del(GrpcTimeoutHeader)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ErrorHandler responds 504 with problem details (RFC 7807) if the deadline of the call expired,
+// and uses the default gateway error handler otherwise.
+func ErrorHandler(
+	ctx context.Context,
+	mux *runtime.ServeMux,
+	marshaler runtime.Marshaler,
+	w http.ResponseWriter,
+	r *http.Request,
+	err error,
+) {
+	if status.Code(err) == codes.DeadlineExceeded || ctx.Err() == context.DeadlineExceeded {
+		writeProblem(w, r, http.StatusGatewayTimeout, "The request did not complete within its deadline")
+		return
+	}
+	runtime.DefaultHTTPErrorHandler(ctx, mux, marshaler, w, r, err)
+}
+
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, code int, detail string) {
+	buf, _ := json.Marshal(problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(code),
+		Status:   code,
+		Detail:   detail,
+		Instance: r.URL.Path,
+	})
+	w.Header().Del("Transfer-Encoding")
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(code)
+	w.Write(buf)
+}
+
+// parseDuration accepts a Go duration, e.g. "1500ms", or a number of seconds, e.g. "1.5".
+func parseDuration(s string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md#requests
+func decodeGrpcTimeout(s string) (time.Duration, error) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, fmt.Errorf("invalid length %q", s)
+	}
+	unit, ok := grpcTimeoutUnits[s[len(s)-1]]
+	if !ok {
+		return 0, fmt.Errorf("invalid unit %q", s)
+	}
+	value, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	// e.g. 99999999H does not fit in a time.Duration
+	if value > math.MaxInt64/int64(unit) {
+		return math.MaxInt64, nil
+	}
+	return time.Duration(value) * unit, nil
+}
+
+// encodeGrpcTimeout uses the finest unit which fits in the 8 digits allowed by the protocol.
+func encodeGrpcTimeout(d time.Duration) string {
+	const maxValue = 99999999
+	for _, unit := range []struct {
+		duration time.Duration
+		suffix   string
+	}{
+		{time.Millisecond, "m"},
+		{time.Second, "S"},
+		{time.Minute, "M"},
+		{time.Hour, "H"},
+	} {
+		// round up so that a timeout never becomes zero or shorter
+		value := (d + unit.duration - 1) / unit.duration
+		if value <= maxValue {
+			return strconv.FormatInt(int64(value), 10) + unit.suffix
+		}
+	}
+	return strconv.Itoa(maxValue) + "H"
+}
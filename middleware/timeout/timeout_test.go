@@ -0,0 +1,135 @@
+package timeout
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func serve(opts Options, path string, header http.Header) (string, *httptest.ResponseRecorder) {
+	var gotTimeout string
+	h := Handler(opts, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTimeout = r.Header.Get(GrpcTimeoutHeader)
+	}))
+	req := httptest.NewRequest(http.MethodPost, path, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return gotTimeout, rec
+}
+
+func TestHandler(t *testing.T) {
+	opts := Options{
+		DefaultTimeout: 30 * time.Second,
+		RouteTimeouts:  map[string]time.Duration{"/test.Service/Watch": 0},
+		MaxTimeout:     time.Minute,
+	}
+	for _, tc := range []struct {
+		path        string
+		header      http.Header
+		wantTimeout string
+	}{
+		{"/test.Service/Get", nil, "30000m"},
+		{"/test.Service/Watch", nil, ""},
+		{"/test.Service/Get", http.Header{"X-Request-Timeout": {"1.5"}}, "1500m"},
+		{"/test.Service/Get", http.Header{"X-Request-Timeout": {"200ms"}}, "200m"},
+		{"/test.Service/Get", http.Header{"X-Request-Timeout": {"1h"}}, "60000m"},
+		{"/test.Service/Get", http.Header{"Grpc-Timeout": {"5S"}}, "5000m"},
+		{"/test.Service/Get", http.Header{"Grpc-Timeout": {"99999999H"}}, "60000m"},
+	} {
+		gotTimeout, _ := serve(opts, tc.path, tc.header)
+
+		if gotTimeout != tc.wantTimeout {
+			t.Errorf("%v %v: timeout %v; want %v", tc.path, tc.header, gotTimeout, tc.wantTimeout)
+		}
+	}
+}
+
+func TestHandler_invalidTimeout(t *testing.T) {
+	_, rec := serve(Options{}, "/test.Service/Get", http.Header{"X-Request-Timeout": {"soon"}})
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("code %v; want %v", rec.Code, http.StatusBadRequest)
+	}
+	if got := rec.Header().Get("Content-Type"); got != problemContentType {
+		t.Errorf("content type %v; want %v", got, problemContentType)
+	}
+}
+
+func TestHandler_zeroTimeout(t *testing.T) {
+	opts := Options{DefaultTimeout: 30 * time.Second}
+	for _, header := range []http.Header{
+		{"Grpc-Timeout": {"0m"}},
+		{"X-Request-Timeout": {"0"}},
+	} {
+		_, rec := serve(opts, "/test.Service/Get", header)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%v: code %v; want %v", header, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestErrorHandler_deadlineExceeded(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/test.Service/Get", nil)
+	rec := httptest.NewRecorder()
+	err := status.Error(codes.DeadlineExceeded, "context deadline exceeded")
+
+	ErrorHandler(context.TODO(), runtime.NewServeMux(), &runtime.JSONPb{}, rec, req, err)
+
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("code %v; want %v", rec.Code, http.StatusGatewayTimeout)
+	}
+	if !strings.Contains(rec.Body.String(), `"status":504`) {
+		t.Errorf("body %v; want problem details", rec.Body.String())
+	}
+}
+
+func TestErrorHandler_otherError(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/test.Service/Get", nil)
+	rec := httptest.NewRecorder()
+	err := status.Error(codes.NotFound, "")
+
+	ErrorHandler(context.TODO(), runtime.NewServeMux(), &runtime.JSONPb{}, rec, req, err)
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("code %v; want %v", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestEncodeGrpcTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{time.Nanosecond, "1m"},
+		{1500 * time.Millisecond, "1500m"},
+		{48 * time.Hour, "172800S"},
+	} {
+		if got := encodeGrpcTimeout(tc.d); got != tc.want {
+			t.Errorf("%v: timeout %v; want %v", tc.d, got, tc.want)
+		}
+	}
+}
+
+func TestParseRouteTimeouts(t *testing.T) {
+	timeouts, err := ParseRouteTimeouts("/a/B=0; /c/D=1.5; /e/F=2m")
+
+	if err != nil {
+		t.Errorf("err %v; want <nil>", err)
+	}
+	for path, want := range map[string]time.Duration{"/a/B": 0, "/c/D": 1500 * time.Millisecond, "/e/F": 2 * time.Minute} {
+		if got, ok := timeouts[path]; !ok || got != want {
+			t.Errorf("%v: timeout %v; want %v", path, got, want)
+		}
+	}
+}
@@ -9,6 +9,11 @@ import (
 	"google.golang.org/grpc/metadata"
 )
 
+// Incoming metadata key of a trace id chosen by the client or forwarded by the gateway.
+const RequestIDMetadataKey = "x-request-id"
+
+const maxTraceIDLength = 128
+
 type contextKey struct{}
 
 func MustGetTraceID(ctx context.Context) string {
@@ -19,6 +24,19 @@ func MustGetTraceID(ctx context.Context) string {
 	return traceId
 }
 
+// IsValidTraceID reports whether a trace id provided by a client can be used as is.
+func IsValidTraceID(traceId string) bool {
+	if traceId == "" || len(traceId) > maxTraceIDLength {
+		return false
+	}
+	for _, c := range traceId {
+		if c < 0x21 || c > 0x7e { // printable ASCII only
+			return false
+		}
+	}
+	return true
+}
+
 func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
 	return func(
 		ctx context.Context,
@@ -26,7 +44,7 @@ func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
 		info *grpc.UnaryServerInfo,
 		handler grpc.UnaryHandler,
 	) (interface{}, error) {
-		traceId := uuid.NewString()
+		traceId := getOrNewTraceID(ctx)
 		newCtx := context.WithValue(ctx, contextKey{}, traceId)
 		grpc.SetHeader(newCtx, metadata.Pairs("trace-id", traceId))
 
@@ -41,7 +59,7 @@ func StreamServerInterceptor() grpc.StreamServerInterceptor {
 		info *grpc.StreamServerInfo,
 		handler grpc.StreamHandler,
 	) error {
-		traceId := uuid.NewString()
+		traceId := getOrNewTraceID(stream.Context())
 		newCtx := context.WithValue(stream.Context(), contextKey{}, traceId)
 		stream.SetHeader(metadata.Pairs("trace-id", traceId))
 		wrapped := grpc_middleware.WrapServerStream(stream)
@@ -50,3 +68,12 @@ func StreamServerInterceptor() grpc.StreamServerInterceptor {
 		return handler(srv, wrapped)
 	}
 }
+
+func getOrNewTraceID(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(RequestIDMetadataKey); len(values) > 0 && IsValidTraceID(values[0]) {
+			return values[0]
+		}
+	}
+	return uuid.NewString()
+}
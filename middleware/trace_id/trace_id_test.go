@@ -3,9 +3,11 @@ package trace_id
 import (
 	"context"
 	"errors"
+	"strings"
 	"testing"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 
 	"github.com/zmzhang8/grpc_example/test"
 )
@@ -64,3 +66,35 @@ func TestStreamServerInterceptor(t *testing.T) {
 		t.Errorf("err %v; want <nil>", err)
 	}
 }
+
+func TestUnaryServerInterceptor_requestID(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.TODO(), metadata.Pairs(RequestIDMetadataKey, "dummy"))
+	info := grpc.UnaryServerInfo{}
+	var gotTraceID string
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		gotTraceID = MustGetTraceID(ctx)
+		return nil, nil
+	}
+
+	UnaryServerInterceptor()(ctx, nil, &info, handler)
+
+	if gotTraceID != "dummy" {
+		t.Errorf("trace id %v; want dummy", gotTraceID)
+	}
+}
+
+func TestIsValidTraceID(t *testing.T) {
+	for _, tc := range []struct {
+		traceId string
+		want    bool
+	}{
+		{"0b5c6f4e-7a4f-4a53-9f6f-3f5a3c1c9f10", true},
+		{"", false},
+		{"has space", false},
+		{strings.Repeat("a", 129), false},
+	} {
+		if got := IsValidTraceID(tc.traceId); got != tc.want {
+			t.Errorf("%v: valid %v; want %v", tc.traceId, got, tc.want)
+		}
+	}
+}